@@ -37,10 +37,20 @@ addHotkey('F4', false, false, false, false, true, 'roundReset();closeMenu()')
 addHotkey('F4', false, false, true, false, true, 'reload();closeMenu()')
 addHotkey('F5', false, false, false, false, true, 'setTime(0);debugFlag(1);debugFlag(2)')
 addHotkey('SPACE', false, false, false, false, true, 'full(1);full(2);full(3);full(4);full(5);full(6);full(7);full(8);setTime(getRoundTime());debugFlag(1);debugFlag(2);clearConsole()')
+addHotkey('p', true, false, false, true, true, 'toggleProfiler()')
+addHotkey('p', true, false, true, true, true, "profilerExport('debug/profile.csv');profilerExport('debug/profile.pb.gz')")
 addHotkey('i', true, false, false, true, true, 'stand(1);stand(2);stand(3);stand(4);stand(5);stand(6);stand(7);stand(8)')
 addHotkey('PAUSE', false, false, false, true, false, 'togglePause();closeMenu()')
 addHotkey('PAUSE', true, false, false, true, false, 'step()')
 addHotkey('SCROLLLOCK', false, false, false, true, false, 'step()')
+addHotkey('SCROLLLOCK', true, false, false, true, false, 'debugTraceNext()')
+addHotkey('SCROLLLOCK', false, false, true, true, false, 'debugContinue()')
+addHotkey('PAGEUP', false, false, false, true, false, 'replaySpeed(replaySpeed() * 2)')
+addHotkey('PAGEDOWN', false, false, false, true, false, 'replaySpeed(replaySpeed() / 2)')
+addHotkey('HOME', false, false, false, true, false, 'replaySeekRound()')
+addHotkey('END', false, false, false, true, false, 'replaySeekRound(roundno() + 1)')
+addHotkey('HOME', true, false, false, true, false, 'replaySeek(replayFrame() - 300)')
+addHotkey('END', true, false, false, true, false, 'replaySeek(replayFrame() + 300)')
 
 local speedMul = 1
 local speedAdd = 0
@@ -17,15 +17,13 @@ json = (loadfile 'external/script/json.lua')()
 --; COMMON FUNCTIONS
 --;===========================================================
 
---return file content
+--return file content (content packs included)
 function main.f_fileRead(path, mode)
-	local file = io.open(path, mode or 'r')
-	if file == nil then
+	local str = loadText(path)
+	if str == nil then
 		panicError("\nFile doesn't exist: " .. path)
 		return
 	end
-	local str = file:read("*all")
-	file:close()
 	return str
 end
 
@@ -215,17 +213,12 @@ if main.f_isdir('debug') then
 	main.debugLog = true
 end
 
---check if file exists
+--check if file exists (content packs included)
 function main.f_fileExists(file)
 	if file == '' then
 		return false
 	end
-	local f = io.open(file,'r')
-	if f ~= nil then
-		io.close(f)
-		return true
-	end
-	return false
+	return fileExist(file) ~= ''
 end
 
 --prints "t" table content into "toFile" file
@@ -1480,6 +1473,12 @@ function main.f_commandLine()
 	if main.flags['-ip'] ~= nil then
 		enterNetPlay(main.flags['-ip'])
 		while not connected() do
+			local err = netPlayError()
+			if err ~= nil then
+				exitNetPlay()
+				print(err)
+				os.exit()
+			end
 			if esc() then
 				exitNetPlay()
 				os.exit()
@@ -1487,7 +1486,12 @@ function main.f_commandLine()
 			refresh()
 		end
 		refresh()
-		synchronize()
+		local ok, err = synchronize()
+		if not ok then
+			exitNetPlay()
+			print(err)
+			os.exit()
+		end
 		math.randomseed(sszRandom())
 		main.f_cmdBufReset()
 		refresh()
@@ -1496,8 +1500,10 @@ function main.f_commandLine()
 	while loading() do
 		--do nothing
 	end
-	local winner, t_gameStats = game()
-	if main.flags['-log'] ~= nil then
+	local winner, t_gameStats, err = game()
+	if err ~= nil then
+		print(err)
+	elseif main.flags['-log'] ~= nil then
 		main.f_printTable(t_gameStats, main.flags['-log'])
 	end
 	os.exit()
@@ -1829,6 +1835,12 @@ function main.f_addChar(line, playable, loading, slot)
 	if main.t_selChars[row].hidden == nil then
 		main.t_selChars[row].hidden = 0
 	end
+	--chars that failed to load can't be selected
+	if main.t_selChars[row].broken then
+		main.t_selChars[row].hidden = 2
+		main.t_selChars[row].playable = false
+		playable = false
+	end
 	if main.t_selChars[row].char ~= nil then
 		main.t_selChars[row].char_ref = main.t_charDef[main.t_selChars[row].char:lower()]
 	end
@@ -2679,26 +2691,14 @@ main.t_itemname = {
 	--SERVER CONNECT
 	['serverconnect'] = function(t, item)
 		if main.f_connect(config.IP[t[item].displayname], main.f_extractText(motif.title_info.connecting_join_text, t[item].displayname, config.IP[t[item].displayname])) then
-			synchronize()
-			math.randomseed(sszRandom())
-			main.f_cmdBufReset()
-			main.menu.submenu.server.loop()
-			replayStop()
-			exitNetPlay()
-			exitReplay()
+			main.f_netPlay()
 		end
 		return nil
 	end,
 	--SERVER HOST
 	['serverhost'] = function(t, item)
 		if main.f_connect("", main.f_extractText(motif.title_info.connecting_host_text, getListenPort())) then
-			synchronize()
-			math.randomseed(sszRandom())
-			main.f_cmdBufReset()
-			main.menu.submenu.server.loop()
-			replayStop()
-			exitNetPlay()
-			exitReplay()
+			main.f_netPlay()
 		end
 		return nil
 	end,
@@ -3366,23 +3366,87 @@ function main.f_replay()
 			main.close = true
 		elseif main.f_input(main.t_players, {'pal', 's'}) then
 			sndPlay(motif.files.snd_data, motif[main.group].cursor_done_snd[1], motif[main.group].cursor_done_snd[2])
-			enterReplay(t[item].itemname)
-			synchronize()
-			math.randomseed(sszRandom())
-			main.f_cmdBufReset()
-			main.menu.submenu.server.loop()
-			replayStop()
-			exitNetPlay()
-			exitReplay()
+			local ok, ret = enterReplay(t[item].itemname)
+			if not ok then
+				exitReplay()
+				main.f_warning(main.f_extractText(ret), motif.replaybgdef)
+			elseif ret then
+				--local match replay, setup is loaded from the replay header
+				main.f_cmdBufReset()
+				loadStart()
+				local _, _, err = game()
+				exitReplay()
+				if err ~= nil then
+					main.f_warning(main.f_extractText(err), motif.replaybgdef)
+				end
+			else
+				local ok, err = synchronize()
+				if ok then
+					math.randomseed(sszRandom())
+					main.f_cmdBufReset()
+					main.menu.submenu.server.loop()
+					err = netPlayError()
+				end
+				replayStop()
+				exitNetPlay()
+				exitReplay()
+				if err ~= nil then
+					main.f_warning(main.f_extractText(err), motif.replaybgdef)
+				end
+			end
 		end
 	end
 end
 
+--netplay session, ended with a warning if the peers refused to play together
+function main.f_netPlay()
+	local ok, err = synchronize()
+	if ok then
+		math.randomseed(sszRandom())
+		main.f_cmdBufReset()
+		main.menu.submenu.server.loop()
+		err = netPlayError()
+	end
+	replayStop()
+	exitNetPlay()
+	exitReplay()
+	if err ~= nil then
+		main.f_warning(main.f_extractText(err), motif.titlebgdef)
+	end
+end
+
+--watch a netplay session, played back like a netplay replay
+function main.f_spectate(server)
+	local ok, ret = enterSpectate(server)
+	if not ok then
+		exitReplay()
+		main.f_warning(main.f_extractText(ret), motif.replaybgdef)
+		return
+	end
+	local ok, err = synchronize()
+	if ok then
+		math.randomseed(sszRandom())
+		main.f_cmdBufReset()
+		main.menu.submenu.server.loop()
+		err = netPlayError()
+	end
+	exitReplay()
+	if err ~= nil then
+		main.f_warning(main.f_extractText(err), motif.replaybgdef)
+	end
+end
+
 local txt_connecting = main.f_createTextImg(motif.title_info, 'connecting')
 local overlay_connecting = main.f_createOverlay(motif.title_info, 'connecting_overlay')
 function main.f_connect(server, t)
 	enterNetPlay(server)
 	while not connected() do
+		local err = netPlayError()
+		if err ~= nil then
+			exitNetPlay()
+			main.f_warning(main.f_extractText(err), motif.titlebgdef)
+			return false
+		end
 		if esc() or main.f_input(main.t_players, {'m'}) then
 			sndPlay(motif.files.snd_data, motif.title_info.cancel_snd[1], motif.title_info.cancel_snd[2])
 			exitNetPlay()
@@ -3466,6 +3530,28 @@ function main.f_unlockChar(num, bool, reset)
 	end
 end
 
+--hide characters that failed to load for the last match
+function main.f_hideBrokenChars()
+	for side = 1, 2 do
+		for _, v in ipairs(start.p[side].t_selected) do
+			local t = main.t_selChars[v.ref + 1]
+			if t ~= nil and not t.broken and getCharInfo(v.ref).broken then
+				t.broken = true
+				t.hidden = 2
+				for k, ref in ipairs(main.t_randomChars) do
+					if ref == v.ref then
+						table.remove(main.t_randomChars, k)
+						break
+					end
+				end
+				if t.row ~= nil and start.t_grid[t.row][t.col].char_ref == v.ref then
+					start.t_grid[t.row][t.col].hidden = t.hidden
+				end
+			end
+		end
+	end
+end
+
 --unlock stages (stage selection menu only)
 function main.f_unlockStage(num, bool)
 	if bool then
@@ -4150,6 +4236,10 @@ main.f_loadingRefresh(main.txt_loading)
 main.txt_loading = nil
 --sleep(1)
 
+if main.flags['-spectate'] ~= nil then
+	main.f_spectate(main.flags['-spectate'])
+end
+
 if motif.attract_mode.enabled == 1 then
 	main.f_attractMode()
 else
@@ -254,8 +254,10 @@ function randomtest.run()
 		start.f_setMusic(stage)
 		loadStart()
 		local oldwinner = winner
-		winner = game()
+		local err
+		winner, _, err = game()
 		clearColor(0, 0, 0)
+		if err ~= nil then print(err) end
 		if winner < 0 or esc() then break end
 		oldwins = wins
 		wins = wins + 1
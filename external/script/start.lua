@@ -1400,7 +1400,8 @@ function start.f_game(lua)
 	local p2In = main.t_pIn[2]
 	main.t_pIn[2] = 2
 	if lua ~= '' then commonLuaInsert(lua) end
-	local winner, tbl = game()
+	local winner, tbl, err = game()
+	main.f_hideBrokenChars()
 	main.f_restoreInput()
 	if lua ~= '' then commonLuaDelete(lua) end
 	if gameend() then
@@ -1408,6 +1409,9 @@ function start.f_game(lua)
 		os.exit()
 	end
 	main.t_pIn[2] = p2In
+	if err ~= nil then
+		main.f_warning(main.f_extractText(err), motif.selectbgdef)
+	end
 	return winner, tbl
 end
 
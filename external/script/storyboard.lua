@@ -121,7 +121,7 @@ local function f_play(t, attract)
 end
 
 local function f_parse(path)
-	local file = io.open(path, 'r')
+	local content = main.f_fileRead(path)
 	local fileDir, fileName = path:match('^(.-)([^/\\]+)$')
 	local t = {info = {localcoord = {320, 240}}}
 	local pos = t
@@ -146,7 +146,7 @@ local function f_parse(path)
 		},
 		scene = {},
 	}
-	for line in file:lines() do
+	for line in content:gmatch('[^\r\n]+') do
 		line = line:gsub('%s*;.*$', '')
 		if line:match('^%s*%[.-%s*%]%s*$') then --matched [] group
 			line = line:match('^%s*%[(.-)%s*%]%s*$') --match text between []
@@ -313,7 +313,6 @@ local function f_parse(path)
 			end
 		end
 	end
-	file:close()
 	--;===========================================================
 	--; FIX REFERENCES, LOAD DATA
 	--;===========================================================
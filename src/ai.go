@@ -0,0 +1,128 @@
+package main
+
+import "sort"
+
+// Drives a CPU controlled player. Update is called every frame the player's
+// commands are read and returns the buttons to hold, with IB_PL and IB_PR
+// meaning screen left and right. Command picks the command the AI is
+// considered to have input this frame (the cpucmd of the char), -1 for none.
+// Controllers are part of the game state: they must only use the Rand
+// functions for randomness, and Clone must copy all of their state so that
+// rollback can restore it. Savestates write the built-in controllers by name
+// (see stateEncoder.resource).
+type AIController interface {
+	Update(m *AIMatchView, level float32) InputBits
+	Command(m *AIMatchView, level float32, commands int) int32
+	Clone() AIController
+}
+
+// Read-only view of the match from the side of a CPU player
+type AIMatchView struct {
+	Self        AICharView
+	Partners    []AICharView
+	Enemies     []AICharView
+	Projectiles []AIProjectileView
+	RoundState  int32
+	RoundTime   int32
+}
+
+type AICharView struct {
+	PlayerNo    int
+	Name        string
+	Pos, Vel    [3]float32
+	Facing      float32
+	StateNo     int32
+	StateType   StateType
+	MoveType    MoveType
+	Ctrl        bool
+	Life        int32
+	LifeMax     int32
+	Power       int32
+	PowerMax    int32
+	MoveContact int32
+	MoveHit     int32
+	MoveGuarded int32
+	HitPause    bool
+	// Copy of the active HitDef, nil if the char is not attacking
+	HitDef *HitDef
+}
+
+type AIProjectileView struct {
+	Owner  int
+	ID     int32
+	Pos    [2]float32
+	Vel    [2]float32
+	Facing float32
+	Hits   int32
+}
+
+func newAICharView(c *Char) AICharView {
+	cv := AICharView{PlayerNo: c.playerNo, Name: c.name, Pos: c.pos, Vel: c.vel,
+		Facing: c.facing, StateNo: c.ss.no, StateType: c.ss.stateType,
+		MoveType: c.ss.moveType, Ctrl: c.ctrl(), Life: c.life, LifeMax: c.lifeMax,
+		Power: c.power, PowerMax: c.powerMax, MoveContact: c.moveContact(),
+		MoveHit: c.moveHit(), MoveGuarded: c.moveGuarded(), HitPause: c.hitPause()}
+	if c.ss.moveType == MT_A && c.hitdef.attr > 0 {
+		hd := c.hitdef
+		cv.HitDef = &hd
+	}
+	return cv
+}
+
+// Builds the view of player pn, or returns nil if it has no char.
+func newAIMatchView(pn int) *AIMatchView {
+	if pn < 0 || pn >= len(sys.chars) || len(sys.chars[pn]) == 0 {
+		return nil
+	}
+	self := sys.chars[pn][0]
+	m := &AIMatchView{Self: newAICharView(self), RoundState: self.roundState(),
+		RoundTime: sys.time}
+	for i, p := range sys.chars {
+		if i == pn || len(p) == 0 {
+			continue
+		}
+		if p[0].teamside == self.teamside {
+			m.Partners = append(m.Partners, newAICharView(p[0]))
+		} else {
+			m.Enemies = append(m.Enemies, newAICharView(p[0]))
+		}
+	}
+	for i, pr := range sys.projs {
+		for _, p := range pr {
+			if p.id >= 0 {
+				m.Projectiles = append(m.Projectiles, AIProjectileView{Owner: i, ID: p.id,
+					Pos: p.pos, Vel: p.velocity, Facing: p.facing, Hits: p.hits})
+			}
+		}
+	}
+	return m
+}
+
+// Built-in controllers, selected with the AIController config setting
+var aiControllers = map[string]func() AIController{
+	"random":   func() AIController { return &AiInput{} },
+	"external": newExternalAI,
+}
+
+func aiControllerNames() (names []string) {
+	for name := range aiControllers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Returns the controller of player pn, creating it on first use.
+func (s *System) aiController(pn int) AIController {
+	if s.aiInput[pn] == nil {
+		newAI, ok := aiControllers[s.aiControllerName]
+		if !ok {
+			s.errLog.Printf("Unknown AI controller %q, available: %v\n",
+				s.aiControllerName, aiControllerNames())
+			newAI = aiControllers["random"]
+			s.aiControllerName = "random"
+		}
+		s.aiInput[pn] = newAI()
+	}
+	return s.aiInput[pn]
+}
@@ -212,6 +212,8 @@ func ReadAnimation(sff *Sff, pal *PaletteList, lines []string, i *int) *Animatio
 			if size < 0 {
 				break
 			}
+			// Boxes past the end of the file cannot be read
+			size = Min(size, int32(len(lines)-*i))
 			var clsn []float32
 			if line[4] == '1' {
 				clsn1 = make([]float32, size*4)
@@ -659,7 +661,11 @@ func (a *Animation) drawSub1(angle, facing float32) (h, v, agl float32) {
 }
 func (a *Animation) Draw(window *[4]int32, x, y, xcs, ycs, xs, xbs, ys,
 	rxadd float32, rot Rotation, rcx float32, pfx *PalFX, old bool, facing float32, isReflection bool, posLocalscl float32, projectionMode int32, fLength float32) {
-	if a.spr == nil || a.spr.Tex == nil {
+	if a.spr == nil {
+		return
+	}
+	tex := a.spr.texture()
+	if tex == nil {
 		return
 	}
 	h, v, angle := a.drawSub1(rot.angle, facing)
@@ -717,7 +723,7 @@ func (a *Animation) Draw(window *[4]int32, x, y, xcs, ycs, xs, xbs, ys,
 		paltex = a.spr.CachePalette(pal)
 	}
 	rp := RenderParams{
-		a.spr.Tex, paltex, a.spr.Size,
+		tex, paltex, a.spr.Size,
 		x * sys.widthScale,
 		y * sys.heightScale, a.tile, xs * sys.widthScale, xcs * xbs * h * sys.widthScale,
 		ys * sys.heightScale, 1, xcs * rxadd * sys.widthScale / sys.heightScale, rot,
@@ -729,7 +735,11 @@ func (a *Animation) Draw(window *[4]int32, x, y, xcs, ycs, xs, xbs, ys,
 }
 func (a *Animation) ShadowDraw(window *[4]int32, x, y, xscl, yscl, vscl, rxadd float32, rot Rotation,
 	pfx *PalFX, old bool, color uint32, alpha int32, facing float32, posLocalscl float32, projectionMode int32, fLength float32) {
-	if a.spr == nil || a.spr.Tex == nil {
+	if a.spr == nil {
+		return
+	}
+	tex := a.spr.texture()
+	if tex == nil {
 		return
 	}
 	h, v, angle := a.drawSub1(rot.angle, facing)
@@ -738,7 +748,7 @@ func (a *Animation) ShadowDraw(window *[4]int32, x, y, xscl, yscl, vscl, rxadd f
 	y += yscl * posLocalscl * vscl * v * (float32(a.frames[a.drawidx].Y) + a.interpolate_offset_y) * (1 / a.scale_x)
 
 	rp := RenderParams{
-		a.spr.Tex, nil, a.spr.Size,
+		tex, nil, a.spr.Size,
 		AbsF(xscl*h) * float32(a.spr.Offset[0]) * sys.widthScale,
 		AbsF(yscl*v) * float32(a.spr.Offset[1]) * sys.heightScale, a.tile,
 		xscl * h * sys.widthScale, xscl * h * sys.widthScale,
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Connection to an out-of-process agent driving the CPU players whose
+// AIController is "external". For every CPU player and frame the engine
+// sends an observation as a line of JSON:
+//
+//	{"type":"observation","frame":120,"player":2,"level":8,"match":{...}}
+//
+// and waits for a reply line giving the buttons to hold:
+//
+//	{"keys":"Fa"}
+//
+// Keys are U, D, L, R (screen directions), F, B (relative to the facing of
+// the char) and a, b, c, x, y, z, s, d, w, m. A "bits" number with the
+// InputBits can be given instead. A reply has to arrive within the
+// AIExternalTimeout setting (in milliseconds), otherwise the player holds no
+// buttons for that frame and the late reply is skipped when it arrives. With
+// a timeout of 0 the engine waits for every reply, so the simulation stays
+// deterministic for a deterministic agent. A "hello" message is sent when
+// connecting, and "matchend" when a match ends.
+type botAgent struct {
+	r       *bufio.Reader
+	w       io.Writer
+	conn    net.Conn
+	timeout time.Duration
+	// Start of a reply cut by the deadline, and the number of replies that
+	// arrived too late and are still to be skipped
+	partial []byte
+	late    int
+	err     error
+}
+
+var sharedBotAgent *botAgent
+
+// Connects to the agent at the AIExternalAddress setting: "unix:<path>" for
+// a Unix socket, or host:port for TCP. Stdin and stdout are not used, as
+// the console and many messages already go through them.
+func connectBotAgent(addr string) *botAgent {
+	ba := &botAgent{}
+	if addr == "" {
+		ba.fail(Error("AIExternalAddress is not set"))
+		return ba
+	}
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", addr[len("unix:"):]
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		ba.fail(err)
+		return ba
+	}
+	ba.r, ba.w, ba.conn = bufio.NewReader(conn), conn, conn
+	ba.timeout = time.Duration(sys.aiExternalTimeout) * time.Millisecond
+	ba.send(map[string]interface{}{"type": "hello", "version": Version})
+	return ba
+}
+func (ba *botAgent) fail(err error) {
+	if ba.err == nil {
+		ba.err = err
+		if ba.conn != nil {
+			ba.conn.Close()
+		}
+		sys.errLog.Printf("External AI agent disconnected: %v\n", err)
+		sys.appendToConsole("External AI agent disconnected")
+	}
+}
+func (ba *botAgent) send(msg interface{}) bool {
+	if ba.err != nil {
+		return false
+	}
+	b, err := json.Marshal(msg)
+	if err == nil {
+		_, err = ba.w.Write(append(b, '\n'))
+	}
+	if err != nil {
+		ba.fail(err)
+		return false
+	}
+	return true
+}
+func (ba *botAgent) receive(v interface{}) bool {
+	if ba.err != nil {
+		return false
+	}
+	if ba.timeout > 0 {
+		ba.conn.SetReadDeadline(time.Now().Add(ba.timeout))
+	}
+	for {
+		b, err := ba.r.ReadBytes('\n')
+		ba.partial = append(ba.partial, b...)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			ba.late++
+			return false
+		}
+		if err == nil {
+			line := ba.partial
+			ba.partial = nil
+			if ba.late > 0 {
+				ba.late--
+				continue
+			}
+			err = json.Unmarshal(line, v)
+		}
+		if err != nil {
+			ba.fail(err)
+			return false
+		}
+		return true
+	}
+}
+
+// Tells the agent that the match has ended, so that it can reset.
+func botMatchEnd(winp int32) {
+	if sharedBotAgent != nil {
+		sharedBotAgent.send(map[string]interface{}{"type": "matchend", "winner": winp})
+	}
+}
+
+// Observations use their own types, as the HitDef of AICharView has no
+// exported fields.
+type botObservation struct {
+	Type   string   `json:"type"`
+	Frame  int32    `json:"frame"`
+	Player int      `json:"player"`
+	Level  float32  `json:"level"`
+	Match  botMatch `json:"match"`
+}
+
+type botMatch struct {
+	Self        botChar            `json:"self"`
+	Partners    []botChar          `json:"partners"`
+	Enemies     []botChar          `json:"enemies"`
+	Projectiles []AIProjectileView `json:"projectiles"`
+	RoundState  int32              `json:"roundstate"`
+	RoundTime   int32              `json:"roundtime"`
+}
+
+type botChar struct {
+	AICharView
+	HitDef *botHitDef `json:"HitDef"`
+}
+
+type botHitDef struct {
+	Attr        int32
+	HitFlag     int32
+	GuardFlag   int32
+	Priority    int32
+	HitDamage   int32
+	GuardDamage int32
+	PauseTime   int32
+	GroundType  HitType
+}
+
+func newBotChar(cv AICharView) botChar {
+	bc := botChar{AICharView: cv}
+	if hd := cv.HitDef; hd != nil {
+		bc.HitDef = &botHitDef{Attr: hd.attr, HitFlag: hd.hitflag,
+			GuardFlag: hd.guardflag, Priority: hd.priority, HitDamage: hd.hitdamage,
+			GuardDamage: hd.guarddamage, PauseTime: hd.pausetime, GroundType: hd.ground_type}
+	}
+	return bc
+}
+func newBotMatch(m *AIMatchView) (bm botMatch) {
+	bm.Self = newBotChar(m.Self)
+	for _, c := range m.Partners {
+		bm.Partners = append(bm.Partners, newBotChar(c))
+	}
+	for _, c := range m.Enemies {
+		bm.Enemies = append(bm.Enemies, newBotChar(c))
+	}
+	bm.Projectiles, bm.RoundState, bm.RoundTime = m.Projectiles, m.RoundState, m.RoundTime
+	return
+}
+
+type botReply struct {
+	Keys string     `json:"keys"`
+	Bits *InputBits `json:"bits"`
+}
+
+func (r *botReply) inputBits(facing float32) InputBits {
+	if r.Bits != nil {
+		return *r.Bits
+	}
+	var ib InputBits
+	for _, k := range r.Keys {
+		switch k {
+		case 'U':
+			ib |= IB_PU
+		case 'D':
+			ib |= IB_PD
+		case 'L':
+			ib |= IB_PL
+		case 'R':
+			ib |= IB_PR
+		case 'F', 'B':
+			if (k == 'F') == (facing < 0) {
+				ib |= IB_PL
+			} else {
+				ib |= IB_PR
+			}
+		case 'a':
+			ib |= IB_A
+		case 'b':
+			ib |= IB_B
+		case 'c':
+			ib |= IB_C
+		case 'x':
+			ib |= IB_X
+		case 'y':
+			ib |= IB_Y
+		case 'z':
+			ib |= IB_Z
+		case 's':
+			ib |= IB_S
+		case 'd':
+			ib |= IB_D
+		case 'w':
+			ib |= IB_W
+		case 'm':
+			ib |= IB_M
+		}
+	}
+	return ib
+}
+
+// AIController forwarding to the external agent. Its only state is the
+// agent, which lives outside the game state, so clones share it.
+type externalAI struct {
+	agent *botAgent
+}
+
+// Reconnects if the previous agent has disconnected.
+func newExternalAI() AIController {
+	if sharedBotAgent == nil || sharedBotAgent.err != nil {
+		sharedBotAgent = connectBotAgent(sys.aiExternalAddress)
+	}
+	return &externalAI{agent: sharedBotAgent}
+}
+func (ai *externalAI) Update(m *AIMatchView, level float32) InputBits {
+	if m == nil || !ai.agent.send(&botObservation{Type: "observation", Frame: sys.gameTime,
+		Player: m.Self.PlayerNo + 1, Level: level, Match: newBotMatch(m)}) {
+		return 0
+	}
+	var r botReply
+	if !ai.agent.receive(&r) {
+		return 0
+	}
+	return r.inputBits(m.Self.Facing)
+}
+func (ai *externalAI) Command(m *AIMatchView, level float32, commands int) int32 {
+	return -1
+}
+func (ai *externalAI) Clone() AIController {
+	return ai
+}
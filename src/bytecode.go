@@ -2261,7 +2261,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 			// Decide if while loop should be stopped
 			if !b.forLoop {
 				// While loop needs to eval conditional indefinitely until it returns false
-				if len(b.trigger) > 0 && !b.trigger.evalB(c) {
+				if len(b.trigger) > 0 && !sys.debugger.evalTrigger(b.trigger, c) {
 					interrupt = true
 				}
 			}
@@ -2275,7 +2275,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 							continue
 						}
 					}
-					if sc.Run(c, ps) {
+					if sys.debugger.runController(sc, c, ps) {
 						if sys.loopBreak {
 							sys.loopBreak = false
 							interrupt = true
@@ -2314,7 +2314,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 			}
 		}
 	} else {
-		if len(b.trigger) > 0 && !b.trigger.evalB(c) {
+		if len(b.trigger) > 0 && !sys.debugger.evalTrigger(b.trigger, c) {
 			if b.elseBlock != nil {
 				return b.elseBlock.Run(c, ps)
 			}
@@ -2328,7 +2328,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 					continue
 				}
 			}
-			if sc.Run(c, ps) {
+			if sys.debugger.runController(sc, c, ps) {
 				return true
 			}
 		}
@@ -7455,26 +7455,22 @@ func (sc loadFile) Run(c *Char, _ []int32) bool {
 		return true
 	})
 	if path != "" {
-		decodeFile, err := os.Open(filepath.Dir(c.gi().def) + "/" + path)
+		decodeFile, err := OpenFile(filepath.Dir(c.gi().def) + "/" + path)
 		if err != nil {
-			defer decodeFile.Close()
 			return false
 		}
 		defer decodeFile.Close()
 		decoder := gob.NewDecoder(decodeFile)
 		switch data {
 		case SaveData_map:
-			if err := decoder.Decode(&crun.mapArray); err != nil {
-				panic(err)
-			}
+			err = decoder.Decode(&crun.mapArray)
 		case SaveData_var:
-			if err := decoder.Decode(&crun.ivar); err != nil {
-				panic(err)
-			}
+			err = decoder.Decode(&crun.ivar)
 		case SaveData_fvar:
-			if err := decoder.Decode(&crun.fvar); err != nil {
-				panic(err)
-			}
+			err = decoder.Decode(&crun.fvar)
+		}
+		if err != nil {
+			sys.appendToConsole(c.warn() + "failed to load " + path + ": " + err.Error())
 		}
 	}
 	return false
@@ -8513,6 +8509,7 @@ type StateBytecode struct {
 	prevMoveType MoveType
 	physics      StateType
 	playerNo     int
+	stateNo      int32
 	stateDef     stateDef
 	block        StateBlock
 	ctrlsps      []int32
@@ -8546,6 +8543,10 @@ func (sb *StateBytecode) init(c *Char) {
 	sb.stateDef.Run(c)
 }
 func (sb *StateBytecode) run(c *Char) (changeState bool) {
+	if sys.profiler.enabled {
+		prev := sys.profiler.beginState(profStateKey{c.playerNo, sb.playerNo, sb.stateNo})
+		defer sys.profiler.endState(prev)
+	}
 	sys.bcVar = sys.bcVarStack.Alloc(int(sb.numVars))
 	sys.workingState = sb
 	changeState = sb.block.Run(c, sb.ctrlsps)
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"os"
 	"strings"
 )
 
@@ -2420,7 +2419,7 @@ func (c *Char) load(def string) error {
 		}
 	}
 	if len(sprite) > 0 {
-		if LoadFile(&sprite, []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
+		if err := LoadFile(&sprite, []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
 			var err error
 			gi.sff, err = loadSff(filename, true)
 			return err
@@ -2446,7 +2445,7 @@ func (c *Char) load(def string) error {
 	}
 	str = ""
 	if len(anim) > 0 {
-		if LoadFile(&anim, []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
+		if err := LoadFile(&anim, []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
 			var err error
 			str, err = LoadText(filename)
 			if err != nil {
@@ -2472,7 +2471,7 @@ func (c *Char) load(def string) error {
 	lines, i = SplitAndTrim(str, "\n"), 0
 	gi.anim = ReadAnimationTable(gi.sff, &gi.palettedata.palList, lines, &i)
 	if len(sound) > 0 {
-		if LoadFile(&sound, []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
+		if err := LoadFile(&sound, []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
 			var err error
 			gi.snd, err = LoadSnd(filename)
 			return err
@@ -2512,10 +2511,10 @@ func (c *Char) loadPalette() {
 		tmp := 0
 		for i := 0; i < MaxPalNo; i++ {
 			pl := gi.palettedata.palList.Get(i)
-			var f *os.File
+			var f io.ReadCloser
 			var err error
 			if LoadFile(&gi.pal[i], []string{gi.def, "", sys.motifDir, "data/"}, func(file string) error {
-				f, err = os.Open(file)
+				f, err = OpenFile(file)
 				return err
 			}) == nil {
 				for i := 255; i >= 0; i-- {
@@ -2525,7 +2524,7 @@ func (c *Char) loadPalette() {
 					}
 					pl[i] = uint32(255)<<24 | uint32(rgb[2])<<16 | uint32(rgb[1])<<8 | uint32(rgb[0])
 				}
-				chk(f.Close())
+				f.Close()
 				if err == nil {
 					if tmp == 0 && i > 0 {
 						copy(gi.palettedata.palList.Get(0), pl)
@@ -3329,7 +3328,7 @@ func (c *Char) winType(wt WinType) bool {
 }
 func (c *Char) playSound(ffx string, lowpriority, loop bool, g, n, chNo, vol int32,
 	p, freqmul, ls float32, x *float32, log bool, priority int32) {
-	if g < 0 {
+	if g < 0 || sys.resimulating {
 		return
 	}
 	var s *Sound
@@ -3452,6 +3451,7 @@ func (c *Char) stateChange1(no int32, pn int) bool {
 		sys.appendToConsole(c.warn() + fmt.Sprintf("changed to invalid state %v (from state %v)", no, c.ss.prevno))
 		sys.errLog.Printf("Invalid state: P%v:%v\n", pn+1, no)
 		c.ss.sb = *newStateBytecode(pn)
+		c.ss.sb.stateNo = no
 		c.ss.sb.prevMoveType = c.ss.sb.moveType
 		c.ss.sb.stateType, c.ss.sb.moveType, c.ss.sb.physics = ST_U, MT_U, ST_U
 	}
@@ -3463,6 +3463,7 @@ func (c *Char) stateChange1(no int32, pn int) bool {
 	if c.stCgi().ikemenver[0] > 0 || c.stCgi().ikemenver[1] > 0 {
 		c.ss.sb.ctrlsps = make([]int32, len(c.ss.sb.ctrlsps))
 	}
+	sys.debugger.enterState(c)
 	c.stchtmp = true
 	return true
 }
@@ -6429,6 +6430,8 @@ func (cl *CharList) delete(dc *Char) {
 }
 func (cl *CharList) action(x float32, cvmin, cvmax,
 	highest, lowest, leftest, rightest *float32) {
+	sys.profiler.frame()
+	sys.debugger.frame()
 	sys.commandUpdate()
 	// Prepare characters before performing their actions
 	for i := 0; i < len(cl.runOrder); i++ {
@@ -6472,6 +6475,7 @@ func (cl *CharList) action(x float32, cvmin, cvmax,
 	}
 	// Update chars
 	sys.charUpdate(cvmin, cvmax, highest, lowest, leftest, rightest)
+	sys.debugger.endFrame()
 }
 func (cl *CharList) update(cvmin, cvmax,
 	highest, lowest, leftest, rightest *float32) {
@@ -2,9 +2,8 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	"math"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -231,7 +230,7 @@ func I32ToU16(i32 int32) uint16 {
 	return uint16(i32)
 }
 func LoadText(filename string) (string, error) {
-	bytes, err := ioutil.ReadFile(filename)
+	bytes, err := ReadFile(filename)
 	if err != nil {
 		return "", err
 	}
@@ -243,27 +242,11 @@ func LoadText(filename string) (string, error) {
 }
 
 func FileExist(filename string) string {
-	if info, err := os.Stat(filename); !os.IsNotExist(err) {
-		if info == nil || info.IsDir() {
-			return ""
-		}
-		return filename
-	}
-	var pattern string
-	for _, r := range filename {
-		if r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' {
-			pattern += "[" + string(unicode.ToLower(r)) +
-				string(unicode.ToLower(r)+'A'-'a') + "]"
-		} else if r == '*' || r == '?' || r == '[' {
-			pattern += "\\" + string(r)
-		} else {
-			pattern += string(r)
-		}
+	m, fn := vfs.find(filename)
+	if m != nil {
+		return m.prefix + fn
 	}
-	if m, _ := filepath.Glob(pattern); len(m) > 0 {
-		return m[0]
-	}
-	return ""
+	return fn
 }
 
 // SearchFile returns full path to specified file
@@ -407,6 +390,38 @@ type Error string
 
 func (e Error) Error() string { return string(e) }
 
+// Error in the data of a file, telling the entry, such as a sprite or a
+// sound, and its offset in the file.
+func formatError(filename, entry string, offset int64, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return Error(fmt.Sprintf("%v: %v at offset %v: %v", filename, entry, offset, err))
+}
+
+// Returns the size of the file, keeping the current position.
+func fileSize(f io.Seeker) (int64, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(pos, io.SeekStart)
+	return size, err
+}
+
+// Checks that the size bytes at the offset are in a file that ends at end,
+// before reading or allocating them.
+func checkRange(end, offset, size int64) error {
+	if offset < 0 || size < 0 || offset > end || size > end-offset {
+		return Error(fmt.Sprintf("%v bytes do not fit in the file (%v bytes)", size, end))
+	}
+	return nil
+}
+
 type IniSection map[string]string
 
 func NewIniSection() IniSection { return IniSection(make(map[string]string)) }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"math"
 	"regexp"
 	"strconv"
@@ -30,10 +29,26 @@ type Compiler struct {
 	funcs            map[string]bytecodeFunction
 	funcUsed         map[string]bool
 	stateNo          int32
+	lint             *lintReport
+	// Number of the last line of a ZSS file taken by the tokenizer
+	zssLine int
+	// Unsaved texts of state files, by normalized path, used instead of the
+	// files
+	overlay map[string]string
+	// Called with the name of every parameter a state controller looks up
+	onParam func(name string)
+	// Whether to leave the compiled expressions as they are, set with
+	// -nooptimize
+	noOptimize bool
+	// sys.ignoreMostErrors, turned off for ZSS. Chars are compiled
+	// concurrently, so this is not changed in sys.
+	ignoreMostErrors bool
 }
 
 func newCompiler() *Compiler {
 	c := &Compiler{funcs: make(map[string]bytecodeFunction)}
+	_, c.noOptimize = sys.cmdFlags["-nooptimize"]
+	c.ignoreMostErrors = sys.ignoreMostErrors
 	c.scmap = map[string]scFunc{
 		"hitby":                c.hitBy,
 		"nothitby":             c.notHitBy,
@@ -642,7 +657,7 @@ func (c *Compiler) attr(text string, hitdef bool) (int32, error) {
 				flg |= int32(ST_A)
 			}
 		default:
-			if sys.ignoreMostErrors && a < 128 && (a < 'A' || a > 'Z') &&
+			if c.ignoreMostErrors && a < 128 && (a < 'A' || a > 'Z') &&
 				(a < 'a' || a > 'z') {
 				return flg, nil
 			}
@@ -652,7 +667,7 @@ func (c *Compiler) attr(text string, hitdef bool) (int32, error) {
 	//hitdefflg := flg
 	for _, a := range att[1:] {
 		l := len(a)
-		if sys.ignoreMostErrors && l >= 2 {
+		if c.ignoreMostErrors && l >= 2 {
 			a = strings.TrimSpace(a[:2])
 		}
 		switch strings.ToLower(a) {
@@ -687,7 +702,7 @@ func (c *Compiler) attr(text string, hitdef bool) (int32, error) {
 		case "h", "a":
 			flg |= int32(AT_HA | AT_HT | AT_HP)
 		default:
-			if sys.ignoreMostErrors && sys.cgi[c.playerNo].ver[0] == 1 {
+			if c.ignoreMostErrors && sys.cgi[c.playerNo].ver[0] == 1 {
 				//if hitdef {
 				//	flg = hitdefflg
 				//}
@@ -816,7 +831,7 @@ func (c *Compiler) checkEquality(in *string) (not bool, err error) {
 				break
 			} else if c.token == "=" {
 				break
-			} else if sys.ignoreMostErrors {
+			} else if c.ignoreMostErrors {
 				if c.token[len(c.token)-1] == '=' {
 					break
 				}
@@ -840,7 +855,7 @@ func (c *Compiler) intRange(in *string) (minop OpCode, maxop OpCode,
 		return
 	}
 	var intf func(in *string) (int32, error)
-	if sys.ignoreMostErrors {
+	if c.ignoreMostErrors {
 		intf = func(in *string) (int32, error) {
 			c.token = c.tokenizer(in)
 			minus := false
@@ -863,7 +878,7 @@ func (c *Compiler) intRange(in *string) (minop OpCode, maxop OpCode,
 	if min, err = intf(in); err != nil {
 		return
 	}
-	if sys.ignoreMostErrors {
+	if c.ignoreMostErrors {
 		if i := strings.Index(*in, ","); i >= 0 {
 			c.token = ","
 			*in = (*in)[i+1:]
@@ -878,7 +893,7 @@ func (c *Compiler) intRange(in *string) (minop OpCode, maxop OpCode,
 	if max, err = intf(in); err != nil {
 		return
 	}
-	if sys.ignoreMostErrors {
+	if c.ignoreMostErrors {
 		if i := strings.IndexAny(*in, "])"); i >= 0 {
 			c.token = string((*in)[i])
 			*in = (*in)[i+1:]
@@ -899,7 +914,7 @@ func (c *Compiler) intRange(in *string) (minop OpCode, maxop OpCode,
 	return
 }
 func (c *Compiler) compareValues(_range bool, in *string) {
-	if sys.ignoreMostErrors {
+	if c.ignoreMostErrors {
 		i := 0
 		for ; i < len(*in); i++ {
 			if (*in)[i] >= '0' && (*in)[i] <= '9' || (*in)[i] == '-' ||
@@ -1054,6 +1069,7 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 		return bv, nil
 	}
 	_var := func(sys, f bool) error {
+		n := len(*out)
 		_, err := c.oneArg(out, in, rd, true)
 		if err != nil {
 			return err
@@ -1061,6 +1077,9 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 		var oc OpCode
 		c.token = c.tokenizer(in)
 		set := c.token == ":="
+		if !sys {
+			c.lintVar(f, set, (*out)[n:])
+		}
 		if set {
 			c.token = c.tokenizer(in)
 			var be2 BytecodeExp
@@ -1667,7 +1686,7 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 			//return bvNone(), Error("Invalid data: " + c.token)
 		}
 		*in = strings.TrimSpace(*in)
-		if len(*in) == 0 || (!sys.ignoreMostErrors && (*in)[0] != ')') {
+		if len(*in) == 0 || (!c.ignoreMostErrors && (*in)[0] != ')') {
 			return bvNone(), Error("Missing ')' before " + c.token)
 		}
 		*in = (*in)[1:]
@@ -1841,14 +1860,14 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 		// }
 		// } else {
 		// if not, err := c.checkEquality(in); err != nil {
-		// if sys.ignoreMostErrors {
+		// if c.ignoreMostErrors {
 		// out.appendValue(BytecodeBool(false))
 		// } else {
 		// return bvNone(), err
 		// }
 		// } else if err := hda(); err != nil {
 		// return bvNone(), err
-		// } else if not && !sys.ignoreMostErrors {
+		// } else if not && !c.ignoreMostErrors {
 		// return bvNone(), Error("hitdefattr doesn't support '!=' in this mugenversion")
 		// }
 		// }
@@ -2270,7 +2289,7 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 	case "animelem":
 		if not, err := c.checkEquality(in); err != nil {
 			return bvNone(), err
-		} else if not && !sys.ignoreMostErrors {
+		} else if not && !c.ignoreMostErrors {
 			return bvNone(), Error("animelem doesn't support '!='")
 		}
 		if c.token == "-" {
@@ -2297,7 +2316,7 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 	case "timemod":
 		if not, err := c.checkEquality(in); err != nil {
 			return bvNone(), err
-		} else if not && !sys.ignoreMostErrors {
+		} else if not && !c.ignoreMostErrors {
 			return bvNone(), Error("timemod doesn't support '!='")
 		}
 		if c.token == "-" {
@@ -2843,7 +2862,7 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 		out.appendI32Op(OC_const_stage_constants, int32(sys.stringPool[c.playerNo].Add(
 			strings.ToLower(c.token))))
 		*in = strings.TrimSpace(*in)
-		if len(*in) == 0 || (!sys.ignoreMostErrors && (*in)[0] != ')') {
+		if len(*in) == 0 || (!c.ignoreMostErrors && (*in)[0] != ')') {
 			return bvNone(), Error("Missing ')' before " + c.token)
 		}
 		*in = (*in)[1:]
@@ -2867,7 +2886,7 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 		out.append(OC_ex_, OC_ex_drawpalno)
 	case "=", "!=", ">", ">=", "<", "<=", "&", "&&", "^", "^^", "|", "||",
 		"+", "*", "**", "/", "%":
-		if !sys.ignoreMostErrors || len(c.previousOperator) > 0 {
+		if !c.ignoreMostErrors || len(c.previousOperator) > 0 {
 			return bvNone(), Error("Invalid data: " + c.token)
 		}
 		if rd {
@@ -2895,7 +2914,7 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 			}
 			if not, err := c.checkEquality(in); err != nil {
 				return bvNone(), err
-			} else if not && !sys.ignoreMostErrors {
+			} else if not && !c.ignoreMostErrors {
 				return bvNone(), Error(trname + " doesn't support '!='")
 			}
 			if c.token == "-" {
@@ -2957,7 +2976,7 @@ func (c *Compiler) expPostNot(out *BytecodeExp, in *string) (BytecodeValue,
 	if err != nil {
 		return bvNone(), err
 	}
-	if sys.ignoreMostErrors {
+	if c.ignoreMostErrors {
 		for c.token == "!" {
 			c.reverseOrder = true
 			if bv.IsNone() {
@@ -2970,7 +2989,7 @@ func (c *Compiler) expPostNot(out *BytecodeExp, in *string) (BytecodeValue,
 	}
 	if len(c.previousOperator) == 0 {
 		if opp := c.isOperator(c.token); opp == 0 {
-			if !sys.ignoreMostErrors || !c.reverseOrder && c.token == "(" {
+			if !c.ignoreMostErrors || !c.reverseOrder && c.token == "(" {
 				return bvNone(), Error("No comparison operator" +
 					"\n" +
 					"Token = '" + c.token + "' String = '" + *in + "'" +
@@ -3433,6 +3452,9 @@ func (c *Compiler) fullExpression(in *string, vt ValueType) (BytecodeExp,
 	if len(c.token) > 0 {
 		return nil, Error("Invalid data: " + c.token)
 	}
+	if !c.noOptimize {
+		be = be.optimize()
+	}
 	return be, nil
 }
 func (c *Compiler) parseSection(
@@ -3469,7 +3491,7 @@ func (c *Compiler) parseSection(
 		if len(name) > 0 {
 			_, ok := is[name]
 			if ok && (len(name) < 7 || name[:7] != "trigger") {
-				if sys.ignoreMostErrors {
+				if c.ignoreMostErrors {
 					continue
 				}
 				return nil, false, Error(name + " is duplicated")
@@ -3511,7 +3533,7 @@ func (c *Compiler) stateSec(is IniSection, f func() error) error {
 	if err := f(); err != nil {
 		return err
 	}
-	if !sys.ignoreMostErrors {
+	if !c.ignoreMostErrors {
 		var str string
 		for k := range is {
 			if len(str) > 0 {
@@ -3527,6 +3549,9 @@ func (c *Compiler) stateSec(is IniSection, f func() error) error {
 }
 func (c *Compiler) stateParam(is IniSection, name string,
 	f func(string) error) error {
+	if c.onParam != nil {
+		c.onParam(name)
+	}
 	data, ok := is[name]
 	if ok {
 		if err := f(data); err != nil {
@@ -3733,7 +3758,7 @@ func (c *Compiler) paramTrans(is IniSection, sc *StateControllerBase,
 					_error = true
 				}
 			}
-			if _error && (!afterImage || !sys.ignoreMostErrors) {
+			if _error && (!afterImage || !c.ignoreMostErrors) {
 				return Error("Invalid value: " + data)
 			}
 		}
@@ -3998,40 +4023,33 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 	var str string
 	zss := HasExtension(filename, ".zss")
 	fnz := filename
-	// Load state file
+	// Load state file. A zss file is compiled once it has been loaded, as
+	// its errors already give the file.
 	if err := LoadFile(&filename, dirs, func(filename string) error {
 		var err error
-		// If this is a zss file
-		if zss {
-			b, err := ioutil.ReadFile(filename)
-			if err != nil {
-				return err
-			}
-			str = string(b)
-			return c.stateCompileZ(states, fnz, str, constants)
-		}
-
-		// Try reading as an st file
-		str, err = LoadText(filename)
+		str, err = c.readStateFile(filename, !zss)
 		return err
 	}); err != nil {
 		// If filename doesn't exist, see if a zss file exists
 		fnz += ".zss"
 		if err := LoadFile(&fnz, dirs, func(filename string) error {
-			b, err := ioutil.ReadFile(filename)
-			if err != nil {
-				return err
-			}
-			str = string(b)
-			return nil
+			var err error
+			str, err = c.readStateFile(filename, false)
+			return err
 		}); err == nil {
 			return c.stateCompileZ(states, fnz, str, constants)
 		}
 		return err
 	}
+	if zss {
+		return c.stateCompileZ(states, filename, str, constants)
+	}
 	c.lines, c.i = SplitAndTrim(str, "\n"), 0
+	if c.lint != nil {
+		c.lint.file = filename
+	}
 	errmes := func(err error) error {
-		return Error(fmt.Sprintf("%v:%v:\n%v", filename, c.i+1, err.Error()))
+		return c.compileError(filename, c.i+1, err)
 	}
 	// Keep a map of states that have already been found in this file
 	existInThisFile := make(map[int32]bool)
@@ -4052,7 +4070,10 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 		line = line[10:]
 		var err error
 		if c.stateNo, err = c.scanStateDef(&line, constants); err != nil {
-			return errmes(err)
+			if err := errmes(err); err != nil {
+				return err
+			}
+			continue
 		}
 
 		// Skip if this state has already been added
@@ -4060,20 +4081,28 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			continue
 		}
 		existInThisFile[c.stateNo] = true
+		c.lintStateDef(c.stateNo)
 
 		c.i++
 		// Parse the statedef properties
 		is, _, err := c.parseSection(nil)
 		if err != nil {
-			return errmes(err)
+			if err := errmes(err); err != nil {
+				return err
+			}
+			continue
 		}
 		sbc := newStateBytecode(c.playerNo)
 		if _, ok := states[c.stateNo]; ok && c.stateNo < 0 {
 			*sbc = states[c.stateNo]
 		}
+		sbc.stateNo = c.stateNo
 		// Interpret the statedef properties
 		if err := c.stateDef(is, sbc); err != nil {
-			return errmes(err)
+			if err := errmes(err); err != nil {
+				return err
+			}
+			continue
 		}
 
 		// Continue looping through state file lines to define the current state
@@ -4090,11 +4119,13 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				break
 			}
 			c.i++
+			scline := c.i
 
 			// Create this sctrl and get its properties
 			c.block = newStateBlock()
 			sc := newStateControllerBase()
 			var scf scFunc
+			var scname string
 			var triggerall []BytecodeExp
 			// Flag if this trigger can never be true
 			allUtikiri := false
@@ -4105,7 +4136,8 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				switch name {
 				case "type":
 					var ok bool
-					scf, ok = c.scmap[strings.ToLower(data)]
+					scname = strings.ToLower(data)
+					scf, ok = c.scmap[scname]
 					if !ok {
 						return Error("Invalid state controller: " + data)
 					}
@@ -4143,7 +4175,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 					// Get the trigger number
 					tn, ok := readDigit(name[7:])
 					if !ok || tn < 1 || tn > 65536 {
-						if sys.ignoreMostErrors {
+						if c.ignoreMostErrors {
 							break
 						}
 						return Error("Invalid trigger name: " + name)
@@ -4160,7 +4192,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 					// Parse trigger condition into a bytecode expression
 					be, err := c.fullExpression(&data, VT_Bool)
 					if err != nil {
-						if sys.ignoreMostErrors {
+						if c.ignoreMostErrors {
 							_break := false
 							for i := 0; i < int(tn); i++ {
 								if trexist[i] == 0 {
@@ -4191,15 +4223,24 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				return nil
 			})
 			if err != nil {
-				return errmes(err)
+				if err := errmes(err); err != nil {
+					return err
+				}
+				continue
 			}
 
 			// Check that the sctrl has a valid type parameter
 			if scf == nil {
-				return errmes(Error("type parameter not specified"))
+				if err := errmes(Error("type parameter not specified")); err != nil {
+					return err
+				}
+				continue
 			}
 			if len(trexist) == 0 || (!allUtikiri && trexist[0] == 0) {
-				return errmes(Error("Missing trigger1"))
+				if err := errmes(Error("Missing trigger1")); err != nil {
+					return err
+				}
+				continue
 			}
 
 			/* Create trigger bytecode */
@@ -4259,6 +4300,9 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 					}
 				}
 			}
+			if !c.noOptimize {
+				texp = texp.optimize()
+			}
 			c.block.trigger = texp
 
 			// Ignorehitpause
@@ -4270,8 +4314,12 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 			// For this sctrl type, call the function to construct the sctrl
 			sctrl, err := scf(is, sc, _ihp)
 			if err != nil {
-				return errmes(err)
+				if err := errmes(err); err != nil {
+					return err
+				}
+				continue
 			}
+			c.lintStateRefs(scname, *sc, scline)
 
 			// Check if the triggers can ever be true before appending the new sctrl
 			appending := true
@@ -4315,6 +4363,18 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 	return nil
 }
 
+// Reads a state file, decoding it as LoadText does if text is set.
+func (c *Compiler) readStateFile(filename string, text bool) (string, error) {
+	if str, ok := c.overlay[lspNormPath(filename)]; ok {
+		return str, nil
+	}
+	if text {
+		return LoadText(filename)
+	}
+	b, err := ReadFile(filename)
+	return string(b), err
+}
+
 func (c *Compiler) wrongClosureToken() error {
 	if c.token == "" {
 		return Error("Missing token")
@@ -4326,6 +4386,7 @@ func (c *Compiler) nextLine() (string, bool) {
 	if s == nil {
 		return "", false
 	}
+	c.zssLine++
 	return *s, true
 }
 func (c *Compiler) scan(line *string) string {
@@ -5087,6 +5148,7 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 				} else {
 					*ctrls = append(*ctrls, sctrl)
 				}
+				c.lintStateRefs(scname, *sc, 0)
 				c.scan(line)
 				continue
 			} else {
@@ -5125,11 +5187,11 @@ func (c *Compiler) stateBlock(line *string, bl *StateBlock, root bool,
 func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 	filename, src string, constants map[string]float32) error {
 	defer func(oime bool) {
-		sys.ignoreMostErrors = oime
-	}(sys.ignoreMostErrors)
-	sys.ignoreMostErrors = false
+		c.ignoreMostErrors = oime
+	}(c.ignoreMostErrors)
+	c.ignoreMostErrors = false
 	c.block = nil
-	c.lines, c.i = SplitAndTrim(src, "\n"), 0
+	c.lines, c.i, c.zssLine = SplitAndTrim(src, "\n"), 0, 0
 	c.linechan = make(chan *string)
 	endchan := make(chan bool, 1)
 	stop := func() int {
@@ -5169,8 +5231,15 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 			c.linechan <- sp
 		}
 	}()
+	if c.lint != nil {
+		c.lint.file = filename
+	}
+	// In lint mode the rest of the file is skipped after an error
 	errmes := func(err error) error {
-		return Error(fmt.Sprintf("%v:%v:\n%v", filename, stop(), err.Error()))
+		if c.lint != nil {
+			c.lint.incomplete = true
+		}
+		return c.compileError(filename, stop(), err)
 	}
 	existInThisFile := make(map[int32]bool)
 	funcExistInThisFile := make(map[string]bool)
@@ -5203,6 +5272,7 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 				}
 			}
 			existInThisFile[c.stateNo] = true
+			c.lintStateDef(c.stateNo)
 			is := NewIniSection()
 			for c.token != "]" {
 				switch c.token {
@@ -5218,6 +5288,7 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 			if _, ok := states[c.stateNo]; ok && c.stateNo < 0 {
 				*sbc = states[c.stateNo]
 			}
+			sbc.stateNo = c.stateNo
 			c.vars = make(map[string]uint8)
 			if err := c.stateDef(is, sbc); err != nil {
 				return errmes(err)
@@ -5369,7 +5440,9 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 			}
 			return nil
 		}); err != nil {
-			return nil, err
+			if err := c.compileError(cmd, 0, err); err != nil {
+				return nil, err
+			}
 		}
 	}
 	for _, s := range sys.commonCmd {
@@ -5381,7 +5454,9 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 			str += "\n" + txt
 			return nil
 		}); err != nil {
-			return nil, err
+			if err := c.compileError(s, 0, err); err != nil {
+				return nil, err
+			}
 		}
 	}
 	lines, i = SplitAndTrim(str, "\n"), 0
@@ -5462,13 +5537,19 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 	for _, is := range cmds {
 		name, _, err := is.getText("name")
 		if err != nil {
-			return nil, Error(fmt.Sprintf("%v:\nname: %v\n%v",
-				cmd, name, err.Error()))
+			if err := c.compileError(cmd, 0, Error(fmt.Sprintf("name: %v\n%v",
+				name, err.Error()))); err != nil {
+				return nil, Error(cmd + ":\n" + err.Error())
+			}
+			continue
 		}
 		cm, err := ReadCommand(name, is["command"], ckr)
 		if err != nil {
-			return nil, Error(cmd + ":\nname = " + is["name"] +
-				"\ncommand = " + is["command"] + "\n" + err.Error())
+			if err := c.compileError(cmd, 0, Error("name = "+is["name"]+
+				"\ncommand = "+is["command"]+"\n"+err.Error())); err != nil {
+				return nil, Error(cmd + ":\n" + err.Error())
+			}
+			continue
 		}
 		cm.time, cm.buftime = c.cmdl.DefaultTime, c.cmdl.DefaultBufferTime
 		is.ReadI32("time", &cm.time)
@@ -5489,7 +5570,9 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 			if err := c.stateCompile(states, s, []string{def, "", sys.motifDir, "data/"},
 				sys.cgi[pn].ikemenver[0] == 0 &&
 					sys.cgi[pn].ikemenver[1] == 0, constants); err != nil {
-				return nil, err
+				if err := c.compileError(s, 0, err); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
@@ -5498,7 +5581,9 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 		if err := c.stateCompile(states, cmd, []string{def, "", sys.motifDir, "data/"},
 			sys.cgi[pn].ikemenver[0] == 0 &&
 				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil {
-			return nil, err
+			if err := c.compileError(cmd, 0, err); err != nil {
+				return nil, err
+			}
 		}
 	}
 	// Compile states in stcommon state file
@@ -5506,14 +5591,21 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 		if err := c.stateCompile(states, stcommon, []string{def, "", sys.motifDir, "data/"},
 			sys.cgi[pn].ikemenver[0] == 0 &&
 				sys.cgi[pn].ikemenver[1] == 0, constants); err != nil {
-			return nil, err
+			if err := c.compileError(stcommon, 0, err); err != nil {
+				return nil, err
+			}
 		}
 	}
 	// Compile common states
+	if c.lint != nil {
+		c.lint.common = true
+	}
 	for _, s := range sys.commonStates {
 		if err := c.stateCompile(states, s, []string{def, sys.motifDir, sys.lifebar.def, "", "data/"},
 			false, constants); err != nil {
-			return nil, err
+			if err := c.compileError(s, 0, err); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return states, nil
@@ -1920,6 +1920,7 @@ func (c *Compiler) varSetSub(is IniSection,
 			}
 		}
 		if v || fv {
+			c.lintVar(fv, true, ve)
 			if oc == OC_st_var {
 				if v {
 					oc = OC_st_var
@@ -1975,6 +1976,9 @@ func (c *Compiler) varSetSub(is IniSection,
 		if !bv.IsNone() {
 			be.appendValue(bv)
 		}
+		if !sys {
+			c.lintVar(fv, true, be)
+		}
 		if oc == OC_st_var {
 			if sys {
 				if v {
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type breakpointKind int32
+
+const (
+	BK_state breakpointKind = iota
+	BK_controller
+	BK_trigger
+	BK_var
+	BK_fvar
+)
+
+var breakpointKindNames = [...]string{"state", "controller", "trigger", "var", "fvar"}
+
+// Stops the match when a char enters a state, runs a controller of a type,
+// when a condition becomes true for it or when one of its vars changes. A
+// breakpoint belongs to the char it was set for, which is identified by its
+// id, so that breakpoints on helpers end with them.
+type breakpoint struct {
+	id     int
+	kind   breakpointKind
+	charID int32
+	value  string
+	// State number or var index
+	no int32
+	// Condition of a trigger breakpoint, evaluated in sb to find the
+	// command names of the char
+	exp BytecodeExp
+	sb  *StateBytecode
+	// Value of the var or condition at the previous check
+	prev float32
+}
+
+func (bp *breakpoint) String() string {
+	return fmt.Sprintf("%v: %v %v of %v", bp.id, breakpointKindNames[bp.kind],
+		bp.value, debugCharName(bp.charID))
+}
+
+// What a traced char was doing at some point of a frame, with its state at
+// that moment: before the controller ran for a controller step.
+type debugStep struct {
+	charID  int32
+	event   string
+	trigger bool
+	result  bool
+	stateNo int32
+	owner   int
+	time    int32
+	animNo  int32
+	ctrl    bool
+	ivar    [NumVar]int32
+	fvar    [NumFvar]float32
+	maps    map[string]float32
+}
+
+// Every controller run and trigger evaluated by the chars that have
+// breakpoints is traced during a frame. When a breakpoint is hit the match
+// is paused at the end of the frame, as the state machine cannot be
+// suspended in the middle of one. The trace is kept so that what the char
+// did in the frame can be looked through a controller at a time, with the
+// state it had before each of them ran. Frames simulated again by rollback
+// or replay seeking are not traced.
+type stateDebugger struct {
+	// Whether there are breakpoints, so that the hooks are skipped otherwise
+	armed       bool
+	breakpoints []*breakpoint
+	nextID      int
+	trace       []debugStep
+	// Index in the trace of the first breakpoint hit in this frame
+	hit    int
+	reason string
+	// Char whose trace is shown and index in the trace of the step shown
+	target    int32
+	cur       int
+	frameNo   int32
+	stopped   bool
+	nextFrame bool
+}
+
+func debugCharName(id int32) string {
+	if c := sys.playerID(id); c != nil {
+		if c.helperIndex != 0 {
+			return fmt.Sprintf("P%v %v helper %v (id %v)", c.playerNo+1, c.name, c.helperId, id)
+		}
+		return fmt.Sprintf("P%v %v", c.playerNo+1, c.name)
+	}
+	return fmt.Sprintf("id %v", id)
+}
+
+// Adds a breakpoint of the kind given by its name for c. value is the state
+// number, controller type, CNS condition or var index.
+func (d *stateDebugger) add(c *Char, kind, value string) (*breakpoint, error) {
+	bp := &breakpoint{kind: -1, charID: c.id, value: strings.TrimSpace(value)}
+	for k, name := range breakpointKindNames {
+		if strings.EqualFold(kind, name) {
+			bp.kind = breakpointKind(k)
+		}
+	}
+	switch bp.kind {
+	case BK_state, BK_var, BK_fvar:
+		n, err := strconv.ParseInt(bp.value, 10, 32)
+		if err != nil {
+			return nil, Error("Invalid number: " + bp.value)
+		}
+		bp.no = int32(n)
+		if bp.kind == BK_var && (n < 0 || n >= NumVar) ||
+			bp.kind == BK_fvar && (n < 0 || n >= NumFvar) {
+			return nil, Error(fmt.Sprintf("%v index %v out of range", kind, n))
+		}
+		bp.prev = d.varValue(bp, c)
+	case BK_controller:
+		if bp.value == "" {
+			return nil, Error("No controller type")
+		}
+	case BK_trigger:
+		comp := newCompiler()
+		comp.playerNo = c.playerNo
+		comp.cmdl = &sys.chars[c.playerNo][0].cmd[c.playerNo]
+		expr := bp.value
+		be, err := comp.fullExpression(&expr, VT_Bool)
+		if err != nil {
+			return nil, err
+		}
+		bp.exp, bp.sb = be, newStateBytecode(c.playerNo)
+		bp.prev = float32(Btoi(d.condition(bp, c)))
+	default:
+		return nil, Error("Invalid breakpoint kind: " + kind)
+	}
+	if !d.armed {
+		d.trace, d.hit = d.trace[:0], -1
+	}
+	d.nextID++
+	bp.id = d.nextID
+	d.breakpoints = append(d.breakpoints, bp)
+	d.armed = true
+	return bp, nil
+}
+
+// Removes the breakpoint with the id, or all of them if id is 0.
+func (d *stateDebugger) clear(id int) bool {
+	found := false
+	for i := 0; i < len(d.breakpoints); i++ {
+		if id == 0 || d.breakpoints[i].id == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			i--
+			found = true
+		}
+	}
+	d.armed = len(d.breakpoints) > 0 || d.stopped
+	return found
+}
+
+// Resumes the match after a stop.
+func (d *stateDebugger) resume() {
+	if d.stopped {
+		d.stopped, d.nextFrame = false, false
+		d.armed = len(d.breakpoints) > 0
+		sys.paused = false
+	}
+}
+
+// Shows the next step in the trace of the char that was stopped. Once the
+// end of the trace is reached, the next frame is run and its trace shown.
+func (d *stateDebugger) traceNext() {
+	if !d.stopped {
+		return
+	}
+	for i := d.cur + 1; i < len(d.trace); i++ {
+		if d.trace[i].charID == d.target {
+			d.cur = i
+			return
+		}
+	}
+	d.nextFrame = true
+	sys.step = true
+}
+
+// Whether the hooks have to trace and check breakpoints.
+func (d *stateDebugger) active() bool {
+	return d.armed && !sys.resimulating
+}
+func (d *stateDebugger) traced(c *Char) bool {
+	if d.stopped && c.id == d.target {
+		return true
+	}
+	for _, bp := range d.breakpoints {
+		if bp.charID == c.id {
+			return true
+		}
+	}
+	return false
+}
+func (d *stateDebugger) record(c *Char, event string) int {
+	s := debugStep{charID: c.id, event: event, stateNo: c.ss.no, owner: c.ss.sb.playerNo,
+		time: c.ss.time, animNo: c.animNo, ctrl: c.ctrl()}
+	copy(s.ivar[:], c.ivar[:NumVar])
+	copy(s.fvar[:], c.fvar[:NumFvar])
+	if len(c.mapArray) > 0 {
+		s.maps = make(map[string]float32, len(c.mapArray))
+		for k, v := range c.mapArray {
+			s.maps[k] = v
+		}
+	}
+	d.trace = append(d.trace, s)
+	return len(d.trace) - 1
+}
+func (d *stateDebugger) breakAt(i int, bp *breakpoint, reason string) {
+	if d.hit < 0 {
+		d.hit = i
+		d.reason = fmt.Sprintf("breakpoint %v: %v", bp.id, reason)
+	}
+}
+func (d *stateDebugger) varValue(bp *breakpoint, c *Char) float32 {
+	if bp.kind == BK_var {
+		return float32(c.ivar[bp.no])
+	}
+	return c.fvar[bp.no]
+}
+func (d *stateDebugger) condition(bp *breakpoint, c *Char) bool {
+	wc, ws := sys.workingChar, sys.workingState
+	sys.workingChar, sys.workingState = sys.chars[c.playerNo][0], bp.sb
+	b := bp.exp.evalB(c)
+	sys.workingChar, sys.workingState = wc, ws
+	return b
+}
+
+// Checks the var breakpoints of the char that has just done the step i.
+func (d *stateDebugger) checkVars(c *Char, i int) {
+	for _, bp := range d.breakpoints {
+		if bp.charID != c.id || bp.kind != BK_var && bp.kind != BK_fvar {
+			continue
+		}
+		if v := d.varValue(bp, c); v != bp.prev {
+			d.breakAt(i, bp, fmt.Sprintf("%v(%v) changed from %v to %v",
+				breakpointKindNames[bp.kind], bp.no, bp.prev, v))
+			bp.prev = v
+		}
+	}
+}
+
+// Called when c has entered a state.
+func (d *stateDebugger) enterState(c *Char) {
+	if !d.active() || !d.traced(c) {
+		return
+	}
+	i := d.record(c, fmt.Sprintf("entered state %v", c.ss.no))
+	for _, bp := range d.breakpoints {
+		if bp.charID == c.id && bp.kind == BK_state && bp.no == c.ss.no {
+			d.breakAt(i, bp, fmt.Sprintf("entered state %v", c.ss.no))
+		}
+	}
+}
+func (d *stateDebugger) runController(sc StateController, c *Char, ps []int32) bool {
+	if !d.active() {
+		return sys.profiler.runController(sc, c, ps)
+	}
+	if _, ok := sc.(StateBlock); ok || !d.traced(c) {
+		return sys.profiler.runController(sc, c, ps)
+	}
+	// Recorded before running, and checked for breakpoints after
+	name := reflect.TypeOf(sc).Name()
+	i := d.record(c, name)
+	cs := sys.profiler.runController(sc, c, ps)
+	for _, bp := range d.breakpoints {
+		if bp.charID == c.id && bp.kind == BK_controller && strings.EqualFold(bp.value, name) {
+			d.breakAt(i, bp, "ran "+name)
+		}
+	}
+	d.checkVars(c, i)
+	return cs
+}
+func (d *stateDebugger) evalTrigger(be BytecodeExp, c *Char) bool {
+	b := sys.profiler.evalTrigger(be, c)
+	if d.active() && d.traced(c) {
+		i := d.record(c, fmt.Sprintf("triggers %v", b))
+		d.trace[i].trigger, d.trace[i].result = true, b
+		d.checkVars(c, i)
+	}
+	return b
+}
+
+// Called at the start of every frame in which the chars act.
+func (d *stateDebugger) frame() {
+	if d.active() {
+		d.trace = d.trace[:0]
+		d.hit = -1
+		d.frameNo = sys.gameTime
+	}
+}
+
+// Called once the chars have acted, to check the trigger breakpoints and
+// stop the match.
+func (d *stateDebugger) endFrame() {
+	if !d.active() {
+		return
+	}
+	// Vars may also be changed by other chars
+	checked := make(map[int32]bool)
+	for _, bp := range d.breakpoints {
+		c := sys.playerID(bp.charID)
+		if c == nil {
+			continue
+		}
+		if (bp.kind == BK_var || bp.kind == BK_fvar) && !checked[c.id] {
+			d.checkVars(c, d.record(c, "end of frame"))
+			checked[c.id] = true
+		} else if bp.kind == BK_trigger {
+			b := d.condition(bp, c)
+			if b && bp.prev == 0 {
+				d.breakAt(d.record(c, "condition became true"), bp, bp.value)
+			}
+			bp.prev = float32(Btoi(b))
+		}
+	}
+	if d.stopped && !sys.paused {
+		// Resumed with the pause key
+		d.resume()
+	}
+	switch {
+	case d.hit >= 0:
+		d.stop(d.hit)
+		d.target = d.trace[d.hit].charID
+	case d.nextFrame:
+		// Show the first step of the char in the new frame
+		d.reason, d.nextFrame = "tracing", false
+		d.stop(-1)
+		for i := range d.trace {
+			if d.trace[i].charID == d.target {
+				d.cur = i
+				break
+			}
+		}
+	case d.stopped:
+		// A frame was stepped, show where it ended
+		d.reason = "tracing"
+		if c := sys.playerID(d.target); c != nil {
+			d.stop(d.record(c, "end of frame"))
+		}
+	}
+}
+func (d *stateDebugger) stop(i int) {
+	d.stopped, d.cur = true, i
+	sys.paused = true
+	sys.remoteConsole.event("debuggerStop", map[string]interface{}{"reason": d.reason,
+		"frame": d.frameNo, "panel": d.panel()})
+}
+
+// Lines shown by the debug display while the match is stopped
+func (d *stateDebugger) panel() (lines []string) {
+	if !d.stopped {
+		return
+	}
+	lines = append(lines, fmt.Sprintf("Debugger: %v, frame %v", d.reason, d.frameNo))
+	if d.cur < 0 || d.cur >= len(d.trace) {
+		return append(lines, debugCharName(d.target)+" did nothing")
+	}
+	s := &d.trace[d.cur]
+	lines = append(lines, fmt.Sprintf("%v: %v (step %v/%v)", debugCharName(s.charID),
+		s.event, d.cur+1, len(d.trace)))
+	state := fmt.Sprintf("State %v", s.stateNo)
+	if c := sys.playerID(s.charID); c != nil && c.playerNo != s.owner {
+		state += fmt.Sprintf(" of P%v", s.owner+1)
+	}
+	lines = append(lines, fmt.Sprintf("%v, time %v, anim %v, ctrl %v",
+		state, s.time, s.animNo, Btoi(s.ctrl)))
+	// Triggers evaluated in the same state up to this step
+	var triggers []string
+	for i := 0; i <= d.cur; i++ {
+		t := &d.trace[i]
+		if t.charID == s.charID && t.trigger && t.stateNo == s.stateNo {
+			triggers = append(triggers, fmt.Sprint(Btoi(t.result)))
+		}
+	}
+	if len(triggers) > 0 {
+		lines = append(lines, "Triggers: "+strings.Join(triggers, " "))
+	}
+	var vars, fvars, maps []string
+	for i, v := range s.ivar {
+		if v != 0 {
+			vars = append(vars, fmt.Sprintf("%v=%v", i, v))
+		}
+	}
+	for i, v := range s.fvar {
+		if v != 0 {
+			fvars = append(fvars, fmt.Sprintf("%v=%v", i, v))
+		}
+	}
+	for k, v := range s.maps {
+		maps = append(maps, fmt.Sprintf("%v=%v", k, v))
+	}
+	sort.Strings(maps)
+	for _, l := range [...]struct {
+		name string
+		vals []string
+	}{{"Var", vars}, {"FVar", fvars}, {"Map", maps}} {
+		if len(l.vals) > 0 {
+			lines = append(lines, l.name+": "+strings.Join(l.vals, " "))
+		}
+	}
+	return
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Frames between the state checksums compared by netplay peers and written
+// into replays. Frame 0 of every synchronized segment is never checked.
+const desyncCheckInterval = 60
+
+const desyncLogFile = "save/desync.log"
+
+func isDesyncCheckFrame(frame int32) bool {
+	return frame > 0 && frame%desyncCheckInterval == 0
+}
+
+// The part of the simulation state covered by the checksums
+type syncState struct {
+	randseed, gameTime, round, time int32
+	chars                           []syncChar
+}
+
+type syncChar struct {
+	name                             string
+	playerNo                         int
+	id, stateNo, animNo, life, power int32
+	pos, vel                         [3]float32
+}
+
+func newSyncChar(c *Char) syncChar {
+	return syncChar{name: c.name, playerNo: c.playerNo, id: c.id,
+		stateNo: c.ss.no, animNo: c.animNo, life: c.life, power: c.power,
+		pos: c.pos, vel: c.vel}
+}
+func (s *System) syncState() (ss syncState) {
+	ss.randseed, ss.gameTime, ss.round, ss.time = s.randseed, s.gameTime, s.round, s.time
+	for _, p := range s.chars {
+		for _, c := range p {
+			ss.chars = append(ss.chars, newSyncChar(c))
+		}
+	}
+	return
+}
+func (gs *GameState) syncState() (ss syncState) {
+	ss.randseed, ss.gameTime, ss.round, ss.time = gs.randseed, gs.gameTime, gs.round, gs.time
+	for _, p := range gs.charData {
+		for i := range p {
+			ss.chars = append(ss.chars, newSyncChar(&p[i].c))
+		}
+	}
+	return
+}
+func (ss *syncState) checksum() uint32 {
+	h := fnv.New32a()
+	var b [4]byte
+	i32 := func(v int32) {
+		binary.LittleEndian.PutUint32(b[:], uint32(v))
+		h.Write(b[:])
+	}
+	f32 := func(v ...float32) {
+		for _, f := range v {
+			binary.LittleEndian.PutUint32(b[:], math.Float32bits(f))
+			h.Write(b[:])
+		}
+	}
+	i32(ss.randseed)
+	i32(ss.gameTime)
+	i32(ss.round)
+	i32(ss.time)
+	for _, c := range ss.chars {
+		i32(int32(c.playerNo))
+		i32(c.id)
+		i32(c.stateNo)
+		i32(c.animNo)
+		i32(c.life)
+		i32(c.power)
+		f32(c.pos[:]...)
+		f32(c.vel[:]...)
+	}
+	return h.Sum32()
+}
+func (ss *syncState) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "randseed=%v gametime=%v round=%v time=%v\n",
+		ss.randseed, ss.gameTime, ss.round, ss.time)
+	for _, c := range ss.chars {
+		fmt.Fprintf(&sb, "P%v id=%v %q stateno=%v anim=%v life=%v power=%v pos=%v vel=%v\n",
+			c.playerNo+1, c.id, c.name, c.stateNo, c.animNo, c.life, c.power, c.pos, c.vel)
+	}
+	return sb.String()
+}
+
+// Appends a state dump to desyncLogFile, truncating it first if requested.
+func writeDesyncLog(truncate bool, title string, state string) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if truncate {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(desyncLogFile, flag, 0644)
+	if err != nil {
+		sys.errLog.Printf("Failed to write %v: %v\n", desyncLogFile, err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%v\n%v\n", title, state)
+}
+
+// Messages sent alongside the inputs on the netplay connection. Inputs are
+// never negative, and -1 marks the end of the stream.
+const (
+	netMsgChecksum int32 = -2 // frame, checksum
+	netMsgState    int32 = -3 // frame, length, state dump
+)
+
+type netMessage struct {
+	kind  int32
+	frame int32
+	sum   uint32
+	state string
+}
+
+func (m *netMessage) encode() []byte {
+	ints := []int32{m.kind, m.frame}
+	if m.kind == netMsgChecksum {
+		ints = append(ints, int32(m.sum))
+	} else {
+		ints = append(ints, int32(len(m.state)))
+	}
+	b := make([]byte, 0, len(ints)*4+len(m.state))
+	for _, i := range ints {
+		b = binary.LittleEndian.AppendUint32(b, uint32(i))
+	}
+	return append(b, m.state...)
+}
+
+// Queues a message for the sending goroutine. Messages are dropped rather
+// than stalling the game if the connection falls behind.
+func (ni *NetInput) send(m *netMessage) {
+	select {
+	case ni.outbox <- m.encode():
+	default:
+		sys.errLog.Printf("Netplay: message for frame %v dropped\n", m.frame)
+	}
+}
+
+// Reads the rest of a message whose kind was already read by the receiving
+// goroutine.
+func (ni *NetInput) readMessage(kind int32) error {
+	m := netMessage{kind: kind}
+	var err error
+	if m.frame, err = ni.readI32(); err != nil {
+		return err
+	}
+	tmp, err := ni.readI32()
+	if err != nil {
+		return err
+	}
+	if kind == netMsgChecksum {
+		m.sum = uint32(tmp)
+	} else {
+		if tmp < 0 || tmp > 1<<20 {
+			return Error(fmt.Sprintf("Invalid state dump size: %v", tmp))
+		}
+		b := make([]byte, tmp)
+		if _, err := io.ReadFull(ni.conn, b); err != nil {
+			return err
+		}
+		m.state = string(b)
+	}
+	select {
+	case ni.inbox <- m:
+	default:
+	}
+	return nil
+}
+
+// Records the state at the start of a check frame, and sends its checksum to
+// the other peer.
+func (ni *NetInput) localSync(frame int32, ss *syncState) {
+	if ni.desync >= 0 {
+		return
+	}
+	ni.locSums[frame] = ss
+	ni.send(&netMessage{kind: netMsgChecksum, frame: frame, sum: ss.checksum()})
+}
+
+// Called every frame to compare the checksums received from the other peer
+// with the local ones. Only the first divergent frame is reported.
+func (ni *NetInput) checkSync() {
+	for len(ni.inbox) > 0 {
+		m := <-ni.inbox
+		switch m.kind {
+		case netMsgChecksum:
+			if m.frame >= ni.syncTime {
+				ni.remSums[m.frame] = m.sum
+			}
+		case netMsgState:
+			ni.logState(fmt.Sprintf("Remote state at frame %v:", m.frame), m.state)
+		}
+	}
+	for f, sum := range ni.remSums {
+		ss, ok := ni.locSums[f]
+		if !ok {
+			continue
+		}
+		delete(ni.locSums, f)
+		delete(ni.remSums, f)
+		if ni.desync < 0 && ss.checksum() != sum {
+			ni.desync = f
+			sys.errLog.Printf("Netplay desync detected at frame %v, see %v\n", f, desyncLogFile)
+			sys.appendToConsole(fmt.Sprintf("Desync detected at frame %v", f))
+			state := ss.String()
+			ni.logState(fmt.Sprintf("Local state at frame %v:", f), state)
+			ni.send(&netMessage{kind: netMsgState, frame: f, state: state})
+		}
+	}
+}
+
+// Both peers log their own state and the one sent by the other peer, in
+// whichever order they arrive.
+func (ni *NetInput) logState(title, state string) {
+	writeDesyncLog(!ni.desyncLogged, title, state)
+	ni.desyncLogged = true
+}
+
+// Checks the checksum stored in a replay before the frame about to be read.
+// A checksum of 0 means that the state was not available when recording.
+func (fi *FileInput) checkSync() error {
+	if fi.header == nil || fi.header.Checksums <= 0 ||
+		fi.segFrame <= 0 || fi.segFrame%fi.header.Checksums != 0 {
+		return nil
+	}
+	var sum uint32
+	if err := binary.Read(fi.f, binary.LittleEndian, &sum); err != nil {
+		return err
+	}
+	if fi.desync < 0 && sum != 0 {
+		if ss := sys.syncState(); ss.checksum() != sum {
+			fi.desync = fi.segFrame
+			sys.errLog.Printf("Replay desync detected at frame %v, see %v\n", fi.segFrame, desyncLogFile)
+			sys.appendToConsole(fmt.Sprintf("Replay desync detected at frame %v", fi.segFrame))
+			writeDesyncLog(true, fmt.Sprintf("Playback state at frame %v:", fi.segFrame), ss.String())
+		}
+	}
+	return nil
+}
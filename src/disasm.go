@@ -0,0 +1,762 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Operands of the const_, st_ and ex_ instructions that have one, by size.
+// Operands of 4 bytes are string pool indexes unless noted.
+var (
+	opCodeConstOperands = map[OpCode]int{OC_const_authorname: 4, OC_const_name: 4,
+		OC_const_p2name: 4, OC_const_p3name: 4, OC_const_p4name: 4, OC_const_p5name: 4,
+		OC_const_p6name: 4, OC_const_p7name: 4, OC_const_p8name: 4,
+		OC_const_stagevar_info_name: 4, OC_const_stagevar_info_displayname: 4,
+		OC_const_stagevar_info_author: 4, OC_const_constants: 4, OC_const_stage_constants: 4}
+	opCodeStOperands = map[OpCode]int{OC_st_map: 4}
+	opCodeExOperands = map[OpCode]int{OC_ex_gamemode: 4, OC_ex_helpername: 4,
+		OC_ex_isassertedchar: 8, OC_ex_isassertedglobal: 4, OC_ex_maparray: 4,
+		OC_ex_physics: 1, OC_ex_prevmovetype: 1, OC_ex_reversaldefattr: 4}
+)
+
+func opCodeName(names []string, op OpCode) string {
+	if int(op) < len(names) && names[op] != "" {
+		return names[op]
+	}
+	return fmt.Sprintf("unknown(%v)", op)
+}
+
+// Decodes the instruction at be[i]. Returns its text, the index of the next
+// instruction, and for the instructions followed by a sub-expression (run,
+// nordrun and redirections) the index where that sub-expression ends.
+func (be BytecodeExp) disasmOp(i int, pool []string) (text string, next, subEnd int) {
+	op := be[i]
+	name := opCodeName(opCodeNames[:], op)
+	truncated := func() (string, int, int) {
+		return name + " <truncated>", len(be), 0
+	}
+	i32 := func(at int) int32 {
+		return *(*int32)(unsafe.Pointer(&be[at]))
+	}
+	str := func(at int) string {
+		if n := int(i32(at)); n >= 0 && n < len(pool) {
+			return fmt.Sprintf("%q", pool[n])
+		}
+		return fmt.Sprintf("string#%v", i32(at))
+	}
+	// Operands of 1 and 4 bytes
+	switch op {
+	case OC_int8, OC_jsf8, OC_jmp8, OC_jz8, OC_jnz8, OC_movetype, OC_statetype,
+		OC_teammode, OC_localvar:
+		if i+2 > len(be) {
+			return truncated()
+		}
+	case OC_int, OC_float, OC_command, OC_hitdefattr, OC_jmp, OC_jz, OC_jnz,
+		OC_run, OC_nordrun, OC_player, OC_parent, OC_root, OC_helper, OC_target,
+		OC_partner, OC_enemy, OC_enemynear, OC_playerid, OC_p2, OC_stateowner,
+		OC_helperindex:
+		if i+5 > len(be) {
+			return truncated()
+		}
+	case OC_int64:
+		if i+9 > len(be) {
+			return truncated()
+		}
+	}
+	pad := fmt.Sprintf("%-14v", name)
+	switch op {
+	case OC_int8:
+		return fmt.Sprintf("%v%v", pad, int8(be[i+1])), i + 2, 0
+	case OC_int:
+		return fmt.Sprintf("%v%v", pad, i32(i+1)), i + 5, 0
+	case OC_int64:
+		return fmt.Sprintf("%v%v", pad, *(*int64)(unsafe.Pointer(&be[i+1]))), i + 9, 0
+	case OC_float:
+		return fmt.Sprintf("%v%v", pad, *(*float32)(unsafe.Pointer(&be[i+1]))), i + 5, 0
+	case OC_jsf8, OC_jmp8, OC_jz8, OC_jnz8:
+		// An offset of 0 jumps to the end of the expression
+		if off := int(uint8(be[i+1])); off != 0 {
+			return fmt.Sprintf("%v-> %04d", pad, i+2+off), i + 2, 0
+		}
+		return pad + "-> end", i + 2, 0
+	case OC_jmp, OC_jz, OC_jnz:
+		return fmt.Sprintf("%v-> %04d", pad, i+5+int(i32(i+1))), i + 5, 0
+	case OC_run, OC_nordrun:
+		return fmt.Sprintf("%vlength %v", pad, i32(i+1)), i + 5, i + 5 + int(i32(i+1))
+	case OC_player, OC_parent, OC_root, OC_helper, OC_target, OC_partner, OC_enemy,
+		OC_enemynear, OC_playerid, OC_p2, OC_stateowner, OC_helperindex:
+		// Skipped when there is no such char
+		end := i + 5 + int(i32(i+1))
+		return fmt.Sprintf("%velse -> %04d", pad, end), i + 5, end
+	case OC_command:
+		return pad + str(i+1), i + 5, 0
+	case OC_hitdefattr:
+		return fmt.Sprintf("%v0x%x", pad, i32(i+1)), i + 5, 0
+	case OC_statetype:
+		return pad + stateTypeString(StateType(be[i+1])), i + 2, 0
+	case OC_movetype:
+		return pad + moveTypeString(MoveType(be[i+1])<<15), i + 2, 0
+	case OC_teammode, OC_localvar:
+		return fmt.Sprintf("%v%v", pad, be[i+1]), i + 2, 0
+	case OC_const_, OC_st_, OC_ex_:
+		if i+2 > len(be) {
+			return truncated()
+		}
+		sub, names, operands := be[i+1], opCodeConstNames[:], opCodeConstOperands
+		if op == OC_st_ {
+			names, operands = opCodeStNames[:], opCodeStOperands
+		} else if op == OC_ex_ {
+			names, operands = opCodeExNames[:], opCodeExOperands
+		}
+		name = strings.TrimSuffix(name, "_") + " " + opCodeName(names, sub)
+		n := operands[sub]
+		if i+2+n > len(be) {
+			return truncated()
+		}
+		switch {
+		case n == 1 && sub == OC_ex_physics:
+			return fmt.Sprintf("%-14v%v", name, stateTypeString(StateType(be[i+2]))), i + 3, 0
+		case n == 1:
+			return fmt.Sprintf("%-14v%v", name, moveTypeString(MoveType(be[i+2])<<15)), i + 3, 0
+		case n == 8:
+			return fmt.Sprintf("%-14v0x%x", name, *(*int64)(unsafe.Pointer(&be[i+2]))), i + 10, 0
+		case n == 4 && op == OC_ex_ && (sub == OC_ex_isassertedglobal ||
+			sub == OC_ex_reversaldefattr):
+			return fmt.Sprintf("%-14v0x%x", name, i32(i+2)), i + 6, 0
+		case n == 4:
+			return fmt.Sprintf("%-14v%v", name, str(i+2)), i + 6, 0
+		}
+		return name, i + 2, 0
+	}
+	return name, i + 1, 0
+}
+
+// Writes the listing of the expression, one instruction per line with its
+// offset. The sub-expressions of run, nordrun and redirections are indented.
+func (be BytecodeExp) disassemble(w io.Writer, indent string, pn int) {
+	var pool []string
+	if pn >= 0 && pn < len(sys.stringPool) {
+		pool = sys.stringPool[pn].List
+	}
+	var ends []int
+	for i := 0; i < len(be); {
+		for len(ends) > 0 && i >= ends[len(ends)-1] {
+			ends = ends[:len(ends)-1]
+		}
+		text, next, subEnd := be.disasmOp(i, pool)
+		fmt.Fprintf(w, "%v%04d  %v%v\n", indent, i, strings.Repeat("  ", len(ends)), text)
+		if subEnd > next {
+			ends = append(ends, subEnd)
+		}
+		i = next
+	}
+}
+
+// Writes the parameters of a state controller, by their id, with the
+// listing of each of their expressions.
+func (scb StateControllerBase) disassemble(w io.Writer, indent string, pn int) {
+	for i := 0; i+2 <= len(scb); {
+		id, n := scb[i], int(scb[i+1])
+		i += 2
+		fmt.Fprintf(w, "%vparam %v:\n", indent, id)
+		for m := 0; m < n && i+4 <= len(scb); m++ {
+			l := int(*(*int32)(unsafe.Pointer(&scb[i])))
+			i += 4
+			if i+l > len(scb) {
+				fmt.Fprintf(w, "%v  <truncated>\n", indent)
+				return
+			}
+			if n > 1 {
+				fmt.Fprintf(w, "%v  arg %v:\n", indent, m+1)
+			}
+			(*(*BytecodeExp)(unsafe.Pointer(&scb)))[i:i+l].disassemble(w, indent+"    ", pn)
+			i += l
+		}
+	}
+}
+
+func disassembleController(w io.Writer, indent string, sc StateController, pn int) {
+	switch sc := sc.(type) {
+	case StateBlock:
+		sc.disassemble(w, indent, pn)
+	case StateExpr:
+		fmt.Fprintf(w, "%vexpr:\n", indent)
+		BytecodeExp(sc).disassemble(w, indent+"  ", pn)
+	case callFunction:
+		fmt.Fprintf(w, "%vcall: %v args, %v returns, %v locals\n", indent,
+			sc.numArgs, sc.numRets, sc.numVars)
+		if len(sc.arg) > 0 {
+			fmt.Fprintf(w, "%v  args:\n", indent)
+			sc.arg.disassemble(w, indent+"    ", pn)
+		}
+		for _, c := range sc.ctrls {
+			disassembleController(w, indent+"  ", c, pn)
+		}
+	case NullStateController:
+	default:
+		t, v := reflect.TypeOf(sc), reflect.ValueOf(sc)
+		if v.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			fmt.Fprintf(w, "%v%v\n", indent, t.Name())
+			StateControllerBase(v.Bytes()).disassemble(w, indent+"  ", pn)
+		} else {
+			fmt.Fprintf(w, "%v%v %+v\n", indent, t.Name(), sc)
+		}
+	}
+}
+
+func (b *StateBlock) disassemble(w io.Writer, indent string, pn int) {
+	var attrs []string
+	if b.persistent != 1 {
+		attrs = append(attrs, fmt.Sprintf("persistent %v", b.persistent))
+	}
+	if b.ignorehitpause >= -1 {
+		attrs = append(attrs, "ignorehitpause")
+	}
+	if b.loopBlock {
+		if b.forLoop {
+			attrs = append(attrs, fmt.Sprintf("for %v..%v step %v", b.forBegin, b.forEnd,
+				b.forIncrement))
+		} else {
+			attrs = append(attrs, "while")
+		}
+	}
+	fmt.Fprintf(w, "%vblock %v\n", indent, strings.Join(attrs, ", "))
+	if len(b.trigger) > 0 {
+		fmt.Fprintf(w, "%v  trigger:\n", indent)
+		b.trigger.disassemble(w, indent+"    ", pn)
+	}
+	for i, e := range b.forExpression {
+		if len(e) > 0 {
+			fmt.Fprintf(w, "%v  loop expression %v:\n", indent, i+1)
+			e.disassemble(w, indent+"    ", pn)
+		}
+	}
+	for _, sc := range b.ctrls {
+		disassembleController(w, indent+"  ", sc, pn)
+	}
+	if b.elseBlock != nil {
+		fmt.Fprintf(w, "%velse:\n", indent)
+		b.elseBlock.disassemble(w, indent+"  ", pn)
+	}
+}
+
+// Writes the listing of a compiled state: its statedef parameters and its
+// tree of blocks, controllers and triggers.
+func (sb *StateBytecode) disassemble(w io.Writer, no int32) {
+	fmt.Fprintf(w, "StateDef %v: type %v, movetype %v, physics %v, locals %v\n", no,
+		stateTypeString(sb.stateType), moveTypeString(sb.moveType),
+		stateTypeString(sb.physics), sb.numVars)
+	if len(sb.stateDef) > 0 {
+		fmt.Fprintf(w, "  statedef:\n")
+		StateControllerBase(sb.stateDef).disassemble(w, "    ", sb.playerNo)
+	}
+	sb.block.disassemble(w, "  ", sb.playerNo)
+}
+
+// Writes the listings of the states, in order of state number.
+func disassembleStates(w io.Writer, states map[int32]StateBytecode) {
+	var nos []int
+	for no := range states {
+		nos = append(nos, int(no))
+	}
+	sort.Ints(nos)
+	for _, no := range nos {
+		sb := states[int32(no)]
+		sb.disassemble(w, int32(no))
+		fmt.Fprintln(w)
+	}
+}
+
+// Compiles the char def and prints the listing of its states, or only of the
+// one given with -stateno, and returns the exit code of the process. sys
+// must have been initialized with sys.headless set.
+func disasmMain(def string) int {
+	def, p, err := headlessLoadChar(def)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", def, err)
+		return 2
+	}
+	states, err := newCompiler().Compile(0, def, p.gi().constants)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if s, ok := sys.cmdFlags["-stateno"]; ok {
+		no, err := strconv.Atoi(s)
+		sb, exist := states[int32(no)]
+		if err != nil || !exist {
+			fmt.Fprintf(os.Stderr, "State %v does not exist\n", s)
+			return 1
+		}
+		sb.disassemble(os.Stdout, int32(no))
+		return 0
+	}
+	disassembleStates(os.Stdout, states)
+	return 0
+}
+
+// Names of the instructions, and of the instructions following the const_,
+// st_ and ex_ prefixes
+var opCodeNames = [...]string{
+	OC_var:               "var",
+	OC_sysvar:            "sysvar",
+	OC_fvar:              "fvar",
+	OC_sysfvar:           "sysfvar",
+	OC_localvar:          "localvar",
+	OC_int8:              "int8",
+	OC_int:               "int",
+	OC_int64:             "int64",
+	OC_float:             "float",
+	OC_pop:               "pop",
+	OC_dup:               "dup",
+	OC_swap:              "swap",
+	OC_run:               "run",
+	OC_nordrun:           "nordrun",
+	OC_jsf8:              "jsf8",
+	OC_jmp8:              "jmp8",
+	OC_jz8:               "jz8",
+	OC_jnz8:              "jnz8",
+	OC_jmp:               "jmp",
+	OC_jz:                "jz",
+	OC_jnz:               "jnz",
+	OC_eq:                "eq",
+	OC_ne:                "ne",
+	OC_gt:                "gt",
+	OC_le:                "le",
+	OC_lt:                "lt",
+	OC_ge:                "ge",
+	OC_neg:               "neg",
+	OC_blnot:             "blnot",
+	OC_bland:             "bland",
+	OC_blxor:             "blxor",
+	OC_blor:              "blor",
+	OC_not:               "not",
+	OC_and:               "and",
+	OC_xor:               "xor",
+	OC_or:                "or",
+	OC_add:               "add",
+	OC_sub:               "sub",
+	OC_mul:               "mul",
+	OC_div:               "div",
+	OC_mod:               "mod",
+	OC_pow:               "pow",
+	OC_abs:               "abs",
+	OC_exp:               "exp",
+	OC_ln:                "ln",
+	OC_log:               "log",
+	OC_cos:               "cos",
+	OC_sin:               "sin",
+	OC_tan:               "tan",
+	OC_acos:              "acos",
+	OC_asin:              "asin",
+	OC_atan:              "atan",
+	OC_floor:             "floor",
+	OC_ceil:              "ceil",
+	OC_ifelse:            "ifelse",
+	OC_time:              "time",
+	OC_animtime:          "animtime",
+	OC_animelemtime:      "animelemtime",
+	OC_animelemno:        "animelemno",
+	OC_statetype:         "statetype",
+	OC_movetype:          "movetype",
+	OC_ctrl:              "ctrl",
+	OC_command:           "command",
+	OC_random:            "random",
+	OC_pos_x:             "pos_x",
+	OC_pos_y:             "pos_y",
+	OC_vel_x:             "vel_x",
+	OC_vel_y:             "vel_y",
+	OC_screenpos_x:       "screenpos_x",
+	OC_screenpos_y:       "screenpos_y",
+	OC_facing:            "facing",
+	OC_anim:              "anim",
+	OC_animexist:         "animexist",
+	OC_selfanimexist:     "selfanimexist",
+	OC_alive:             "alive",
+	OC_life:              "life",
+	OC_lifemax:           "lifemax",
+	OC_power:             "power",
+	OC_powermax:          "powermax",
+	OC_canrecover:        "canrecover",
+	OC_roundstate:        "roundstate",
+	OC_ishelper:          "ishelper",
+	OC_numhelper:         "numhelper",
+	OC_numexplod:         "numexplod",
+	OC_numprojid:         "numprojid",
+	OC_numproj:           "numproj",
+	OC_teammode:          "teammode",
+	OC_teamside:          "teamside",
+	OC_hitdefattr:        "hitdefattr",
+	OC_inguarddist:       "inguarddist",
+	OC_movecontact:       "movecontact",
+	OC_movehit:           "movehit",
+	OC_moveguarded:       "moveguarded",
+	OC_movereversed:      "movereversed",
+	OC_projcontacttime:   "projcontacttime",
+	OC_projhittime:       "projhittime",
+	OC_projguardedtime:   "projguardedtime",
+	OC_projcanceltime:    "projcanceltime",
+	OC_backedge:          "backedge",
+	OC_backedgedist:      "backedgedist",
+	OC_backedgebodydist:  "backedgebodydist",
+	OC_frontedge:         "frontedge",
+	OC_frontedgedist:     "frontedgedist",
+	OC_frontedgebodydist: "frontedgebodydist",
+	OC_leftedge:          "leftedge",
+	OC_rightedge:         "rightedge",
+	OC_topedge:           "topedge",
+	OC_bottomedge:        "bottomedge",
+	OC_camerapos_x:       "camerapos_x",
+	OC_camerapos_y:       "camerapos_y",
+	OC_camerazoom:        "camerazoom",
+	OC_gamewidth:         "gamewidth",
+	OC_gameheight:        "gameheight",
+	OC_screenwidth:       "screenwidth",
+	OC_screenheight:      "screenheight",
+	OC_stateno:           "stateno",
+	OC_prevstateno:       "prevstateno",
+	OC_id:                "id",
+	OC_playeridexist:     "playeridexist",
+	OC_gametime:          "gametime",
+	OC_numtarget:         "numtarget",
+	OC_numenemy:          "numenemy",
+	OC_numpartner:        "numpartner",
+	OC_ailevel:           "ailevel",
+	OC_palno:             "palno",
+	OC_hitcount:          "hitcount",
+	OC_uniqhitcount:      "uniqhitcount",
+	OC_hitpausetime:      "hitpausetime",
+	OC_hitover:           "hitover",
+	OC_hitshakeover:      "hitshakeover",
+	OC_hitfall:           "hitfall",
+	OC_hitvel_x:          "hitvel_x",
+	OC_hitvel_y:          "hitvel_y",
+	OC_player:            "player",
+	OC_parent:            "parent",
+	OC_root:              "root",
+	OC_helper:            "helper",
+	OC_target:            "target",
+	OC_partner:           "partner",
+	OC_enemy:             "enemy",
+	OC_enemynear:         "enemynear",
+	OC_playerid:          "playerid",
+	OC_helperindex:       "helperindex",
+	OC_p2:                "p2",
+	OC_stateowner:        "stateowner",
+	OC_rdreset:           "rdreset",
+	OC_const_:            "const_",
+	OC_st_:               "st_",
+	OC_ex_:               "ex_",
+}
+var opCodeConstNames = [...]string{
+	OC_const_data_life:                                          "data_life",
+	OC_const_data_power:                                         "data_power",
+	OC_const_data_guardpoints:                                   "data_guardpoints",
+	OC_const_data_dizzypoints:                                   "data_dizzypoints",
+	OC_const_data_attack:                                        "data_attack",
+	OC_const_data_defence:                                       "data_defence",
+	OC_const_data_fall_defence_up:                               "data_fall_defence_up",
+	OC_const_data_fall_defence_mul:                              "data_fall_defence_mul",
+	OC_const_data_liedown_time:                                  "data_liedown_time",
+	OC_const_data_airjuggle:                                     "data_airjuggle",
+	OC_const_data_sparkno:                                       "data_sparkno",
+	OC_const_data_guard_sparkno:                                 "data_guard_sparkno",
+	OC_const_data_hitsound_channel:                              "data_hitsound_channel",
+	OC_const_data_guardsound_channel:                            "data_guardsound_channel",
+	OC_const_data_ko_echo:                                       "data_ko_echo",
+	OC_const_data_intpersistindex:                               "data_intpersistindex",
+	OC_const_data_floatpersistindex:                             "data_floatpersistindex",
+	OC_const_size_xscale:                                        "size_xscale",
+	OC_const_size_yscale:                                        "size_yscale",
+	OC_const_size_ground_back:                                   "size_ground_back",
+	OC_const_size_ground_front:                                  "size_ground_front",
+	OC_const_size_air_back:                                      "size_air_back",
+	OC_const_size_air_front:                                     "size_air_front",
+	OC_const_size_height:                                        "size_height",
+	OC_const_size_attack_dist:                                   "size_attack_dist",
+	OC_const_size_attack_z_width_back:                           "size_attack_z_width_back",
+	OC_const_size_attack_z_width_front:                          "size_attack_z_width_front",
+	OC_const_size_proj_attack_dist:                              "size_proj_attack_dist",
+	OC_const_size_proj_doscale:                                  "size_proj_doscale",
+	OC_const_size_head_pos_x:                                    "size_head_pos_x",
+	OC_const_size_head_pos_y:                                    "size_head_pos_y",
+	OC_const_size_mid_pos_x:                                     "size_mid_pos_x",
+	OC_const_size_mid_pos_y:                                     "size_mid_pos_y",
+	OC_const_size_shadowoffset:                                  "size_shadowoffset",
+	OC_const_size_draw_offset_x:                                 "size_draw_offset_x",
+	OC_const_size_draw_offset_y:                                 "size_draw_offset_y",
+	OC_const_size_z_width:                                       "size_z_width",
+	OC_const_size_z_enable:                                      "size_z_enable",
+	OC_const_velocity_walk_fwd_x:                                "velocity_walk_fwd_x",
+	OC_const_velocity_walk_back_x:                               "velocity_walk_back_x",
+	OC_const_velocity_walk_up_x:                                 "velocity_walk_up_x",
+	OC_const_velocity_walk_down_x:                               "velocity_walk_down_x",
+	OC_const_velocity_run_fwd_x:                                 "velocity_run_fwd_x",
+	OC_const_velocity_run_fwd_y:                                 "velocity_run_fwd_y",
+	OC_const_velocity_run_back_x:                                "velocity_run_back_x",
+	OC_const_velocity_run_back_y:                                "velocity_run_back_y",
+	OC_const_velocity_run_up_x:                                  "velocity_run_up_x",
+	OC_const_velocity_run_up_y:                                  "velocity_run_up_y",
+	OC_const_velocity_run_down_x:                                "velocity_run_down_x",
+	OC_const_velocity_run_down_y:                                "velocity_run_down_y",
+	OC_const_velocity_jump_y:                                    "velocity_jump_y",
+	OC_const_velocity_jump_neu_x:                                "velocity_jump_neu_x",
+	OC_const_velocity_jump_back_x:                               "velocity_jump_back_x",
+	OC_const_velocity_jump_fwd_x:                                "velocity_jump_fwd_x",
+	OC_const_velocity_jump_up_x:                                 "velocity_jump_up_x",
+	OC_const_velocity_jump_down_x:                               "velocity_jump_down_x",
+	OC_const_velocity_runjump_back_x:                            "velocity_runjump_back_x",
+	OC_const_velocity_runjump_back_y:                            "velocity_runjump_back_y",
+	OC_const_velocity_runjump_y:                                 "velocity_runjump_y",
+	OC_const_velocity_runjump_fwd_x:                             "velocity_runjump_fwd_x",
+	OC_const_velocity_runjump_up_x:                              "velocity_runjump_up_x",
+	OC_const_velocity_runjump_down_x:                            "velocity_runjump_down_x",
+	OC_const_velocity_airjump_y:                                 "velocity_airjump_y",
+	OC_const_velocity_airjump_neu_x:                             "velocity_airjump_neu_x",
+	OC_const_velocity_airjump_back_x:                            "velocity_airjump_back_x",
+	OC_const_velocity_airjump_fwd_x:                             "velocity_airjump_fwd_x",
+	OC_const_velocity_airjump_up_x:                              "velocity_airjump_up_x",
+	OC_const_velocity_airjump_down_x:                            "velocity_airjump_down_x",
+	OC_const_velocity_air_gethit_groundrecover_x:                "velocity_air_gethit_groundrecover_x",
+	OC_const_velocity_air_gethit_groundrecover_y:                "velocity_air_gethit_groundrecover_y",
+	OC_const_velocity_air_gethit_airrecover_mul_x:               "velocity_air_gethit_airrecover_mul_x",
+	OC_const_velocity_air_gethit_airrecover_mul_y:               "velocity_air_gethit_airrecover_mul_y",
+	OC_const_velocity_air_gethit_airrecover_add_x:               "velocity_air_gethit_airrecover_add_x",
+	OC_const_velocity_air_gethit_airrecover_add_y:               "velocity_air_gethit_airrecover_add_y",
+	OC_const_velocity_air_gethit_airrecover_back:                "velocity_air_gethit_airrecover_back",
+	OC_const_velocity_air_gethit_airrecover_fwd:                 "velocity_air_gethit_airrecover_fwd",
+	OC_const_velocity_air_gethit_airrecover_up:                  "velocity_air_gethit_airrecover_up",
+	OC_const_velocity_air_gethit_airrecover_down:                "velocity_air_gethit_airrecover_down",
+	OC_const_velocity_air_gethit_ko_add_x:                       "velocity_air_gethit_ko_add_x",
+	OC_const_velocity_air_gethit_ko_add_y:                       "velocity_air_gethit_ko_add_y",
+	OC_const_velocity_air_gethit_ko_ymin:                        "velocity_air_gethit_ko_ymin",
+	OC_const_velocity_ground_gethit_ko_xmul:                     "velocity_ground_gethit_ko_xmul",
+	OC_const_velocity_ground_gethit_ko_add_x:                    "velocity_ground_gethit_ko_add_x",
+	OC_const_velocity_ground_gethit_ko_add_y:                    "velocity_ground_gethit_ko_add_y",
+	OC_const_velocity_ground_gethit_ko_ymin:                     "velocity_ground_gethit_ko_ymin",
+	OC_const_movement_airjump_num:                               "movement_airjump_num",
+	OC_const_movement_airjump_height:                            "movement_airjump_height",
+	OC_const_movement_yaccel:                                    "movement_yaccel",
+	OC_const_movement_stand_friction:                            "movement_stand_friction",
+	OC_const_movement_crouch_friction:                           "movement_crouch_friction",
+	OC_const_movement_stand_friction_threshold:                  "movement_stand_friction_threshold",
+	OC_const_movement_crouch_friction_threshold:                 "movement_crouch_friction_threshold",
+	OC_const_movement_air_gethit_groundlevel:                    "movement_air_gethit_groundlevel",
+	OC_const_movement_air_gethit_groundrecover_ground_threshold: "movement_air_gethit_groundrecover_ground_threshold",
+	OC_const_movement_air_gethit_groundrecover_groundlevel:      "movement_air_gethit_groundrecover_groundlevel",
+	OC_const_movement_air_gethit_airrecover_threshold:           "movement_air_gethit_airrecover_threshold",
+	OC_const_movement_air_gethit_airrecover_yaccel:              "movement_air_gethit_airrecover_yaccel",
+	OC_const_movement_air_gethit_trip_groundlevel:               "movement_air_gethit_trip_groundlevel",
+	OC_const_movement_down_bounce_offset_x:                      "movement_down_bounce_offset_x",
+	OC_const_movement_down_bounce_offset_y:                      "movement_down_bounce_offset_y",
+	OC_const_movement_down_bounce_yaccel:                        "movement_down_bounce_yaccel",
+	OC_const_movement_down_bounce_groundlevel:                   "movement_down_bounce_groundlevel",
+	OC_const_movement_down_friction_threshold:                   "movement_down_friction_threshold",
+	OC_const_name:                                               "name",
+	OC_const_p2name:                                             "p2name",
+	OC_const_p3name:                                             "p3name",
+	OC_const_p4name:                                             "p4name",
+	OC_const_p5name:                                             "p5name",
+	OC_const_p6name:                                             "p6name",
+	OC_const_p7name:                                             "p7name",
+	OC_const_p8name:                                             "p8name",
+	OC_const_authorname:                                         "authorname",
+	OC_const_stagevar_info_author:                               "stagevar_info_author",
+	OC_const_stagevar_info_displayname:                          "stagevar_info_displayname",
+	OC_const_stagevar_info_name:                                 "stagevar_info_name",
+	OC_const_stagevar_camera_boundleft:                          "stagevar_camera_boundleft",
+	OC_const_stagevar_camera_boundright:                         "stagevar_camera_boundright",
+	OC_const_stagevar_camera_boundhigh:                          "stagevar_camera_boundhigh",
+	OC_const_stagevar_camera_boundlow:                           "stagevar_camera_boundlow",
+	OC_const_stagevar_camera_verticalfollow:                     "stagevar_camera_verticalfollow",
+	OC_const_stagevar_camera_floortension:                       "stagevar_camera_floortension",
+	OC_const_stagevar_camera_tensionhigh:                        "stagevar_camera_tensionhigh",
+	OC_const_stagevar_camera_tensionlow:                         "stagevar_camera_tensionlow",
+	OC_const_stagevar_camera_tension:                            "stagevar_camera_tension",
+	OC_const_stagevar_camera_startzoom:                          "stagevar_camera_startzoom",
+	OC_const_stagevar_camera_zoomout:                            "stagevar_camera_zoomout",
+	OC_const_stagevar_camera_zoomin:                             "stagevar_camera_zoomin",
+	OC_const_stagevar_camera_ytension_enable:                    "stagevar_camera_ytension_enable",
+	OC_const_stagevar_playerinfo_leftbound:                      "stagevar_playerinfo_leftbound",
+	OC_const_stagevar_playerinfo_rightbound:                     "stagevar_playerinfo_rightbound",
+	OC_const_stagevar_scaling_topscale:                          "stagevar_scaling_topscale",
+	OC_const_stagevar_bound_screenleft:                          "stagevar_bound_screenleft",
+	OC_const_stagevar_bound_screenright:                         "stagevar_bound_screenright",
+	OC_const_stagevar_stageinfo_zoffset:                         "stagevar_stageinfo_zoffset",
+	OC_const_stagevar_stageinfo_zoffsetlink:                     "stagevar_stageinfo_zoffsetlink",
+	OC_const_stagevar_stageinfo_xscale:                          "stagevar_stageinfo_xscale",
+	OC_const_stagevar_stageinfo_yscale:                          "stagevar_stageinfo_yscale",
+	OC_const_stagevar_shadow_intensity:                          "stagevar_shadow_intensity",
+	OC_const_stagevar_shadow_color_r:                            "stagevar_shadow_color_r",
+	OC_const_stagevar_shadow_color_g:                            "stagevar_shadow_color_g",
+	OC_const_stagevar_shadow_color_b:                            "stagevar_shadow_color_b",
+	OC_const_stagevar_shadow_yscale:                             "stagevar_shadow_yscale",
+	OC_const_stagevar_shadow_fade_range_begin:                   "stagevar_shadow_fade_range_begin",
+	OC_const_stagevar_shadow_fade_range_end:                     "stagevar_shadow_fade_range_end",
+	OC_const_stagevar_shadow_xshear:                             "stagevar_shadow_xshear",
+	OC_const_stagevar_reflection_intensity:                      "stagevar_reflection_intensity",
+	OC_const_constants:                                          "constants",
+	OC_const_stage_constants:                                    "stage_constants",
+}
+var opCodeStNames = [...]string{
+	OC_st_var:        "var",
+	OC_st_sysvar:     "sysvar",
+	OC_st_fvar:       "fvar",
+	OC_st_sysfvar:    "sysfvar",
+	OC_st_varadd:     "varadd",
+	OC_st_sysvaradd:  "sysvaradd",
+	OC_st_fvaradd:    "fvaradd",
+	OC_st_sysfvaradd: "sysfvaradd",
+	OC_st_map:        "map",
+}
+var opCodeExNames = [...]string{
+	OC_ex_p2dist_x:                      "p2dist_x",
+	OC_ex_p2dist_y:                      "p2dist_y",
+	OC_ex_p2bodydist_x:                  "p2bodydist_x",
+	OC_ex_parentdist_x:                  "parentdist_x",
+	OC_ex_parentdist_y:                  "parentdist_y",
+	OC_ex_rootdist_x:                    "rootdist_x",
+	OC_ex_rootdist_y:                    "rootdist_y",
+	OC_ex_win:                           "win",
+	OC_ex_winko:                         "winko",
+	OC_ex_wintime:                       "wintime",
+	OC_ex_winperfect:                    "winperfect",
+	OC_ex_winspecial:                    "winspecial",
+	OC_ex_winhyper:                      "winhyper",
+	OC_ex_lose:                          "lose",
+	OC_ex_loseko:                        "loseko",
+	OC_ex_losetime:                      "losetime",
+	OC_ex_drawgame:                      "drawgame",
+	OC_ex_matchover:                     "matchover",
+	OC_ex_matchno:                       "matchno",
+	OC_ex_roundno:                       "roundno",
+	OC_ex_roundsexisted:                 "roundsexisted",
+	OC_ex_ishometeam:                    "ishometeam",
+	OC_ex_tickspersecond:                "tickspersecond",
+	OC_ex_majorversion:                  "majorversion",
+	OC_ex_drawpalno:                     "drawpalno",
+	OC_ex_const240p:                     "const240p",
+	OC_ex_const480p:                     "const480p",
+	OC_ex_const720p:                     "const720p",
+	OC_ex_gethitvar_animtype:            "gethitvar_animtype",
+	OC_ex_gethitvar_air_animtype:        "gethitvar_air_animtype",
+	OC_ex_gethitvar_ground_animtype:     "gethitvar_ground_animtype",
+	OC_ex_gethitvar_fall_animtype:       "gethitvar_fall_animtype",
+	OC_ex_gethitvar_type:                "gethitvar_type",
+	OC_ex_gethitvar_airtype:             "gethitvar_airtype",
+	OC_ex_gethitvar_groundtype:          "gethitvar_groundtype",
+	OC_ex_gethitvar_damage:              "gethitvar_damage",
+	OC_ex_gethitvar_hitcount:            "gethitvar_hitcount",
+	OC_ex_gethitvar_fallcount:           "gethitvar_fallcount",
+	OC_ex_gethitvar_hitshaketime:        "gethitvar_hitshaketime",
+	OC_ex_gethitvar_hittime:             "gethitvar_hittime",
+	OC_ex_gethitvar_slidetime:           "gethitvar_slidetime",
+	OC_ex_gethitvar_ctrltime:            "gethitvar_ctrltime",
+	OC_ex_gethitvar_recovertime:         "gethitvar_recovertime",
+	OC_ex_gethitvar_xoff:                "gethitvar_xoff",
+	OC_ex_gethitvar_yoff:                "gethitvar_yoff",
+	OC_ex_gethitvar_xvel:                "gethitvar_xvel",
+	OC_ex_gethitvar_yvel:                "gethitvar_yvel",
+	OC_ex_gethitvar_yaccel:              "gethitvar_yaccel",
+	OC_ex_gethitvar_chainid:             "gethitvar_chainid",
+	OC_ex_gethitvar_guarded:             "gethitvar_guarded",
+	OC_ex_gethitvar_isbound:             "gethitvar_isbound",
+	OC_ex_gethitvar_fall:                "gethitvar_fall",
+	OC_ex_gethitvar_fall_damage:         "gethitvar_fall_damage",
+	OC_ex_gethitvar_fall_xvel:           "gethitvar_fall_xvel",
+	OC_ex_gethitvar_fall_yvel:           "gethitvar_fall_yvel",
+	OC_ex_gethitvar_fall_recover:        "gethitvar_fall_recover",
+	OC_ex_gethitvar_fall_time:           "gethitvar_fall_time",
+	OC_ex_gethitvar_fall_recovertime:    "gethitvar_fall_recovertime",
+	OC_ex_gethitvar_fall_kill:           "gethitvar_fall_kill",
+	OC_ex_gethitvar_fall_envshake_time:  "gethitvar_fall_envshake_time",
+	OC_ex_gethitvar_fall_envshake_freq:  "gethitvar_fall_envshake_freq",
+	OC_ex_gethitvar_fall_envshake_ampl:  "gethitvar_fall_envshake_ampl",
+	OC_ex_gethitvar_fall_envshake_phase: "gethitvar_fall_envshake_phase",
+	OC_ex_gethitvar_fall_envshake_mul:   "gethitvar_fall_envshake_mul",
+	OC_ex_gethitvar_attr:                "gethitvar_attr",
+	OC_ex_gethitvar_dizzypoints:         "gethitvar_dizzypoints",
+	OC_ex_gethitvar_guardpoints:         "gethitvar_guardpoints",
+	OC_ex_gethitvar_id:                  "gethitvar_id",
+	OC_ex_gethitvar_playerno:            "gethitvar_playerno",
+	OC_ex_gethitvar_redlife:             "gethitvar_redlife",
+	OC_ex_gethitvar_score:               "gethitvar_score",
+	OC_ex_gethitvar_hitdamage:           "gethitvar_hitdamage",
+	OC_ex_gethitvar_guarddamage:         "gethitvar_guarddamage",
+	OC_ex_gethitvar_hitpower:            "gethitvar_hitpower",
+	OC_ex_gethitvar_guardpower:          "gethitvar_guardpower",
+	OC_ex_gethitvar_kill:                "gethitvar_kill",
+	OC_ex_ailevelf:                      "ailevelf",
+	OC_ex_animelemlength:                "animelemlength",
+	OC_ex_animlength:                    "animlength",
+	OC_ex_attack:                        "attack",
+	OC_ex_combocount:                    "combocount",
+	OC_ex_consecutivewins:               "consecutivewins",
+	OC_ex_defence:                       "defence",
+	OC_ex_dizzy:                         "dizzy",
+	OC_ex_dizzypoints:                   "dizzypoints",
+	OC_ex_dizzypointsmax:                "dizzypointsmax",
+	OC_ex_fighttime:                     "fighttime",
+	OC_ex_firstattack:                   "firstattack",
+	OC_ex_framespercount:                "framespercount",
+	OC_ex_float:                         "float",
+	OC_ex_gamemode:                      "gamemode",
+	OC_ex_getplayerid:                   "getplayerid",
+	OC_ex_groundangle:                   "groundangle",
+	OC_ex_guardbreak:                    "guardbreak",
+	OC_ex_guardpoints:                   "guardpoints",
+	OC_ex_guardpointsmax:                "guardpointsmax",
+	OC_ex_helpername:                    "helpername",
+	OC_ex_hitoverridden:                 "hitoverridden",
+	OC_ex_incustomstate:                 "incustomstate",
+	OC_ex_indialogue:                    "indialogue",
+	OC_ex_isassertedchar:                "isassertedchar",
+	OC_ex_isassertedglobal:              "isassertedglobal",
+	OC_ex_ishost:                        "ishost",
+	OC_ex_localscale:                    "localscale",
+	OC_ex_maparray:                      "maparray",
+	OC_ex_max:                           "max",
+	OC_ex_min:                           "min",
+	OC_ex_memberno:                      "memberno",
+	OC_ex_movecountered:                 "movecountered",
+	OC_ex_pausetime:                     "pausetime",
+	OC_ex_physics:                       "physics",
+	OC_ex_playerno:                      "playerno",
+	OC_ex_randomrange:                   "randomrange",
+	OC_ex_ratiolevel:                    "ratiolevel",
+	OC_ex_receiveddamage:                "receiveddamage",
+	OC_ex_receivedhits:                  "receivedhits",
+	OC_ex_redlife:                       "redlife",
+	OC_ex_round:                         "round",
+	OC_ex_roundtype:                     "roundtype",
+	OC_ex_score:                         "score",
+	OC_ex_scoretotal:                    "scoretotal",
+	OC_ex_selfstatenoexist:              "selfstatenoexist",
+	OC_ex_sprpriority:                   "sprpriority",
+	OC_ex_stagebackedgedist:             "stagebackedgedist",
+	OC_ex_stagefrontedgedist:            "stagefrontedgedist",
+	OC_ex_stagetime:                     "stagetime",
+	OC_ex_standby:                       "standby",
+	OC_ex_teamleader:                    "teamleader",
+	OC_ex_teamsize:                      "teamsize",
+	OC_ex_timeelapsed:                   "timeelapsed",
+	OC_ex_timeremaining:                 "timeremaining",
+	OC_ex_timetotal:                     "timetotal",
+	OC_ex_pos_z:                         "pos_z",
+	OC_ex_vel_z:                         "vel_z",
+	OC_ex_prevanim:                      "prevanim",
+	OC_ex_prevmovetype:                  "prevmovetype",
+	OC_ex_reversaldefattr:               "reversaldefattr",
+	OC_ex_bgmlength:                     "bgmlength",
+	OC_ex_bgmposition:                   "bgmposition",
+	OC_ex_airjumpcount:                  "airjumpcount",
+	OC_ex_envshakevar_time:              "envshakevar_time",
+	OC_ex_envshakevar_freq:              "envshakevar_freq",
+	OC_ex_envshakevar_ampl:              "envshakevar_ampl",
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math"
-	"os"
 	"regexp"
 	"strings"
 )
@@ -56,13 +56,13 @@ func loadFntV1(filename string) (*Fnt, error) {
 	f := newFnt()
 	f.images[0] = make(map[rune]*FntCharImage)
 
-	fp, err := os.Open(filename)
+	fp, err := OpenFile(filename)
 
 	if err != nil {
 		return nil, Error("File not found")
 	}
 
-	defer func() { chk(fp.Close()) }()
+	defer fp.Close()
 
 	//Read header
 	buf := make([]byte, 12)
@@ -107,9 +107,24 @@ func loadFntV1(filename string) (*Fnt, error) {
 		return nil, err
 	}
 
+	end, err := fileSize(fp)
+	if err != nil {
+		return nil, err
+	}
+	if pcxDataLength < 128+768 {
+		return nil, formatError(filename, "image", int64(pcxDataOffset),
+			Error(fmt.Sprintf("%v bytes are too few for a PCX image", pcxDataLength)))
+	}
+	if err := checkRange(end, int64(pcxDataOffset), int64(pcxDataLength)); err != nil {
+		return nil, formatError(filename, "image", int64(pcxDataOffset), err)
+	}
+	if err := checkRange(end, int64(txtDataOffset), int64(txtDataLength)); err != nil {
+		return nil, formatError(filename, "text", int64(txtDataOffset), err)
+	}
+
 	spr := newSprite()
 	if err := spr.readPcxHeader(fp, int64(pcxDataOffset)); err != nil {
-		return nil, err
+		return nil, formatError(filename, "image", int64(pcxDataOffset), err)
 	}
 
 	fp.Seek(int64(pcxDataOffset)+128, 0)
@@ -128,6 +143,10 @@ func loadFntV1(filename string) (*Fnt, error) {
 	}
 
 	px = spr.RlePcxDecode(px)
+	if len(px) < int(spr.Size[0])*int(spr.Size[1]) {
+		return nil, formatError(filename, "image", int64(pcxDataOffset)+128,
+			Error("Invalid image data"))
+	}
 	fp.Seek(int64(txtDataOffset), 0)
 	buf = make([]byte, txtDataLength)
 	if err := read(buf); err != nil {
@@ -202,7 +221,9 @@ func loadFntV1(filename string) (*Fnt, error) {
 				defflg = false
 				is := NewIniSection()
 				is.Parse(lines, &i)
-				loadDefInfo(f, filename, is, 0)
+				if err := loadDefInfo(f, filename, is, 0); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
@@ -268,14 +289,16 @@ func loadFntV2(filename string, height int32) (*Fnt, error) {
 			i--
 			switch name {
 			case "def":
-				loadDefInfo(f, filename, is, height)
+				if err := loadDefInfo(f, filename, is, height); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
 	return f, nil
 }
 
-func loadDefInfo(f *Fnt, filename string, is IniSection, height int32) {
+func loadDefInfo(f *Fnt, filename string, is IniSection, height int32) error {
 	f.Type = strings.ToLower(is["type"])
 	if _, ok := is["banktype"]; ok {
 		f.BankType = strings.ToLower(is["banktype"])
@@ -305,19 +328,19 @@ func loadDefInfo(f *Fnt, filename string, is IniSection, height int32) {
 
 	if len(is["file"]) > 0 {
 		if f.Type == "truetype" {
-			LoadFntTtf(f, filename, is["file"], height)
-		} else {
-			LoadFntSff(f, filename, is["file"])
+			return LoadFntTtf(f, filename, is["file"], height)
 		}
+		return LoadFntSff(f, filename, is["file"])
 	}
+	return nil
 }
 
-func LoadFntSff(f *Fnt, fontfile string, filename string) {
+func LoadFntSff(f *Fnt, fontfile string, filename string) error {
 	fileDir := SearchFile(filename, []string{fontfile, "font/", sys.motifDir, "", "data/"})
 	sff, err := loadSff(fileDir, false)
 
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	//Load sprites
@@ -371,6 +394,7 @@ func LoadFntSff(f *Fnt, fontfile string, filename string) {
 		f.palettes = make([][256]uint32, 1)
 		copy(f.palettes[0][:], pal_default)
 	}
+	return nil
 }
 
 // CharWidth returns the width that has a specified character
@@ -393,7 +417,9 @@ func (f *Fnt) TextWidth(txt string, bank int32) (w int32) {
 	}
 	for i, c := range txt {
 		if f.Type == "truetype" {
-			w += int32(f.ttf.Width(1, string(c)))
+			if f.ttf != nil {
+				w += int32(f.ttf.Width(1, string(c)))
+			}
 		} else {
 			cw := f.CharWidth(c, bank)
 			// in mugen negative spacing matching char width seems to skip calc,
@@ -435,7 +461,11 @@ func (f *Fnt) drawChar(
 	}
 
 	spr := f.getCharSpr(c, bank, bt)
-	if spr == nil || spr.Tex == nil {
+	if spr == nil {
+		return 0
+	}
+	tex := spr.texture()
+	if tex == nil {
 		return 0
 	}
 
@@ -453,7 +483,7 @@ func (f *Fnt) drawChar(
 		f.paltex = spr.CachePalette(pal)
 	}
 	rp := RenderParams{
-		spr.Tex, f.paltex, spr.Size,
+		tex, f.paltex, spr.Size,
 		-x * sys.widthScale, -y * sys.heightScale, notiling,
 		xscl * sys.widthScale, xscl * sys.widthScale,
 		yscl * sys.heightScale, 1, 0,
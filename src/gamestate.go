@@ -0,0 +1,700 @@
+package main
+
+// GameState is an in-memory snapshot of everything that is advanced by
+// System.action, so that a match can be rewound to an earlier frame and
+// simulated again (rollback netcode, savestates).
+// Loaded resources (Sff, Snd, animation tables, compiled states) are not
+// copied: a GameState is only valid while the same characters and stage are
+// loaded.
+type GameState struct {
+	saved bool
+	// Characters, kept by pointer so that references held by other objects
+	// (charList, children, enemynear, camera) stay valid after a restore
+	chars    [MaxSimul*2 + MaxAttachedChar][]*Char
+	charData [MaxSimul*2 + MaxAttachedChar][]charState
+	charList CharList
+	cgi      [MaxSimul*2 + MaxAttachedChar]cgiState
+
+	projs             [MaxSimul*2 + MaxAttachedChar][]Projectile
+	explods           [MaxSimul*2 + MaxAttachedChar][]Explod
+	explDrawlist      [MaxSimul*2 + MaxAttachedChar][]int
+	topexplDrawlist   [MaxSimul*2 + MaxAttachedChar][]int
+	underexplDrawlist [MaxSimul*2 + MaxAttachedChar][]int
+
+	// System
+	randseed                                          int32
+	gameTime, time, intro, round                      int32
+	roundsExisted, wins                               [2]int32
+	consecutiveWins                                   [2]int32
+	draws                                             int32
+	lastHitter                                        [2]int
+	winTeam                                           int
+	winType, winTrigger                               [2]WinType
+	finish                                            FinishType
+	waitdown, slowtime, shuttertime                   int32
+	fadeintime, fadeouttime, wintime                  int32
+	winskipped, introSkipped                          bool
+	firstAttack                                       [3]int
+	teamLeader                                        [2]int
+	specialFlag                                       GlobalSpecialFlag
+	envShake                                          EnvShake
+	pause, pausetime                                  int32
+	pausebg                                           bool
+	pauseendcmdbuftime                                int32
+	pauseplayer                                       int
+	super, supertime                                  int32
+	superpausebg                                      bool
+	superendcmdbuftime                                int32
+	superplayer                                       int
+	superdarken                                       bool
+	superanim                                         *Animation
+	superpmap                                         PalFX
+	superpos                                          [2]float32
+	superfacing, superp2defmul                        float32
+	envcol                                            [3]int32
+	envcol_time                                       int32
+	envcol_under                                      bool
+	allPalFX, bgPalFX                                 PalFX
+	nextCharId                                        int32
+	tickCount, oldTickCount                           int
+	tickCountF, lastTick, nextAddTime, oldNextAddTime float32
+	turbo, accel                                      float32
+	screenleft, screenright, xmin, xmax               float32
+	drawScale, zoomlag, zoomScale                     float32
+	zoomPosXLag, zoomPosYLag                          float32
+	enableZoomtime                                    int32
+	zoomCameraBound, zoomStageBound                   bool
+	zoomPos                                           [2]float32
+	aiInput                                           [MaxSimul*2 + MaxAttachedChar]AIController
+	cam                                               Camera
+	stage                                             stageState
+	lifebar                                           lifebarState
+	timerCount, timerRounds                           []int32
+	scoreRounds                                       [][2]float32
+	// Last, so that every PalFX is already known when a savestate is written
+	palfx map[*PalFX]PalFX
+	// Remap slices of the previous save, reused by the next one
+	remapBuf palFXRemapBuffers
+}
+
+type palFXRemapBuffers [][]int
+
+type charState struct {
+	c   Char
+	cmd []CommandList
+}
+
+type cgiState struct {
+	pctype      ProjContact
+	pctime      int32
+	pcid        int32
+	projidcount int
+	unhittable  int32
+}
+
+type stageState struct {
+	stage     *Stage
+	bg        []backGround
+	bgc       []bgCtrl
+	bgct      bgcTimeLine
+	bga       bgAction
+	stageTime int32
+}
+
+type lifebarState struct {
+	ro_cur         int32
+	ro_wt, ro_swt  [4]int32
+	ro_dt          [4]int32
+	ro_timerActive bool
+	ro_introState  [2]bool
+	co             [2]LifeBarCombo
+	sc             [2]LifeBarScore
+	wi             [2]LifeBarWinIcon
+	wc             [2]LifeBarWinCount
+	ac             [2][]LbMsg
+}
+
+func cloneAnimation(a *Animation) *Animation {
+	if a == nil {
+		return nil
+	}
+	ret := &Animation{}
+	*ret = *a
+	return ret
+}
+
+// Returns a copy of the command lists that shares no mutable data with cl,
+// reusing the buffers of dst, a previous copy. Command lists that share a
+// CommandBuffer keep sharing one in the copy.
+func cloneCommandLists(dst, cl []CommandList) []CommandList {
+	if cl == nil {
+		return nil
+	}
+	ret := dst[:0]
+	for i, l := range cl {
+		var buf *CommandBuffer
+		var cmds [][]Command
+		if i < len(dst) {
+			buf, cmds = dst[i].Buffer, dst[i].Commands
+		}
+		ret = append(ret, l)
+		if l.Buffer != nil {
+			// Command lists are few, so the shared buffers are searched
+			shared := false
+			for j := 0; j < i; j++ {
+				if cl[j].Buffer == l.Buffer {
+					ret[i].Buffer, shared = ret[j].Buffer, true
+					break
+				} else if ret[j].Buffer == buf {
+					buf = nil
+				}
+			}
+			if !shared {
+				if buf == nil {
+					buf = &CommandBuffer{}
+				}
+				*buf = *l.Buffer
+				ret[i].Buffer = buf
+			}
+		}
+		for len(cmds) < len(l.Commands) {
+			cmds = append(cmds, nil)
+		}
+		ret[i].Commands = cmds[:len(l.Commands)]
+		for j, ca := range l.Commands {
+			ret[i].Commands[j] = cloneCommands(ret[i].Commands[j], ca)
+		}
+	}
+	return ret
+}
+func cloneCommands(dst, ca []Command) []Command {
+	ret := dst[:0]
+	for k, c := range ca {
+		var held []bool
+		if k < len(dst) {
+			held = dst[k].held
+		}
+		ret = append(ret, c)
+		ret[k].held = append(held[:0], c.held...)
+	}
+	return ret
+}
+
+// Copies the command state saved by cloneCommandLists back into cl without
+// replacing any of its buffers.
+func restoreCommandLists(cl, src []CommandList) {
+	for i := range cl {
+		if i >= len(src) {
+			break
+		}
+		if cl[i].Buffer != nil && src[i].Buffer != nil {
+			*cl[i].Buffer = *src[i].Buffer
+		}
+		for j := range cl[i].Commands {
+			if j >= len(src[i].Commands) {
+				break
+			}
+			for k := range cl[i].Commands[j] {
+				if k >= len(src[i].Commands[j]) {
+					break
+				}
+				held := cl[i].Commands[j][k].held
+				cl[i].Commands[j][k] = src[i].Commands[j][k]
+				if len(held) == len(src[i].Commands[j][k].held) {
+					copy(held, src[i].Commands[j][k].held)
+					cl[i].Commands[j][k].held = held
+				} else {
+					cl[i].Commands[j][k].held = append([]bool(nil), src[i].Commands[j][k].held...)
+				}
+			}
+		}
+	}
+}
+
+// Returns a copy of c whose slices and maps can be modified independently.
+// Pointers to other characters and to PalFX are kept as they are.
+func (c *Char) cloneState() (ret Char) {
+	c.cloneStateInto(&ret)
+	return
+}
+
+// Like cloneState, but reuses the slices and maps of dst, which must not be
+// referred to by anything else.
+func (c *Char) cloneStateInto(dst *Char) {
+	anim, children, targets := dst.anim, dst.children, dst.targets
+	targetsOfHitdef, enemynear, p2enemy := dst.targetsOfHitdef, dst.enemynear, dst.p2enemy
+	ps, wakegawakaranai, ctrlsps := dst.ss.ps, dst.ss.wakegawakaranai, dst.ss.sb.ctrlsps
+	hitBy, palfx := dst.ghv.hitBy, dst.aimg.palfx
+	mapArray, remapSpr := dst.mapArray, dst.remapSpr
+	clipboardText, dialogue := dst.clipboardText, dst.dialogue
+	defaultHitScale := dst.defaultHitScale
+	nextHitScale, activeHitScale := dst.nextHitScale, dst.activeHitScale
+	*dst = *c
+	dst.anim = reuseAnimation(anim, c.anim)
+	dst.children = append(children[:0], c.children...)
+	dst.targets = append(targets[:0], c.targets...)
+	dst.targetsOfHitdef = append(targetsOfHitdef[:0], c.targetsOfHitdef...)
+	for i := range c.enemynear {
+		dst.enemynear[i] = append(enemynear[i][:0], c.enemynear[i]...)
+	}
+	dst.p2enemy = append(p2enemy[:0], c.p2enemy...)
+	dst.ss.ps = append(ps[:0], c.ss.ps...)
+	for i, ww := range c.ss.wakegawakaranai {
+		dst.ss.wakegawakaranai[i] = append(wakegawakaranai[i][:0], ww...)
+	}
+	dst.ss.sb.ctrlsps = append(ctrlsps[:0], c.ss.sb.ctrlsps...)
+	dst.ghv.hitBy = append(hitBy[:0], c.ghv.hitBy...)
+	dst.aimg.palfx = append(palfx[:0], c.aimg.palfx...)
+	if c.mapArray != nil {
+		if mapArray == nil {
+			mapArray = make(map[string]float32, len(c.mapArray))
+		}
+		for k := range mapArray {
+			delete(mapArray, k)
+		}
+		for k, v := range c.mapArray {
+			mapArray[k] = v
+		}
+		dst.mapArray = mapArray
+	}
+	if c.remapSpr != nil {
+		if remapSpr == nil {
+			remapSpr = make(RemapPreset, len(c.remapSpr))
+		}
+		for k := range remapSpr {
+			delete(remapSpr, k)
+		}
+		for k, v := range c.remapSpr {
+			remapSpr[k] = v
+		}
+		dst.remapSpr = remapSpr
+	}
+	dst.clipboardText = append(clipboardText[:0], c.clipboardText...)
+	dst.dialogue = append(dialogue[:0], c.dialogue...)
+	for i, hs := range c.defaultHitScale {
+		dst.defaultHitScale[i] = reuseHitScale(defaultHitScale[i], hs)
+	}
+	cloneHitScale := func(dst, m map[int32][3]*HitScale) map[int32][3]*HitScale {
+		if m == nil {
+			return nil
+		}
+		if dst == nil {
+			dst = make(map[int32][3]*HitScale, len(m))
+		}
+		for k := range dst {
+			if _, ok := m[k]; !ok {
+				delete(dst, k)
+			}
+		}
+		for k, v := range m {
+			hs := dst[k]
+			for i, h := range v {
+				hs[i] = reuseHitScale(hs[i], h)
+			}
+			dst[k] = hs
+		}
+		return dst
+	}
+	dst.nextHitScale = cloneHitScale(nextHitScale, c.nextHitScale)
+	dst.activeHitScale = cloneHitScale(activeHitScale, c.activeHitScale)
+}
+
+// Copies a into dst, allocating dst if needed. Returns nil if a is nil.
+func reuseAnimation(dst, a *Animation) *Animation {
+	if a == nil {
+		return nil
+	}
+	if dst == nil {
+		dst = &Animation{}
+	}
+	*dst = *a
+	return dst
+}
+func reuseHitScale(dst, hs *HitScale) *HitScale {
+	if hs == nil {
+		return nil
+	}
+	if dst == nil {
+		dst = &HitScale{}
+	}
+	*dst = *hs
+	return dst
+}
+
+func (p *Projectile) cloneState() (ret Projectile) {
+	p.cloneStateInto(&ret)
+	return
+}
+func (p *Projectile) cloneStateInto(dst *Projectile) {
+	ani, palfx := dst.ani, dst.aimg.palfx
+	*dst = *p
+	dst.ani = reuseAnimation(ani, p.ani)
+	dst.aimg.palfx = append(palfx[:0], p.aimg.palfx...)
+}
+
+func (e *Explod) cloneState() (ret Explod) {
+	e.cloneStateInto(&ret)
+	return
+}
+func (e *Explod) cloneStateInto(dst *Explod) {
+	anim := dst.anim
+	*dst = *e
+	dst.anim = reuseAnimation(anim, e.anim)
+}
+
+func (gs *GameState) savePalFX(pf *PalFX) {
+	if pf == nil {
+		return
+	}
+	if _, ok := gs.palfx[pf]; !ok {
+		tmp := *pf
+		var remap []int
+		if n := len(gs.remapBuf); n > 0 {
+			remap, gs.remapBuf = gs.remapBuf[n-1], gs.remapBuf[:n-1]
+		}
+		tmp.remap = append(remap[:0], pf.remap...)
+		gs.palfx[pf] = tmp
+	}
+}
+
+// Captures the current simulation state into gs, reusing its buffers.
+func (s *System) saveGameState(gs *GameState) {
+	gs.saved = true
+	if gs.palfx == nil {
+		gs.palfx = make(map[*PalFX]PalFX)
+	}
+	for pf, v := range gs.palfx {
+		if v.remap != nil {
+			gs.remapBuf = append(gs.remapBuf, v.remap)
+		}
+		delete(gs.palfx, pf)
+	}
+	for i, p := range s.chars {
+		gs.chars[i] = append(gs.chars[i][:0], p...)
+		if cap(gs.charData[i]) < len(p) {
+			gs.charData[i] = append(gs.charData[i][:cap(gs.charData[i])],
+				make([]charState, len(p)-cap(gs.charData[i]))...)
+		}
+		gs.charData[i] = gs.charData[i][:len(p)]
+		for j, c := range p {
+			cs := &gs.charData[i][j]
+			c.cloneStateInto(&cs.c)
+			cmd := cs.cmd
+			cs.cmd = nil
+			// Helpers without keyctrl share the command lists of their root
+			if len(p) > 0 && (c == p[0] || len(c.cmd) == 0 || len(p[0].cmd) == 0 ||
+				&c.cmd[0] != &p[0].cmd[0]) {
+				cs.cmd = cloneCommandLists(cmd, c.cmd)
+			}
+			gs.savePalFX(c.palfx)
+		}
+		gs.cgi[i] = cgiState{s.cgi[i].pctype, s.cgi[i].pctime, s.cgi[i].pcid,
+			s.cgi[i].projidcount, s.cgi[i].unhittable}
+		if cap(gs.projs[i]) < len(s.projs[i]) {
+			gs.projs[i] = append(gs.projs[i][:cap(gs.projs[i])],
+				make([]Projectile, len(s.projs[i])-cap(gs.projs[i]))...)
+		}
+		gs.projs[i] = gs.projs[i][:len(s.projs[i])]
+		for j := range s.projs[i] {
+			s.projs[i][j].cloneStateInto(&gs.projs[i][j])
+			gs.savePalFX(s.projs[i][j].palfx)
+		}
+		if cap(gs.explods[i]) < len(s.explods[i]) {
+			gs.explods[i] = append(gs.explods[i][:cap(gs.explods[i])],
+				make([]Explod, len(s.explods[i])-cap(gs.explods[i]))...)
+		}
+		gs.explods[i] = gs.explods[i][:len(s.explods[i])]
+		for j := range s.explods[i] {
+			s.explods[i][j].cloneStateInto(&gs.explods[i][j])
+			gs.savePalFX(s.explods[i][j].palfx)
+		}
+		gs.explDrawlist[i] = append(gs.explDrawlist[i][:0], s.explDrawlist[i]...)
+		gs.topexplDrawlist[i] = append(gs.topexplDrawlist[i][:0], s.topexplDrawlist[i]...)
+		gs.underexplDrawlist[i] = append(gs.underexplDrawlist[i][:0], s.underexplDrawlist[i]...)
+	}
+	gs.charList.runOrder = append(gs.charList.runOrder[:0], s.charList.runOrder...)
+	gs.charList.drawOrder = append(gs.charList.drawOrder[:0], s.charList.drawOrder...)
+	if gs.charList.idMap == nil {
+		gs.charList.idMap = make(map[int32]*Char, len(s.charList.idMap))
+	}
+	for k := range gs.charList.idMap {
+		delete(gs.charList.idMap, k)
+	}
+	for k, v := range s.charList.idMap {
+		gs.charList.idMap[k] = v
+	}
+
+	gs.randseed = s.randseed
+	gs.gameTime, gs.time, gs.intro, gs.round = s.gameTime, s.time, s.intro, s.round
+	gs.roundsExisted, gs.wins = s.roundsExisted, s.wins
+	gs.consecutiveWins = s.consecutiveWins
+	gs.draws = s.draws
+	gs.lastHitter = s.lastHitter
+	gs.winTeam = s.winTeam
+	gs.winType, gs.winTrigger = s.winType, s.winTrigger
+	gs.finish = s.finish
+	gs.waitdown, gs.slowtime, gs.shuttertime = s.waitdown, s.slowtime, s.shuttertime
+	gs.fadeintime, gs.fadeouttime, gs.wintime = s.fadeintime, s.fadeouttime, s.wintime
+	gs.winskipped, gs.introSkipped = s.winskipped, s.introSkipped
+	gs.firstAttack = s.firstAttack
+	gs.teamLeader = s.teamLeader
+	gs.specialFlag = s.specialFlag
+	gs.envShake = s.envShake
+	gs.pause, gs.pausetime = s.pause, s.pausetime
+	gs.pausebg = s.pausebg
+	gs.pauseendcmdbuftime = s.pauseendcmdbuftime
+	gs.pauseplayer = s.pauseplayer
+	gs.super, gs.supertime = s.super, s.supertime
+	gs.superpausebg = s.superpausebg
+	gs.superendcmdbuftime = s.superendcmdbuftime
+	gs.superplayer = s.superplayer
+	gs.superdarken = s.superdarken
+	gs.superanim = reuseAnimation(gs.superanim, s.superanim)
+	gs.superpmap = s.superpmap
+	gs.superpos = s.superpos
+	gs.superfacing, gs.superp2defmul = s.superfacing, s.superp2defmul
+	gs.envcol, gs.envcol_time, gs.envcol_under = s.envcol, s.envcol_time, s.envcol_under
+	gs.allPalFX, gs.bgPalFX = s.allPalFX, s.bgPalFX
+	gs.nextCharId = s.nextCharId
+	gs.tickCount, gs.oldTickCount = s.tickCount, s.oldTickCount
+	gs.tickCountF, gs.lastTick = s.tickCountF, s.lastTick
+	gs.nextAddTime, gs.oldNextAddTime = s.nextAddTime, s.oldNextAddTime
+	gs.turbo, gs.accel = s.turbo, s.accel
+	gs.screenleft, gs.screenright, gs.xmin, gs.xmax = s.screenleft, s.screenright, s.xmin, s.xmax
+	gs.drawScale, gs.zoomlag, gs.zoomScale = s.drawScale, s.zoomlag, s.zoomScale
+	gs.zoomPosXLag, gs.zoomPosYLag = s.zoomPosXLag, s.zoomPosYLag
+	gs.enableZoomtime = s.enableZoomtime
+	gs.zoomCameraBound, gs.zoomStageBound = s.zoomCameraBound, s.zoomStageBound
+	gs.zoomPos = s.zoomPos
+	for i, ai := range s.aiInput {
+		if ai != nil {
+			gs.aiInput[i] = ai.Clone()
+		} else {
+			gs.aiInput[i] = nil
+		}
+	}
+	gs.cam = s.cam
+
+	gs.stage.save(s.stage)
+	if s.stage != nil {
+		for _, b := range s.stage.bg {
+			gs.savePalFX(b.palfx)
+		}
+	}
+	gs.lifebar.save(&s.lifebar)
+	gs.timerCount = append(gs.timerCount[:0], s.timerCount...)
+	gs.timerRounds = append(gs.timerRounds[:0], s.timerRounds...)
+	gs.scoreRounds = append(gs.scoreRounds[:0], s.scoreRounds...)
+}
+
+// Restores a state previously captured with saveGameState. The state itself
+// is left untouched, so it can be loaded any number of times.
+func (s *System) loadGameState(gs *GameState) {
+	if !gs.saved {
+		return
+	}
+	for i := range s.chars {
+		s.chars[i] = append(s.chars[i][:0], gs.chars[i]...)
+		for j, c := range gs.chars[i] {
+			cs := &gs.charData[i][j]
+			sc := c.soundChannels
+			*c = cs.c.cloneState()
+			c.soundChannels = sc
+			if cs.cmd != nil {
+				restoreCommandLists(c.cmd, cs.cmd)
+			}
+		}
+		s.cgi[i].pctype, s.cgi[i].pctime, s.cgi[i].pcid = gs.cgi[i].pctype,
+			gs.cgi[i].pctime, gs.cgi[i].pcid
+		s.cgi[i].projidcount = gs.cgi[i].projidcount
+		s.cgi[i].unhittable = gs.cgi[i].unhittable
+		s.projs[i] = s.projs[i][:0]
+		for j := range gs.projs[i] {
+			s.projs[i] = append(s.projs[i], gs.projs[i][j].cloneState())
+		}
+		s.explods[i] = s.explods[i][:0]
+		for j := range gs.explods[i] {
+			s.explods[i] = append(s.explods[i], gs.explods[i][j].cloneState())
+		}
+		s.explDrawlist[i] = append(s.explDrawlist[i][:0], gs.explDrawlist[i]...)
+		s.topexplDrawlist[i] = append(s.topexplDrawlist[i][:0], gs.topexplDrawlist[i]...)
+		s.underexplDrawlist[i] = append(s.underexplDrawlist[i][:0], gs.underexplDrawlist[i]...)
+	}
+	for pf, v := range gs.palfx {
+		remap := pf.remap
+		*pf = v
+		if len(remap) == len(v.remap) {
+			copy(remap, v.remap)
+			pf.remap = remap
+		} else {
+			pf.remap = append([]int(nil), v.remap...)
+		}
+	}
+	s.charList.runOrder = append(s.charList.runOrder[:0], gs.charList.runOrder...)
+	s.charList.drawOrder = append(s.charList.drawOrder[:0], gs.charList.drawOrder...)
+	s.charList.idMap = make(map[int32]*Char, len(gs.charList.idMap))
+	for k, v := range gs.charList.idMap {
+		s.charList.idMap[k] = v
+	}
+
+	s.randseed = gs.randseed
+	s.gameTime, s.time, s.intro, s.round = gs.gameTime, gs.time, gs.intro, gs.round
+	s.roundsExisted, s.wins = gs.roundsExisted, gs.wins
+	s.consecutiveWins = gs.consecutiveWins
+	s.draws = gs.draws
+	s.lastHitter = gs.lastHitter
+	s.winTeam = gs.winTeam
+	s.winType, s.winTrigger = gs.winType, gs.winTrigger
+	s.finish = gs.finish
+	s.waitdown, s.slowtime, s.shuttertime = gs.waitdown, gs.slowtime, gs.shuttertime
+	s.fadeintime, s.fadeouttime, s.wintime = gs.fadeintime, gs.fadeouttime, gs.wintime
+	s.winskipped, s.introSkipped = gs.winskipped, gs.introSkipped
+	s.firstAttack = gs.firstAttack
+	s.teamLeader = gs.teamLeader
+	s.specialFlag = gs.specialFlag
+	s.envShake = gs.envShake
+	s.pause, s.pausetime = gs.pause, gs.pausetime
+	s.pausebg = gs.pausebg
+	s.pauseendcmdbuftime = gs.pauseendcmdbuftime
+	s.pauseplayer = gs.pauseplayer
+	s.super, s.supertime = gs.super, gs.supertime
+	s.superpausebg = gs.superpausebg
+	s.superendcmdbuftime = gs.superendcmdbuftime
+	s.superplayer = gs.superplayer
+	s.superdarken = gs.superdarken
+	s.superanim = cloneAnimation(gs.superanim)
+	s.superpmap = gs.superpmap
+	s.superpos = gs.superpos
+	s.superfacing, s.superp2defmul = gs.superfacing, gs.superp2defmul
+	s.envcol, s.envcol_time, s.envcol_under = gs.envcol, gs.envcol_time, gs.envcol_under
+	s.allPalFX, s.bgPalFX = gs.allPalFX, gs.bgPalFX
+	s.nextCharId = gs.nextCharId
+	s.tickCount, s.oldTickCount = gs.tickCount, gs.oldTickCount
+	s.tickCountF, s.lastTick = gs.tickCountF, gs.lastTick
+	s.nextAddTime, s.oldNextAddTime = gs.nextAddTime, gs.oldNextAddTime
+	s.turbo, s.accel = gs.turbo, gs.accel
+	s.screenleft, s.screenright, s.xmin, s.xmax = gs.screenleft, gs.screenright, gs.xmin, gs.xmax
+	s.drawScale, s.zoomlag, s.zoomScale = gs.drawScale, gs.zoomlag, gs.zoomScale
+	s.zoomPosXLag, s.zoomPosYLag = gs.zoomPosXLag, gs.zoomPosYLag
+	s.enableZoomtime = gs.enableZoomtime
+	s.zoomCameraBound, s.zoomStageBound = gs.zoomCameraBound, gs.zoomStageBound
+	s.zoomPos = gs.zoomPos
+	// Cloned again so that the saved state can be loaded more than once
+	for i, ai := range gs.aiInput {
+		if ai != nil {
+			s.aiInput[i] = ai.Clone()
+		} else {
+			s.aiInput[i] = nil
+		}
+	}
+	s.cam = gs.cam
+
+	gs.stage.load(s.stage)
+	gs.lifebar.load(&s.lifebar)
+	s.timerCount = append(s.timerCount[:0], gs.timerCount...)
+	s.timerRounds = append(s.timerRounds[:0], gs.timerRounds...)
+	s.scoreRounds = append(s.scoreRounds[:0], gs.scoreRounds...)
+}
+
+func (ss *stageState) save(s *Stage) {
+	ss.stage = s
+	if s == nil {
+		return
+	}
+	ss.bg = ss.bg[:0]
+	for _, b := range s.bg {
+		ss.bg = append(ss.bg, *b)
+	}
+	ss.bgc = append(ss.bgc[:0], s.bgc...)
+	ss.bgct.line = ss.bgct.line[:0]
+	for _, n := range s.bgct.line {
+		ss.bgct.line = append(ss.bgct.line,
+			bgctNode{append([]*bgCtrl(nil), n.bgc...), n.waitTime})
+	}
+	ss.bgct.al = append(ss.bgct.al[:0], s.bgct.al...)
+	ss.bga = s.bga
+	ss.stageTime = s.stageTime
+}
+func (ss *stageState) load(s *Stage) {
+	if s == nil || s != ss.stage {
+		return
+	}
+	for i, b := range s.bg {
+		if i < len(ss.bg) {
+			*b = ss.bg[i]
+		}
+	}
+	copy(s.bgc, ss.bgc)
+	s.bgct.line = s.bgct.line[:0]
+	for _, n := range ss.bgct.line {
+		s.bgct.line = append(s.bgct.line,
+			bgctNode{append([]*bgCtrl(nil), n.bgc...), n.waitTime})
+	}
+	s.bgct.al = append(s.bgct.al[:0], ss.bgct.al...)
+	s.bga = ss.bga
+	s.stageTime = ss.stageTime
+}
+
+func (ls *lifebarState) save(l *Lifebar) {
+	if l.ro != nil {
+		ls.ro_cur = l.ro.cur
+		ls.ro_wt, ls.ro_swt, ls.ro_dt = l.ro.wt, l.ro.swt, l.ro.dt
+		ls.ro_timerActive = l.ro.timerActive
+		ls.ro_introState = l.ro.introState
+	}
+	for i := 0; i < 2; i++ {
+		if l.co[i] != nil {
+			ls.co[i] = *l.co[i]
+		}
+		if l.sc[i] != nil {
+			ls.sc[i] = *l.sc[i]
+		}
+		if l.wi[i] != nil {
+			ls.wi[i] = *l.wi[i]
+			ls.wi[i].wins = append([]WinType(nil), l.wi[i].wins...)
+			ls.wi[i].added = cloneAnimation(l.wi[i].added)
+			ls.wi[i].addedP = cloneAnimation(l.wi[i].addedP)
+		}
+		if l.wc[i] != nil {
+			ls.wc[i] = *l.wc[i]
+		}
+		ls.ac[i] = ls.ac[i][:0]
+		if l.ac[i] != nil {
+			for _, m := range l.ac[i].messages {
+				ls.ac[i] = append(ls.ac[i], *m)
+			}
+		}
+	}
+}
+func (ls *lifebarState) load(l *Lifebar) {
+	if l.ro != nil {
+		l.ro.cur = ls.ro_cur
+		l.ro.wt, l.ro.swt, l.ro.dt = ls.ro_wt, ls.ro_swt, ls.ro_dt
+		l.ro.timerActive = ls.ro_timerActive
+		l.ro.introState = ls.ro_introState
+	}
+	for i := 0; i < 2; i++ {
+		if l.co[i] != nil {
+			*l.co[i] = ls.co[i]
+		}
+		if l.sc[i] != nil {
+			*l.sc[i] = ls.sc[i]
+		}
+		if l.wi[i] != nil {
+			*l.wi[i] = ls.wi[i]
+			l.wi[i].wins = append([]WinType(nil), ls.wi[i].wins...)
+			l.wi[i].added = cloneAnimation(ls.wi[i].added)
+			l.wi[i].addedP = cloneAnimation(ls.wi[i].addedP)
+		}
+		if l.wc[i] != nil {
+			*l.wc[i] = ls.wc[i]
+		}
+		if l.ac[i] != nil {
+			l.ac[i].messages = l.ac[i].messages[:0]
+			for j := range ls.ac[i] {
+				m := ls.ac[i][j]
+				l.ac[i].messages = append(l.ac[i].messages, &m)
+			}
+		}
+	}
+}
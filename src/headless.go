@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Setup of a match run without a window, GPU or audio
+type HeadlessMatch struct {
+	Chars     [2][]string
+	Pals      [2][]int
+	Com       [MaxSimul*2 + MaxAttachedChar]float32
+	TeamMode  [2]TeamMode
+	Stage     string
+	Lifebar   string
+	Rounds    int32
+	RoundTime int32
+	// If set, the match setup is read from the replay and its inputs are
+	// played back instead
+	Replay string
+	// Replay without a header, whose inputs are played back in the match set
+	// up by the fields above
+	Input string
+	// Called at the start of every frame of a replayed match, with the
+	// frame number
+	OnFrame func(frame int32)
+}
+
+type HeadlessResult struct {
+	// 1 or 2 for the winning side, 0 on a draw and -1 if the match was aborted
+	Winner int32
+	Wins   [2]int32
+	Draws  int32
+	Frames int32
+}
+
+// Runs a single match as fast as possible. sys must have been initialized
+// with sys.headless set.
+func runHeadless(hm *HeadlessMatch) (*HeadlessResult, error) {
+	// Common Lua scripts belong to the menus, which are not loaded
+	sys.commonLua = nil
+	lifebar := hm.Lifebar
+	if lifebar == "" {
+		lifebar = "data/fight.def"
+	}
+	lb, err := loadLifebar(lifebar)
+	if err != nil {
+		return nil, Error(fmt.Sprintf("Can't load %v: %v", lifebar, err))
+	}
+	sys.lifebar = *lb
+	if hm.Replay != "" {
+		if err := headlessReplay(hm.Replay); err != nil {
+			return nil, err
+		}
+	} else if err := headlessSelect(hm); err != nil {
+		return nil, err
+	} else if hm.Input != "" {
+		if sys.fileInput, err = OpenFileInput(hm.Input); err != nil {
+			sys.fileInput = nil
+			return nil, err
+		}
+	}
+	if sys.fileInput != nil {
+		sys.fileInput.onFrame = hm.OnFrame
+		defer func() {
+			sys.fileInput.Close()
+			sys.fileInput = nil
+		}()
+	}
+	for tn, sel := range sys.sel.selected {
+		if len(sel) < int(sys.numSimul[tn]) {
+			return nil, Error(fmt.Sprintf("Not enough P%v side chars to load: expected %v, got %v",
+				tn+1, sys.numSimul[tn], len(sel)))
+		}
+	}
+	sys.loadStart()
+
+	l, start := sys.luaLState, sys.frameCounter
+	if err := l.CallByParam(lua.P{Fn: l.GetGlobal("game"), NRet: 3, Protect: true}); err != nil {
+		return nil, err
+	}
+	winp, loadErr := int32(lua.LVAsNumber(l.Get(-3))), l.Get(-1)
+	l.Pop(3)
+	if loadErr != lua.LNil {
+		return nil, Error(lua.LVAsString(loadErr))
+	}
+	return &HeadlessResult{Winner: winp, Wins: sys.wins, Draws: sys.draws,
+		Frames: sys.frameCounter - start}, nil
+}
+
+func headlessSelect(hm *HeadlessMatch) error {
+	sys.sel.ClearSelected()
+	for tn, chars := range hm.Chars {
+		n := int32(len(chars))
+		if n == 0 {
+			return Error(fmt.Sprintf("No P%v side chars", tn+1))
+		}
+		tm := hm.TeamMode[tn]
+		if tm == TM_Single && n > 1 {
+			tm = TM_Simul
+		}
+		if tm != TM_Turns && n > MaxSimul {
+			return Error(fmt.Sprintf("Invalid team size: %v", n))
+		}
+		sys.tmode[tn], sys.numSimul[tn], sys.numTurns[tn] = tm, n, n
+		if tm == TM_Turns {
+			sys.numSimul[tn] = 1
+		} else if n == 1 {
+			sys.tmode[tn] = TM_Single
+		}
+		if hm.Rounds > 0 {
+			sys.lifebar.ro.match_wins[tn] = hm.Rounds
+		}
+		for i, c := range chars {
+			sys.sel.addChar(c)
+			cn := len(sys.sel.charlist) - 1
+			if sys.sel.charlist[cn].def == "" {
+				return Error(fmt.Sprintf("Unable to add character: %v", c))
+			}
+			pal := 1
+			if i < len(hm.Pals[tn]) && hm.Pals[tn][i] > 0 {
+				pal = hm.Pals[tn][i]
+			}
+			sys.sel.AddSelectedChar(tn, cn, pal)
+		}
+	}
+	stage := hm.Stage
+	for _, s := range []string{stage, "stages/" + stage, "stages/" + stage + ".def"} {
+		if FileExist(s) != "" {
+			stage = s
+			break
+		}
+	}
+	if err := sys.sel.AddStage(stage); err != nil {
+		return Error(fmt.Sprintf("Unable to add stage: %v: %v", stage, err))
+	}
+	sys.sel.SelectStage(len(sys.sel.stagelist))
+	if hm.RoundTime != 0 {
+		sys.roundTime = Max(-1, hm.RoundTime*sys.lifebar.ti.framespercount)
+	}
+	sys.com = hm.Com
+	return nil
+}
+
+func headlessReplay(filename string) error {
+	fi, err := OpenFileInput(filename)
+	if err != nil {
+		return err
+	}
+	if fi.header == nil || fi.header.Netplay {
+		fi.Close()
+		return Error(fmt.Sprintf("Not a local match replay: %v", filename))
+	}
+	for _, chars := range fi.header.Chars {
+		for _, rf := range chars {
+			sys.sel.addChar(rf.Def)
+		}
+	}
+	if fi.header.Stage.Def != "" {
+		sys.sel.AddStage(fi.header.Stage.Def)
+	}
+	if err := fi.header.apply(); err != nil {
+		fi.Close()
+		return err
+	}
+	sys.fileInput = fi
+	return nil
+}
+
+// Loads the char def, which may also be a char name as in select.def, as
+// player 1 without compiling its states, for the tools working on a single
+// char. Returns the path of its def.
+func headlessLoadChar(def string) (string, *Char, error) {
+	lifebar := sys.cmdFlags["-lifebar"]
+	if lifebar == "" {
+		lifebar = "data/fight.def"
+	}
+	if lb, err := loadLifebar(lifebar); err == nil {
+		sys.lifebar = *lb
+	}
+	sys.sel.addChar(def)
+	if cd := sys.sel.charlist[len(sys.sel.charlist)-1].def; cd != "" {
+		def = cd
+	}
+	p := newChar(0, 0)
+	sys.chars[0] = []*Char{p}
+	return def, p, p.load(def)
+}
+
+// Builds the match from the Quick VS command line options, runs it and
+// returns the exit code of the process.
+func headlessMain(cfg configSettings) int {
+	hm := &HeadlessMatch{Stage: cfg.StartStage, Lifebar: sys.cmdFlags["-lifebar"],
+		RoundTime: cfg.RoundTime, Replay: sys.cmdFlags["-replay"]}
+	if s, ok := sys.cmdFlags["-s"]; ok {
+		hm.Stage = s
+	}
+	atoi := func(key string) (int, bool) {
+		i, err := strconv.Atoi(sys.cmdFlags[key])
+		return i, err == nil
+	}
+	if v, ok := atoi("-rounds"); ok {
+		hm.Rounds = int32(v)
+	}
+	if v, ok := atoi("-time"); ok {
+		hm.RoundTime = int32(v)
+	}
+	for tn := range hm.TeamMode {
+		if v, ok := atoi(fmt.Sprintf("-tmode%v", tn+1)); ok && v >= 0 && v <= int(TM_LAST) {
+			hm.TeamMode[tn] = TeamMode(v)
+		}
+	}
+	var players []int
+	r, _ := regexp.Compile("^-p([0-9]+)$")
+	for k := range sys.cmdFlags {
+		if m := r.FindStringSubmatch(k); m != nil {
+			pn, _ := strconv.Atoi(m[1])
+			if pn >= 1 && pn <= MaxSimul*2 {
+				players = append(players, pn)
+			}
+		}
+	}
+	sort.Ints(players)
+	for _, pn := range players {
+		tn := (pn - 1) & 1
+		pal := 1
+		if v, ok := atoi(fmt.Sprintf("-p%v.color", pn)); ok {
+			pal = v
+		} else if v, ok := atoi(fmt.Sprintf("-p%v.pal", pn)); ok {
+			pal = v
+		}
+		hm.Chars[tn] = append(hm.Chars[tn], sys.cmdFlags[fmt.Sprintf("-p%v", pn)])
+		hm.Pals[tn] = append(hm.Pals[tn], pal)
+		// Nobody is at the controls, so players default to the highest AI level
+		hm.Com[pn-1] = 8
+		if v, ok := atoi(fmt.Sprintf("-p%v.ai", pn)); ok {
+			hm.Com[pn-1] = float32(Max(0, int32(v)))
+		}
+	}
+
+	res, err := runHeadless(hm)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("Winner: %v\nWins: %v-%v\nDraws: %v\nFrames: %v\n",
+		res.Winner, res.Wins[0], res.Wins[1], res.Draws, res.Frames)
+	if res.Winner < 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"container/list"
 	"encoding/binary"
 	"fmt"
 	"image"
@@ -10,6 +11,7 @@ import (
 	"math"
 	"os"
 	"runtime"
+	"sync"
 	"unsafe"
 )
 
@@ -439,6 +441,27 @@ func (sh *SffHeader) Read(r io.Reader, lofs *uint32, tofs *uint32) error {
 	return nil
 }
 
+// Checks that the headers of the sprites and palettes are in the file,
+// before allocating them.
+func (sh *SffHeader) checkRange(filename string, end int64) error {
+	if sh.Ver0 == 1 {
+		// The headers of the sprites are chained, 32 bytes each
+		if err := checkRange(end, 0, int64(sh.NumberOfSprites)*32); err != nil {
+			return formatError(filename, "sprite headers", int64(sh.FirstSpriteHeaderOffset), err)
+		}
+		return nil
+	}
+	if err := checkRange(end, int64(sh.FirstSpriteHeaderOffset),
+		int64(sh.NumberOfSprites)*28); err != nil {
+		return formatError(filename, "sprite headers", int64(sh.FirstSpriteHeaderOffset), err)
+	}
+	if err := checkRange(end, int64(sh.FirstPaletteHeaderOffset),
+		int64(sh.NumberOfPalettes)*16); err != nil {
+		return formatError(filename, "palette headers", int64(sh.FirstPaletteHeaderOffset), err)
+	}
+	return nil
+}
+
 type Sprite struct {
 	Pal           []uint32
 	Tex           *Texture
@@ -450,6 +473,11 @@ type Sprite struct {
 	coldepth      byte
 	paltemp       []uint32
 	PalTex        *Texture
+	// Pixels as stored in the SFF, decoded into Tex when the sprite is drawn
+	data      []byte
+	pcx       bool
+	link      *Sprite
+	cacheElem *list.Element
 }
 
 func newSprite() *Sprite {
@@ -585,6 +613,7 @@ func newSprite() *Sprite {
 func (s *Sprite) shareCopy(src *Sprite) {
 	s.Pal = src.Pal
 	s.Tex = src.Tex
+	s.link = src
 	s.Size = src.Size
 	if s.palidx < 0 {
 		s.palidx = src.palidx
@@ -619,13 +648,6 @@ func (s *Sprite) SetPxl(px []byte) {
 	}
 }
 
-func (s *Sprite) SetRaw(data []byte, sprWidth int32, sprHeight int32, sprDepth int32) {
-	sys.mainThreadTask <- func() {
-		s.Tex = newTexture(sprWidth, sprHeight, sprDepth, sys.pngFilter)
-		s.Tex.SetData(data)
-	}
-}
-
 func (s *Sprite) readHeader(r io.Reader, ofs, size *uint32,
 	link *uint16) error {
 	read := func(x interface{}) error {
@@ -651,7 +673,7 @@ func (s *Sprite) readHeader(r io.Reader, ofs, size *uint32,
 	}
 	return nil
 }
-func (s *Sprite) readPcxHeader(f *os.File, offset int64) error {
+func (s *Sprite) readPcxHeader(f io.ReadSeeker, offset int64) error {
 	f.Seek(offset, 0)
 	read := func(x interface{}) error {
 		return binary.Read(f, binary.LittleEndian, x)
@@ -704,6 +726,9 @@ func (s *Sprite) RlePcxDecode(rle []byte) (p []byte) {
 			d = rle[i]
 			if i < len(rle)-1 {
 				i++
+			} else if n == 0 {
+				// Truncated data, which would be read again forever
+				break
 			}
 		}
 		for ; n > 0; n-- {
@@ -721,7 +746,7 @@ func (s *Sprite) RlePcxDecode(rle []byte) (p []byte) {
 	s.rle = 0
 	return
 }
-func (s *Sprite) read(f *os.File, sh *SffHeader, offset int64, datasize uint32,
+func (s *Sprite) read(f io.ReadSeeker, sh *SffHeader, offset int64, datasize uint32,
 	nextSubheader uint32, prev *Sprite, pl *PaletteList, c00 bool) error {
 	if int64(nextSubheader) > offset {
 		// 最後以外datasizeを無視 / Ignore datasize except last
@@ -748,6 +773,13 @@ func (s *Sprite) read(f *os.File, sh *SffHeader, offset int64, datasize uint32,
 	if datasize < 128+palSize {
 		datasize = 128 + palSize
 	}
+	end, err := fileSize(f)
+	if err != nil {
+		return err
+	}
+	if err := checkRange(end, offset, int64(datasize)); err != nil {
+		return err
+	}
 	px := make([]byte, datasize-(128+palSize))
 	if err := read(px); err != nil {
 		return err
@@ -773,7 +805,7 @@ func (s *Sprite) read(f *os.File, sh *SffHeader, offset int64, datasize uint32,
 			pal[i] = uint32(255)<<24 | uint32(rgb[2])<<16 | uint32(rgb[1])<<8 | uint32(rgb[0])
 		}
 	}
-	s.SetPxl(s.RlePcxDecode(px))
+	s.data, s.pcx = px, true
 	return nil
 }
 func (s *Sprite) readHeaderV2(r io.Reader, ofs *uint32, size *uint32,
@@ -841,6 +873,9 @@ func (s *Sprite) Rle8Decode(rle []byte) (p []byte) {
 			d = rle[i]
 			if i < len(rle)-1 {
 				i++
+			} else if n == 0 {
+				// Truncated data, which would be read again forever
+				break
 			}
 		}
 		for ; n > 0; n-- {
@@ -934,6 +969,10 @@ func (s *Sprite) Lz5Decode(rle []byte) (p []byte) {
 					rb, rbc = 0, 0
 				}
 			}
+			// Back reference before the start of the image
+			if d > j {
+				return nil
+			}
 			for {
 				if j < len(p) {
 					p[j] = p[j-d]
@@ -971,14 +1010,39 @@ func (s *Sprite) Lz5Decode(rle []byte) (p []byte) {
 	}
 	return
 }
-func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32) error {
-	var px []byte
-	var isRaw bool = false
 
+// Reads the data of a sprite, returning how many bytes of it are missing
+// from the file.
+func (s *Sprite) readV2(f io.ReadSeeker, offset int64, datasize uint32) (missing int64, err error) {
 	if s.rle > 0 {
-		return nil
+		return 0, nil
+	}
+	end, err := fileSize(f)
+	if err != nil {
+		return 0, err
+	}
+	// Truncated data is kept as is, the sprite is left blank if it cannot
+	// be decoded
+	avail := end - offset
+	if offset < 0 || avail < 0 {
+		avail = 0
+	}
+	if int64(datasize) > avail {
+		missing = int64(datasize) - avail
+		datasize = uint32(avail)
+	}
+	f.Seek(offset, 0)
+	s.data = make([]byte, datasize)
+	_, err = io.ReadFull(f, s.data)
+	return
+}
 
-	} else if s.rle == 0 {
+// Decodes the data of a sprite, which is made of palette indices if depth is
+// 8, or of raw colors of the given size otherwise.
+func (s *Sprite) decodeV2(f io.ReadSeeker, offset int64, datasize uint32) (px []byte,
+	w, h, depth int32, err error) {
+	w, h, depth = int32(s.Size[0]), int32(s.Size[1]), 8
+	if s.rle == 0 {
 		f.Seek(offset, 0)
 		px = make([]uint8, datasize)
 		binary.Read(f, binary.LittleEndian, px)
@@ -987,27 +1051,22 @@ func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32) error {
 		case 8:
 			// Do nothing, px is already in the expected format
 		case 24, 32:
-			isRaw = true
-			s.SetRaw(px, int32(s.Size[0]), int32(s.Size[1]), int32(s.coldepth))
+			depth = int32(s.coldepth)
 		default:
-			return Error("Unknown color depth")
+			return nil, 0, 0, 0, Error("Unknown color depth")
 		}
 
 	} else {
 		f.Seek(offset+4, 0)
 		format := -s.rle
 
-		var rgba *image.RGBA
-		var rect image.Rectangle
-
 		if 2 <= format && format <= 4 {
 			if datasize < 4 {
 				datasize = 4
 			}
 			px = make([]byte, datasize-4)
 			if err := binary.Read(f, binary.LittleEndian, px); err != nil {
-				panic(err)
-				//return err
+				return nil, 0, 0, 0, err
 			}
 		}
 
@@ -1021,39 +1080,35 @@ func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32) error {
 		case 10:
 			img, err := png.Decode(f)
 			if err != nil {
-				return err
+				return nil, 0, 0, 0, err
 			}
 			pi, ok := img.(*image.Paletted)
 			if ok {
 				px = pi.Pix
 			}
 		case 11, 12:
-			var ok bool = false
-			isRaw = true
-
 			// Decode PNG image to RGBA
 			img, err := png.Decode(f)
 			if err != nil {
-				return err
+				return nil, 0, 0, 0, err
 			}
 
-			rect = img.Bounds()
-			rgba, ok = img.(*image.RGBA)
+			rect := img.Bounds()
+			rgba, ok := img.(*image.RGBA)
 
 			if !ok {
 				rgba = image.NewRGBA(rect)
 				draw.Draw(rgba, rect, img, rect.Min, draw.Src)
 			}
-			s.SetRaw(rgba.Pix, int32(rect.Max.X-rect.Min.X), int32(rect.Max.Y-rect.Min.Y), 32)
+			px, w, h, depth = rgba.Pix, int32(rect.Max.X-rect.Min.X), int32(rect.Max.Y-rect.Min.Y), 32
 		default:
-			return Error("Unknown format")
+			return nil, 0, 0, 0, Error("Unknown format")
+		}
+		if format <= 4 && int64(len(px)) != int64(w)*int64(h) {
+			return nil, 0, 0, 0, Error("Invalid compressed data")
 		}
 	}
-
-	if !isRaw {
-		s.SetPxl(px)
-	}
-	return nil
+	return
 }
 
 // Cache the provided palette data in a sprite. But first check if the
@@ -1088,7 +1143,7 @@ func (s *Sprite) Draw(x, y, xscale, yscale, angle float32, fx *PalFX, window *[4
 		y *= -1
 	}
 	rp := RenderParams{
-		s.Tex, s.PalTex, s.Size,
+		s.texture(), s.PalTex, s.Size,
 		-x * sys.widthScale, -y * sys.heightScale, notiling,
 		xscale * sys.widthScale, xscale * sys.widthScale, yscale * sys.heightScale, 1, 0,
 		Rotation{angle, 0, 0}, 0, sys.brightness*255>>8 | 1<<9, 0, fx, window, 0, 0, 0, 0,
@@ -1129,31 +1184,83 @@ func newPaldata() (p *Palette) {
 type SffCacheEntry struct {
 	sffData  Sff
 	refCount int
+	// Closed once the file is loaded, so that concurrent loads of the same
+	// file wait for the first one
+	done chan struct{}
+	err  error
 }
 
 var SffCache = map[string]*SffCacheEntry{}
 
+// Chars and stages are loaded concurrently
+var sffCacheMutex sync.Mutex
+
 func removeSFFCache(filename string) {
+	sffCacheMutex.Lock()
+	defer sffCacheMutex.Unlock()
 	if _, ok := SffCache[filename]; ok {
 		delete(SffCache, filename)
 	}
 }
 func loadSff(filename string, char bool) (*Sff, error) {
 	// If this SFF is already in the cache, just return a copy
+	sffCacheMutex.Lock()
 	if cached, ok := SffCache[filename]; ok {
+		sffCacheMutex.Unlock()
+		<-cached.done
+		if cached.err != nil {
+			return nil, cached.err
+		}
+		sffCacheMutex.Lock()
 		cached.refCount++
 		s := cached.sffData
+		sffCacheMutex.Unlock()
 		return &s, nil
 	}
+	entry := &SffCacheEntry{done: make(chan struct{})}
+	SffCache[filename] = entry
+	sffCacheMutex.Unlock()
+	s, err := readSff(filename, char)
+	sffCacheMutex.Lock()
+	defer sffCacheMutex.Unlock()
+	defer close(entry.done)
+	if err != nil {
+		entry.err = err
+		if SffCache[filename] == entry {
+			delete(SffCache, filename)
+		}
+		return nil, err
+	}
+	entry.sffData, entry.refCount = *s, 1
+	runtime.SetFinalizer(s, func(s *Sff) {
+		sffCacheMutex.Lock()
+		defer sffCacheMutex.Unlock()
+		if cached, ok := SffCache[filename]; ok && cached == entry {
+			cached.refCount--
+			if cached.refCount == 0 {
+				delete(SffCache, filename)
+			}
+		}
+	})
+	return s, nil
+}
+func readSff(filename string, char bool) (*Sff, error) {
 	s := newSff()
 	s.filename = filename
-	f, err := os.Open(filename)
+	f, err := OpenFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { chk(f.Close()) }()
+	defer f.Close()
 	var lofs, tofs uint32
 	if err := s.header.Read(f, &lofs, &tofs); err != nil {
+		return nil, formatError(filename, "header", 0, err)
+	}
+	end, err := fileSize(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.header.checkRange(filename, end); err != nil {
 		return nil, err
 	}
 	read := func(x interface{}) error {
@@ -1162,22 +1269,17 @@ func loadSff(filename string, char bool) (*Sff, error) {
 	if s.header.Ver0 != 1 {
 		uniquePals := make(map[[2]int16]int)
 		for i := 0; i < int(s.header.NumberOfPalettes); i++ {
-			f.Seek(int64(s.header.FirstPaletteHeaderOffset)+int64(i*16), 0)
+			phofs := int64(s.header.FirstPaletteHeaderOffset) + int64(i*16)
+			f.Seek(phofs, 0)
 			var gn_ [3]int16
-			if err := read(gn_[:]); err != nil {
-				return nil, err
-			}
 			var link uint16
-			if err := read(&link); err != nil {
-				return nil, err
-			}
 			var ofs, siz uint32
-			if err := read(&ofs); err != nil {
-				return nil, err
-			}
-			if err := read(&siz); err != nil {
-				return nil, err
+			for _, x := range []interface{}{gn_[:], &link, &ofs, &siz} {
+				if err := read(x); err != nil {
+					return nil, formatError(filename, fmt.Sprintf("palette header %v", i), phofs, err)
+				}
 			}
+			entry := fmt.Sprintf("palette %v,%v", gn_[0], gn_[1])
 			var pal []uint32
 			var idx int
 			if old, ok := uniquePals[[...]int16{gn_[0], gn_[1]}]; ok {
@@ -1186,14 +1288,27 @@ func loadSff(filename string, char bool) (*Sff, error) {
 				sys.errLog.Printf("%v duplicated palette: %v,%v (%v/%v)\n", filename, gn_[0], gn_[1], i+1, s.header.NumberOfPalettes)
 			} else if siz == 0 {
 				idx = int(link)
-				pal = s.palList.Get(idx)
+				if idx >= i {
+					sys.errLog.Println(formatError(filename, entry, phofs, Error(fmt.Sprintf(
+						"linked to palette %v, which is not before it, using palette 0", link))))
+					idx = 0
+				}
+				if idx < i {
+					pal = s.palList.Get(idx)
+				} else {
+					pal = make([]uint32, 256)
+				}
 			} else {
-				f.Seek(int64(lofs+ofs), 0)
+				pofs := int64(lofs) + int64(ofs)
+				if err := checkRange(end, pofs, int64(Min(int32(siz/4), 256)*4)); err != nil {
+					return nil, formatError(filename, entry, pofs, err)
+				}
+				f.Seek(pofs, 0)
 				pal = make([]uint32, 256)
 				var rgba [4]byte
 				for i := 0; i < int(siz)/4 && i < len(pal); i++ {
 					if err := read(rgba[:]); err != nil {
-						return nil, err
+						return nil, formatError(filename, entry, pofs, err)
 					}
 					if s.header.Ver2 == 0 {
 						rgba[3] = 255
@@ -1228,14 +1343,23 @@ func loadSff(filename string, char bool) (*Sff, error) {
 		var indexOfPrevious uint16
 		switch s.header.Ver0 {
 		case 1:
-			if err := spriteList[i].readHeader(f, &xofs, &size,
-				&indexOfPrevious); err != nil {
-				return nil, err
-			}
+			err = spriteList[i].readHeader(f, &xofs, &size, &indexOfPrevious)
 		case 2:
-			if err := spriteList[i].readHeaderV2(f, &xofs, &size,
-				lofs, tofs, &indexOfPrevious); err != nil {
-				return nil, err
+			err = spriteList[i].readHeaderV2(f, &xofs, &size, lofs, tofs, &indexOfPrevious)
+		}
+		if err != nil {
+			return nil, formatError(filename, fmt.Sprintf("sprite header %v", i), shofs, err)
+		}
+		entry := fmt.Sprintf("sprite %v,%v", spriteList[i].Group, spriteList[i].Number)
+		if s.header.Ver0 != 1 && spriteList[i].coldepth <= 8 &&
+			spriteList[i].palidx >= int(s.header.NumberOfPalettes) {
+			sys.errLog.Println(formatError(filename, entry, shofs, Error(fmt.Sprintf(
+				"palette %v out of %v, using palette 0", spriteList[i].palidx,
+				s.header.NumberOfPalettes))))
+			spriteList[i].palidx = 0
+			// Without any palette in the file, palette 0 is a blank one
+			if len(s.palList.palettes) == 0 {
+				s.palList.NewPal()
 			}
 		}
 		if size == 0 {
@@ -1254,11 +1378,14 @@ func loadSff(filename string, char bool) (*Sff, error) {
 					xofs, prev, &s.palList,
 					char && (prev == nil || spriteList[i].Group == 0 &&
 						spriteList[i].Number == 0)); err != nil {
-					return nil, err
+					return nil, formatError(filename, entry, shofs+32, err)
 				}
 			case 2:
-				if err := spriteList[i].readV2(f, int64(xofs), size); err != nil {
-					return nil, err
+				if missing, err := spriteList[i].readV2(f, int64(xofs), size); err != nil {
+					return nil, formatError(filename, entry, int64(xofs), err)
+				} else if missing > 0 {
+					sys.errLog.Println(formatError(filename, entry, int64(xofs),
+						Error(fmt.Sprintf("%v of %v bytes are missing", missing, size))))
 				}
 			}
 			prev = spriteList[i]
@@ -1274,27 +1401,25 @@ func loadSff(filename string, char bool) (*Sff, error) {
 			shofs += 28
 		}
 	}
-	SffCache[filename] = &SffCacheEntry{*s, 1}
-	runtime.SetFinalizer(s, func(s *Sff) {
-		if cached, ok := SffCache[filename]; ok {
-			cached.refCount--
-			if cached.refCount == 0 {
-				delete(SffCache, filename)
-			}
-		}
-	})
 	return s, nil
 }
 func preloadSff(filename string, char bool, preloadSpr map[[2]int16]bool) (*Sff, []int32, error) {
 	sff := newSff()
-	f, err := os.Open(filename)
+	f, err := OpenFile(filename)
 	if err != nil {
 		return nil, nil, err
 	}
-	defer func() { chk(f.Close()) }()
+	defer f.Close()
 	h := &SffHeader{}
 	var lofs, tofs uint32
 	if err := h.Read(f, &lofs, &tofs); err != nil {
+		return nil, nil, formatError(filename, "header", 0, err)
+	}
+	end, err := fileSize(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := h.checkRange(filename, end); err != nil {
 		return nil, nil, err
 	}
 	sff.header.Ver0 = h.Ver0
@@ -1319,15 +1444,14 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]int16]bool) (*Sff,
 		f.Seek(int64(shofs), 0)
 		switch h.Ver0 {
 		case 1:
-			if err := spriteList[i].readHeader(f, &xofs, &size, &indexOfPrevious); err != nil {
-				return nil, nil, err
-			}
+			err = spriteList[i].readHeader(f, &xofs, &size, &indexOfPrevious)
 		case 2:
-			if err := spriteList[i].readHeaderV2(f, &xofs, &size,
-				lofs, tofs, &indexOfPrevious); err != nil {
-				return nil, nil, err
-			}
+			err = spriteList[i].readHeaderV2(f, &xofs, &size, lofs, tofs, &indexOfPrevious)
+		}
+		if err != nil {
+			return nil, nil, formatError(filename, fmt.Sprintf("sprite header %v", i), int64(shofs), err)
 		}
+		entry := fmt.Sprintf("sprite %v,%v", spriteList[i].Group, spriteList[i].Number)
 		if _, ok := preloadSpr[[...]int16{spriteList[i].Group, spriteList[i].Number}]; ok || (prev == nil && spriteList[i].palidx < 0) {
 			if ok {
 				ok = sff.sprites[[...]int16{spriteList[i].Group, spriteList[i].Number}] == nil
@@ -1351,11 +1475,14 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]int16]bool) (*Sff,
 					if err := spriteList[i].read(f, h, int64(shofs+32), size, xofs, prev,
 						pl, char && (prev == nil || spriteList[i].Group == 0 && spriteList[i].Number == 0)); err != nil {
 						//pl, false); err != nil {
-						return nil, nil, err
+						return nil, nil, formatError(filename, entry, int64(shofs)+32, err)
 					}
 				case 2:
-					if err := spriteList[i].readV2(f, int64(xofs), size); err != nil {
-						return nil, nil, err
+					if missing, err := spriteList[i].readV2(f, int64(xofs), size); err != nil {
+						return nil, nil, formatError(filename, entry, int64(xofs), err)
+					} else if missing > 0 {
+						sys.errLog.Println(formatError(filename, entry, int64(xofs),
+							Error(fmt.Sprintf("%v of %v bytes are missing", missing, size))))
 					}
 				}
 				if ok {
@@ -1370,26 +1497,31 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]int16]bool) (*Sff,
 						plSize = 0
 						plIndexOfPrevious = uint16(spriteList[i].palidx)
 						ip := plIndexOfPrevious + 1
-						for plSize == 0 && ip != plIndexOfPrevious {
+						// Links are followed at most once per palette
+						for n := 0; plSize == 0 && ip != plIndexOfPrevious; n++ {
 							ip = plIndexOfPrevious
 							plShofs = h.FirstPaletteHeaderOffset + uint32(ip)*16
-							f.Seek(int64(plShofs)+6, 0)
-							if err := read(&plIndexOfPrevious); err != nil {
-								return nil, nil, err
-							}
-							if err := read(&plXofs); err != nil {
-								return nil, nil, err
+							if int(ip) >= int(h.NumberOfPalettes) || n > int(h.NumberOfPalettes) {
+								sys.errLog.Println(formatError(filename, entry, int64(xofs),
+									Error(fmt.Sprintf("invalid palette %v, using a blank one", ip))))
+								plSize = 0
+								break
 							}
-							if err := read(&plSize); err != nil {
-								return nil, nil, err
+							f.Seek(int64(plShofs)+6, 0)
+							for _, x := range []interface{}{&plIndexOfPrevious, &plXofs, &plSize} {
+								if err := read(x); err != nil {
+									return nil, nil, formatError(filename, fmt.Sprintf("palette header %v", ip),
+										int64(plShofs), err)
+								}
 							}
 						}
-						f.Seek(int64(lofs+plXofs), 0)
+						f.Seek(int64(lofs)+int64(plXofs), 0)
 						spriteList[i].Pal = make([]uint32, 256)
 						var rgba [4]byte
 						for j := 0; j < int(plSize)/4 && j < len(spriteList[i].Pal); j++ {
 							if err := read(rgba[:]); err != nil {
-								return nil, nil, err
+								return nil, nil, formatError(filename, fmt.Sprintf("palette %v", ip),
+									int64(lofs)+int64(plXofs), err)
 							}
 							if h.Ver2 == 0 {
 								rgba[3] = 255
@@ -1426,7 +1558,8 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]int16]bool) (*Sff,
 			f.Seek(int64(h.FirstPaletteHeaderOffset)+int64(i*16), 0)
 			var gn_ [3]int16
 			if err := read(gn_[:]); err != nil {
-				return nil, nil, err
+				return nil, nil, formatError(filename, fmt.Sprintf("palette header %v", i),
+					int64(h.FirstPaletteHeaderOffset)+int64(i*16), err)
 			}
 			if gn_[0] == 1 && gn_[1] >= 1 && gn_[1] <= MaxPalNo {
 				selPal = append(selPal, int32(gn_[1]))
@@ -1450,6 +1583,7 @@ func (s *Sff) getOwnPalSprite(g, n int16, pl *PaletteList) *Sprite {
 	if sp == nil {
 		return nil
 	}
+	sp.texture()
 	osp, pal := *sp, sp.GetPal(pl)
 	osp.Pal = make([]uint32, len(pal))
 	copy(osp.Pal, pal)
@@ -2,8 +2,12 @@ package main
 
 import (
 	"encoding/binary"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -566,7 +570,9 @@ func (nb *NetBuffer) input(cb *CommandBuffer, f int32) {
 
 type NetInput struct {
 	ln           *net.TCPListener
-	conn         *net.TCPConn
+	conn         io.ReadWriteCloser
+	udp          *udpConn
+	pc           *net.UDPConn
 	st           NetState
 	sendEnd      chan bool
 	recvEnd      chan bool
@@ -577,13 +583,35 @@ type NetInput struct {
 	stoppedcnt   int32
 	delay        int32
 	rep          *os.File
+	spec         *spectatorHub
 	host         bool
 	preFightTime int32
+	// Rollback mode, enabled when rollback > 0
+	rollback   int32
+	confirmed  int32
+	rewind     int32
+	predicted  [32]InputBits
+	states     [32]GameState
+	stateTimes [32]int32
+	// Desync detection, see desync.go
+	syncTime     int32
+	repT         int32
+	desync       int32
+	desyncLogged bool
+	outbox       chan []byte
+	inbox        chan netMessage
+	locSums      map[int32]*syncState
+	remSums      map[int32]uint32
+	// Session negotiation, see netsession.go
+	hashes     map[string]string
+	sessionErr error
 }
 
 func NewNetInput() *NetInput {
 	ni := &NetInput{st: NS_Stop,
-		sendEnd: make(chan bool, 1), recvEnd: make(chan bool, 1)}
+		sendEnd: make(chan bool, 1), recvEnd: make(chan bool, 1),
+		desync: -1, outbox: make(chan []byte, 16), inbox: make(chan netMessage, 64),
+		locSums: make(map[int32]*syncState), remSums: make(map[int32]uint32)}
 	ni.sendEnd <- true
 	ni.recvEnd <- true
 	return ni
@@ -593,8 +621,14 @@ func (ni *NetInput) Close() {
 		ni.ln.Close()
 		ni.ln = nil
 	}
+	if ni.spec != nil {
+		ni.spec.Close()
+		ni.spec = nil
+	}
 	if ni.conn != nil {
 		ni.conn.Close()
+	} else if ni.pc != nil {
+		ni.pc.Close()
 	}
 	if ni.sendEnd != nil {
 		<-ni.sendEnd
@@ -628,12 +662,16 @@ func (ni *NetInput) GetHostGuestRemap() (host, guest int) {
 	return
 }
 func (ni *NetInput) Accept(port string) error {
+	if sys.netplayTransport == "udp" {
+		return ni.acceptUDP(port)
+	}
 	if ln, err := net.Listen("tcp", ":"+port); err != nil {
 		return err
 	} else {
 		ni.ln = ln.(*net.TCPListener)
 		ni.host = true
 		ni.locIn, ni.remIn = ni.GetHostGuestRemap()
+		ni.startSpectators()
 		go func() {
 			ln := ni.ln
 			if conn, err := ln.AcceptTCP(); err == nil {
@@ -644,21 +682,91 @@ func (ni *NetInput) Accept(port string) error {
 	}
 	return nil
 }
-func (ni *NetInput) Connect(server, port string) {
+func (ni *NetInput) Connect(server, port string) error {
+	if sys.netplayTransport == "udp" {
+		return ni.connectUDP(server, port)
+	}
 	ni.host = false
 	ni.remIn, ni.locIn = ni.GetHostGuestRemap()
 	go func() {
 		if conn, err := net.Dial("tcp", server+":"+port); err == nil {
 			ni.conn = conn.(*net.TCPConn)
+		} else {
+			ni.fail(err)
+		}
+	}()
+	return nil
+}
+func (ni *NetInput) acceptUDP(port string) error {
+	laddr, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		return err
+	}
+	if ni.pc, err = net.ListenUDP("udp", laddr); err != nil {
+		return err
+	}
+	ni.host = true
+	ni.locIn, ni.remIn = ni.GetHostGuestRemap()
+	ni.startSpectators()
+	go func() {
+		if raddr, err := udpHandshake(ni.pc, nil, sys.netplayRendezvous, ""); err == nil {
+			ni.udp = newUDPConn(ni.pc, raddr)
+			ni.conn = ni.udp
+		} else {
+			ni.fail(err)
+		}
+	}()
+	return nil
+}
+func (ni *NetInput) connectUDP(server, port string) error {
+	ni.host = false
+	ni.remIn, ni.locIn = ni.GetHostGuestRemap()
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	ni.pc = pc
+	go func() {
+		var raddr *net.UDPAddr
+		var hostIP string
+		if sys.netplayRendezvous != "" {
+			// The rendezvous server knows hosts by their public IP
+			ip, err := net.ResolveIPAddr("ip", server)
+			if err != nil {
+				ni.fail(err)
+				return
+			}
+			hostIP = ip.String()
+		} else if raddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(server, port)); err != nil {
+			ni.fail(err)
+			return
+		}
+		if raddr, err = udpHandshake(pc, raddr, sys.netplayRendezvous, hostIP); err == nil {
+			ni.udp = newUDPConn(pc, raddr)
+			ni.conn = ni.udp
+		} else {
+			ni.fail(err)
 		}
 	}()
+	return nil
+}
+
+// Records why the connection could not be made, for netPlayError to report
+// while the menu waits for it.
+func (ni *NetInput) fail(err error) {
+	ni.st, ni.sessionErr = NS_Error, err
 }
 func (ni *NetInput) IsConnected() bool {
 	return ni != nil && ni.conn != nil
 }
 func (ni *NetInput) Input(cb *CommandBuffer, i int, facing int32) {
 	if i >= 0 && i < len(ni.buf) {
-		ni.buf[sys.inputRemap[i]].input(cb, facing)
+		in := sys.inputRemap[i]
+		if ni.rollback > 0 && in == ni.remIn && ni.buf[in].curT >= ni.buf[in].inpT {
+			ni.predicted[ni.buf[in].curT&31].GetInput(cb, facing)
+			return
+		}
+		ni.buf[in].input(cb, facing)
 	}
 }
 func (ni *NetInput) AnyButton() bool {
@@ -680,6 +788,9 @@ func (ni *NetInput) Stop() {
 		ni.sendEnd <- true
 		<-ni.recvEnd
 		ni.recvEnd <- true
+		if ni.udp != nil {
+			ni.udp.setBuffers(nil, nil)
+		}
 	}
 }
 func (ni *NetInput) end() {
@@ -690,7 +801,7 @@ func (ni *NetInput) end() {
 }
 func (ni *NetInput) readI32() (int32, error) {
 	b := [4]byte{}
-	if _, err := ni.conn.Read(b[:]); err != nil {
+	if _, err := io.ReadFull(ni.conn, b[:]); err != nil {
 		return 0, err
 	}
 	return int32(b[0]) | int32(b[1])<<8 | int32(b[2])<<16 | int32(b[3])<<24, nil
@@ -707,6 +818,11 @@ func (ni *NetInput) Synchronize() error {
 		return Error("Can not connect to the other player")
 	}
 	ni.Stop()
+	ns, err := ni.negotiate()
+	if err != nil {
+		ni.st, ni.sessionErr = NS_Error, err
+		return err
+	}
 	var seed int32
 	if ni.host {
 		seed = Random()
@@ -733,10 +849,24 @@ func (ni *NetInput) Synchronize() error {
 		}
 	}
 	ni.preFightTime = pfTime
-	if ni.rep != nil {
-		binary.Write(ni.rep, binary.LittleEndian, &seed)
-		binary.Write(ni.rep, binary.LittleEndian, &pfTime)
+	var rollback int32
+	if ni.host {
+		rollback = sys.rollbackFrames
+		if err := ni.writeI32(rollback); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if rollback, err = ni.readI32(); err != nil {
+			return err
+		}
 	}
+	ni.rollback = Clamp(rollback, 0, 15)
+	if err := ni.recordSession(ns); err != nil {
+		return err
+	}
+	ni.record(&seed)
+	ni.record(&pfTime)
 	if err := ni.writeI32(ni.time); err != nil {
 		return err
 	}
@@ -747,12 +877,30 @@ func (ni *NetInput) Synchronize() error {
 	}
 	ni.buf[ni.locIn].reset(ni.time)
 	ni.buf[ni.remIn].reset(ni.time)
+	ni.confirmed, ni.rewind = ni.time, -1
+	ni.syncTime, ni.repT = ni.time, ni.time
+	ni.locSums, ni.remSums = make(map[int32]*syncState), make(map[int32]uint32)
+	for i := range ni.stateTimes {
+		ni.stateTimes[i] = -1
+	}
+	// Over UDP, the inputs are exchanged by the connection itself
+	if ni.udp != nil {
+		ni.udp.setBuffers(&ni.buf[ni.locIn], &ni.buf[ni.remIn])
+	}
 	ni.st = NS_Playing
 	<-ni.sendEnd
 	go func(nb *NetBuffer) {
 		defer func() { ni.sendEnd <- true }()
 		for ni.st == NS_Playing {
-			if nb.senT < nb.inpT {
+			select {
+			case m := <-ni.outbox:
+				if _, err := ni.conn.Write(m); err != nil {
+					ni.st = NS_Error
+					return
+				}
+			default:
+			}
+			if ni.udp == nil && nb.senT < nb.inpT {
 				if err := ni.writeI32(int32(nb.buf[nb.senT&31])); err != nil {
 					ni.st = NS_Error
 					return
@@ -767,10 +915,15 @@ func (ni *NetInput) Synchronize() error {
 	go func(nb *NetBuffer) {
 		defer func() { ni.recvEnd <- true }()
 		for ni.st == NS_Playing {
-			if nb.inpT-nb.curT < 32 {
+			if ni.udp != nil || nb.inpT-nb.curT < 32 {
 				if tmp, err := ni.readI32(); err != nil {
 					ni.st = NS_Error
 					return
+				} else if tmp == netMsgChecksum || tmp == netMsgState {
+					if err := ni.readMessage(tmp); err != nil {
+						ni.st = NS_Error
+						return
+					}
 				} else {
 					nb.buf[nb.inpT&31] = InputBits(tmp)
 					if tmp < 0 {
@@ -798,6 +951,7 @@ func (ni *NetInput) Update() bool {
 	if ni.st != NS_Stopped {
 		ni.stoppedcnt = 0
 	}
+	ni.checkSync()
 	if !sys.gameEnd {
 		switch ni.st {
 		case NS_Stopped:
@@ -808,6 +962,10 @@ func (ni *NetInput) Update() bool {
 			}
 			fallthrough
 		case NS_Playing:
+			if ni.rollback > 0 {
+				ni.rollbackUpdate()
+				break
+			}
 			for {
 				foo := Min(ni.buf[ni.locIn].senT, ni.buf[ni.remIn].senT)
 				tmp := ni.buf[ni.remIn].inpT + ni.delay>>3 - ni.buf[ni.locIn].inpT
@@ -827,10 +985,16 @@ func (ni *NetInput) Update() bool {
 				}
 				ni.buf[ni.locIn].curT = ni.time
 				ni.buf[ni.remIn].curT = ni.time
-				if ni.rep != nil {
-					for _, nb := range ni.buf {
-						binary.Write(ni.rep, binary.LittleEndian, &nb.buf[ni.time&31])
-					}
+				if isDesyncCheckFrame(ni.time - ni.syncTime) {
+					ss := sys.syncState()
+					ni.localSync(ni.time, &ss)
+					ni.record(ss.checksum())
+				}
+				for _, nb := range ni.buf {
+					ni.record(&nb.buf[ni.time&31])
+				}
+				if ni.spec != nil {
+					ni.spec.endFrame()
 				}
 				ni.time++
 				if ni.time >= foo {
@@ -848,22 +1012,194 @@ func (ni *NetInput) Update() bool {
 	return !sys.gameEnd
 }
 
+// Advances one frame in rollback mode. Instead of waiting for the remote
+// input, the last known one is used as a prediction, as long as it is not
+// more than ni.rollback frames old.
+func (ni *NetInput) rollbackUpdate() {
+	loc, rem := &ni.buf[ni.locIn], &ni.buf[ni.remIn]
+	if loc.inpT <= ni.time {
+		loc.localUpdate(0)
+	}
+	for {
+		ni.confirm()
+		if rem.inpT > ni.time ||
+			sys.canRollback() && ni.time-rem.inpT < ni.rollback {
+			break
+		}
+		if sys.esc || !sys.await(FPS) || ni.st != NS_Playing {
+			return
+		}
+	}
+	ni.predict(ni.time)
+	loc.curT, rem.curT = ni.time, ni.time
+	ni.time++
+}
+
+// Sets the remote input used for frame t, predicting it when it has not
+// arrived yet.
+func (ni *NetInput) predict(t int32) {
+	rem := &ni.buf[ni.remIn]
+	if rem.inpT > t {
+		ni.predicted[t&31] = rem.buf[t&31]
+	} else if rem.inpT > 0 {
+		ni.predicted[t&31] = rem.buf[(rem.inpT-1)&31]
+	}
+}
+
+// Checks the predictions made for every remote input that arrived since the
+// last call, and records the earliest mispredicted frame in ni.rewind.
+func (ni *NetInput) confirm() {
+	rem := &ni.buf[ni.remIn]
+	for ni.confirmed < ni.time && ni.confirmed < rem.inpT {
+		t := ni.confirmed
+		if rem.buf[t&31] != ni.predicted[t&31] {
+			ni.predicted[t&31] = rem.buf[t&31]
+			if ni.rewind < 0 {
+				ni.rewind = t
+			}
+		}
+		ni.confirmed++
+	}
+	ni.syncConfirmed()
+}
+
+// Writes the replay and checks the state of every frame confirmed since the
+// last call. Frames after a misprediction are left for rollbackFrame to
+// correct first.
+func (ni *NetInput) syncConfirmed() {
+	for ; ni.repT < ni.confirmed; ni.repT++ {
+		t := ni.repT
+		saved := ni.stateTimes[t&31] == t
+		if saved && ni.rewind >= 0 && t > ni.rewind {
+			break
+		}
+		if isDesyncCheckFrame(t - ni.syncTime) {
+			var sum uint32
+			if saved {
+				ss := ni.states[t&31].syncState()
+				ni.localSync(t, &ss)
+				sum = ss.checksum()
+			}
+			ni.record(&sum)
+		}
+		for i := range ni.buf {
+			ib := ni.buf[i].buf[t&31]
+			if i == ni.remIn {
+				ib = ni.predicted[t&31]
+			}
+			ni.record(&ib)
+		}
+		if ni.spec != nil {
+			ni.spec.endFrame()
+		}
+	}
+}
+
+// Called once per frame after Update in rollback mode. If a misprediction was
+// found, the state of the mispredicted frame is restored and the following
+// frames are simulated again with the corrected inputs. The state of the
+// frame about to be run is then saved for later rollbacks.
+func (ni *NetInput) rollbackFrame() {
+	defer ni.syncConfirmed()
+	loc, rem := &ni.buf[ni.locIn], &ni.buf[ni.remIn]
+	cur := ni.time - 1
+	if ni.rewind < 0 && ni.stateTimes[cur&31] == cur {
+		return
+	}
+	if ni.rewind >= 0 {
+		if ni.stateTimes[ni.rewind&31] == ni.rewind && cur-ni.rewind < 32 {
+			sys.loadGameState(&ni.states[ni.rewind&31])
+			sys.resimulating = true
+			for t := ni.rewind; t < cur; t++ {
+				if t >= ni.confirmed {
+					ni.predict(t)
+				}
+				loc.curT, rem.curT = t, t
+				sys.simulateFrame()
+				if t+1 < cur {
+					sys.saveGameState(&ni.states[(t+1)&31])
+					ni.stateTimes[(t+1)&31] = t + 1
+				}
+			}
+			sys.resimulating = false
+			ni.predict(cur)
+			loc.curT, rem.curT = cur, cur
+		} else {
+			sys.errLog.Printf("Rollback to frame %v failed: state not available\n", ni.rewind)
+		}
+		ni.rewind = -1
+	}
+	sys.saveGameState(&ni.states[cur&31])
+	ni.stateTimes[cur&31] = cur
+}
+
+// Called when a match ends. Mispredictions found from now on can no longer be
+// corrected, so the saved states are dropped and the remaining frames are
+// written to the replay without checksums.
+func (ni *NetInput) endMatch() {
+	ni.rewind = -1
+	for i := range ni.stateTimes {
+		ni.stateTimes[i] = -1
+	}
+	ni.syncConfirmed()
+}
+
 type FileInput struct {
-	f      *os.File
+	f      io.ReadSeekCloser
+	spec   *spectateStream
 	ib     [MaxSimul*2 + MaxAttachedChar]InputBits
 	pfTime int32
+	header *ReplayHeader
+	// Playback controls, see replay.go
+	match       bool
+	frame       int32
+	round       int32
+	speed       float32
+	seekFrame   int32
+	seekRound   int32
+	seekPaused  bool
+	checkpoints []*replayCheckpoint
+	// Frames read since the last Synchronize, and the first frame whose
+	// checksum did not match
+	segFrame int32
+	desync   int32
+	// Called with the state at the start of every frame of a match
+	onFrame func(frame int32)
+	// Hashes of the defs the recorded sessions are checked against, and the
+	// error of the first session that differs
+	hashes     map[string]string
+	sessionErr error
 }
 
-func OpenFileInput(filename string) *FileInput {
-	fi := &FileInput{}
-	fi.f, _ = os.Open(filename)
-	return fi
+func OpenFileInput(filename string) (*FileInput, error) {
+	fi := &FileInput{speed: 1, seekFrame: -1, desync: -1}
+	f, err := os.Open(filename)
+	if err == nil {
+		fi.f = f
+		fi.header, err = readReplayHeader(f)
+	}
+	return fi, err
+}
+
+// Plays back a netplay session hosted on server as a spectator.
+func OpenSpectateInput(server, port string) (*FileInput, error) {
+	fi := &FileInput{speed: 1, seekFrame: -1, desync: -1}
+	ss, err := dialSpectate(server, port)
+	if err != nil {
+		return fi, err
+	}
+	fi.f, fi.spec = ss, ss
+	if fi.header, err = readReplayHeader(ss); err == nil && fi.header == nil {
+		err = Error("Invalid spectator stream")
+	}
+	return fi, err
 }
 func (fi *FileInput) Close() {
 	if fi.f != nil {
 		fi.f.Close()
 		fi.f = nil
 	}
+	fi.spec = nil
 }
 func (fi *FileInput) Input(cb *CommandBuffer, i int, facing int32) {
 	if i >= 0 && i < len(fi.ib) {
@@ -878,7 +1214,17 @@ func (fi *FileInput) AnyButton() bool {
 	}
 	return false
 }
-func (fi *FileInput) Synchronize() {
+func (fi *FileInput) Synchronize() error {
+	if fi.f != nil && fi.header != nil && fi.header.MatchSetups {
+		if err := fi.readSession(); err != nil {
+			fi.Close()
+			fi.sessionErr = err
+			return err
+		}
+	}
+	if fi.spec != nil && !fi.spec.wait(8) {
+		fi.Close()
+	}
 	if fi.f != nil {
 		var seed int32
 		if binary.Read(fi.f, binary.LittleEndian, &seed) == nil {
@@ -887,17 +1233,32 @@ func (fi *FileInput) Synchronize() {
 		var pfTime int32
 		if binary.Read(fi.f, binary.LittleEndian, &pfTime) == nil {
 			fi.pfTime = pfTime
+			fi.segFrame = 0
 			fi.Update()
 		}
 	}
+	return nil
 }
 func (fi *FileInput) Update() bool {
 	if fi.f == nil {
 		sys.esc = true
 	} else {
-		if sys.oldNextAddTime > 0 &&
-			binary.Read(fi.f, binary.LittleEndian, fi.ib[:]) != nil {
-			sys.esc = true
+		if sys.oldNextAddTime > 0 {
+			if fi.match && fi.onFrame != nil {
+				fi.onFrame(fi.frame)
+			}
+			if fi.spec != nil && !fi.spec.wait(fi.frameSize()) {
+				sys.esc = true
+			} else if fi.checkSync() != nil ||
+				binary.Read(fi.f, binary.LittleEndian, fi.ib[:]) != nil {
+				sys.esc = true
+			} else {
+				fi.segFrame++
+				if fi.match {
+					fi.frame++
+					fi.checkpoint()
+				}
+			}
 		}
 		if sys.esc {
 			fi.Close()
@@ -906,16 +1267,155 @@ func (fi *FileInput) Update() bool {
 	return !sys.gameEnd
 }
 
+// Size of the next frame in the stream, including its checksum
+func (fi *FileInput) frameSize() int {
+	n := len(fi.ib) * 4
+	if h := fi.header; h != nil && h.Checksums > 0 &&
+		fi.segFrame > 0 && fi.segFrame%h.Checksums == 0 {
+		n += 4
+	}
+	return n
+}
+
+// Writes the inputs of a local match in the same format as NetInput replays,
+// so that they can be played back with FileInput.
+type InputRecorder struct {
+	f      *os.File
+	ib     [MaxSimul*2 + MaxAttachedChar]InputBits
+	set    [MaxSimul*2 + MaxAttachedChar]bool
+	header bool
+	frame  int32
+}
+
+func NewInputRecorder(filename string) (*InputRecorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &InputRecorder{f: f}, nil
+}
+func (ir *InputRecorder) Close() {
+	if ir.f != nil {
+		ir.f.Close()
+		ir.f = nil
+	}
+}
+func (ir *InputRecorder) Synchronize() {
+	seed := Random()
+	Srand(seed)
+	if ir.f != nil && !ir.header {
+		if err := newReplayHeader(false).write(ir.f); err != nil {
+			sys.errLog.Printf("Failed to write replay: %v\n", err)
+		}
+		ir.header = true
+	}
+	if ir.f != nil {
+		binary.Write(ir.f, binary.LittleEndian, &seed)
+		binary.Write(ir.f, binary.LittleEndian, &sys.preFightTime)
+	}
+	ir.ib, ir.set = [len(ir.ib)]InputBits{}, [len(ir.set)]bool{}
+	ir.frame = 0
+}
+
+// Directory of the recorded local matches, which the replay menu lists along
+// with the other replays
+const localReplayDir = "save/replays/local"
+
+// Starts recording a local match to localReplayDir, unless disabled or the
+// inputs are already recorded or played back. Netplay sessions are recorded
+// with replayRecord. Only the replays of localReplayDir are pruned, so that
+// the other ones are kept.
+func (s *System) recordLocalMatch() *InputRecorder {
+	if !s.recordLocalReplays || s.headless || s.netInput != nil || s.fileInput != nil ||
+		s.inputRecorder != nil || s.gameMode == "demo" || s.gameMode == "randomtest" ||
+		s.gameMode == "training" {
+		return nil
+	}
+	os.MkdirAll(localReplayDir, os.ModeSticky|0755)
+	pruneReplays(localReplayDir, int(s.replayMax)-1)
+	ir, err := NewInputRecorder(localReplayDir + "/" +
+		time.Now().Format("2006-01-02 03-04PM-05s") + ".replay")
+	if err != nil {
+		s.errLog.Printf("Failed to create replay: %v\n", err)
+		return nil
+	}
+	s.inputRecorder = ir
+	return ir
+}
+
+// Deletes the oldest replays in dir until at most keep are left. A negative
+// keep means no limit.
+func pruneReplays(dir string, keep int) {
+	if keep < 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var replays []os.FileInfo
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".replay") {
+			replays = append(replays, e)
+		}
+	}
+	sort.Slice(replays, func(i, j int) bool {
+		return replays[i].ModTime().Before(replays[j].ModTime())
+	})
+	for i := 0; i < len(replays)-keep; i++ {
+		if err := os.Remove(filepath.Join(dir, replays[i].Name())); err != nil {
+			sys.errLog.Printf("Failed to delete old replay: %v\n", err)
+		}
+	}
+}
+func (s *System) stopLocalRecording(ir *InputRecorder) {
+	// Nothing was played, such as when the chars failed to load
+	if ir.f != nil && !ir.header {
+		name := ir.f.Name()
+		ir.Close()
+		os.Remove(name)
+	}
+	ir.Close()
+	if s.inputRecorder == ir {
+		s.inputRecorder = nil
+	}
+}
+
+// Stores the input given to input slot i. Only the first input of each frame
+// is kept, as FileInput reads a single one per frame.
+func (ir *InputRecorder) record(i int, ib InputBits) {
+	if i >= 0 && i < len(ir.ib) && !ir.set[i] {
+		ir.ib[i], ir.set[i] = ib, true
+	}
+}
+func (ir *InputRecorder) Update() {
+	if ir.f != nil && sys.oldNextAddTime > 0 {
+		if binary.Write(ir.f, binary.LittleEndian, ir.ib[:]) != nil {
+			sys.errLog.Printf("Failed to write replay: %v\n", ir.f.Name())
+			ir.Close()
+			return
+		}
+		// The checksum of the state at the start of the next frame
+		if ir.frame++; isDesyncCheckFrame(ir.frame) {
+			ss := sys.syncState()
+			binary.Write(ir.f, binary.LittleEndian, ss.checksum())
+		}
+		ir.ib, ir.set = [len(ir.ib)]InputBits{}, [len(ir.set)]bool{}
+	}
+}
+
+// The default AIController, which holds random directions and buttons for
+// random durations, pressing buttons more often at higher levels
 type AiInput struct {
 	dir, dirt, at, bt, ct, xt, yt, zt, st, dt, wt, mt int32
 }
 
-func (ai *AiInput) Update(level float32) {
+func (ai *AiInput) Update(m *AIMatchView, level float32) InputBits {
 	if sys.intro != 0 {
 		ai.dirt, ai.at, ai.bt, ai.ct = 0, 0, 0, 0
 		ai.xt, ai.yt, ai.zt, ai.st = 0, 0, 0, 0
 		ai.dt, ai.wt, ai.mt = 0, 0, 0
-		return
+		return 0
 	}
 	var osu, hanasu int32 = 15, 60
 	dec := func(t *int32) bool {
@@ -945,6 +1445,22 @@ func (ai *AiInput) Update(level float32) {
 	osu = 3600
 	dec(&ai.st)
 	//dec(&ai.mt)
+	return InputBits(Btoi(ai.U()) | Btoi(ai.D())<<1 | Btoi(ai.L())<<2 | Btoi(ai.R())<<3 |
+		Btoi(ai.a())<<4 | Btoi(ai.b())<<5 | Btoi(ai.c())<<6 | Btoi(ai.x())<<7 |
+		Btoi(ai.y())<<8 | Btoi(ai.z())<<9 | Btoi(ai.s())<<10 | Btoi(ai.d())<<11 |
+		Btoi(ai.w())<<12 | Btoi(ai.m())<<13)
+}
+func (ai *AiInput) Command(m *AIMatchView, level float32, commands int) int32 {
+	// AI Scaling
+	// TODO: Balance AI Scaling
+	if m.RoundState == 2 && RandF32(0, level/2+32) > 32 {
+		return Rand(0, int32(commands)-1)
+	}
+	return -1
+}
+func (ai *AiInput) Clone() AIController {
+	c := *ai
+	return &c
 }
 func (ai *AiInput) L() bool {
 	return ai.dirt != 0 && (ai.dir == 5 || ai.dir == 6 || ai.dir == 7)
@@ -1493,8 +2009,9 @@ func (cl *CommandList) Input(i int, facing int32, aiLevel float32, ib InputBits)
 		return false
 	}
 	step := cl.Buffer.Bb != 0
+	var aib InputBits
 	if i < 0 && ^i < len(sys.aiInput) {
-		sys.aiInput[^i].Update(aiLevel) // 乱数を使うので同期がずれないようここで / Here we use random numbers so we can not get out of sync
+		aib = sys.aiController(^i).Update(newAIMatchView(^i), aiLevel) // 乱数を使うので同期がずれないようここで / Here we use random numbers so we can not get out of sync
 	}
 	_else := i < 0
 	if _else {
@@ -1510,20 +2027,10 @@ func (cl *CommandList) Input(i int, facing int32, aiLevel float32, ib InputBits)
 		if i < 0 {
 			i = ^i
 			if i < len(sys.aiInput) {
-				L = sys.aiInput[i].L() || ib&IB_PL != 0
-				R = sys.aiInput[i].R() || ib&IB_PR != 0
-				U = sys.aiInput[i].U() || ib&IB_PU != 0
-				D = sys.aiInput[i].D() || ib&IB_PD != 0
-				a = sys.aiInput[i].a() || ib&IB_A != 0
-				b = sys.aiInput[i].b() || ib&IB_B != 0
-				c = sys.aiInput[i].c() || ib&IB_C != 0
-				x = sys.aiInput[i].x() || ib&IB_X != 0
-				y = sys.aiInput[i].y() || ib&IB_Y != 0
-				z = sys.aiInput[i].z() || ib&IB_Z != 0
-				s = sys.aiInput[i].s() || ib&IB_S != 0
-				d = sys.aiInput[i].d() || ib&IB_D != 0
-				w = sys.aiInput[i].w() || ib&IB_W != 0
-				m = sys.aiInput[i].m() || ib&IB_M != 0
+				ib |= aib
+				L, R, U, D = ib&IB_PL != 0, ib&IB_PR != 0, ib&IB_PU != 0, ib&IB_PD != 0
+				a, b, c, x, y = ib&IB_A != 0, ib&IB_B != 0, ib&IB_C != 0, ib&IB_X != 0, ib&IB_Y != 0
+				z, s, d, w, m = ib&IB_Z != 0, ib&IB_S != 0, ib&IB_D != 0, ib&IB_W != 0, ib&IB_M != 0
 			}
 		} else if i < len(sys.inputRemap) {
 			in := sys.inputRemap[i]
@@ -1601,6 +2108,11 @@ func (cl *CommandList) Input(i int, facing int32, aiLevel float32, ib InputBits)
 			B, F = L, R
 		}
 		cl.Buffer.Input(B, D, F, U, a, b, c, x, y, z, s, d, w, m)
+		if sys.inputRecorder != nil && i < len(sys.inputRemap) {
+			sys.inputRecorder.record(sys.inputRemap[i], InputBits(Btoi(U)|Btoi(D)<<1|
+				Btoi(L)<<2|Btoi(R)<<3|Btoi(a)<<4|Btoi(b)<<5|Btoi(c)<<6|Btoi(x)<<7|
+				Btoi(y)<<8|Btoi(z)<<9|Btoi(s)<<10|Btoi(d)<<11|Btoi(w)<<12|Btoi(m)<<13))
+		}
 	}
 	return step
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// Position in a state file. Line is 0 when it is not known.
+type lintPos struct {
+	file string
+	line int
+}
+
+func (p lintPos) String() string {
+	if p.line > 0 {
+		return fmt.Sprintf("%v:%v", p.file, p.line)
+	}
+	return p.file
+}
+
+type lintMessage struct {
+	pos     lintPos
+	warning bool
+	msg     string
+}
+
+// Collects the errors of a compilation instead of stopping at the first one,
+// and what the analyses run after it need to know.
+type lintReport struct {
+	msgs []lintMessage
+	file string
+	// Set while compiling the common states, which do not belong to the char
+	common bool
+	// First position where each var and fvar index is set and read
+	varSet, varRead [2]map[int32]lintPos
+	// Whether a var or fvar is read with an index that is not constant
+	varDynamic [2]bool
+	stateDefs  map[int32]lintPos
+	stateRefs  []lintStateRef
+	// Whether a state is entered with a number that is not constant
+	stateDynamic bool
+	// Whether a ZSS file was not compiled to the end because of an error
+	incomplete bool
+}
+
+type lintStateRef struct {
+	pos   lintPos
+	no    int32
+	param string
+}
+
+func newLintReport() *lintReport {
+	lr := &lintReport{stateDefs: make(map[int32]lintPos)}
+	for i := range lr.varSet {
+		lr.varSet[i] = make(map[int32]lintPos)
+		lr.varRead[i] = make(map[int32]lintPos)
+	}
+	return lr
+}
+func (lr *lintReport) add(pos lintPos, warning bool, msg string) {
+	// Compiler errors may span several lines
+	msg = strings.Join(SplitAndTrim(strings.TrimSpace(msg), "\n"), ": ")
+	lr.msgs = append(lr.msgs, lintMessage{pos, warning, msg})
+}
+func (lr *lintReport) errors() (n int) {
+	for _, m := range lr.msgs {
+		if !m.warning {
+			n++
+		}
+	}
+	return
+}
+
+// Reports an error in a state file, at line if it is greater than 0. Outside
+// of lint mode the error is returned to stop compiling. In lint mode it is
+// collected and nil is returned, so that compilation goes on.
+func (c *Compiler) compileError(file string, line int, err error) error {
+	if c.lint == nil {
+		if line > 0 {
+			return Error(fmt.Sprintf("%v:%v:\n%v", file, line, err.Error()))
+		}
+		return err
+	}
+	c.lint.add(lintPos{file, line}, false, err.Error())
+	return nil
+}
+
+// Position of the line being compiled
+func (c *Compiler) lintPos() lintPos {
+	if c.linechan != nil {
+		return lintPos{c.lint.file, c.zssLine}
+	}
+	return lintPos{c.lint.file, c.i + 1}
+}
+
+// Returns the value of a bytecode expression that only pushes an integer
+// constant, as compiled for the argument of var and the like.
+func lintConstant(be BytecodeExp) (int32, bool) {
+	if len(be) > 5 && be[0] == OC_nordrun {
+		be = be[5:]
+	}
+	switch {
+	case len(be) == 2 && be[0] == OC_int8:
+		return int32(int8(be[1])), true
+	case len(be) == 5 && be[0] == OC_int:
+		return *(*int32)(unsafe.Pointer(&be[1])), true
+	}
+	return 0, false
+}
+
+// Records that the var, or fvar if float is set, whose index is computed by
+// idx is set or read.
+func (c *Compiler) lintVar(float, set bool, idx BytecodeExp) {
+	if c.lint == nil {
+		return
+	}
+	k := Btoi(float)
+	n, ok := lintConstant(idx)
+	if !ok {
+		if !set {
+			c.lint.varDynamic[k] = true
+		}
+		return
+	}
+	m := c.lint.varRead[k]
+	if set {
+		if c.lint.common {
+			return
+		}
+		m = c.lint.varSet[k]
+	}
+	if _, ok := m[n]; !ok {
+		m[n] = c.lintPos()
+	}
+}
+
+type lintStateParam struct {
+	id   byte
+	name string
+}
+
+// Parameters of the state controllers that give a state number of the char
+var lintStateParams = map[string][]lintStateParam{
+	"changestate": {{changeState_value, "value"}},
+	"selfstate":   {{changeState_value, "value"}},
+	"targetstate": {{targetState_value, "value"}},
+	"hitdef":      {{hitDef_p1stateno, "p1stateno"}, {hitDef_p2stateno, "p2stateno"}},
+	"reversaldef": {{hitDef_p1stateno, "p1stateno"}, {hitDef_p2stateno, "p2stateno"}},
+	"projectile":  {{hitDef_p1stateno, "p1stateno"}, {hitDef_p2stateno, "p2stateno"}},
+	"helper":      {{helper_stateno, "stateno"}},
+	"hitoverride": {{hitOverride_stateno, "stateno"}},
+	"tagin":       {{tagIn_stateno, "stateno"}},
+	"tagout":      {{tagOut_stateno, "stateno"}},
+}
+
+// Records the states a state controller refers to, reading the parameters
+// from the compiled controller sc.
+func (c *Compiler) lintStateRefs(sctrl string, sc StateControllerBase, line int) {
+	if c.lint == nil {
+		return
+	}
+	params := lintStateParams[sctrl]
+	if len(params) == 0 {
+		return
+	}
+	// Same layout as read by StateControllerBase.run
+	for i := 0; i < len(sc); {
+		id, n := sc[i], int(sc[i+1])
+		i += 2
+		for m := 0; m < n; m++ {
+			l := int(*(*int32)(unsafe.Pointer(&sc[i])))
+			i += 4
+			for _, p := range params {
+				if m != 0 || p.id != id {
+					continue
+				}
+				if no, ok := lintConstant((*(*BytecodeExp)(unsafe.Pointer(&sc)))[i : i+l]); !ok {
+					c.lint.stateDynamic = true
+				} else if no >= 0 {
+					c.lint.stateRefs = append(c.lint.stateRefs,
+						lintStateRef{lintPos{c.lint.file, line}, no, sctrl + " " + p.name})
+				}
+			}
+			i += l
+		}
+	}
+}
+
+// Records a statedef of the char
+func (c *Compiler) lintStateDef(no int32) {
+	if c.lint == nil || c.lint.common {
+		return
+	}
+	if _, ok := c.lint.stateDefs[no]; !ok {
+		c.lint.stateDefs[no] = c.lintPos()
+	}
+}
+
+// States the engine or the common states can put a char in by themselves
+func lintEngineState(no int32) bool {
+	return no < 200 || no >= 5000 && no < 6000
+}
+
+// Runs the analyses that need the whole char to have been compiled.
+func (lr *lintReport) analyze(states map[int32]StateBytecode) {
+	for _, ref := range lr.stateRefs {
+		_, ok := states[ref.no]
+		if _, def := lr.stateDefs[ref.no]; !ok && !def && !lr.incomplete {
+			lr.add(ref.pos, false, fmt.Sprintf("%v refers to state %v, which does not exist",
+				ref.param, ref.no))
+		}
+	}
+	if !lr.stateDynamic {
+		referenced := make(map[int32]bool)
+		for _, ref := range lr.stateRefs {
+			referenced[ref.no] = true
+		}
+		for _, no := range lintSortedKeys(lr.stateDefs) {
+			if no >= 0 && !referenced[no] && !lintEngineState(no) {
+				lr.add(lr.stateDefs[no], true, fmt.Sprintf("state %v is never entered", no))
+			}
+		}
+	}
+	for k, name := range [...]string{"var", "fvar"} {
+		if lr.varDynamic[k] {
+			continue
+		}
+		for _, n := range lintSortedKeys(lr.varSet[k]) {
+			if _, ok := lr.varRead[k][n]; !ok {
+				lr.add(lr.varSet[k][n], true, fmt.Sprintf("%v(%v) is set but never read", name, n))
+			}
+		}
+	}
+}
+func lintSortedKeys(m map[int32]lintPos) (keys []int32) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return
+}
+
+// Compiles the char def, which may also be a char name as in select.def,
+// prints the errors and warnings found and returns the exit code of the
+// process: 0 without errors, 1 with errors and 2 if the char could not be
+// loaded. sys must have been initialized with sys.headless set.
+func lintMain(def string) int {
+	def, p, err := headlessLoadChar(def)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", def, err)
+		return 2
+	}
+	c := newCompiler()
+	c.lint = newLintReport()
+	states, err := c.Compile(0, def, p.gi().constants)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", def, err)
+		return 2
+	}
+	c.lint.analyze(states)
+	for _, m := range c.lint.msgs {
+		kind := "error"
+		if m.warning {
+			kind = "warning"
+		}
+		fmt.Printf("%v: %v: %v\n", m.pos, kind, m.msg)
+	}
+	errors := c.lint.errors()
+	fmt.Printf("%v: %v errors, %v warnings\n", def, errors, len(c.lint.msgs)-errors)
+	if errors > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Language server for ZSS and CNS state files, speaking the Language Server
+// Protocol over stdin and stdout. Diagnostics come from compiling the whole
+// char a file belongs to with the engine's compiler in lint mode, so that the
+// editor reports exactly what the engine would. Files that belong to no char
+// def in their directory or the one above, like the common states, are
+// compiled on their own with the common commands and constants.
+type lspServer struct {
+	r    *bufio.Reader
+	w    io.Writer
+	docs map[string]string
+	// Chars loaded for their constants, by def
+	chars map[string]*Char
+	// Parameters of every state controller, and of the statedef section
+	params    map[string][]string
+	stateDefs []string
+	// Sorted names of the state controllers and triggers
+	sctrls, triggers []string
+	shutdown         bool
+}
+
+type lspRequest struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string   `json:"name"`
+	Kind           int      `json:"kind"`
+	Range          lspRange `json:"range"`
+	SelectionRange lspRange `json:"selectionRange"`
+}
+
+// Runs the language server until the client exits, and returns the exit
+// code of the process. sys must have been initialized with sys.headless set.
+func lspMain() int {
+	// Everything else printed would corrupt the protocol stream
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	ls := &lspServer{r: bufio.NewReader(os.Stdin), w: out, docs: make(map[string]string),
+		chars: make(map[string]*Char)}
+	if lb, err := loadLifebar("data/fight.def"); err == nil {
+		sys.lifebar = *lb
+	}
+	ls.findParams()
+	for {
+		b, err := ls.read()
+		if err != nil {
+			if err == io.EOF {
+				return int(Btoi(!ls.shutdown))
+			}
+			sys.errLog.Printf("Language server: %v\n", err)
+			return 1
+		}
+		var req lspRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			continue
+		}
+		if req.Method == "exit" {
+			return int(Btoi(!ls.shutdown))
+		}
+		result, err := ls.handle(&req)
+		if req.ID == nil {
+			continue
+		}
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		if err != nil {
+			resp["error"] = map[string]interface{}{"code": -32603, "message": err.Error()}
+		} else {
+			resp["result"] = result
+		}
+		ls.write(resp)
+	}
+}
+func (ls *lspServer) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := ls.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 &&
+			strings.EqualFold(kv[0], "Content-Length") {
+			length, _ = strconv.Atoi(strings.TrimSpace(kv[1]))
+		}
+	}
+	if length < 0 {
+		return nil, Error("Missing Content-Length")
+	}
+	b := make([]byte, length)
+	_, err := io.ReadFull(ls.r, b)
+	return b, err
+}
+func (ls *lspServer) write(msg interface{}) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(ls.w, "Content-Length: %v\r\n\r\n%s", len(b), b)
+}
+func (ls *lspServer) notify(method string, params interface{}) {
+	ls.write(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (ls *lspServer) handle(req *lspRequest) (interface{}, error) {
+	var doc struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+	}
+	var pos lspTextDocumentPosition
+	switch req.Method {
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didSave",
+		"textDocument/didClose":
+		if err := json.Unmarshal(req.Params, &doc); err != nil {
+			return nil, err
+		}
+	case "textDocument/completion", "textDocument/hover", "textDocument/definition",
+		"textDocument/documentSymbol":
+		if err := json.Unmarshal(req.Params, &pos); err != nil {
+			return nil, err
+		}
+	}
+	uri := doc.TextDocument.URI
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				// Full text on every change
+				"textDocumentSync":       1,
+				"completionProvider":     map[string]interface{}{},
+				"hoverProvider":          true,
+				"definitionProvider":     true,
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]interface{}{"name": "ikemen-lsp", "version": Version},
+		}, nil
+	case "shutdown":
+		ls.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		ls.docs[uri] = doc.TextDocument.Text
+		ls.diagnose(uri)
+	case "textDocument/didChange":
+		if n := len(doc.ContentChanges); n > 0 {
+			ls.docs[uri] = doc.ContentChanges[n-1].Text
+		}
+		ls.diagnose(uri)
+	case "textDocument/didSave":
+		// Constants are read from the files of the char when it is loaded
+		delete(ls.chars, lspOwnerDef(lspURIPath(uri)))
+		ls.diagnose(uri)
+	case "textDocument/didClose":
+		delete(ls.docs, uri)
+		ls.notify("textDocument/publishDiagnostics",
+			map[string]interface{}{"uri": uri, "diagnostics": []lspDiagnostic{}})
+	case "textDocument/completion":
+		return ls.completion(pos.TextDocument.URI, pos.Position), nil
+	case "textDocument/hover":
+		return ls.hover(pos.TextDocument.URI, pos.Position), nil
+	case "textDocument/definition":
+		return ls.definition(pos.TextDocument.URI, pos.Position), nil
+	case "textDocument/documentSymbol":
+		return lspSymbols(ls.docs[pos.TextDocument.URI]), nil
+	}
+	return nil, nil
+}
+
+func lspURIPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	p := u.Path
+	if runtime.GOOS == "windows" {
+		p = strings.TrimPrefix(p, "/")
+	}
+	return filepath.FromSlash(p)
+}
+func lspPathURI(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	p = filepath.ToSlash(p)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
+
+// Path of a file as used to compare it with others. Chars are often written
+// on case insensitive file systems, so case is ignored.
+func lspNormPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	return strings.ToLower(filepath.ToSlash(filepath.Clean(p)))
+}
+
+// Returns the state files of a char, in the order Compile reads them, with
+// the common states last.
+func lspCharFiles(def string) []string {
+	return append(lspOwnFiles(def), lspCommonFiles(def)...)
+}
+func lspOwnFiles(def string) (files []string) {
+	str, err := LoadText(def)
+	if err != nil {
+		return nil
+	}
+	lines, i := SplitAndTrim(str, "\n"), 0
+	for i < len(lines) {
+		is, name, _ := ReadIniSection(lines, &i)
+		if name != "files" {
+			continue
+		}
+		keys := []string{"st"}
+		for n := 0; n < 10; n++ {
+			keys = append(keys, fmt.Sprintf("st%v", n))
+		}
+		for _, k := range append(keys, "cmd", "stcommon") {
+			if f := is[k]; f != "" {
+				files = append(files, SearchFile(f, []string{def, "", sys.motifDir, "data/"}))
+			}
+		}
+		break
+	}
+	return
+}
+func lspCommonFiles(def string) (files []string) {
+	for _, s := range sys.commonStates {
+		files = append(files, SearchFile(s, []string{def, sys.motifDir, sys.lifebar.def, "", "data/"}))
+	}
+	return
+}
+
+// Returns the def of the char whose own state files include path, looking in
+// the directory of path and the one above, or "" if there is none.
+func lspOwnerDef(path string) string {
+	np := lspNormPath(path)
+	dir := filepath.Dir(path)
+	for _, d := range []string{dir, filepath.Dir(dir)} {
+		defs, _ := filepath.Glob(filepath.Join(d, "*.def"))
+		for _, def := range defs {
+			for _, f := range lspOwnFiles(def) {
+				if lspNormPath(f) == np {
+					return def
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Files searched for state and function definitions from path
+func lspSearchFiles(path string) []string {
+	if def := lspOwnerDef(path); def != "" {
+		return lspCharFiles(def)
+	}
+	return append([]string{path}, lspCommonFiles("")...)
+}
+
+// Text of a file, from the editor if it is open there
+func (ls *lspServer) text(path string) string {
+	np := lspNormPath(path)
+	for uri, text := range ls.docs {
+		if lspNormPath(lspURIPath(uri)) == np {
+			return text
+		}
+	}
+	str, _ := LoadText(path)
+	return str
+}
+
+func (ls *lspServer) char(def string) (*Char, error) {
+	if p, ok := ls.chars[def]; ok {
+		return p, nil
+	}
+	p := newChar(0, 0)
+	sys.chars[0] = []*Char{p}
+	if err := p.load(def); err != nil {
+		return nil, err
+	}
+	ls.chars[def] = p
+	return p, nil
+}
+
+// Commands and constants of the common files, for the state files that
+// belong to no char
+func lspCommonCommands() *CommandList {
+	cl := NewCommandList(NewCommandBuffer())
+	for _, s := range sys.commonCmd {
+		LoadFile(&s, []string{"", sys.motifDir, "data/"}, func(filename string) error {
+			str, err := LoadText(filename)
+			if err != nil {
+				return err
+			}
+			lines, i := SplitAndTrim(str, "\n"), 0
+			for i < len(lines) {
+				is, name, _ := ReadIniSection(lines, &i)
+				if len(name) < 7 || name[:7] != "command" {
+					continue
+				}
+				cmdName, _, _ := is.getText("name")
+				if cm, err := ReadCommand(cmdName, is["command"], NewCommandKeyRemap()); err == nil {
+					cl.Add(*cm)
+				}
+			}
+			return nil
+		})
+	}
+	return cl
+}
+func lspCommonConstants() map[string]float32 {
+	constants := make(map[string]float32)
+	for _, s := range sys.commonConst {
+		LoadFile(&s, []string{"", sys.motifDir, "data/"}, func(filename string) error {
+			str, err := LoadText(filename)
+			if err != nil {
+				return err
+			}
+			lines, i := SplitAndTrim(str, "\n"), 0
+			is, _, _ := ReadIniSection(lines, &i)
+			for key, value := range is {
+				constants[key] = float32(Atof(value))
+			}
+			return nil
+		})
+	}
+	return constants
+}
+
+// Compiles the document and publishes its errors and warnings.
+func (ls *lspServer) diagnose(uri string) {
+	path := lspURIPath(uri)
+	c := newCompiler()
+	c.lint = newLintReport()
+	c.overlay = make(map[string]string)
+	for u, text := range ls.docs {
+		c.overlay[lspNormPath(lspURIPath(u))] = text
+	}
+	def := lspOwnerDef(path)
+	if def != "" {
+		if p, err := ls.char(def); err != nil {
+			c.compileError(def, 0, err)
+		} else {
+			p.cmd = nil
+			sys.chars[0] = []*Char{p}
+			states, err := c.Compile(0, def, p.gi().constants)
+			if err != nil {
+				c.compileError(def, 0, err)
+			} else {
+				c.lint.analyze(states)
+			}
+		}
+	} else {
+		c.cmdl = lspCommonCommands()
+		sys.stringPool[0].Clear()
+		if err := c.stateCompile(make(map[int32]StateBytecode), path, []string{"", "data/"},
+			false, lspCommonConstants()); err != nil {
+			c.compileError(path, 0, err)
+		}
+	}
+	lines := strings.Split(ls.docs[uri], "\n")
+	np := lspNormPath(path)
+	diags := []lspDiagnostic{}
+	for _, m := range c.lint.msgs {
+		// Errors of the def are shown at the top of its files
+		if f := lspNormPath(m.pos.file); f != np && (def == "" || f != lspNormPath(def)) {
+			continue
+		} else if f != np {
+			m.pos.line = 0
+		}
+		line := Max(0, int32(m.pos.line-1))
+		end := 0
+		if int(line) < len(lines) {
+			end = lspLen(strings.TrimRight(lines[line], "\r"))
+		}
+		severity := 1
+		if m.warning {
+			severity = 2
+		}
+		diags = append(diags, lspDiagnostic{Range: lspRange{lspPosition{int(line), 0},
+			lspPosition{int(line), end}}, Severity: severity, Source: "ikemen", Message: m.msg})
+	}
+	ls.notify("textDocument/publishDiagnostics",
+		map[string]interface{}{"uri": uri, "diagnostics": diags})
+}
+
+// Finds the parameters of every state controller by compiling it with the
+// parameters found so far, adding each mandatory one the compiler asks for.
+func (ls *lspServer) findParams() {
+	c := newCompiler()
+	find := func(compile func(is IniSection) error) (params []string) {
+		seen := make(map[string]bool)
+		c.onParam = func(name string) {
+			if !seen[name] {
+				seen[name] = true
+				params = append(params, name)
+			}
+		}
+		given := NewIniSection()
+		for i := 0; i < 32; i++ {
+			is := NewIniSection()
+			for k, v := range given {
+				is[k] = v
+			}
+			n := len(params)
+			err := func() (err error) {
+				defer func() {
+					if recover() != nil {
+						err = Error("panic")
+					}
+				}()
+				c.block = newStateBlock()
+				return compile(is)
+			}()
+			if err == nil || len(params) == n {
+				break
+			}
+			msg := err.Error()
+			if !strings.HasSuffix(msg, " not specified") {
+				break
+			}
+			given[strings.TrimSuffix(msg, " not specified")] = "0"
+		}
+		c.onParam = nil
+		return
+	}
+	ls.params = make(map[string][]string)
+	for name, scf := range c.scmap {
+		ls.params[name] = find(func(is IniSection) error {
+			_, err := scf(is, newStateControllerBase(), -1)
+			return err
+		})
+		ls.sctrls = append(ls.sctrls, name)
+	}
+	for name := range triggerMap {
+		ls.triggers = append(ls.triggers, name)
+	}
+	sort.Strings(ls.sctrls)
+	sort.Strings(ls.triggers)
+	ls.stateDefs = find(func(is IniSection) error {
+		return c.stateDef(is, newStateBytecode(0))
+	})
+	sys.stringPool[0].Clear()
+}
+
+var (
+	lspStateDefRe   = regexp.MustCompile(`(?i)^\s*\[\s*statedef\s+(-?\d+|\+1)`)
+	lspFunctionRe   = regexp.MustCompile(`(?i)^\s*\[\s*function\s+([a-z_][a-z0-9_]*)`)
+	lspSectionRe    = regexp.MustCompile(`^\s*\[`)
+	lspTypeRe       = regexp.MustCompile(`(?i)^\s*type\s*=\s*([a-z0-9_]*)`)
+	lspTypePrefixRe = regexp.MustCompile(`(?i)^\s*type\s*=\s*[a-z0-9_]*$`)
+	lspIdentRe      = regexp.MustCompile(`^[A-Za-z0-9_.]*$`)
+)
+
+// Returns the length of s in UTF-16 code units, in which LSP counts the
+// characters of a line.
+func lspLen(s string) (n int) {
+	for _, c := range s {
+		if n++; c >= 0x10000 {
+			n++
+		}
+	}
+	return
+}
+
+// Returns the index in r of the UTF-16 offset ch.
+func lspRuneIndex(r []rune, ch int) int {
+	n := 0
+	for i, c := range r {
+		if n >= ch {
+			return i
+		}
+		if n++; c >= 0x10000 {
+			n++
+		}
+	}
+	return len(r)
+}
+
+// Returns the word at ch in line, with its start and end. A state number
+// keeps its minus sign.
+func lspWord(line string, ch int) (string, int, int) {
+	r := []rune(line)
+	isWord := func(i int) bool {
+		c := r[i]
+		return c == '_' || c == '.' || c >= '0' && c <= '9' ||
+			c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	isDigit := func(i int) bool {
+		return i >= 0 && i < len(r) && r[i] >= '0' && r[i] <= '9'
+	}
+	ch = lspRuneIndex(r, ch)
+	if ch < len(r) && r[ch] == '-' && isDigit(ch+1) {
+		ch++
+	}
+	s, e := ch, ch
+	for s > 0 && isWord(s-1) {
+		s--
+	}
+	for e < len(r) && isWord(e) {
+		e++
+	}
+	// Unless it is a subtraction
+	if _, err := strconv.Atoi(string(r[s:e])); err == nil && s > 0 && r[s-1] == '-' &&
+		(s == 1 || !isWord(s-2) && r[s-2] != ')') {
+		s--
+	}
+	return string(r[s:e]), lspLen(string(r[:s])), lspLen(string(r[:e]))
+}
+func lspLine(text string, line int) string {
+	lines := strings.Split(text, "\n")
+	if line < 0 || line >= len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[line], "\r")
+}
+
+// Removes the comment from a line of a state file
+func lspCode(line string, zss bool) string {
+	if zss {
+		line = strings.SplitN(line, "#", 2)[0]
+	}
+	return strings.SplitN(line, ";", 2)[0]
+}
+
+func (ls *lspServer) completion(uri string, pos lspPosition) []lspCompletionItem {
+	text, zss := ls.docs[uri], HasExtension(lspURIPath(uri), ".zss")
+	line := []rune(lspLine(text, pos.Line))
+	prefix := string(line[:lspRuneIndex(line, pos.Character)])
+	var items []lspCompletionItem
+	add := func(kind int, detail string, names ...string) {
+		for _, n := range names {
+			items = append(items, lspCompletionItem{Label: n, Kind: kind, Detail: detail})
+		}
+	}
+	sctrls := func() {
+		add(14, "state controller", ls.sctrls...)
+	}
+	triggers := func() {
+		for _, n := range ls.triggers {
+			if triggerMap[n] == 0 {
+				add(3, "redirection", n)
+			} else {
+				add(3, "trigger", n)
+			}
+		}
+	}
+	if !zss {
+		switch {
+		case lspTypePrefixRe.MatchString(prefix):
+			sctrls()
+		case lspIdentRe.MatchString(strings.TrimSpace(prefix)):
+			// Parameters of the section around the line
+			lines := strings.Split(text, "\n")
+			sctype, statedef := "", false
+			for i := pos.Line - 1; i >= 0 && i < len(lines); i-- {
+				l := lspCode(lines[i], false)
+				if lspSectionRe.MatchString(l) {
+					statedef = lspStateDefRe.MatchString(l)
+					break
+				}
+				if m := lspTypeRe.FindStringSubmatch(l); m != nil {
+					sctype = strings.ToLower(m[1])
+				}
+			}
+			for i := pos.Line + 1; i < len(lines) && sctype == ""; i++ {
+				l := lspCode(lines[i], false)
+				if lspSectionRe.MatchString(l) {
+					break
+				}
+				if m := lspTypeRe.FindStringSubmatch(l); m != nil {
+					sctype = strings.ToLower(m[1])
+				}
+			}
+			if statedef {
+				add(10, "statedef", ls.stateDefs...)
+			} else {
+				add(10, "", "type", "triggerall", "trigger1", "persistent", "ignorehitpause")
+				add(10, sctype, ls.params[sctype]...)
+			}
+		default:
+			triggers()
+		}
+		return items
+	}
+	// In ZSS, find the state controller whose braces the cursor is in
+	lines := strings.Split(text, "\n")
+	var before strings.Builder
+	for i := 0; i < pos.Line && i < len(lines); i++ {
+		before.WriteString(lspCode(lines[i], true))
+		before.WriteString("\n")
+	}
+	before.WriteString(lspCode(prefix, true))
+	b, depth, sctrl := before.String(), 0, ""
+	segStart := strings.LastIndexAny(b, ";{}\n") + 1
+scan:
+	for i := len(b) - 1; i >= 0; i-- {
+		switch b[i] {
+		case '}':
+			depth++
+		case '{':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			head := strings.TrimRight(b[:i], " \t\r\n")
+			name, _, _ := lspWord(head, lspLen(head))
+			// Otherwise this is a block of statements, in no controller
+			if _, ok := ls.params[strings.ToLower(name)]; ok {
+				sctrl = strings.ToLower(name)
+			}
+			break scan
+		}
+	}
+	seg := strings.TrimSpace(b[segStart:])
+	switch {
+	case sctrl != "" && !strings.Contains(seg, ":"):
+		add(10, sctrl, ls.params[sctrl]...)
+	case sctrl == "" && lspIdentRe.MatchString(seg):
+		sctrls()
+		add(14, "keyword", "call", "if", "else", "switch", "case", "default", "let",
+			"persistent", "ignorehitpause")
+		triggers()
+	default:
+		triggers()
+	}
+	return items
+}
+
+func (ls *lspServer) hover(uri string, pos lspPosition) interface{} {
+	word, s, e := lspWord(lspLine(ls.docs[uri], pos.Line), pos.Character)
+	lw := strings.ToLower(word)
+	var md string
+	if params, ok := ls.params[lw]; ok {
+		md = fmt.Sprintf("**%v** (state controller)", lw)
+		if len(params) > 0 {
+			md += "\n\nParameters: " + strings.Join(params, ", ")
+		}
+	} else if kind, ok := triggerMap[lw]; ok {
+		md = fmt.Sprintf("**%v** (trigger)", lw)
+		if kind == 0 {
+			md = fmt.Sprintf("**%v** (redirection)", lw)
+		}
+		if doc, ok := lspTriggerDocs[lw]; ok {
+			md += "\n\n" + doc
+		}
+	} else if loc := ls.findDef(uri, word); loc != nil {
+		md = fmt.Sprintf("```\n%v\n```\n%v:%v", strings.TrimSpace(lspLine(
+			ls.text(lspURIPath(loc.URI)), loc.Range.Start.Line)),
+			filepath.Base(lspURIPath(loc.URI)), loc.Range.Start.Line+1)
+	}
+	if md == "" {
+		return nil
+	}
+	return map[string]interface{}{
+		"contents": map[string]interface{}{"kind": "markdown", "value": md},
+		"range":    lspRange{lspPosition{pos.Line, s}, lspPosition{pos.Line, e}},
+	}
+}
+
+func (ls *lspServer) definition(uri string, pos lspPosition) interface{} {
+	word, _, _ := lspWord(lspLine(ls.docs[uri], pos.Line), pos.Character)
+	if loc := ls.findDef(uri, word); loc != nil {
+		return loc
+	}
+	return nil
+}
+
+// Finds the statedef of a state number, or the function of a name, in the
+// files of the char the document belongs to.
+func (ls *lspServer) findDef(uri, word string) *lspLocation {
+	if word == "" {
+		return nil
+	}
+	_, err := strconv.Atoi(word)
+	isNum := err == nil
+	for _, f := range lspSearchFiles(lspURIPath(uri)) {
+		for i, l := range strings.Split(ls.text(f), "\n") {
+			re := lspFunctionRe
+			if isNum {
+				re = lspStateDefRe
+			}
+			if m := re.FindStringSubmatch(l); m != nil && strings.EqualFold(m[1], word) {
+				end := lspLen(strings.TrimRight(l, "\r"))
+				return &lspLocation{URI: lspPathURI(f),
+					Range: lspRange{lspPosition{i, 0}, lspPosition{i, end}}}
+			}
+		}
+	}
+	return nil
+}
+
+// Lists the states and functions of a document, each spanning up to the
+// next one.
+func lspSymbols(text string) []lspDocumentSymbol {
+	syms := []lspDocumentSymbol{}
+	lines := strings.Split(text, "\n")
+	end := func(i int) lspPosition {
+		return lspPosition{i, lspLen(strings.TrimRight(lines[i], "\r"))}
+	}
+	for i, l := range lines {
+		var sym lspDocumentSymbol
+		if m := lspStateDefRe.FindStringSubmatch(l); m != nil {
+			sym = lspDocumentSymbol{Name: "StateDef " + m[1], Kind: 5}
+		} else if m := lspFunctionRe.FindStringSubmatch(l); m != nil {
+			sym = lspDocumentSymbol{Name: m[1], Kind: 12}
+		} else {
+			continue
+		}
+		sym.SelectionRange = lspRange{lspPosition{i, 0}, end(i)}
+		sym.Range = sym.SelectionRange
+		if n := len(syms); n > 0 && i > 0 {
+			syms[n-1].Range.End = end(i - 1)
+		}
+		syms = append(syms, sym)
+	}
+	if n := len(syms); n > 0 {
+		syms[n-1].Range.End = end(len(lines) - 1)
+	}
+	return syms
+}
+
+// Short descriptions of the most used triggers, shown on hover
+var lspTriggerDocs = map[string]string{
+	"abs":               "Absolute value of its argument.",
+	"ailevel":           "AI level of the char, 0 if it is controlled by a human.",
+	"alive":             "1 if the char has not been KOed, 0 otherwise.",
+	"anim":              "Number of the current animation.",
+	"animelem":          "True on the tick the given element of the current animation starts. `AnimElem = 2, >= 0`",
+	"animelemno":        "Number of the element of the current animation displayed after the given number of ticks.",
+	"animelemtime":      "Ticks elapsed since the start of the given element of the current animation.",
+	"animexist":         "1 if the char has the given animation.",
+	"animtime":          "Ticks left in the current animation, negative until its end, 0 on its last tick.",
+	"backedgebodydist":  "Distance from the back of the char to the edge of the screen behind it.",
+	"backedgedist":      "Distance from the char to the edge of the screen behind it.",
+	"canrecover":        "1 if the char can recover from a fall now.",
+	"command":           "True if the given command of the cmd file has been input. `Command = \"QCF_x\"`",
+	"const":             "Value of a char constant. `Const(size.ground.front)`",
+	"ctrl":              "1 if the char has control.",
+	"drawgame":          "1 if the round ended in a draw.",
+	"facing":            "1 when facing right, -1 when facing left.",
+	"frontedgebodydist": "Distance from the front of the char to the edge of the screen in front of it.",
+	"frontedgedist":     "Distance from the char to the edge of the screen in front of it.",
+	"fvar":              "Value of a float variable. `FVar(3)`",
+	"gameheight":        "Height of the visible game area, in local coordinates.",
+	"gametime":          "Ticks elapsed since the start of the match.",
+	"gamewidth":         "Width of the visible game area, in local coordinates.",
+	"gethitvar":         "Property of the last hit taken. `GetHitVar(damage)`",
+	"hitcount":          "Number of hits of the current attack that connected.",
+	"hitdefattr":        "True if the current HitDef has the given attributes. `HitDefAttr = SCA, NA, SA`",
+	"hitfall":           "1 if the last hit taken makes the char fall.",
+	"hitover":           "1 once the hit time of the last hit taken has run out.",
+	"hitpausetime":      "Ticks of hit pause left.",
+	"hitshakeover":      "1 once the shaking of the last hit taken is over.",
+	"hitvel":            "Velocity given by the last hit taken. `HitVel X`",
+	"id":                "Unique ID of the char or helper.",
+	"ifelse":            "Second argument if the first is true, third otherwise. Both are evaluated.",
+	"inguarddist":       "1 if an attack of the opponent is close enough for the char to guard.",
+	"ishelper":          "1 if the char is a helper, or a helper with the given ID.",
+	"ishometeam":        "1 if the char is on the home team.",
+	"life":              "Current life.",
+	"lifemax":           "Maximum life.",
+	"lose":              "1 if the char's team lost the round.",
+	"matchno":           "Number of the current match in arcade mode.",
+	"matchover":         "1 once the match is over.",
+	"movecontact":       "Ticks since the current attack hit or was guarded, 0 if it did not.",
+	"moveguarded":       "Ticks since the current attack was guarded, 0 if it was not.",
+	"movehit":           "Ticks since the current attack hit, 0 if it did not.",
+	"movereversed":      "Ticks since the current attack was reversed, 0 if it was not.",
+	"movetype":          "Move type of the state: A (attack), I (idle) or H (being hit).",
+	"numenemy":          "Number of opponents.",
+	"numexplod":         "Number of explods of the char, or with the given ID.",
+	"numhelper":         "Number of helpers of the char, or with the given ID.",
+	"numpartner":        "Number of partners.",
+	"numproj":           "Number of projectiles of the char.",
+	"numprojid":         "Number of projectiles of the char with the given ID.",
+	"numtarget":         "Number of targets, or with the given HitDef ID.",
+	"p1name":            "Name of the char.",
+	"p2bodydist":        "Distance between the fronts of the char and its opponent. `P2BodyDist X`",
+	"p2dist":            "Distance between the char and its opponent. `P2Dist X`",
+	"p2life":            "Life of the opponent.",
+	"p2movetype":        "Move type of the opponent.",
+	"p2name":            "Name of the opponent.",
+	"p2stateno":         "State number of the opponent.",
+	"p2statetype":       "State type of the opponent.",
+	"palno":             "Palette number of the char.",
+	"parentdist":        "Distance from the helper to its parent. `ParentDist X`",
+	"pos":               "Position of the char. `Pos Y`",
+	"power":             "Current power.",
+	"powermax":          "Maximum power.",
+	"prevstateno":       "Number of the previous state.",
+	"projcanceltime":    "Ticks since a projectile of the char was cancelled.",
+	"projcontacttime":   "Ticks since a projectile of the char hit or was guarded.",
+	"projguardedtime":   "Ticks since a projectile of the char was guarded.",
+	"projhittime":       "Ticks since a projectile of the char hit.",
+	"random":            "Random integer from 0 to 999.",
+	"rootdist":          "Distance from the helper to the root. `RootDist X`",
+	"roundno":           "Number of the current round.",
+	"roundsexisted":     "Number of rounds the char has been in.",
+	"roundstate":        "0 before the intro, 1 during it, 2 while fighting, 3 when the round is decided and 4 during the win poses.",
+	"screenpos":         "Position of the char on the screen. `ScreenPos X`",
+	"selfanimexist":     "1 if the char itself has the given animation, even in a custom state.",
+	"stateno":           "Number of the current state.",
+	"statetype":         "State type: S (standing), C (crouching), A (air) or L (lying down).",
+	"sysfvar":           "Value of a system float variable.",
+	"sysvar":            "Value of a system variable.",
+	"teammode":          "Team mode of the char's side: single, simul, turns or tag.",
+	"teamside":          "Side of the char's team: 1 or 2.",
+	"tickspersecond":    "Game ticks per second.",
+	"time":              "Ticks spent in the current state.",
+	"timemod":           "Remainder of the state time divided by the argument. Obsolete, use Time % n.",
+	"uniqhitcount":      "Number of hits of the current attack, counting each target.",
+	"var":               "Value of an integer variable. `Var(3)`",
+	"vel":               "Velocity of the char. `Vel X`",
+	"win":               "1 if the char's team won the round.",
+	"winko":             "1 if the char's team won the round by KO.",
+	"winperfect":        "1 if the char's team won the round without losing life.",
+	"wintime":           "1 if the char's team won the round by time over.",
+}
@@ -54,6 +54,22 @@ func main() {
 	os.Mkdir("save/replays", os.ModeSticky|0755)
 
 	processCommandLine()
+	_, sys.headless = sys.cmdFlags["-headless"]
+	testDir, test := sys.cmdFlags["-test"]
+	lintDef, lint := sys.cmdFlags["-lint"]
+	_, lsp := sys.cmdFlags["-lsp"]
+	disasmDef, disasm := sys.cmdFlags["-disasm"]
+	sprPackDir, sprPack := sys.cmdFlags["-sprpack"]
+	sys.headless = sys.headless || test || lint || lsp || disasm || sprPack
+
+	// Run only the netplay rendezvous server
+	if port, ok := sys.cmdFlags["-rendezvous"]; ok {
+		if err := runRendezvous(port); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Try reading stats
 	if _, err := ioutil.ReadFile("save/stats.json"); err != nil {
@@ -69,9 +85,30 @@ func main() {
 
 	//os.Mkdir("debug", os.ModeSticky|0755)
 
+	// Run a single match or one of the tools without the menus, window or
+	// audio
+	if sys.headless {
+		sys.luaLState = sys.init(tmp.GameWidth, tmp.GameHeight)
+		var code int
+		if test {
+			code = regressionMain(testDir)
+		} else if lint {
+			code = lintMain(lintDef)
+		} else if lsp {
+			code = lspMain()
+		} else if disasm {
+			code = disasmMain(disasmDef)
+		} else if sprPack {
+			code = sprPackMain(sprPackDir)
+		} else {
+			code = headlessMain(tmp)
+		}
+		sys.shutdown()
+		os.Exit(code)
+	}
+
 	// Check if the main lua file exists.
-	if ftemp, err1 := os.Open(tmp.System); err1 != nil {
-		ftemp.Close()
+	if ftemp, err1 := OpenFile(tmp.System); err1 != nil {
 		var err2 = Error(
 			"Main lua file \"" + tmp.System + "\" error." +
 				"\n" + err1.Error(),
@@ -87,7 +124,12 @@ func main() {
 	defer sys.shutdown()
 
 	// Begin processing game using its lua scripts
-	if err := sys.luaLState.DoFile(tmp.System); err != nil {
+	fn, err := luaLoadFile(sys.luaLState, tmp.System)
+	if err == nil {
+		sys.luaLState.Push(fn)
+		err = sys.luaLState.PCall(0, lua.MultRet, nil)
+	}
+	if err != nil {
 		// Display error logs.
 		errorLog := createLog("Ikemen.log")
 		defer closeLog(errorLog)
@@ -113,14 +155,17 @@ func processCommandLine() {
 		sys.cmdFlags = make(map[string]string)
 		key := ""
 		player := 1
-		r1, _ := regexp.Compile("^-[h%?]")
+		r1, _ := regexp.Compile("^(-[h%?]|--help)$")
 		r2, _ := regexp.Compile("^-")
+		// Options that take no value, so that the next argument can be a
+		// player name
+		switches := map[string]bool{"-headless": true, "-lsp": true, "-nooptimize": true}
 		// Loop through arguments
 		for _, a := range os.Args[1:] {
 			// If getting help about command line options
 			if r1.MatchString(a) {
 				text := `Options (case sensitive):
--h -?                   Help
+-h -? --help            Help
 -log <logfile>          Records match data to <logfile>
 -r <path>               Loads motif <path>. eg. -r motifdir or -r motifdir/system.def
 -lifebar <path>         Loads lifebar <path>. eg. -lifebar data/fight.def
@@ -138,6 +183,21 @@ Quick VS Options:
 -rounds <num>           Plays for <num> rounds, and then quits
 -s <stagename>          Loads stage <stagename>
 
+Headless Options:
+-headless               Runs the Quick VS match without a window or audio, prints the result and quits
+-replay <path>          Plays back the local match replay <path> (headless only)
+-test <dir>             Runs the regression test case in <dir>, or all those in its subdirectories
+-lint <def>             Compiles the char <def> and lists its errors and warnings, eg. -lint kfm
+-lsp                    Runs a language server for ZSS and CNS files over stdin and stdout
+-disasm <def>           Prints the compiled bytecode of the states of the char <def>
+-stateno <num>          Only prints state <num> with -disasm
+-sprpack <dir>          Builds an SFF v2 file from the PNGs and sprites.json manifest in <dir>
+-sffout <file>          Writes the SFF file built with -sprpack to <file>
+
+Netplay Options:
+-rendezvous <port>      Runs a UDP rendezvous server on <port> for NAT hole punching
+-spectate <ip>          Watches the netplay session hosted at <ip> (or <ip>:<port>)
+
 Debug Options:
 -nojoy                  Disables joysticks
 -nomusic                Disables music
@@ -148,7 +208,11 @@ Debug Options:
 -ailevel <level>        Changes game difficulty setting to <level> (1-8)
 -speed <speed>          Changes game speed setting to <speed> (10%%-200%%)
 -stresstest <frameskip> Stability test (AI matches at speed increased by <frameskip>)
--speedtest              Speed test (match speed x100)`
+-speedtest              Speed test (match speed x100)
+-nooptimize             Disables the optimization of compiled CNS and ZSS expressions
+-remoteconsole <addr>   Accepts debug console commands on localhost:<port> or unix:<path>
+-remoteconsoletoken <t> Token the remote console clients must send first (random by default,
+                        written to save/remoteconsole.token)`
 				//ShowInfoDialog(text, "I.K.E.M.E.N Command line options")
 				fmt.Printf("I.K.E.M.E.N Command line options\n\n" + text + "\nPress ENTER to exit")
 				var s string
@@ -160,6 +224,9 @@ Debug Options:
 				sys.cmdFlags[a] = ""
 				// Prepare the key for the next argument
 				key = a
+				if switches[a] {
+					key = ""
+				}
 				// If an argument with no key
 			} else if key == "" {
 				// Set p1/p2's name
@@ -176,6 +243,9 @@ Debug Options:
 }
 
 type configSettings struct {
+	AIController               string
+	AIExternalAddress          string
+	AIExternalTimeout          int32
 	AIRamping                  bool
 	AIRandomColor              bool
 	AISurvivalColor            bool
@@ -193,6 +263,7 @@ type configSettings struct {
 	CommonFx                   []string
 	CommonLua                  []string
 	CommonStates               []string
+	ContentPacks               []string
 	ControllerStickSensitivity float32
 	Credits                    int
 	DebugClipboardRows         int
@@ -228,9 +299,12 @@ type configSettings struct {
 	MaxExplod                  int
 	MaxHelper                  int32
 	MaxPlayerProjectile        int
+	MaxReplays                 int32
 	Modules                    []string
 	Motif                      string
 	MSAA                       bool
+	NetplayRendezvous          string
+	NetplayTransport           string
 	NumSimul                   [2]int
 	NumTag                     [2]int
 	NumTurns                   [2]int
@@ -243,11 +317,18 @@ type configSettings struct {
 	RatioLife                  [4]float32
 	RatioRecoveryBase          float32
 	RatioRecoveryBonus         float32
+	RecordLocalReplays         bool
+	RemoteConsole              string
+	RollbackFrames             int32
 	RoundsNumSimul             int32
 	RoundsNumSingle            int32
 	RoundsNumTag               int32
 	RoundTime                  int32
 	ScreenshotFolder           string
+	SpectatorAddress           string
+	SpectatorDelay             int32
+	SpectatorPort              string
+	SpriteCacheSize            int64
 	StartStage                 string
 	StereoEffects              bool
 	System                     string
@@ -323,6 +404,9 @@ func setupConfig() configSettings {
 
 	// Set each config property to the system object
 	sys.afterImageMax = tmp.MaxAfterImage
+	sys.aiControllerName = tmp.AIController
+	sys.aiExternalAddress = tmp.AIExternalAddress
+	sys.aiExternalTimeout = tmp.AIExternalTimeout
 	sys.allowDebugKeys = tmp.DebugKeys
 	sys.allowDebugMode = tmp.DebugMode
 	sys.audioDucking = tmp.AudioDucking
@@ -342,6 +426,11 @@ func setupConfig() configSettings {
 	sys.commonFx = tmp.CommonFx
 	sys.commonLua = tmp.CommonLua
 	sys.commonStates = tmp.CommonStates
+	for _, pack := range tmp.ContentPacks {
+		if err := vfs.mount(pack); err != nil {
+			sys.errLog.Printf("Failed to mount content pack: %v\n", err)
+		}
+	}
 	sys.clipboardRows = tmp.DebugClipboardRows
 	sys.clsnDarken = tmp.DebugClsnDarken
 	sys.consoleRows = tmp.DebugConsoleRows
@@ -366,11 +455,21 @@ func setupConfig() configSettings {
 	sys.loseTag = tmp.LoseTag
 	sys.masterVolume = tmp.VolumeMaster
 	sys.multisampleAntialiasing = tmp.MSAA
+	sys.netplayRendezvous = tmp.NetplayRendezvous
+	sys.netplayTransport = strings.ToLower(tmp.NetplayTransport)
 	sys.panningRange = tmp.PanningRange
 	sys.playerProjectileMax = tmp.MaxPlayerProjectile
 	sys.postProcessingShader = tmp.PostProcessingShader
 	sys.pngFilter = tmp.PngSpriteFilter
 	sys.powerShare = [...]bool{tmp.TeamPowerShare, tmp.TeamPowerShare}
+	sys.recordLocalReplays = tmp.RecordLocalReplays
+	sys.replayMax = tmp.MaxReplays
+	sys.remoteConsoleAddr = tmp.RemoteConsole
+	if addr, ok := sys.cmdFlags["-remoteconsole"]; ok {
+		sys.remoteConsoleAddr = addr
+	}
+	sys.remoteConsoleToken = strings.TrimSpace(sys.cmdFlags["-remoteconsoletoken"])
+	sys.rollbackFrames = tmp.RollbackFrames
 	tmp.ScreenshotFolder = strings.TrimSpace(tmp.ScreenshotFolder)
 	if tmp.ScreenshotFolder != "" {
 		tmp.ScreenshotFolder = strings.Replace(tmp.ScreenshotFolder, "\\", "/", -1)
@@ -379,6 +478,11 @@ func setupConfig() configSettings {
 	} else {
 		sys.screenshotFolder = tmp.ScreenshotFolder
 	}
+	sys.spectatorDelay = tmp.SpectatorDelay
+	sys.spectatorPort = tmp.SpectatorPort
+	sys.spectatorAddress = tmp.SpectatorAddress
+	// Megabytes of sprite textures, unlimited if 0
+	sys.spriteCache.budget = tmp.SpriteCacheSize << 20
 	sys.stereoEffects = tmp.StereoEffects
 	sys.team1VS2Life = tmp.Team1VS2Life / 100
 	sys.vRetrace = tmp.VRetrace
@@ -406,7 +510,7 @@ func setupConfig() configSettings {
 			stoki(b[9].(string)), stoki(b[10].(string)), stoki(b[11].(string)),
 			stoki(b[12].(string)), stoki(b[13].(string))})
 	}
-	if _, ok := sys.cmdFlags["-nojoy"]; !ok {
+	if _, ok := sys.cmdFlags["-nojoy"]; !ok && !sys.headless {
 		for _, jc := range tmp.JoystickConfig {
 			b := jc.Buttons
 			sys.joystickConfig = append(sys.joystickConfig, KeyConfig{jc.Joystick,
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Everything both netplay peers must agree on, exchanged at every
+// Synchronize before the random seed.
+type netSession struct {
+	Version string
+	Chars   [2][]ReplayFile
+	Stage   ReplayFile
+	Rules   netRules
+}
+
+// Match rules and config settings that affect the simulation. Fields are
+// compared one by one and reported by name on mismatch.
+type netRules struct {
+	TeamMode              [2]TeamMode
+	NumSimul              [2]int32
+	NumTurns              [2]int32
+	MatchWins             [2]int32
+	RoundTime             int32
+	LifeMul               float32
+	Team1VS2Life          float32
+	GameSpeed             float32
+	Framerate             int
+	ComboExtraFrameWindow int32
+	MaxAfterImage         int32
+	MaxExplod             int
+	MaxHelper             int32
+	MaxPlayerProjectile   int
+	TeamLifeShare         [2]bool
+	TeamPowerShare        [2]bool
+	LoseSimul             bool
+	LoseTag               bool
+	CommonAir             []string
+	CommonCmd             []string
+	CommonConst           []string
+	CommonFx              []string
+	CommonStates          []string
+}
+
+// Describes the local session. Hashing a def reads every file it refers to,
+// so the hashes are cached for the whole connection.
+func (ni *NetInput) localSession() *netSession {
+	if ni.hashes == nil {
+		ni.hashes = make(map[string]string)
+	}
+	return newNetSession(ni.hashes)
+}
+
+// Describes the local session, caching the hashes of the defs in hashes.
+func newNetSession(hashes map[string]string) *netSession {
+	file := func(def string, pal int) ReplayFile {
+		h, ok := hashes[def]
+		if !ok {
+			h = replayHash(def)
+			hashes[def] = h
+		}
+		return ReplayFile{Def: filepath.ToSlash(def), Hash: h, Pal: pal}
+	}
+	ns := &netSession{Version: Version, Rules: netRules{
+		LifeMul: sys.lifeMul, Team1VS2Life: sys.team1VS2Life,
+		GameSpeed: sys.gameSpeed, Framerate: FPS,
+		ComboExtraFrameWindow: sys.comboExtraFrameWindow, MaxAfterImage: sys.afterImageMax,
+		MaxExplod: sys.explodMax, MaxHelper: sys.helperMax,
+		MaxPlayerProjectile: sys.playerProjectileMax, LoseSimul: sys.loseSimul,
+		LoseTag: sys.loseTag, TeamLifeShare: sys.lifeShare,
+		TeamPowerShare: sys.powerShare, CommonAir: sys.commonAir,
+		CommonCmd: sys.commonCmd, CommonConst: sys.commonConst,
+		CommonFx: sys.commonFx, CommonStates: sys.commonStates}}
+	// The team setup is only meaningful once a match has been selected.
+	// Selections are cleared when netplay starts, so peers agree before that.
+	if len(sys.sel.selected[0]) > 0 || len(sys.sel.selected[1]) > 0 {
+		r := &ns.Rules
+		r.TeamMode, r.NumSimul, r.NumTurns = sys.tmode, sys.numSimul, sys.numTurns
+		r.MatchWins, r.RoundTime = sys.lifebar.ro.match_wins, sys.roundTime
+	}
+	for tn, sel := range sys.sel.selected {
+		for _, s := range sel {
+			ns.Chars[tn] = append(ns.Chars[tn], file(sys.sel.GetChar(s[0]).def, s[1]))
+		}
+	}
+	if sys.sel.selectedStageNo >= 0 && sys.stage != nil {
+		ns.Stage = file(sys.stage.def, 0)
+	}
+	return ns
+}
+
+// Sends the local session and reads the remote one. Both peers write
+// before reading, so neither waits on the other. Returns the local session,
+// which the peers agreed on.
+func (ni *NetInput) negotiate() (*netSession, error) {
+	loc := ni.localSession()
+	b, err := json.Marshal(loc)
+	if err != nil {
+		return nil, err
+	}
+	if err := ni.writeI32(int32(len(b))); err != nil {
+		return nil, err
+	}
+	if _, err := ni.conn.Write(b); err != nil {
+		return nil, err
+	}
+	size, err := ni.readI32()
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > 1<<20 {
+		return nil, Error("Invalid netplay session data")
+	}
+	b = make([]byte, size)
+	if _, err := io.ReadFull(ni.conn, b); err != nil {
+		return nil, err
+	}
+	rem := &netSession{}
+	if err := json.Unmarshal(b, rem); err != nil {
+		return nil, err
+	}
+	if msg := loc.mismatch(rem, "on the other side"); msg != "" {
+		return nil, Error(msg)
+	}
+	return loc, nil
+}
+
+// Writes the session of the match about to start to the replay, so that
+// playing it back can check for the same content. See
+// ReplayHeader.MatchSetups.
+func (ni *NetInput) recordSession(ns *netSession) error {
+	b, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+	ni.record(int32(len(b)))
+	ni.record(b)
+	return nil
+}
+
+// Reads the session written by recordSession and checks it against the
+// local one.
+func (fi *FileInput) readSession() error {
+	if fi.spec != nil && !fi.spec.wait(4) {
+		return Error("Spectating stopped")
+	}
+	var size int32
+	if err := binary.Read(fi.f, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size < 0 || size > 1<<20 {
+		return Error("Invalid replay match setup")
+	}
+	if fi.spec != nil && !fi.spec.wait(int(size)) {
+		return Error("Spectating stopped")
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(fi.f, b); err != nil {
+		return err
+	}
+	rec := &netSession{}
+	if err := json.Unmarshal(b, rec); err != nil {
+		return err
+	}
+	if fi.hashes == nil {
+		fi.hashes = make(map[string]string)
+	}
+	// A different version is only warned about, by ReplayHeader.apply
+	loc := newNetSession(fi.hashes)
+	loc.Version = rec.Version
+	if msg := loc.mismatch(rec, "in the replay"); msg != "" {
+		return Error(msg)
+	}
+	return nil
+}
+
+// Returns a message describing the first difference between the sessions,
+// or an empty string if they match. other tells where rem comes from.
+func (ns *netSession) mismatch(rem *netSession, other string) string {
+	if ns.Version != rem.Version {
+		return fmt.Sprintf("Engine version differs: %v here, %v %v",
+			ns.Version, rem.Version, other)
+	}
+	file := func(kind string, loc, rem ReplayFile) string {
+		if !strings.EqualFold(loc.Def, rem.Def) {
+			return fmt.Sprintf("Different %v selected: %v here, %v %v",
+				kind, loc.Def, rem.Def, other)
+		}
+		if loc.Hash != rem.Hash {
+			return fmt.Sprintf("%v differs from the one %v", loc.Def, other)
+		}
+		if loc.Pal != rem.Pal {
+			return fmt.Sprintf("Different palette selected for %v: %v here, %v %v",
+				loc.Def, loc.Pal, rem.Pal, other)
+		}
+		return ""
+	}
+	for tn := range ns.Chars {
+		if len(ns.Chars[tn]) != len(rem.Chars[tn]) {
+			return fmt.Sprintf("Different number of P%v side characters: %v here, %v %v",
+				tn+1, len(ns.Chars[tn]), len(rem.Chars[tn]), other)
+		}
+		for i := range ns.Chars[tn] {
+			if msg := file("character", ns.Chars[tn][i], rem.Chars[tn][i]); msg != "" {
+				return msg
+			}
+		}
+	}
+	if msg := file("stage", ns.Stage, rem.Stage); msg != "" {
+		return msg
+	}
+	lv, rv := reflect.ValueOf(ns.Rules), reflect.ValueOf(rem.Rules)
+	for i := 0; i < lv.NumField(); i++ {
+		// Printed rather than deeply compared, as JSON turns empty lists nil
+		l, r := fmt.Sprint(lv.Field(i).Interface()), fmt.Sprint(rv.Field(i).Interface())
+		if l != r {
+			return fmt.Sprintf("%v setting differs: %v here, %v %v",
+				lv.Type().Field(i).Name, l, r, other)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"math"
+	"unsafe"
+)
+
+// Instruction of an expression being optimized. Jumps and redirections refer
+// to the instruction they go to by index instead of by offset.
+type optInstr struct {
+	op OpCode
+	// Operands other than offsets and lengths
+	arg BytecodeExp
+	// Instruction jumped to: len(code) for the end of the expression, or
+	// optExit for an 8-bit jump with offset 0, which leaves the expression it
+	// ends up in even once appended to another one.
+	target int
+	// Whether the jump has a 32-bit offset
+	wide bool
+	// Body of run and nordrun, which is optimized on its own
+	body BytecodeExp
+}
+
+const optExit = -1
+
+func optJump(op OpCode) bool {
+	switch op {
+	case OC_jsf8, OC_jmp8, OC_jz8, OC_jnz8, OC_jmp, OC_jz, OC_jnz:
+		return true
+	}
+	return false
+}
+func optCondJump(op OpCode) bool {
+	switch op {
+	case OC_jz8, OC_jnz8, OC_jz, OC_jnz:
+		return true
+	}
+	return false
+}
+func optRedirect(op OpCode) bool {
+	switch op {
+	case OC_player, OC_parent, OC_root, OC_helper, OC_target, OC_partner,
+		OC_enemy, OC_enemynear, OC_playerid, OC_p2, OC_stateowner, OC_helperindex:
+		return true
+	}
+	return false
+}
+func (in *optInstr) size() int {
+	switch {
+	case optJump(in.op) && !in.wide:
+		return 2
+	case optJump(in.op) || optRedirect(in.op):
+		return 5
+	case in.op == OC_run || in.op == OC_nordrun:
+		return 5 + len(in.body)
+	}
+	return 1 + len(in.arg)
+}
+
+// Returns the value pushed by the instruction if it is a constant.
+func (in *optInstr) constant() (BytecodeValue, bool) {
+	switch in.op {
+	case OC_int8:
+		return BytecodeInt(int32(int8(in.arg[0]))), true
+	case OC_int:
+		return BytecodeInt(*(*int32)(unsafe.Pointer(&in.arg[0]))), true
+	case OC_float:
+		if f := *(*float32)(unsafe.Pointer(&in.arg[0])); !math.IsNaN(float64(f)) {
+			return BytecodeFloat(f), true
+		}
+	}
+	return bvNone(), false
+}
+
+// Returns the instruction pushing bv. There is none for SFalse, which is
+// not a constant the bytecode can push.
+func optValue(bv BytecodeValue) (optInstr, bool) {
+	if bv.IsNone() || bv.IsSF() {
+		return optInstr{}, false
+	}
+	var be BytecodeExp
+	be.appendValue(bv)
+	return optInstr{op: be[0], arg: be[1:]}, true
+}
+
+// Operators whose result only depends on their operands. Bools are pushed as
+// ints, which all of them treat the same way.
+var optBinaryOps = map[OpCode]func(BytecodeExp, *BytecodeValue, BytecodeValue){
+	OC_eq: BytecodeExp.eq, OC_ne: BytecodeExp.ne, OC_gt: BytecodeExp.gt,
+	OC_le: BytecodeExp.le, OC_lt: BytecodeExp.lt, OC_ge: BytecodeExp.ge,
+	OC_bland: BytecodeExp.bland, OC_blxor: BytecodeExp.blxor,
+	OC_blor: BytecodeExp.blor, OC_and: BytecodeExp.and, OC_xor: BytecodeExp.xor,
+	OC_or: BytecodeExp.or, OC_add: BytecodeExp.add, OC_sub: BytecodeExp.sub,
+	OC_mul: BytecodeExp.mul, OC_div: BytecodeExp.div, OC_mod: BytecodeExp.mod,
+	OC_log: BytecodeExp.log,
+}
+var optUnaryOps = map[OpCode]func(BytecodeExp, *BytecodeValue){
+	OC_neg: BytecodeExp.neg, OC_not: BytecodeExp.not, OC_blnot: BytecodeExp.blnot,
+	OC_abs: BytecodeExp.abs, OC_exp: BytecodeExp.exp, OC_ln: BytecodeExp.ln,
+	OC_cos: BytecodeExp.cos, OC_sin: BytecodeExp.sin, OC_tan: BytecodeExp.tan,
+	OC_acos: BytecodeExp.acos, OC_asin: BytecodeExp.asin, OC_atan: BytecodeExp.atan,
+	OC_floor: BytecodeExp.floor, OC_ceil: BytecodeExp.ceil,
+}
+
+// Length of the instruction at be[i] with its operands, or 0 if it is cut
+// off.
+func (be BytecodeExp) opLen(i int) int {
+	n := 1
+	switch be[i] {
+	case OC_int8, OC_jsf8, OC_jmp8, OC_jz8, OC_jnz8, OC_movetype, OC_statetype,
+		OC_teammode, OC_localvar:
+		n = 2
+	case OC_int, OC_float, OC_command, OC_hitdefattr, OC_jmp, OC_jz, OC_jnz,
+		OC_run, OC_nordrun:
+		n = 5
+	case OC_int64:
+		n = 9
+	case OC_const_, OC_st_, OC_ex_:
+		if i+1 >= len(be) {
+			return 0
+		}
+		operands := opCodeConstOperands
+		if be[i] == OC_st_ {
+			operands = opCodeStOperands
+		} else if be[i] == OC_ex_ {
+			operands = opCodeExOperands
+		}
+		n = 2 + operands[be[i+1]]
+	default:
+		if optRedirect(be[i]) {
+			n = 5
+		}
+	}
+	if i+n > len(be) {
+		return 0
+	}
+	if be[i] == OC_run || be[i] == OC_nordrun {
+		l := int(*(*int32)(unsafe.Pointer(&be[i+1])))
+		if l < 0 || i+n+l > len(be) {
+			return 0
+		}
+		n += l
+	}
+	return n
+}
+
+func (be BytecodeExp) optDecode() ([]optInstr, bool) {
+	var code []optInstr
+	// Instruction starting at each byte, and byte each instruction jumps to
+	index := make([]int, len(be)+1)
+	for i := range index {
+		index[i] = -1
+	}
+	var to []int
+	for p := 0; p < len(be); {
+		n := be.opLen(p)
+		if n == 0 {
+			return nil, false
+		}
+		index[p] = len(code)
+		in, t := optInstr{op: be[p]}, -1
+		i32 := func() int { return int(*(*int32)(unsafe.Pointer(&be[p+1]))) }
+		switch {
+		case optJump(be[p]) && n == 2:
+			if be[p+1] == 0 {
+				t = len(be) + 1
+			} else {
+				t = p + 2 + int(uint8(be[p+1]))
+			}
+		case optJump(be[p]) || optRedirect(be[p]):
+			in.wide = optJump(be[p])
+			t = p + 5 + i32()
+			if t <= p {
+				return nil, false
+			}
+		case be[p] == OC_run || be[p] == OC_nordrun:
+			in.body = be[p+5 : p+n].optimize()
+		default:
+			in.arg = be[p+1 : p+n]
+		}
+		code, to = append(code, in), append(to, t)
+		p += n
+	}
+	index[len(be)] = len(code)
+	for i, t := range to {
+		switch {
+		case t < 0:
+		case t == len(be)+1:
+			code[i].target = optExit
+		case t > len(be) || index[t] < 0:
+			return nil, false
+		default:
+			code[i].target = index[t]
+		}
+	}
+	return code, true
+}
+
+func optEncode(code []optInstr) (BytecodeExp, bool) {
+	pos := make([]int, len(code)+1)
+	for widened := true; widened; {
+		widened = false
+		p := 0
+		for i := range code {
+			pos[i] = p
+			p += code[i].size()
+		}
+		pos[len(code)] = p
+		for i := range code {
+			in := &code[i]
+			if !optJump(in.op) || in.wide || in.target == optExit {
+				continue
+			}
+			// An 8-bit offset of 0 would mean the exit
+			if off := pos[in.target] - pos[i] - 2; off < 1 || off > math.MaxUint8 {
+				switch in.op {
+				case OC_jmp8:
+					in.op = OC_jmp
+				case OC_jz8:
+					in.op = OC_jz
+				case OC_jnz8:
+					in.op = OC_jnz
+				default:
+					return nil, false
+				}
+				in.wide, widened = true, true
+			}
+		}
+	}
+	be := make(BytecodeExp, 0, pos[len(code)])
+	for i, in := range code {
+		switch {
+		case optJump(in.op) && !in.wide:
+			var off int
+			if in.target != optExit {
+				off = pos[in.target] - pos[i] - 2
+			}
+			be.append(in.op, OpCode(off))
+		case optJump(in.op) || optRedirect(in.op):
+			be.appendI32Op(in.op, int32(pos[in.target]-pos[i]-5))
+		case in.op == OC_run || in.op == OC_nordrun:
+			be.appendI32Op(in.op, int32(len(in.body)))
+			be.append(in.body...)
+		default:
+			be.append(in.op)
+			be.append(in.arg...)
+		}
+	}
+	return be, true
+}
+
+// Marks the instructions that can be run.
+func optReachable(code []optInstr) []bool {
+	live := make([]bool, len(code))
+	for work := []int{0}; len(work) > 0; {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= len(code) || live[i] {
+			continue
+		}
+		live[i] = true
+		if (optJump(code[i].op) || optRedirect(code[i].op)) && code[i].target >= 0 {
+			work = append(work, code[i].target)
+		}
+		if code[i].op != OC_jmp8 && code[i].op != OC_jmp {
+			work = append(work, i+1)
+		}
+	}
+	return live
+}
+
+// Makes the jumps that land on another jump whose outcome is known go to
+// where that one leads instead. For example the false branch of a && b,
+// jumping to the jz of the && after it, goes straight to its end.
+func optThreadJumps(code []optInstr) (changed bool) {
+	for i := range code {
+		in := &code[i]
+		if !optJump(in.op) || in.op == OC_jsf8 {
+			continue
+		}
+		for n := 0; n < 16 && in.target >= 0 && in.target < len(code); n++ {
+			t, next := &code[in.target], -2
+			switch {
+			case t.op == OC_jmp8 || t.op == OC_jmp:
+				next = t.target
+			case optCondJump(in.op) && optCondJump(t.op):
+				// The value tested is still on top of the stack
+				if (in.op == OC_jz8 || in.op == OC_jz) == (t.op == OC_jz8 || t.op == OC_jz) {
+					next = t.target
+				} else {
+					next = in.target + 1
+				}
+			}
+			if next == -2 || next == in.target || next == optExit && in.wide {
+				break
+			}
+			in.target, changed = next, true
+		}
+	}
+	return
+}
+
+// Removes the instructions marked in del. Jumps to a removed instruction go
+// to the next one that is kept.
+func optRemove(code []optInstr, del []bool) []optInstr {
+	index := make([]int, len(code)+1)
+	n := 0
+	for i := range code {
+		index[i] = n
+		if !del[i] {
+			n++
+		}
+	}
+	index[len(code)] = n
+	out := make([]optInstr, 0, n)
+	for i, in := range code {
+		if del[i] {
+			continue
+		}
+		if (optJump(in.op) || optRedirect(in.op)) && in.target >= 0 {
+			in.target = index[in.target]
+		}
+		out = append(out, in)
+	}
+	return out
+}
+
+// Runs the passes until none of them changes anything.
+func optimizeCode(code []optInstr) []optInstr {
+	for changed := true; changed; {
+		changed = optThreadJumps(code)
+		live := optReachable(code)
+		targets := make([]int, len(code)+1)
+		del := make([]bool, len(code))
+		for i, in := range code {
+			if !live[i] {
+				del[i], changed = true, true
+			} else if (optJump(in.op) || optRedirect(in.op)) && in.target >= 0 {
+				targets[in.target]++
+			}
+		}
+		// The instruction after a redirection, and those after the nordrun
+		// giving its arguments, run on the redirected char
+		redirected := func(i int) bool {
+			return i > 0 && (optRedirect(code[i-1].op) || code[i-1].op == OC_nordrun)
+		}
+		// Whether the instruction is only reached from the one before it, so
+		// that both can be merged
+		free := func(i int) bool {
+			return i < len(code) && !del[i] && targets[i] == 0 && !redirected(i)
+		}
+		for i := 0; i < len(code); i++ {
+			if del[i] {
+				continue
+			}
+			in := &code[i]
+			if v, ok := in.constant(); ok && !redirected(i) {
+				// Constant folding
+				if free(i+1) && free(i+2) {
+					if v2, ok := code[i+1].constant(); ok {
+						if f, ok := optBinaryOps[code[i+2].op]; ok {
+							f(nil, &v, v2)
+							if ni, ok := optValue(v); ok {
+								*in, del[i+1], del[i+2], changed = ni, true, true, true
+								i += 2
+								continue
+							}
+						}
+					}
+				}
+				if free(i + 1) {
+					if f, ok := optUnaryOps[code[i+1].op]; ok {
+						f(nil, &v)
+						if ni, ok := optValue(v); ok {
+							*in, del[i+1], changed = ni, true, true
+							i++
+							continue
+						}
+					}
+					switch next := &code[i+1]; {
+					case next.op == OC_pop:
+						del[i], del[i+1], changed = true, true, true
+						i++
+						continue
+					case next.op == OC_jsf8:
+						// A constant is never SFalse
+						del[i+1], changed = true, true
+						i++
+						continue
+					case optCondJump(next.op):
+						// Dead branch
+						if v.ToB() == (next.op == OC_jnz8 || next.op == OC_jnz) {
+							next.op = OC_jmp8
+							if next.wide {
+								next.op = OC_jmp
+							}
+						} else {
+							del[i+1] = true
+						}
+						changed = true
+						i++
+						continue
+					}
+				}
+			}
+			switch {
+			case optJump(in.op) && in.target == i+1 && !redirected(i):
+				// Jump to the next instruction
+				del[i], changed = true, true
+			case in.op == OC_rdreset && !redirected(i):
+				// Only resets the redirection, which there is none of here
+				del[i], changed = true, true
+			case in.op == OC_stateowner && !redirected(i) && i+1 < len(code) && !del[i+1] &&
+				targets[i+1] == 0:
+				// The state owner always exists, so the redirection is
+				// redundant if the next instruction does not use it
+				if code[i+1].op == OC_rdreset {
+					del[i], del[i+1], changed = true, true, true
+					i++
+				} else if _, ok := code[i+1].constant(); ok {
+					del[i], changed = true, true
+				}
+			}
+		}
+		code = optRemove(code, del)
+	}
+	return code
+}
+
+// Returns an expression giving the same results faster: constant operations
+// are folded, branches on constant conditions removed, chained short-circuit
+// jumps go straight to their end and redundant redirections are dropped. An
+// expression that cannot be decoded is returned unchanged.
+func (be BytecodeExp) optimize() BytecodeExp {
+	if len(be) == 0 {
+		return be
+	}
+	code, ok := be.optDecode()
+	if !ok {
+		return be
+	}
+	if out, ok := optEncode(optimizeCode(code)); ok {
+		return out
+	}
+	return be
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// Compiles the expression without optimizing it.
+func optCompile(t *testing.T, expr string) BytecodeExp {
+	t.Helper()
+	c := newCompiler()
+	c.noOptimize = true
+	in := expr
+	be, err := c.fullExpression(&in, VT_None)
+	if err != nil {
+		t.Fatalf("%v: %v", expr, err)
+	}
+	return be
+}
+func optDecodeTest(t *testing.T, be BytecodeExp) []optInstr {
+	t.Helper()
+	code, ok := be.optDecode()
+	if !ok {
+		t.Fatalf("cannot decode %v", be)
+	}
+	return code
+}
+func optSame(a, b BytecodeValue) bool {
+	return a.t == b.t && (a.v == b.v || math.IsNaN(a.v) && math.IsNaN(b.v))
+}
+
+// Sum of n var(i), long enough to need the jumps over it to be far
+func optLongSum(n, i int) string {
+	return "(" + strings.Repeat(fmt.Sprintf("var(%v) + ", i), n) + "0)"
+}
+
+// Nested && whose inner jump, threaded through the outer one, does not fit in
+// 8 bits, while the jumps compiled for it do
+var optWideExpr = "(var(0) && " + optLongSum(25, 1) + ") && " + optLongSum(55, 2)
+
+// Runs the expressions before and after optimizing them, on a root and a
+// helper, with var(0) to var(3) set to different values, and compares the
+// results.
+func TestOptimizeEquivalence(t *testing.T) {
+	root, helper := newChar(0, 0), newChar(0, 1)
+	sys.chars[0] = []*Char{root, helper}
+	defer func() { sys.chars[0] = nil }()
+	exprs := []string{
+		// Constant folding
+		"1 + 2 * 3",
+		"(0 && var(0)) + 1",
+		"cond(1, 2, var(0)) + 3",
+		"-(1 || var(0))",
+		"(1 || var(0)) * 3 + var(1)",
+		"cond(0, var(0), 4) * 2",
+		"!(2 > 1) || var(1)",
+		"cond(1, 2.5, var(0)) / 2",
+		"cond(1, 7, var(0)) % 0",
+		// Dead branches
+		"0 && var(0)",
+		"var(0) && 0",
+		"1 || var(0)",
+		"cond(1, var(0), var(1))",
+		"cond(0, var(0), var(1))",
+		"cond(var(0), 0 && var(1), 1 || var(2))",
+		// Threaded jumps
+		"var(0) && var(1) && var(2) || var(3)",
+		"var(0) || var(1) || var(2) && var(3)",
+		"(var(0) || var(1)) && (var(2) || var(3))",
+		"cond(var(0), 1, var(1)) && var(2)",
+		"var(0) && (var(1) || var(2) && var(3))",
+		optWideExpr,
+		// Redirections
+		"stateowner, 5",
+		"stateowner, var(0)",
+		"stateowner, var(0) + 1",
+		"stateowner, cond(1, 5, var(0))",
+		"root, 5",
+		"root, var(0) || 1",
+		"root, var(0) && stateowner, var(1)",
+		"stateowner, var(1) || root, var(2)",
+	}
+	vars := [][4]int32{{0, 0, 0, 0}, {1, 0, 2, 0}, {0, 1, 0, 1}, {1, 1, 1, 1}, {-3, 0, 5, 2}}
+	for _, expr := range exprs {
+		be := optCompile(t, expr)
+		opt := be.optimize()
+		for _, c := range sys.chars[0] {
+			for _, v := range vars {
+				copy(root.ivar[:], v[:])
+				copy(helper.ivar[:], []int32{v[3], v[2], v[1], v[0]})
+				if want, got := be.run(c), opt.run(c); !optSame(want, got) {
+					t.Errorf("%v with vars %v on helper %v: got %v, want %v\n%v\n%v",
+						expr, v, c.helperIndex, got, want, be, opt)
+				}
+			}
+		}
+	}
+}
+
+func TestOptimizeConstantFolding(t *testing.T) {
+	for expr, v := range map[string]BytecodeValue{
+		"(0 && var(0)) + 1":        BytecodeInt(1),
+		"cond(1, 2, var(0)) + 3":   BytecodeInt(5),
+		"-(1 || var(0))":           BytecodeInt(-1),
+		"cond(0, var(0), 4) * 2":   BytecodeInt(8),
+		"cond(1, 2.5, var(0)) * 2": BytecodeFloat(5),
+		"cond(1, 300, var(0)) + 1": BytecodeInt(301),
+		"stateowner, 5":            BytecodeInt(5),
+	} {
+		var want BytecodeExp
+		want.appendValue(v)
+		if got := optCompile(t, expr).optimize(); string(got) != string(want) {
+			t.Errorf("%v: got %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestOptimizeDeadBranches(t *testing.T) {
+	for _, expr := range []string{
+		"0 && var(0)",
+		"1 || var(0)",
+		"cond(1, var(0), var(1))",
+		"cond(0, var(0), var(1))",
+		"!(2 > 1) || var(1)",
+	} {
+		be := optCompile(t, expr)
+		opt := be.optimize()
+		if len(opt) >= len(be) {
+			t.Errorf("%v: not shortened: %v", expr, opt)
+		}
+		for _, in := range optDecodeTest(t, opt) {
+			if optJump(in.op) {
+				t.Errorf("%v: jump left: %v", expr, opt)
+				break
+			}
+		}
+	}
+}
+
+func TestOptimizeThreadedJumps(t *testing.T) {
+	// The jump of the first && goes straight past the || instead of through
+	// the jump of the second &&
+	code := optDecodeTest(t, optCompile(t, "var(0) && var(1) && var(2) || var(3)").optimize())
+	for i, in := range code {
+		if optCondJump(in.op) && in.target >= 0 && in.target < len(code) &&
+			optJump(code[in.target].op) {
+			t.Errorf("jump %v lands on jump %v", i, in.target)
+		}
+	}
+	// Threading makes the first jump too far for an 8-bit offset
+	for _, in := range optDecodeTest(t, optCompile(t, optWideExpr)) {
+		if in.wide {
+			t.Fatalf("the compiled expression already has a 32-bit jump")
+		}
+	}
+	wide := false
+	for _, in := range optDecodeTest(t, optCompile(t, optWideExpr).optimize()) {
+		wide = wide || in.wide && optCondJump(in.op)
+	}
+	if !wide {
+		t.Errorf("no jump widened to a 32-bit offset")
+	}
+}
+
+func TestOptimizeRedirections(t *testing.T) {
+	for expr, kept := range map[string]bool{
+		"stateowner, 5":      false,
+		"stateowner, var(0)": true,
+		// The root does not exist for a root, so it must stay to give SFalse
+		"root, 5": true,
+	} {
+		found := false
+		for _, in := range optDecodeTest(t, optCompile(t, expr).optimize()) {
+			found = found || optRedirect(in.op)
+		}
+		if found != kept {
+			t.Errorf("%v: redirection kept: %v, want %v", expr, found, kept)
+		}
+	}
+}
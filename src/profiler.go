@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Frames between refreshes of the overlay
+const profilerRefresh = 60
+
+// Time spent running the states of the chars, by player, state and state
+// controller type, collected while it is enabled with toggleProfiler. Each
+// entry is timed without the entries run inside of it, such as the state
+// entered by a ChangeState, so that their times add up to the time spent in
+// the states. The evaluation of the triggers of the blocks is counted as a
+// controller of its own.
+type stateProfiler struct {
+	enabled bool
+	start   time.Time
+	frames  int32
+	states  map[profStateKey]*profStat
+	ctrls   map[profCtrlKey]*profStat
+	// Entries being timed, innermost last
+	stack []profFrame
+	// State being run
+	state profStateKey
+	lines []string
+}
+
+type profStateKey struct {
+	playerNo int
+	// Player whose state it is, which differs from playerNo in custom states
+	owner int
+	no    int32
+}
+
+type profCtrlKey struct {
+	state profStateKey
+	// Type of the state controller, nil for the triggers
+	typ reflect.Type
+}
+
+type profStat struct {
+	calls int64
+	// Time without and with the entries run inside of it
+	self, total time.Duration
+}
+
+type profFrame struct {
+	start time.Time
+	child time.Duration
+}
+
+func (p *stateProfiler) toggle() {
+	p.enabled = !p.enabled
+	if p.enabled {
+		p.start, p.frames, p.lines = time.Now(), 0, nil
+		p.states = make(map[profStateKey]*profStat)
+		p.ctrls = make(map[profCtrlKey]*profStat)
+	}
+}
+
+// Called at the start of every frame in which the chars run their states.
+func (p *stateProfiler) frame() {
+	if !p.enabled {
+		return
+	}
+	// Entries left open by a panic in a state are dropped
+	p.stack = p.stack[:0]
+	if p.frames%profilerRefresh == 0 {
+		p.lines = nil
+	}
+	p.frames++
+}
+func (p *stateProfiler) begin() {
+	p.stack = append(p.stack, profFrame{start: time.Now()})
+}
+func (p *stateProfiler) end(stat *profStat) {
+	if len(p.stack) == 0 {
+		return
+	}
+	f := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	d := time.Since(f.start)
+	if len(p.stack) > 0 {
+		p.stack[len(p.stack)-1].child += d
+	}
+	stat.calls++
+	stat.self += d - f.child
+	stat.total += d
+}
+func (p *stateProfiler) stateStat(k profStateKey) *profStat {
+	s, ok := p.states[k]
+	if !ok {
+		s = &profStat{}
+		p.states[k] = s
+	}
+	return s
+}
+func (p *stateProfiler) ctrlStat(k profCtrlKey) *profStat {
+	s, ok := p.ctrls[k]
+	if !ok {
+		s = &profStat{}
+		p.ctrls[k] = s
+	}
+	return s
+}
+
+// Starts timing the state and returns the state that was being run, to be
+// given to endState.
+func (p *stateProfiler) beginState(k profStateKey) profStateKey {
+	prev := p.state
+	p.state = k
+	p.begin()
+	return prev
+}
+func (p *stateProfiler) endState(prev profStateKey) {
+	p.end(p.stateStat(p.state))
+	p.state = prev
+}
+
+// Runs the state controller, timing it if the profiler is enabled. Blocks
+// are not timed, their controllers are.
+func (p *stateProfiler) runController(sc StateController, c *Char, ps []int32) bool {
+	if !p.enabled {
+		return sc.Run(c, ps)
+	}
+	return p.timeController(sc, c, ps)
+}
+func (p *stateProfiler) timeController(sc StateController, c *Char, ps []int32) bool {
+	if _, ok := sc.(StateBlock); ok {
+		return sc.Run(c, ps)
+	}
+	p.begin()
+	cs := sc.Run(c, ps)
+	p.end(p.ctrlStat(profCtrlKey{p.state, reflect.TypeOf(sc)}))
+	return cs
+}
+func (p *stateProfiler) evalTrigger(be BytecodeExp, c *Char) bool {
+	if !p.enabled {
+		return be.evalB(c)
+	}
+	p.begin()
+	b := be.evalB(c)
+	p.end(p.ctrlStat(profCtrlKey{state: p.state}))
+	return b
+}
+
+func profPlayerName(pn int) string {
+	if pn >= 0 && pn < len(sys.chars) && len(sys.chars[pn]) > 0 {
+		return fmt.Sprintf("P%v %v", pn+1, sys.chars[pn][0].name)
+	}
+	return fmt.Sprintf("P%v", pn+1)
+}
+func (k profStateKey) String() string {
+	if k.owner != k.playerNo {
+		return fmt.Sprintf("P%v state %v of P%v", k.playerNo+1, k.no, k.owner+1)
+	}
+	return fmt.Sprintf("P%v state %v", k.playerNo+1, k.no)
+}
+func (k profCtrlKey) name() string {
+	if k.typ == nil {
+		return "triggers"
+	}
+	return k.typ.Name()
+}
+
+type profTotal struct {
+	name  string
+	calls int64
+	time  time.Duration
+}
+
+// Self times summed by player, state and controller type, the largest first
+func (p *stateProfiler) totals() (players, states, ctrls []profTotal) {
+	sum := func(m map[string]*profTotal, name string, s *profStat) {
+		t, ok := m[name]
+		if !ok {
+			t = &profTotal{name: name}
+			m[name] = t
+		}
+		t.calls += s.calls
+		t.time += s.self
+	}
+	pm, sm, cm := make(map[string]*profTotal), make(map[string]*profTotal),
+		make(map[string]*profTotal)
+	for k, s := range p.states {
+		sum(pm, profPlayerName(k.playerNo), &profStat{self: s.self})
+		sum(sm, k.String(), &profStat{calls: s.calls, self: s.self})
+	}
+	for k, s := range p.ctrls {
+		sum(pm, profPlayerName(k.state.playerNo), &profStat{self: s.self})
+		sum(sm, k.state.String(), &profStat{self: s.self})
+		sum(cm, k.name(), s)
+	}
+	sorted := func(m map[string]*profTotal) (ts []profTotal) {
+		for _, t := range m {
+			ts = append(ts, *t)
+		}
+		sort.Slice(ts, func(i, j int) bool {
+			if ts[i].time != ts[j].time {
+				return ts[i].time > ts[j].time
+			}
+			return ts[i].name < ts[j].name
+		})
+		return
+	}
+	return sorted(pm), sorted(sm), sorted(cm)
+}
+
+// Lines of the overlay, with the times averaged over the frames
+func (p *stateProfiler) overlay() []string {
+	if p.lines != nil {
+		return p.lines
+	}
+	frames := float64(Max(p.frames, 1))
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond)/frames)
+	}
+	players, states, ctrls := p.totals()
+	var total time.Duration
+	for _, t := range players {
+		total += t.time
+	}
+	p.lines = []string{fmt.Sprintf("Profiler: %v frames, %v per frame", p.frames, ms(total))}
+	for _, t := range players {
+		p.lines = append(p.lines, fmt.Sprintf("%v %v", t.name, ms(t.time)))
+	}
+	for i, t := range states {
+		if i == 5 {
+			break
+		}
+		p.lines = append(p.lines, fmt.Sprintf("%v %v, %.1f runs", t.name, ms(t.time),
+			float64(t.calls)/frames))
+	}
+	for i, t := range ctrls {
+		if i == 5 {
+			break
+		}
+		p.lines = append(p.lines, fmt.Sprintf("%v %v, %.1f runs", t.name, ms(t.time),
+			float64(t.calls)/frames))
+	}
+	return p.lines
+}
+
+// Writes what has been collected to filename, in the pprof format if its
+// extension is .pb.gz or .pprof and as CSV otherwise.
+func (p *stateProfiler) export(filename string) error {
+	if p.states == nil {
+		return Error("No profile has been collected")
+	}
+	var b []byte
+	if strings.HasSuffix(filename, ".pb.gz") || strings.HasSuffix(filename, ".pprof") {
+		var err error
+		if b, err = p.pprof(); err != nil {
+			return err
+		}
+	} else {
+		b = p.csv()
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b, 0644)
+}
+
+// One row per state, with an empty controller, and per controller type in
+// each state. Times are in nanoseconds.
+func (p *stateProfiler) csv() []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"player", "name", "stateowner", "state", "controller", "calls",
+		"self_ns", "total_ns", "frames"})
+	row := func(k profStateKey, ctrl string, s *profStat) {
+		name := ""
+		if k.playerNo < len(sys.chars) && len(sys.chars[k.playerNo]) > 0 {
+			name = sys.chars[k.playerNo][0].name
+		}
+		w.Write([]string{fmt.Sprint(k.playerNo + 1), name, fmt.Sprint(k.owner + 1),
+			fmt.Sprint(k.no), ctrl, fmt.Sprint(s.calls), fmt.Sprint(int64(s.self)),
+			fmt.Sprint(int64(s.total)), fmt.Sprint(p.frames)})
+	}
+	states := make([]profStateKey, 0, len(p.states))
+	for k := range p.states {
+		states = append(states, k)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		a, b := states[i], states[j]
+		if a.playerNo != b.playerNo {
+			return a.playerNo < b.playerNo
+		} else if a.owner != b.owner {
+			return a.owner < b.owner
+		}
+		return a.no < b.no
+	})
+	ctrls := make(map[profStateKey][]profCtrlKey)
+	for k := range p.ctrls {
+		ctrls[k.state] = append(ctrls[k.state], k)
+	}
+	for _, k := range states {
+		row(k, "", p.states[k])
+		cs := ctrls[k]
+		sort.Slice(cs, func(i, j int) bool { return cs[i].name() < cs[j].name() })
+		for _, ck := range cs {
+			row(k, ck.name(), p.ctrls[ck])
+		}
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// Protocol buffer encoder for the few messages of the pprof format needed
+type protoBuf []byte
+
+func (b *protoBuf) varint(x uint64) {
+	for x >= 0x80 {
+		*b = append(*b, byte(x)|0x80)
+		x >>= 7
+	}
+	*b = append(*b, byte(x))
+}
+func (b *protoBuf) uint(field int, x uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+func (b *protoBuf) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+func (b *protoBuf) packed(field int, xs []uint64) {
+	var p protoBuf
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.bytes(field, p)
+}
+
+// Encodes the profile for the pprof tool, with stacks going from the player
+// to the state and to the controller type, and the number of runs and self
+// time as values.
+func (p *stateProfiler) pprof() ([]byte, error) {
+	var prof protoBuf
+	strs := map[string]uint64{"": 0}
+	strList := []string{""}
+	str := func(s string) uint64 {
+		i, ok := strs[s]
+		if !ok {
+			i = uint64(len(strList))
+			strs[s] = i
+			strList = append(strList, s)
+		}
+		return i
+	}
+	valueType := func(field int, typ, unit string) {
+		var vt protoBuf
+		vt.uint(1, str(typ))
+		vt.uint(2, str(unit))
+		prof.bytes(field, vt)
+	}
+	valueType(1, "runs", "count")
+	valueType(1, "time", "nanoseconds")
+	// A location and a function for each name
+	locs := make(map[string]uint64)
+	var funcs protoBuf
+	loc := func(name, file string) uint64 {
+		id, ok := locs[name]
+		if !ok {
+			id = uint64(len(locs) + 1)
+			locs[name] = id
+			var fn, line, l protoBuf
+			fn.uint(1, id)
+			fn.uint(2, str(name))
+			fn.uint(3, str(name))
+			fn.uint(4, str(file))
+			funcs.bytes(5, fn)
+			line.uint(1, id)
+			l.uint(1, id)
+			l.bytes(4, line)
+			funcs.bytes(4, l)
+		}
+		return id
+	}
+	sample := func(stack []uint64, s *profStat) {
+		var sm protoBuf
+		sm.packed(1, stack)
+		sm.packed(2, []uint64{uint64(s.calls), uint64(s.self)})
+		prof.bytes(2, sm)
+	}
+	stateLocs := func(k profStateKey) []uint64 {
+		var file string
+		if k.owner < len(sys.cgi) {
+			file = sys.cgi[k.owner].def
+		}
+		return []uint64{loc(k.String(), file), loc(profPlayerName(k.playerNo), "")}
+	}
+	for k, s := range p.states {
+		sample(stateLocs(k), s)
+	}
+	for k, s := range p.ctrls {
+		sample(append([]uint64{loc(k.name(), "")}, stateLocs(k.state)...), s)
+	}
+	prof = append(prof, funcs...)
+	for _, s := range strList {
+		prof.bytes(6, []byte(s))
+	}
+	prof.uint(9, uint64(p.start.UnixNano()))
+	prof.uint(10, uint64(time.Since(p.start)))
+	valueType(11, "time", "nanoseconds")
+	prof.uint(12, 1)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(prof); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const regressionTestFile = "test.json"
+
+// Rows of checked values shown before a failing check
+const regressionHistory = 10
+
+// A test case directory holds a test.json file of this form. The match
+// setup is read from the replay header, or from the other fields for a
+// replay without one. The replay path, and the char and stage paths of a
+// replay without a header, are searched for in the test case directory
+// first; a replay header keeps the paths it was recorded with. Every case
+// starts with an empty char and stage list. For example:
+//
+//	{"Replay": "match.replay", "Winner": 1,
+//	 "Checks": [{"Frame": 240, "Player": 2, "Life": 820, "StateNo": 5000}]}
+//
+// Frames are counted from the start of the match, like replayFrame().
+type regressionTest struct {
+	Replay    string
+	Chars     [2][]string
+	Pals      [2][]int
+	Stage     string
+	TeamMode  [2]TeamMode
+	Rounds    int32
+	RoundTime int32
+	Winner    *int32
+	Checks    []regressionCheck
+	// Maximum difference allowed for floating point values
+	Tolerance float32
+}
+
+// Values expected for a player at the start of a frame of the match. Only
+// the values that are set are checked.
+type regressionCheck struct {
+	Frame     int32
+	Player    int
+	Life      *int32
+	Power     *int32
+	StateNo   *int32
+	AnimNo    *int32
+	Ctrl      *bool
+	StateType *string
+	MoveType  *string
+	PosX      *float32
+	PosY      *float32
+	VelX      *float32
+	VelY      *float32
+}
+
+type regressionValue struct {
+	name     string
+	expected interface{}
+	actual   func(c *Char) interface{}
+}
+
+// Returns the values set in the check, in a fixed order.
+func (rc *regressionCheck) values() (vs []regressionValue) {
+	add := func(name string, expected interface{}, isSet bool, actual func(c *Char) interface{}) {
+		if isSet {
+			vs = append(vs, regressionValue{name, expected, actual})
+		}
+	}
+	add("life", rc.Life, rc.Life != nil, func(c *Char) interface{} { return c.life })
+	add("power", rc.Power, rc.Power != nil, func(c *Char) interface{} { return c.power })
+	add("stateno", rc.StateNo, rc.StateNo != nil, func(c *Char) interface{} { return c.ss.no })
+	add("anim", rc.AnimNo, rc.AnimNo != nil, func(c *Char) interface{} { return c.animNo })
+	add("ctrl", rc.Ctrl, rc.Ctrl != nil, func(c *Char) interface{} { return c.ctrl() })
+	add("statetype", rc.StateType, rc.StateType != nil, func(c *Char) interface{} {
+		return stateTypeString(c.ss.stateType)
+	})
+	add("movetype", rc.MoveType, rc.MoveType != nil, func(c *Char) interface{} {
+		return moveTypeString(c.ss.moveType)
+	})
+	add("pos x", rc.PosX, rc.PosX != nil, func(c *Char) interface{} { return c.pos[0] })
+	add("pos y", rc.PosY, rc.PosY != nil, func(c *Char) interface{} { return c.pos[1] })
+	add("vel x", rc.VelX, rc.VelX != nil, func(c *Char) interface{} { return c.vel[0] })
+	add("vel y", rc.VelY, rc.VelY != nil, func(c *Char) interface{} { return c.vel[1] })
+	return
+}
+
+func stateTypeString(st StateType) string {
+	switch st {
+	case ST_S:
+		return "S"
+	case ST_C:
+		return "C"
+	case ST_A:
+		return "A"
+	case ST_L:
+		return "L"
+	case ST_N:
+		return "N"
+	}
+	return "U"
+}
+func moveTypeString(mt MoveType) string {
+	switch mt {
+	case MT_I:
+		return "I"
+	case MT_H:
+		return "H"
+	case MT_A:
+		return "A"
+	}
+	return "U"
+}
+
+// Compares the expected value, a pointer from regressionCheck, with the
+// actual one.
+func (rt *regressionTest) matches(expected, actual interface{}) bool {
+	switch e := expected.(type) {
+	case *float32:
+		return AbsF(*e-actual.(float32)) <= rt.Tolerance
+	case *string:
+		return strings.EqualFold(*e, actual.(string))
+	case *int32:
+		return *e == actual.(int32)
+	case *bool:
+		return *e == actual.(bool)
+	}
+	return false
+}
+func regressionFormat(v interface{}) string {
+	switch v := v.(type) {
+	case *float32:
+		return fmt.Sprint(*v)
+	case *string:
+		return *v
+	case *int32:
+		return fmt.Sprint(*v)
+	case *bool:
+		return fmt.Sprint(*v)
+	}
+	return fmt.Sprint(v)
+}
+
+// Records the checked values every frame and reports the failed checks.
+type regressionRun struct {
+	test     *regressionTest
+	checks   map[int32][]*regressionCheck
+	history  map[int][]regressionRow
+	failures []string
+}
+
+type regressionRow struct {
+	frame  int32
+	values []interface{}
+}
+
+func newRegressionRun(rt *regressionTest) *regressionRun {
+	rr := &regressionRun{test: rt, checks: make(map[int32][]*regressionCheck),
+		history: make(map[int][]regressionRow)}
+	for i := range rt.Checks {
+		rc := &rt.Checks[i]
+		rr.checks[rc.Frame] = append(rr.checks[rc.Frame], rc)
+	}
+	return rr
+}
+
+// Every value a check can look at, all of which are kept in the history
+var regressionAllValues = (&regressionCheck{Life: new(int32), Power: new(int32),
+	StateNo: new(int32), AnimNo: new(int32), Ctrl: new(bool), StateType: new(string),
+	MoveType: new(string), PosX: new(float32), PosY: new(float32), VelX: new(float32),
+	VelY: new(float32)}).values()
+
+// Called with the state at the start of every frame of the match.
+func (rr *regressionRun) frame(frame int32) {
+	players := make(map[int]bool)
+	for _, rc := range rr.test.Checks {
+		players[rc.Player] = true
+	}
+	for pn := range players {
+		c := regressionChar(pn)
+		if c == nil {
+			continue
+		}
+		row := regressionRow{frame: frame}
+		for _, v := range regressionAllValues {
+			row.values = append(row.values, v.actual(c))
+		}
+		h := append(rr.history[pn], row)
+		if len(h) > regressionHistory {
+			h = h[1:]
+		}
+		rr.history[pn] = h
+	}
+	for _, rc := range rr.checks[frame] {
+		rr.check(rc)
+	}
+	delete(rr.checks, frame)
+}
+func regressionChar(pn int) *Char {
+	if pn < 1 || pn > len(sys.chars) || len(sys.chars[pn-1]) == 0 {
+		return nil
+	}
+	return sys.chars[pn-1][0]
+}
+func (rr *regressionRun) check(rc *regressionCheck) {
+	c := regressionChar(rc.Player)
+	if c == nil {
+		rr.failures = append(rr.failures, fmt.Sprintf("frame %v: P%v does not exist", rc.Frame, rc.Player))
+		return
+	}
+	var diffs []string
+	failed := make(map[string]bool)
+	for _, v := range rc.values() {
+		if actual := v.actual(c); !rr.test.matches(v.expected, actual) {
+			diffs = append(diffs, fmt.Sprintf("%v: expected %v, got %v",
+				v.name, regressionFormat(v.expected), actual))
+			failed[v.name] = true
+		}
+	}
+	if len(diffs) == 0 {
+		return
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "frame %v P%v %v\n", rc.Frame, rc.Player, strings.Join(diffs, ", "))
+	// Values of the preceding frames, to show how the char got there
+	all := regressionAllValues
+	fmt.Fprintf(&sb, "    %8v", "frame")
+	for _, v := range all {
+		if failed[v.name] {
+			fmt.Fprintf(&sb, " %12v", v.name)
+		}
+	}
+	sb.WriteString("\n")
+	for _, row := range rr.history[rc.Player] {
+		fmt.Fprintf(&sb, "    %8v", row.frame)
+		for i, v := range all {
+			if failed[v.name] {
+				fmt.Fprintf(&sb, " %12v", row.values[i])
+			}
+		}
+		sb.WriteString("\n")
+	}
+	fmt.Fprintf(&sb, "    %8v", "expected")
+	for _, v := range rc.values() {
+		if failed[v.name] {
+			fmt.Fprintf(&sb, " %12v", regressionFormat(v.expected))
+		}
+	}
+	rr.failures = append(rr.failures, sb.String())
+}
+
+// Drops the chars and stages of the previous case, so that the results do
+// not depend on the order the cases are run in.
+func regressionReset() {
+	sys.sel.ClearSelected()
+	sys.sel.charlist, sys.sel.stagelist = nil, nil
+	sys.sel.cdefOverwrite, sys.sel.sdefOverwrite = make(map[int]string), ""
+	for i := range sys.chars {
+		// Makes loadChar load the char again instead of reusing it
+		sys.chars[i], sys.cgi[i].states, sys.cgi[i].def = nil, nil, ""
+		sys.cgi[i].sff, sys.cgi[i].wakewakaLength = nil, 0
+	}
+	sys.charList.clear()
+}
+
+// Runs the test case in dir, returning the failed checks.
+func runRegressionTest(dir string) ([]string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, regressionTestFile))
+	if err != nil {
+		return nil, err
+	}
+	rt := &regressionTest{Tolerance: 0.001}
+	if err := json.Unmarshal(b, rt); err != nil {
+		return nil, Error(fmt.Sprintf("%v: %v", regressionTestFile, err))
+	}
+	if rt.Replay == "" {
+		return nil, Error(fmt.Sprintf("%v: no replay", regressionTestFile))
+	}
+	local := func(path string) string {
+		if p := filepath.Join(dir, path); path != "" && FileExist(p) != "" {
+			return p
+		}
+		return path
+	}
+	hm := &HeadlessMatch{Pals: rt.Pals, TeamMode: rt.TeamMode, Stage: local(rt.Stage),
+		Rounds: rt.Rounds, RoundTime: rt.RoundTime}
+	for tn, chars := range rt.Chars {
+		for _, c := range chars {
+			hm.Chars[tn] = append(hm.Chars[tn], local(c))
+		}
+	}
+	replay := local(rt.Replay)
+	fi, err := OpenFileInput(replay)
+	fi.Close()
+	if err != nil {
+		return nil, err
+	}
+	if fi.header != nil {
+		hm.Replay = replay
+	} else {
+		hm.Input = replay
+	}
+	regressionReset()
+	rr := newRegressionRun(rt)
+	hm.OnFrame = rr.frame
+	res, err := runHeadless(hm)
+	if err != nil {
+		return nil, err
+	}
+	var missed []int32
+	for f := range rr.checks {
+		missed = append(missed, f)
+	}
+	sort.Slice(missed, func(i, j int) bool { return missed[i] < missed[j] })
+	for _, f := range missed {
+		rr.failures = append(rr.failures,
+			fmt.Sprintf("frame %v: not reached, the match lasted %v frames", f, res.Frames))
+	}
+	if rt.Winner != nil && *rt.Winner != res.Winner {
+		rr.failures = append(rr.failures,
+			fmt.Sprintf("winner: expected %v, got %v", *rt.Winner, res.Winner))
+	}
+	return rr.failures, nil
+}
+
+// Runs the test case in dir, or every test case in its subdirectories, and
+// returns the exit code of the process: 0 if all passed, 1 if some failed
+// and 2 if some could not be run.
+func regressionMain(dir string) int {
+	var dirs []string
+	if FileExist(filepath.Join(dir, regressionTestFile)) != "" {
+		dirs = append(dirs, dir)
+	} else {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		for _, e := range entries {
+			d := filepath.Join(dir, e.Name())
+			if e.IsDir() && FileExist(filepath.Join(d, regressionTestFile)) != "" {
+				dirs = append(dirs, d)
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		fmt.Fprintf(os.Stderr, "No %v found in %v\n", regressionTestFile, dir)
+		return 2
+	}
+	var passed, failed, errors int
+	for _, d := range dirs {
+		failures, err := runRegressionTest(d)
+		switch {
+		case err != nil:
+			errors++
+			fmt.Printf("ERROR %v: %v\n", d, err)
+		case len(failures) > 0:
+			failed++
+			fmt.Printf("FAIL  %v\n", d)
+			for _, f := range failures {
+				fmt.Printf("  %v\n", strings.TrimRight(f, "\n"))
+			}
+		default:
+			passed++
+			fmt.Printf("PASS  %v\n", d)
+		}
+	}
+	fmt.Printf("%v passed, %v failed, %v errors\n", passed, failed, errors)
+	if errors > 0 {
+		return 2
+	} else if failed > 0 {
+		return 1
+	}
+	return 0
+}
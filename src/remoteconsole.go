@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Messages buffered for a client before it is considered stuck and dropped
+const remoteConsoleBuffer = 1024
+
+// Commands queued for the next frame of the match, shared with the terminal
+const consoleCommandQueue = 64
+
+// Where the token is written when it is not given with -remoteconsoletoken
+const remoteConsoleTokenFile = "save/remoteconsole.token"
+
+// A Lua command typed in the terminal or sent by a remote console client.
+// The results of the commands of a client are sent back to it.
+type consoleCommand struct {
+	id     json.RawMessage
+	text   string
+	client *consoleClient
+}
+
+// Everything the remote console sends is one of these, as a line of JSON:
+//
+//	{"type": "ready"}
+//	{"type": "result", "id": 1, "values": [1000]}
+//	{"type": "error", "id": 1, "message": "..."}
+//	{"type": "console", "text": "..."}
+//	{"type": "event", "event": "roundEnd", "data": {"round": 1, "winner": 1, "finish": "KO"}}
+type consoleMessage struct {
+	Type    string          `json:"type"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Values  []interface{}   `json:"values,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Text    string          `json:"text,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Data    interface{}     `json:"data,omitempty"`
+}
+
+// Accepts Lua commands on a localhost TCP port or a Unix socket, to let
+// tools drive the engine. As the commands can do anything Lua can, the first
+// line a client sends must be the token, which is only known to whoever
+// started the engine or can read remoteConsoleTokenFile, so that other
+// programs, such as web pages posting to localhost, cannot run commands.
+// The client is then sent a ready message. Afterwards clients send a command
+// per line, either as is or as {"id": 1, "command": "..."} to tell its
+// results apart. Commands are run between frames of a match, like the ones
+// typed in the terminal, and are refused with an error outside of a match.
+// Clients also receive the lines of the debug console and match events.
+type remoteConsole struct {
+	ln    net.Listener
+	path  string
+	token string
+	mu    sync.Mutex
+	// Clients and the messages waiting to be sent to them
+	clients map[*consoleClient]bool
+}
+
+type consoleClient struct {
+	conn net.Conn
+	out  chan []byte
+}
+
+// Listens on addr, which is a port or host:port on the loopback interface,
+// or unix:path for a Unix socket. If token is empty, a random one is written
+// to remoteConsoleTokenFile.
+func newRemoteConsole(addr, token string) (*remoteConsole, error) {
+	rc := &remoteConsole{token: token, clients: make(map[*consoleClient]bool)}
+	if rc.token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		rc.token = hex.EncodeToString(b)
+		if err := os.WriteFile(remoteConsoleTokenFile, []byte(rc.token+"\n"), 0600); err != nil {
+			return nil, err
+		}
+	}
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", addr[len("unix:"):]
+		// Socket left behind by a previous run
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+		rc.path = addr
+	} else {
+		if !strings.Contains(addr, ":") {
+			addr = "127.0.0.1:" + addr
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, Error("The remote console only listens on localhost: " + addr)
+		}
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	rc.ln = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go rc.serve(conn)
+		}
+	}()
+	return rc, nil
+}
+func (rc *remoteConsole) close() {
+	if rc == nil {
+		return
+	}
+	rc.ln.Close()
+	rc.mu.Lock()
+	for cl := range rc.clients {
+		rc.drop(cl)
+	}
+	rc.mu.Unlock()
+	if rc.path != "" {
+		os.Remove(rc.path)
+	}
+}
+func (rc *remoteConsole) serve(conn net.Conn) {
+	sc := bufio.NewScanner(conn)
+	if !sc.Scan() {
+		conn.Close()
+		return
+	}
+	if line := strings.TrimSpace(sc.Text()); subtle.ConstantTimeCompare([]byte(line),
+		[]byte(rc.token)) != 1 {
+		msg := "Invalid token"
+		// Most likely a browser sending a request to localhost
+		if strings.Contains(line, " HTTP/") {
+			msg = "Not an HTTP server"
+		}
+		b, _ := json.Marshal(consoleMessage{Type: "error", Message: msg})
+		conn.Write(append(b, '\n'))
+		conn.Close()
+		return
+	}
+	cl := &consoleClient{conn: conn, out: make(chan []byte, remoteConsoleBuffer)}
+	rc.mu.Lock()
+	rc.clients[cl] = true
+	rc.mu.Unlock()
+	go func() {
+		for b := range cl.out {
+			if _, err := conn.Write(b); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+	rc.send(cl, consoleMessage{Type: "ready"})
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		cmd := &consoleCommand{text: line, client: cl}
+		// A Lua statement cannot start with a brace
+		if line[0] == '{' {
+			var req struct {
+				ID      json.RawMessage
+				Command string
+			}
+			if err := json.Unmarshal([]byte(line), &req); err != nil {
+				rc.send(cl, consoleMessage{Type: "error", Message: err.Error()})
+				continue
+			}
+			cmd.id, cmd.text = req.ID, req.Command
+		}
+		if !sys.fighting.Load() {
+			rc.send(cl, consoleMessage{Type: "error", ID: cmd.id, Message: "not in a match"})
+			continue
+		}
+		select {
+		case sys.commandLine <- cmd:
+		default:
+			rc.send(cl, consoleMessage{Type: "error", ID: cmd.id, Message: "too many queued commands"})
+		}
+	}
+	rc.mu.Lock()
+	if rc.clients[cl] {
+		rc.drop(cl)
+	}
+	rc.mu.Unlock()
+}
+
+// Must be called with mu locked.
+func (rc *remoteConsole) drop(cl *consoleClient) {
+	delete(rc.clients, cl)
+	close(cl.out)
+	cl.conn.Close()
+}
+
+// Queues the message for the client, dropping the client if it does not
+// read what it is sent.
+func (rc *remoteConsole) send(cl *consoleClient, msg consoleMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		b, _ = json.Marshal(consoleMessage{Type: "error", ID: msg.ID, Message: err.Error()})
+	}
+	b = append(b, '\n')
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if !rc.clients[cl] {
+		return
+	}
+	select {
+	case cl.out <- b:
+	default:
+		rc.drop(cl)
+	}
+}
+func (rc *remoteConsole) broadcast(msg consoleMessage) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	clients := make([]*consoleClient, 0, len(rc.clients))
+	for cl := range rc.clients {
+		clients = append(clients, cl)
+	}
+	rc.mu.Unlock()
+	for _, cl := range clients {
+		rc.send(cl, msg)
+	}
+}
+
+// Sends a line of the debug console to the clients.
+func (rc *remoteConsole) console(text string) {
+	rc.broadcast(consoleMessage{Type: "console", Text: text})
+}
+
+// Sends a match event to the clients.
+func (rc *remoteConsole) event(name string, data map[string]interface{}) {
+	rc.broadcast(consoleMessage{Type: "event", Event: name, Data: data})
+}
+
+// Runs the command. The values of an expression are sent back to the client,
+// as in the interactive Lua interpreter.
+func (cmd *consoleCommand) run(l *lua.LState) {
+	if cmd.client == nil {
+		if err := l.DoString(cmd.text); err != nil {
+			sys.errLog.Println(err.Error())
+		}
+		return
+	}
+	top := l.GetTop()
+	fn, err := l.LoadString("return " + cmd.text)
+	if err != nil {
+		fn, err = l.LoadString(cmd.text)
+	}
+	if err == nil {
+		l.Push(fn)
+		err = l.PCall(0, lua.MultRet, nil)
+	}
+	if err != nil {
+		l.SetTop(top)
+		sys.remoteConsole.send(cmd.client, consoleMessage{Type: "error", ID: cmd.id,
+			Message: err.Error()})
+		return
+	}
+	values := make([]interface{}, 0, l.GetTop()-top)
+	for i := top + 1; i <= l.GetTop(); i++ {
+		values = append(values, luaToJSON(l.Get(i), 0))
+	}
+	l.SetTop(top)
+	sys.remoteConsole.send(cmd.client, consoleMessage{Type: "result", ID: cmd.id, Values: values})
+}
+
+// Converts a Lua value to one that can be encoded as JSON. Tables nested too
+// deep, functions and the like are given as strings.
+func luaToJSON(v lua.LValue, depth int) interface{} {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		if f := float64(v); !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f
+		}
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if depth >= 8 {
+			break
+		}
+		count := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { count++ })
+		if n := v.MaxN(); n > 0 && n == count {
+			arr := make([]interface{}, n)
+			for i := range arr {
+				arr[i] = luaToJSON(v.RawGetInt(i+1), depth+1)
+			}
+			return arr
+		}
+		m := make(map[string]interface{})
+		v.ForEach(func(k, e lua.LValue) {
+			m[k.String()] = luaToJSON(e, depth+1)
+		})
+		return m
+	}
+	return v.String()
+}
@@ -125,6 +125,10 @@ type Texture struct {
 
 // Generate a new texture name
 func newTexture(width, height, depth int32, filter bool) (t *Texture) {
+	// There is no GL context in headless mode
+	if sys.headless {
+		return &Texture{width, height, depth, filter, gl.Texture{}}
+	}
 	t = &Texture{width, height, depth, filter, gl.CreateTexture()}
 	runtime.SetFinalizer(t, func(t *Texture) {
 		sys.mainThreadTask <- func() {
@@ -136,6 +140,9 @@ func newTexture(width, height, depth int32, filter bool) (t *Texture) {
 
 // Bind a texture and upload texel data to it
 func (t *Texture) SetData(data []byte) {
+	if sys.headless {
+		return
+	}
 	var interp int = gl.NEAREST
 	if t.filter {
 		interp = gl.LINEAR
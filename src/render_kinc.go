@@ -73,6 +73,9 @@ var TextureFormatLUT = map[int32]C.kinc_image_format_t{
 }
 
 func newTexture(width, height, depth int32, filter bool) (t *Texture) {
+	if sys.headless {
+		return &Texture{width, height, depth, filter, nil}
+	}
 	handle := (*C.kinc_g4_texture_t)(C.malloc(C.sizeof_kinc_g4_texture_t))
 	t = &Texture{width, height, depth, filter, handle}
 
@@ -90,6 +93,9 @@ func newTexture(width, height, depth int32, filter bool) (t *Texture) {
 }
 
 func (t *Texture) SetData(data []byte) {
+	if sys.headless {
+		return
+	}
 	pixels := C.kinc_g4_texture_lock(t.handle)
 	stride := C.kinc_g4_texture_stride(t.handle)
 	rowBytes := t.width * (t.depth / 8)
@@ -102,7 +108,7 @@ func (t *Texture) SetData(data []byte) {
 }
 
 func (t *Texture) IsValid() bool {
-	return true
+	return t.handle != nil
 }
 
 // ------------------------------------------------------------------
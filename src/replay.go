@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	replayMagic         = "IKEMENRP"
+	replayFormatVersion = 1
+)
+
+type ReplayFile struct {
+	Def  string
+	Hash string
+	Pal  int `json:",omitempty"`
+}
+
+// Header written at the start of every replay, followed by the input stream.
+// Netplay replays contain the whole session including the menus, so they
+// only record the settings and leave the match setup empty; the setup of
+// each match is written to the stream instead. Local replays record the
+// setup of the first match.
+type ReplayHeader struct {
+	Version      string
+	Netplay      bool
+	Chars        [2][]ReplayFile
+	Stage        ReplayFile
+	TeamMode     [2]TeamMode
+	NumSimul     [2]int32
+	NumTurns     [2]int32
+	MatchWins    [2]int32
+	RoundTime    int32
+	LifeMul      float32
+	Team1VS2Life float32
+	GameSpeed    float32
+	Com          [MaxSimul*2 + MaxAttachedChar]float32
+	InputRemap   [MaxSimul*2 + MaxAttachedChar]int
+	// Frames between the state checksums in the input stream, 0 if there are
+	// none
+	Checksums int32 `json:",omitempty"`
+	// Whether every synchronize in the stream starts with the chars, stage
+	// and rules of the match, as agreed on by the netplay peers
+	MatchSetups bool `json:",omitempty"`
+}
+
+func newReplayHeader(netplay bool) *ReplayHeader {
+	rh := &ReplayHeader{Version: Version, Netplay: netplay,
+		TeamMode: sys.tmode, NumSimul: sys.numSimul, NumTurns: sys.numTurns,
+		MatchWins: sys.lifebar.ro.match_wins, RoundTime: sys.roundTime,
+		LifeMul: sys.lifeMul, Team1VS2Life: sys.team1VS2Life,
+		GameSpeed: sys.gameSpeed, Com: sys.com, InputRemap: sys.inputRemap,
+		Checksums: desyncCheckInterval, MatchSetups: netplay}
+	if netplay {
+		return rh
+	}
+	for tn, sel := range sys.sel.selected {
+		for _, s := range sel {
+			def := sys.sel.GetChar(s[0]).def
+			rh.Chars[tn] = append(rh.Chars[tn],
+				ReplayFile{Def: filepath.ToSlash(def), Hash: replayHash(def), Pal: s[1]})
+		}
+	}
+	if sys.stage != nil {
+		rh.Stage = ReplayFile{Def: filepath.ToSlash(sys.stage.def),
+			Hash: replayHash(sys.stage.def)}
+	}
+	return rh
+}
+func (rh *ReplayHeader) write(w io.Writer) error {
+	data, err := json.Marshal(rh)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, replayMagic); err != nil {
+		return err
+	}
+	for _, v := range []uint32{replayFormatVersion, uint32(len(data))} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Reads the replay header. Replays written before headers were added have
+// none, in which case nil is returned and r is left at the start.
+func readReplayHeader(r io.ReadSeeker) (*ReplayHeader, error) {
+	magic := make([]byte, len(replayMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != replayMagic {
+		_, err := r.Seek(0, io.SeekStart)
+		return nil, err
+	}
+	var ver, size uint32
+	if err := binary.Read(r, binary.LittleEndian, &ver); err != nil {
+		return nil, err
+	}
+	if ver != replayFormatVersion {
+		return nil, Error(fmt.Sprintf("Unsupported replay format version: %v", ver))
+	}
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	rh := &ReplayHeader{}
+	if err := json.Unmarshal(data, rh); err != nil {
+		return nil, err
+	}
+	return rh, nil
+}
+
+// Hashes a def file together with every file it refers to.
+func replayHash(def string) string {
+	b, err := ReadFile(def)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	h.Write(b)
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		file := strings.Trim(strings.TrimSpace(kv[1]), "\"")
+		if file == "" {
+			continue
+		}
+		fp := FileExist(SearchFile(file, []string{def}))
+		if fp == "" || seen[fp] {
+			continue
+		}
+		seen[fp] = true
+		if b, err := ReadFile(fp); err == nil {
+			h.Write(b)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Applies the settings and match setup stored in the header. Returns an
+// error if a character or stage is missing or differs from the recorded one.
+func (rh *ReplayHeader) apply() error {
+	if rh.Version != Version {
+		sys.errLog.Printf("Replay was recorded with version %v, running %v\n", rh.Version, Version)
+		sys.appendToConsole(fmt.Sprintf("Warning: replay was recorded with version %v", rh.Version))
+	}
+	sameDef := func(a, b string) bool {
+		return strings.EqualFold(filepath.ToSlash(a), filepath.ToSlash(b))
+	}
+	check := func(rf ReplayFile, def string) error {
+		if rf.Hash != "" && replayHash(def) != rf.Hash {
+			return Error(fmt.Sprintf("%v differs from the one this replay was recorded with", rf.Def))
+		}
+		return nil
+	}
+	var selected [2][][2]int
+	for tn, chars := range rh.Chars {
+		for _, rf := range chars {
+			cn := -1
+			for i, c := range sys.sel.charlist {
+				if sameDef(c.def, rf.Def) {
+					cn = i
+					break
+				}
+			}
+			if cn < 0 {
+				return Error(fmt.Sprintf("Character not found: %v", rf.Def))
+			}
+			if err := check(rf, sys.sel.charlist[cn].def); err != nil {
+				return err
+			}
+			selected[tn] = append(selected[tn], [...]int{cn, rf.Pal})
+		}
+	}
+	sn := -1
+	if rh.Stage.Def != "" {
+		for i, s := range sys.sel.stagelist {
+			if sameDef(s.def, rh.Stage.Def) {
+				sn = i + 1
+				break
+			}
+		}
+		if sn < 0 {
+			return Error(fmt.Sprintf("Stage not found: %v", rh.Stage.Def))
+		}
+		if err := check(rh.Stage, sys.sel.stagelist[sn-1].def); err != nil {
+			return err
+		}
+	}
+
+	sys.lifeMul, sys.team1VS2Life = rh.LifeMul, rh.Team1VS2Life
+	sys.gameSpeed = rh.GameSpeed
+	sys.com, sys.inputRemap = rh.Com, rh.InputRemap
+	if rh.Netplay {
+		return nil
+	}
+	sys.roundTime = rh.RoundTime
+	sys.lifebar.ro.match_wins = rh.MatchWins
+	sys.tmode, sys.numSimul, sys.numTurns = rh.TeamMode, rh.NumSimul, rh.NumTurns
+	sys.sel.ClearSelected()
+	for tn, sel := range selected {
+		for _, s := range sel {
+			sys.sel.AddSelectedChar(tn, s[0], s[1])
+		}
+	}
+	sys.sel.SelectStage(sn)
+	return nil
+}
+
+// Frames between the checkpoints saved while playing back a replay
+const replayCheckpointInterval = 300
+
+type replayCheckpoint struct {
+	frame, round int32
+	segFrame     int32
+	roundStart   bool
+	offset       int64
+	ib           [MaxSimul*2 + MaxAttachedChar]InputBits
+	state        GameState
+}
+
+func (fi *FileInput) beginMatch() {
+	fi.match, fi.frame, fi.round = true, 0, 0
+	fi.checkpoints = nil
+	fi.stopSeek()
+}
+func (fi *FileInput) endMatch() {
+	fi.stopSeek()
+	fi.match, fi.checkpoints = false, nil
+}
+func (fi *FileInput) fps() int {
+	if fi.seeking() || fi.catchingUp() {
+		return FPS * 1000
+	}
+	speed := fi.speed
+	if sys.anyHardButton() {
+		speed *= 4
+	}
+	return int(Max(1, int32(float32(FPS)*speed)))
+}
+func (fi *FileInput) setSpeed(speed float32) {
+	fi.speed = ClampF(speed, 0.25, 8)
+}
+func (fi *FileInput) seeking() bool {
+	return fi.seekFrame >= 0 || fi.seekRound > 0
+}
+
+// Called after the input of each frame is read. Saves a checkpoint at the
+// start of every round and every replayCheckpointInterval frames, and ends
+// seeking once the target is reached.
+func (fi *FileInput) checkpoint() {
+	roundStart := sys.round != fi.round
+	fi.round = sys.round
+	var last *replayCheckpoint
+	if len(fi.checkpoints) > 0 {
+		last = fi.checkpoints[len(fi.checkpoints)-1]
+	}
+	if last == nil || fi.frame > last.frame &&
+		(roundStart || fi.frame-last.frame >= replayCheckpointInterval) {
+		cp := &replayCheckpoint{frame: fi.frame, round: sys.round,
+			segFrame: fi.segFrame, roundStart: roundStart, ib: fi.ib}
+		cp.offset, _ = fi.f.Seek(0, io.SeekCurrent)
+		sys.saveGameState(&cp.state)
+		fi.checkpoints = append(fi.checkpoints, cp)
+	}
+	if fi.seekFrame >= 0 && fi.frame >= fi.seekFrame ||
+		fi.seekRound > 0 && roundStart && sys.round >= fi.seekRound {
+		fi.stopSeek()
+	}
+}
+func (fi *FileInput) startSeek() {
+	if !fi.seeking() {
+		fi.seekPaused, sys.paused = sys.paused, false
+	}
+	sys.resimulating = true
+}
+func (fi *FileInput) stopSeek() {
+	if fi.seeking() {
+		sys.paused = fi.seekPaused
+		sys.resimulating = false
+	}
+	fi.seekFrame, fi.seekRound = -1, 0
+}
+func (fi *FileInput) rewind(cp *replayCheckpoint) error {
+	if _, err := fi.f.Seek(cp.offset, io.SeekStart); err != nil {
+		return err
+	}
+	sys.loadGameState(&cp.state)
+	fi.ib, fi.frame, fi.round = cp.ib, cp.frame, cp.round
+	fi.segFrame = cp.segFrame
+	return nil
+}
+func (fi *FileInput) canSeek() error {
+	if fi.f == nil || !fi.match || len(fi.checkpoints) == 0 {
+		return Error("No replay match in progress")
+	}
+	if sys.postMatchFlg {
+		return Error("Cannot seek after the match has ended")
+	}
+	return nil
+}
+
+// Seeks to the given frame of the current match. Seeking backwards restores
+// the closest checkpoint before the frame and plays forward from there.
+func (fi *FileInput) seek(frame int32) error {
+	if err := fi.canSeek(); err != nil {
+		return err
+	}
+	fi.stopSeek()
+	if frame < fi.frame {
+		cp := fi.checkpoints[0]
+		for _, c := range fi.checkpoints {
+			if c.frame <= frame {
+				cp = c
+			}
+		}
+		if err := fi.rewind(cp); err != nil {
+			return err
+		}
+	}
+	if frame > fi.frame {
+		fi.startSeek()
+		fi.seekFrame = frame
+	}
+	return nil
+}
+
+// Seeks to the start of the given round of the current match.
+func (fi *FileInput) seekToRound(round int32) error {
+	if err := fi.canSeek(); err != nil {
+		return err
+	}
+	fi.stopSeek()
+	for _, cp := range fi.checkpoints {
+		if cp.roundStart && cp.round == round {
+			return fi.rewind(cp)
+		}
+	}
+	if round <= sys.round {
+		return Error(fmt.Sprintf("Round %v not found", round))
+	}
+	fi.startSeek()
+	fi.seekRound = round
+	return nil
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"unsafe"
+)
+
+// Savestates are GameStates serialized with a reflection based codec.
+// Pointers and slices shared between objects are written once and referenced
+// afterwards, so the object graph is rebuilt as it was. Loaded resources
+// (Sff, palettes, compiled states, stage and characters) are written as
+// references and must be loaded when the savestate is restored. AI
+// controllers are written as their name followed by their state.
+
+const (
+	saveStateMagic   = "IKEMENSS"
+	saveStateVersion = 3
+)
+
+var (
+	ssCharType        = reflect.TypeOf((*Char)(nil))
+	ssSffType         = reflect.TypeOf((*Sff)(nil))
+	ssPaletteListType = reflect.TypeOf((*PaletteList)(nil))
+	ssSpriteType      = reflect.TypeOf((*Sprite)(nil))
+	ssStageType       = reflect.TypeOf((*Stage)(nil))
+	ssBackGroundType  = reflect.TypeOf((*backGround)(nil))
+	ssBgCtrlType      = reflect.TypeOf((*bgCtrl)(nil))
+	ssStateBlockType  = reflect.TypeOf(StateBlock{})
+	ssAIType          = reflect.TypeOf((*AIController)(nil)).Elem()
+	// Not part of the simulation, left as they are when loading
+	ssSoundChannelsType = reflect.TypeOf(SoundChannels{})
+	ssRemapBuffersType  = reflect.TypeOf(palFXRemapBuffers{})
+)
+
+// Resources a savestate can refer to, in a fixed order.
+type stateResources struct {
+	defs   []string
+	sffs   []*Sff
+	sffIdx map[*Sff]int
+	pals   []*PaletteList
+	palIdx map[*PaletteList]int
+	blocks map[uintptr][2]int32
+}
+
+func (s *System) stateResources() *stateResources {
+	r := &stateResources{sffIdx: make(map[*Sff]int),
+		palIdx: make(map[*PaletteList]int), blocks: make(map[uintptr][2]int32)}
+	addSff := func(sff *Sff) {
+		if sff == nil {
+			return
+		}
+		if _, ok := r.sffIdx[sff]; !ok {
+			r.sffIdx[sff] = len(r.sffs)
+			r.sffs = append(r.sffs, sff)
+		}
+		if _, ok := r.palIdx[&sff.palList]; !ok {
+			r.palIdx[&sff.palList] = len(r.pals)
+			r.pals = append(r.pals, &sff.palList)
+		}
+	}
+	for pn := range s.cgi {
+		gi := &s.cgi[pn]
+		if len(s.chars[pn]) == 0 {
+			r.defs = append(r.defs, "")
+			continue
+		}
+		r.defs = append(r.defs, gi.def)
+		addSff(gi.sff)
+		if gi.palettedata != nil {
+			r.palIdx[&gi.palettedata.palList] = len(r.pals)
+			r.pals = append(r.pals, &gi.palettedata.palList)
+		}
+		for no, sb := range gi.states {
+			if len(sb.block.ctrls) > 0 {
+				r.blocks[uintptr(unsafe.Pointer(&sb.block.ctrls[0]))] = [...]int32{int32(pn), no}
+			}
+		}
+	}
+	if s.stage != nil {
+		r.defs = append(r.defs, s.stage.def)
+		addSff(s.stage.sff)
+	} else {
+		r.defs = append(r.defs, "")
+	}
+	addSff(s.lifebar.sff)
+	prefixes := make([]string, 0, len(s.ffx))
+	for k := range s.ffx {
+		prefixes = append(prefixes, k)
+	}
+	sort.Strings(prefixes)
+	for _, k := range prefixes {
+		addSff(s.ffx[k].fsff)
+	}
+	return r
+}
+
+type stateRefKey struct {
+	t reflect.Type
+	p uintptr
+	n int
+}
+
+type stateEncoder struct {
+	buf   []byte
+	res   *stateResources
+	refs  map[stateRefKey]uint64
+	chars map[*Char][2]int32
+}
+
+func (e *stateEncoder) uint(u uint64) {
+	e.buf = binary.AppendUvarint(e.buf, u)
+}
+func (e *stateEncoder) int(i int64) {
+	e.buf = binary.AppendVarint(e.buf, i)
+}
+func (e *stateEncoder) string(str string) {
+	e.uint(uint64(len(str)))
+	e.buf = append(e.buf, str...)
+}
+
+// Writes 2 and the id if the object was already written, otherwise registers
+// it, writes 1 and returns true.
+func (e *stateEncoder) newRef(k stateRefKey) bool {
+	if id, ok := e.refs[k]; ok {
+		e.uint(2)
+		e.uint(id)
+		return false
+	}
+	e.refs[k] = uint64(len(e.refs))
+	e.uint(1)
+	return true
+}
+func (e *stateEncoder) resource(v reflect.Value) (bool, error) {
+	switch v.Type() {
+	case ssSoundChannelsType, ssRemapBuffersType:
+		return true, nil
+	case ssAIType:
+		// Read through the value, as the field is unexported
+		if v.IsNil() {
+			e.string("")
+			return true, nil
+		}
+		switch t := v.Elem().Type(); t {
+		case reflect.TypeOf((*AiInput)(nil)):
+			e.string("random")
+			return true, e.value(v.Elem().Elem())
+		case reflect.TypeOf((*externalAI)(nil)):
+			// The agent lives outside the game state
+			e.string("external")
+		default:
+			return true, fmt.Errorf("cannot save AI controller %v", t)
+		}
+		return true, nil
+	case ssStateBlockType:
+		ctrls := v.FieldByName("ctrls")
+		if ctrls.Len() == 0 {
+			e.int(-1)
+			return true, nil
+		}
+		ref, ok := e.res.blocks[ctrls.Pointer()]
+		if !ok {
+			return true, fmt.Errorf("state controllers not owned by any loaded character")
+		}
+		e.int(int64(ref[0]))
+		e.int(int64(ref[1]))
+		return true, nil
+	case ssCharType, ssSffType, ssPaletteListType, ssSpriteType, ssStageType,
+		ssBackGroundType, ssBgCtrlType:
+	default:
+		return false, nil
+	}
+	if v.IsNil() {
+		e.int(-1)
+		return true, nil
+	}
+	p := unsafe.Pointer(v.Pointer())
+	idx := -1
+	switch v.Type() {
+	case ssCharType:
+		if ref, ok := e.chars[(*Char)(p)]; ok {
+			e.int(int64(ref[0]))
+			e.int(int64(ref[1]))
+			return true, nil
+		}
+		// A character that is no longer part of the match
+		e.int(-1)
+		return true, nil
+	case ssSffType:
+		if i, ok := e.res.sffIdx[(*Sff)(p)]; ok {
+			idx = i
+		}
+	case ssPaletteListType:
+		if i, ok := e.res.palIdx[(*PaletteList)(p)]; ok {
+			idx = i
+		}
+	case ssSpriteType:
+		spr := (*Sprite)(p)
+		for i, sff := range e.res.sffs {
+			if sff.sprites[[...]int16{spr.Group, spr.Number}] == spr {
+				e.int(int64(i))
+				e.int(int64(spr.Group))
+				e.int(int64(spr.Number))
+				return true, nil
+			}
+		}
+	case ssStageType:
+		if (*Stage)(p) == sys.stage {
+			idx = 0
+		}
+	case ssBackGroundType:
+		for i, b := range sys.stage.bg {
+			if b == (*backGround)(p) {
+				idx = i
+			}
+		}
+	case ssBgCtrlType:
+		for i := range sys.stage.bgc {
+			if &sys.stage.bgc[i] == (*bgCtrl)(p) {
+				idx = i
+			}
+		}
+	}
+	if idx < 0 {
+		return true, fmt.Errorf("%v does not belong to a loaded resource", v.Type())
+	}
+	e.int(int64(idx))
+	return true, nil
+}
+func (e *stateEncoder) value(v reflect.Value) error {
+	if ok, err := e.resource(v); ok {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		e.uint(v.Uint())
+	case reflect.Float32:
+		e.buf = binary.LittleEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.string(v.String())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if err := e.value(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			e.uint(0)
+		} else if e.newRef(stateRefKey{v.Type(), v.Pointer(), 0}) {
+			return e.value(v.Elem())
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			e.uint(0)
+		} else if v.Len() == 0 {
+			e.uint(3)
+		} else if e.newRef(stateRefKey{v.Type(), v.Pointer(), v.Len()}) {
+			e.uint(uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				if err := e.value(v.Index(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.uint(0)
+		} else if e.newRef(stateRefKey{v.Type(), v.Pointer(), 0}) {
+			keys := v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool {
+				return e.less(keys[i], keys[j])
+			})
+			e.uint(uint64(len(keys)))
+			for _, k := range keys {
+				if err := e.value(k); err != nil {
+					return err
+				}
+				if err := e.value(v.MapIndex(k)); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("cannot save %v", v.Type())
+	}
+	return nil
+}
+
+// Orders map keys so that equal states encode to the same bytes. Pointer keys
+// are ordered by the order in which they were first written.
+func (e *stateEncoder) less(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.String:
+		return a.String() < b.String()
+	case reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			if e.less(a.Index(i), b.Index(i)) {
+				return true
+			}
+			if e.less(b.Index(i), a.Index(i)) {
+				return false
+			}
+		}
+	case reflect.Pointer:
+		ia, oka := e.refs[stateRefKey{a.Type(), a.Pointer(), 0}]
+		ib, okb := e.refs[stateRefKey{b.Type(), b.Pointer(), 0}]
+		if oka && okb {
+			return ia < ib
+		}
+		return oka
+	}
+	return false
+}
+
+type stateDecoder struct {
+	buf   *bytes.Reader
+	res   *stateResources
+	refs  []reflect.Value
+	chars map[[2]int32]*Char
+}
+
+func (d *stateDecoder) uint() (uint64, error) {
+	return binary.ReadUvarint(d.buf)
+}
+func (d *stateDecoder) int() (int64, error) {
+	return binary.ReadVarint(d.buf)
+}
+func (d *stateDecoder) string() (string, error) {
+	n, err := d.uint()
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(d.buf.Len()) {
+		return "", fmt.Errorf("unexpected end of data")
+	}
+	b := make([]byte, n)
+	d.buf.Read(b)
+	return string(b), nil
+}
+func (d *stateDecoder) ints(n int) ([]int64, error) {
+	ret := make([]int64, n)
+	for i := range ret {
+		var err error
+		if ret[i], err = d.int(); err != nil {
+			return nil, err
+		}
+		if i == 0 && ret[0] < 0 {
+			return ret[:1], nil
+		}
+	}
+	return ret, nil
+}
+
+// Reads the tag written by stateEncoder.newRef. Returns true if a new object
+// follows, otherwise sets v to the referenced object.
+func (d *stateDecoder) newRef(v reflect.Value) (bool, error) {
+	tag, err := d.uint()
+	if err != nil {
+		return false, err
+	}
+	switch tag {
+	case 0:
+		v.Set(reflect.Zero(v.Type()))
+		return false, nil
+	case 1:
+		return true, nil
+	case 2:
+		id, err := d.uint()
+		if err != nil {
+			return false, err
+		}
+		if id >= uint64(len(d.refs)) || d.refs[id].Type() != v.Type() {
+			return false, fmt.Errorf("invalid reference")
+		}
+		v.Set(d.refs[id])
+		return false, nil
+	case 3:
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("invalid tag %v", tag)
+}
+func (d *stateDecoder) resource(v reflect.Value) (bool, error) {
+	switch v.Type() {
+	case ssSoundChannelsType, ssRemapBuffersType:
+		return true, nil
+	case ssAIType:
+		name, err := d.string()
+		if err != nil {
+			return true, err
+		}
+		switch name {
+		case "":
+			v.Set(reflect.Zero(v.Type()))
+		case "random":
+			ai := &AiInput{}
+			if err := d.value(reflect.ValueOf(ai).Elem()); err != nil {
+				return true, err
+			}
+			v.Set(reflect.ValueOf(ai))
+		case "external":
+			v.Set(reflect.ValueOf(newExternalAI()))
+		default:
+			return true, fmt.Errorf("unknown AI controller %q", name)
+		}
+		return true, nil
+	case ssStateBlockType:
+		ref, err := d.ints(2)
+		if err != nil {
+			return true, err
+		}
+		if ref[0] < 0 {
+			v.Set(reflect.ValueOf(*newStateBlock()))
+			return true, nil
+		}
+		if ref[0] >= int64(len(sys.cgi)) {
+			return true, fmt.Errorf("invalid player number %v", ref[0])
+		}
+		sb, ok := sys.cgi[ref[0]].states[int32(ref[1])]
+		if !ok {
+			return true, fmt.Errorf("state %v of player %v is not loaded", ref[1], ref[0]+1)
+		}
+		v.Set(reflect.ValueOf(sb.block))
+		return true, nil
+	case ssCharType:
+		ref, err := d.ints(2)
+		if err != nil || ref[0] < 0 {
+			return true, err
+		}
+		pn := [...]int32{int32(ref[0]), int32(ref[1])}
+		if pn[0] >= int32(len(sys.chars)) || pn[1] < 0 {
+			return true, fmt.Errorf("invalid character %v", pn)
+		}
+		c, ok := d.chars[pn]
+		if !ok {
+			if int(pn[1]) < len(sys.chars[pn[0]]) {
+				c = sys.chars[pn[0]][pn[1]]
+			} else {
+				c = &Char{}
+			}
+			d.chars[pn] = c
+		}
+		v.Set(reflect.ValueOf(c))
+		return true, nil
+	case ssSpriteType:
+		ref, err := d.ints(3)
+		if err != nil || ref[0] < 0 {
+			return true, err
+		}
+		if ref[0] >= int64(len(d.res.sffs)) {
+			return true, fmt.Errorf("invalid sff index %v", ref[0])
+		}
+		spr := d.res.sffs[ref[0]].sprites[[...]int16{int16(ref[1]), int16(ref[2])}]
+		if spr == nil {
+			return true, fmt.Errorf("sprite %v,%v is not loaded", ref[1], ref[2])
+		}
+		v.Set(reflect.ValueOf(spr))
+		return true, nil
+	case ssSffType, ssPaletteListType, ssStageType, ssBackGroundType, ssBgCtrlType:
+	default:
+		return false, nil
+	}
+	idx, err := d.int()
+	if err != nil || idx < 0 {
+		return true, err
+	}
+	var ret interface{}
+	switch v.Type() {
+	case ssSffType:
+		if idx < int64(len(d.res.sffs)) {
+			ret = d.res.sffs[idx]
+		}
+	case ssPaletteListType:
+		if idx < int64(len(d.res.pals)) {
+			ret = d.res.pals[idx]
+		}
+	case ssStageType:
+		if sys.stage != nil {
+			ret = sys.stage
+		}
+	case ssBackGroundType:
+		if sys.stage != nil && idx < int64(len(sys.stage.bg)) {
+			ret = sys.stage.bg[idx]
+		}
+	case ssBgCtrlType:
+		if sys.stage != nil && idx < int64(len(sys.stage.bgc)) {
+			ret = &sys.stage.bgc[idx]
+		}
+	}
+	if ret == nil {
+		return true, fmt.Errorf("%v %v is not loaded", v.Type(), idx)
+	}
+	v.Set(reflect.ValueOf(ret))
+	return true, nil
+}
+
+// Decodes into v, which must be settable.
+func (d *stateDecoder) value(v reflect.Value) error {
+	if ok, err := d.resource(v); ok {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.buf.ReadByte()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := d.int()
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		u, err := d.uint()
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32:
+		var u uint32
+		if err := binary.Read(d.buf, binary.LittleEndian, &u); err != nil {
+			return err
+		}
+		v.SetFloat(float64(math.Float32frombits(u)))
+	case reflect.Float64:
+		var u uint64
+		if err := binary.Read(d.buf, binary.LittleEndian, &u); err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(u))
+	case reflect.String:
+		str, err := d.string()
+		if err != nil {
+			return err
+		}
+		v.SetString(str)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := d.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			f = reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+			if err := d.value(f); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer:
+		if ok, err := d.newRef(v); !ok {
+			return err
+		}
+		p := reflect.New(v.Type().Elem())
+		d.refs = append(d.refs, p)
+		v.Set(p)
+		return d.value(p.Elem())
+	case reflect.Slice:
+		if ok, err := d.newRef(v); !ok {
+			return err
+		}
+		n, err := d.uint()
+		if err != nil {
+			return err
+		}
+		if n > uint64(d.buf.Len()) {
+			return fmt.Errorf("unexpected end of data")
+		}
+		s := reflect.MakeSlice(v.Type(), int(n), int(n))
+		d.refs = append(d.refs, s)
+		v.Set(s)
+		for i := 0; i < int(n); i++ {
+			if err := d.value(s.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if ok, err := d.newRef(v); !ok {
+			return err
+		}
+		n, err := d.uint()
+		if err != nil {
+			return err
+		}
+		if n > uint64(d.buf.Len()) {
+			return fmt.Errorf("unexpected end of data")
+		}
+		m := reflect.MakeMapWithSize(v.Type(), int(n))
+		d.refs = append(d.refs, m)
+		v.Set(m)
+		for i := 0; i < int(n); i++ {
+			k := reflect.New(v.Type().Key()).Elem()
+			if err := d.value(k); err != nil {
+				return err
+			}
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(e); err != nil {
+				return err
+			}
+			m.SetMapIndex(k, e)
+		}
+	default:
+		return fmt.Errorf("cannot load %v", v.Type())
+	}
+	return nil
+}
+
+// Returns a serialized snapshot of the current match.
+func (s *System) SaveState() ([]byte, error) {
+	if len(s.chars[0]) == 0 {
+		return nil, fmt.Errorf("no match in progress")
+	}
+	var gs GameState
+	s.saveGameState(&gs)
+	e := &stateEncoder{res: s.stateResources(), refs: make(map[stateRefKey]uint64),
+		chars: make(map[*Char][2]int32)}
+	for pn, p := range gs.chars {
+		for i, c := range p {
+			e.chars[c] = [...]int32{int32(pn), int32(i)}
+		}
+	}
+	e.buf = append(e.buf, saveStateMagic...)
+	e.uint(saveStateVersion)
+	e.uint(uint64(len(e.res.defs)))
+	for _, def := range e.res.defs {
+		e.string(def)
+	}
+	if err := e.value(reflect.ValueOf(&gs).Elem()); err != nil {
+		return nil, fmt.Errorf("failed to save state: %v", err)
+	}
+	return e.buf, nil
+}
+
+// Restores a snapshot made by SaveState. The characters and stage it was
+// made with must be loaded.
+func (s *System) LoadState(data []byte) error {
+	if len(s.chars[0]) == 0 {
+		return fmt.Errorf("no match in progress")
+	}
+	if !bytes.HasPrefix(data, []byte(saveStateMagic)) {
+		return fmt.Errorf("not a savestate")
+	}
+	d := &stateDecoder{buf: bytes.NewReader(data[len(saveStateMagic):]),
+		res: s.stateResources(), chars: make(map[[2]int32]*Char)}
+	if ver, err := d.uint(); err != nil || ver != saveStateVersion {
+		return fmt.Errorf("unsupported savestate version %v", ver)
+	}
+	n, err := d.uint()
+	if err != nil {
+		return err
+	}
+	if n != uint64(len(d.res.defs)) {
+		return fmt.Errorf("savestate was made with a different team setup")
+	}
+	for _, loaded := range d.res.defs {
+		def, err := d.string()
+		if err != nil {
+			return err
+		}
+		if def != loaded {
+			if def == "" {
+				return fmt.Errorf("savestate was made without %v", loaded)
+			}
+			return fmt.Errorf("savestate requires %v, which is not loaded", def)
+		}
+	}
+	var gs GameState
+	if err := d.value(reflect.ValueOf(&gs).Elem()); err != nil {
+		return fmt.Errorf("failed to load state: %v", err)
+	}
+	s.loadGameState(&gs)
+	return nil
+}
@@ -695,6 +695,45 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(sys.netInput.IsConnected()))
 		return 1
 	})
+	luaRegister(l, "debugBreak", func(*lua.LState) int {
+		// Breakpoint on the debugged char
+		if !sys.allowDebugMode || sys.debugWC == nil {
+			return 0
+		}
+		bp, err := sys.debugger.add(sys.debugWC, strArg(l, 1), strArg(l, 2))
+		if err != nil {
+			sys.appendToConsole(err.Error())
+			return 0
+		}
+		sys.appendToConsole("Breakpoint " + bp.String())
+		l.Push(lua.LNumber(bp.id))
+		return 1
+	})
+	luaRegister(l, "debugBreakClear", func(*lua.LState) int {
+		id := 0
+		if l.GetTop() >= 1 {
+			id = int(numArg(l, 1))
+		}
+		l.Push(lua.LBool(sys.debugger.clear(id)))
+		return 1
+	})
+	luaRegister(l, "debugBreakList", func(*lua.LState) int {
+		if len(sys.debugger.breakpoints) == 0 {
+			sys.appendToConsole("No breakpoints")
+		}
+		for _, bp := range sys.debugger.breakpoints {
+			sys.appendToConsole("Breakpoint " + bp.String())
+		}
+		return 0
+	})
+	luaRegister(l, "debugContinue", func(*lua.LState) int {
+		sys.debugger.resume()
+		return 0
+	})
+	luaRegister(l, "debugTraceNext", func(*lua.LState) int {
+		sys.debugger.traceNext()
+		return 0
+	})
 	luaRegister(l, "dialogueReset", func(*lua.LState) int {
 		for _, p := range sys.chars {
 			if len(p) > 0 {
@@ -706,6 +745,36 @@ func systemScriptInit(l *lua.LState) {
 		sys.dialogueBarsFlg = false
 		return 0
 	})
+	luaRegister(l, "disasmState", func(*lua.LState) int {
+		// Current state of the debugged char, or one of its states
+		c := sys.debugWC
+		if c == nil {
+			return 0
+		}
+		sb, no := &c.ss.sb, c.ss.no
+		if l.GetTop() >= 1 {
+			no = int32(numArg(l, 1))
+			s, ok := c.gi().states[no]
+			if !ok {
+				sys.appendToConsole(fmt.Sprintf("State %v does not exist", no))
+				return 0
+			}
+			sb = &s
+		}
+		var b strings.Builder
+		sb.disassemble(&b, no)
+		if l.GetTop() >= 2 {
+			if err := os.WriteFile(strArg(l, 2), []byte(b.String()), 0644); err != nil {
+				l.RaiseError(err.Error())
+			}
+			return 0
+		}
+		for _, line := range strings.Split(strings.TrimRight(b.String(), "\n"), "\n") {
+			sys.appendToConsole(line)
+			fmt.Println(line)
+		}
+		return 0
+	})
 	luaRegister(l, "endMatch", func(*lua.LState) int {
 		sys.endMatch = true
 		return 0
@@ -715,13 +784,16 @@ func systemScriptInit(l *lua.LState) {
 			l.RaiseError("\nConnection already established.\n")
 		}
 		sys.chars = [len(sys.chars)][]*Char{}
+		sys.sel.ClearSelected()
 		sys.netInput = NewNetInput()
+		var err error
 		if host := strArg(l, 1); host != "" {
-			sys.netInput.Connect(host, sys.listenPort)
+			err = sys.netInput.Connect(host, sys.listenPort)
 		} else {
-			if err := sys.netInput.Accept(sys.listenPort); err != nil {
-				l.RaiseError(err.Error())
-			}
+			err = sys.netInput.Accept(sys.listenPort)
+		}
+		if err != nil {
+			l.RaiseError(err.Error())
 		}
 		return 0
 	})
@@ -730,8 +802,47 @@ func systemScriptInit(l *lua.LState) {
 			sys.window.SetSwapInterval(1) //broken frame skipping when set to 0
 		}
 		sys.chars = [len(sys.chars)][]*Char{}
-		sys.fileInput = OpenFileInput(strArg(l, 1))
-		return 0
+		var err error
+		sys.fileInput, err = OpenFileInput(strArg(l, 1))
+		if err == nil {
+			if h := sys.fileInput.header; h != nil {
+				err = h.apply()
+			} else {
+				sys.errLog.Printf("Replay has no header, it may not play back correctly: %v\n", strArg(l, 1))
+			}
+		}
+		if err != nil {
+			sys.errLog.Printf("Failed to play replay %v: %v\n", strArg(l, 1), err)
+			sys.fileInput.Close()
+			sys.fileInput = nil
+			l.Push(lua.LFalse)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		h := sys.fileInput.header
+		l.Push(lua.LTrue)
+		l.Push(lua.LBool(h != nil && !h.Netplay))
+		return 2
+	})
+	luaRegister(l, "enterSpectate", func(*lua.LState) int {
+		if sys.vRetrace >= 0 {
+			sys.window.SetSwapInterval(1)
+		}
+		sys.chars = [len(sys.chars)][]*Char{}
+		var err error
+		if sys.fileInput, err = OpenSpectateInput(strArg(l, 1), sys.spectatorPort); err == nil {
+			err = sys.fileInput.header.apply()
+		}
+		if err != nil {
+			sys.errLog.Printf("Failed to spectate %v: %v\n", strArg(l, 1), err)
+			sys.fileInput.Close()
+			sys.fileInput = nil
+			l.Push(lua.LFalse)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		l.Push(lua.LTrue)
+		return 1
 	})
 	luaRegister(l, "esc", func(l *lua.LState) int {
 		if l.GetTop() >= 1 {
@@ -791,6 +902,10 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(true))
 		return 1
 	})
+	luaRegister(l, "fileExist", func(l *lua.LState) int {
+		l.Push(lua.LString(FileExist(strArg(l, 1))))
+		return 1
+	})
 	luaRegister(l, "fillRect", func(l *lua.LState) int {
 		rect := [4]int32{int32((float32(numArg(l, 1))/sys.luaSpriteScale + float32(sys.gameWidth-320)/2 + sys.luaSpriteOffsetX) * sys.widthScale),
 			int32((float32(numArg(l, 2))/sys.luaSpriteScale + float32(sys.gameHeight-240)) * sys.heightScale),
@@ -886,11 +1001,19 @@ func systemScriptInit(l *lua.LState) {
 			tbl := l.NewTable()
 			sys.matchData = l.NewTable()
 
+			// Set when the chars or the stage fail to load
+			var loadErr error
+
 			// Anonymous function to perform gameplay
 			fight := func() (int32, error) {
-				// Load characters and stage
+				// Load characters and stage. The chars that fail to load are
+				// marked as such, and the match is given up with the error.
 				if err := load(); err != nil {
-					return -1, err
+					for _, line := range strings.Split(err.Error(), "\n") {
+						sys.appendToConsole(line)
+					}
+					loadErr = err
+					return -1, nil
 				}
 				if sys.loader.state == LS_Cancel {
 					return -1, nil
@@ -1018,6 +1141,11 @@ func systemScriptInit(l *lua.LState) {
 				sys.netInput.Stop()
 			}
 
+			// Record the match if local, until it ends
+			if ir := sys.recordLocalMatch(); ir != nil {
+				defer sys.stopLocalRecording(ir)
+			}
+
 			// Defer synchronizing with external inputs on return
 			defer sys.synchronize()
 
@@ -1048,6 +1176,7 @@ func systemScriptInit(l *lua.LState) {
 
 			// If not restarting match
 			if winp != -2 {
+				botMatchEnd(winp)
 				// Cleanup
 				var ti int32
 				tbl_time := l.NewTable()
@@ -1088,6 +1217,12 @@ func systemScriptInit(l *lua.LState) {
 				sys.sel.sdefOverwrite = ""
 				l.Push(lua.LNumber(winp))
 				l.Push(tbl)
+				nret := 2
+				// A third value gives the error if loading failed
+				if loadErr != nil {
+					l.Push(lua.LString(loadErr.Error()))
+					nret = 3
+				}
 				if sys.playBgmFlg {
 					sys.bgm.Open("", 1, 100, 0, 0, 0)
 					sys.playBgmFlg = false
@@ -1108,7 +1243,7 @@ func systemScriptInit(l *lua.LState) {
 				sys.consoleText = []string{}
 				sys.stageLoopNo = 0
 				sys.paused = false
-				return 2
+				return nret
 			}
 		}
 	})
@@ -1178,6 +1313,7 @@ func systemScriptInit(l *lua.LState) {
 		tbl.RawSetString("arcadepath", lua.LString(c.arcadepath))
 		tbl.RawSetString("ratiopath", lua.LString(c.ratiopath))
 		tbl.RawSetString("portrait_scale", lua.LNumber(c.portrait_scale))
+		tbl.RawSetString("broken", lua.LBool(c.loadErr != nil))
 		subt := l.NewTable()
 		for k, v := range c.cns_scale {
 			subt.RawSetInt(k+1, lua.LNumber(v))
@@ -1538,6 +1674,43 @@ func systemScriptInit(l *lua.LState) {
 		sys.loadStart()
 		return 0
 	})
+	luaRegister(l, "loadState", func(l *lua.LState) int {
+		if sys.netInput != nil {
+			l.Push(lua.LFalse)
+			l.Push(lua.LString("savestates are not available during netplay"))
+			return 2
+		}
+		if err := sys.LoadState([]byte(strArg(l, 1))); err != nil {
+			sys.errLog.Printf("loadState: %v\n", err)
+			l.Push(lua.LFalse)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		l.Push(lua.LTrue)
+		return 1
+	})
+	luaRegister(l, "loadText", func(l *lua.LState) int {
+		str, err := LoadText(strArg(l, 1))
+		if err != nil {
+			l.Push(lua.LNil)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		l.Push(lua.LString(str))
+		return 1
+	})
+	luaRegister(l, "netPlayError", func(*lua.LState) int {
+		// Also the error of a netplay replay or spectated session whose
+		// content differs from the local one
+		if sys.netInput != nil && sys.netInput.sessionErr != nil {
+			l.Push(lua.LString(sys.netInput.sessionErr.Error()))
+		} else if sys.fileInput != nil && sys.fileInput.sessionErr != nil {
+			l.Push(lua.LString(sys.fileInput.sessionErr.Error()))
+		} else {
+			l.Push(lua.LNil)
+		}
+		return 1
+	})
 	luaRegister(l, "numberToRune", func(l *lua.LState) int {
 		l.Push(lua.LString(fmt.Sprint('A' - 1 + int(numArg(l, 1)))))
 		return 1
@@ -1653,6 +1826,18 @@ func systemScriptInit(l *lua.LState) {
 		fmt.Println(strArg(l, 1))
 		return 0
 	})
+	luaRegister(l, "profilerExport", func(*lua.LState) int {
+		filename := "debug/profile.csv"
+		if l.GetTop() >= 1 {
+			filename = strArg(l, 1)
+		}
+		if err := sys.profiler.export(filename); err != nil {
+			sys.appendToConsole(err.Error())
+		} else {
+			sys.appendToConsole("Profile saved to " + filename)
+		}
+		return 0
+	})
 	luaRegister(l, "puts", func(*lua.LState) int {
 		fmt.Println(strArg(l, 1))
 		return 0
@@ -1686,9 +1871,31 @@ func systemScriptInit(l *lua.LState) {
 		sys.debugWC.unsetSCF(SCF_dizzy)
 		return 0
 	})
+	luaRegister(l, "replayFrame", func(*lua.LState) int {
+		if sys.fileInput != nil && sys.fileInput.match {
+			l.Push(lua.LNumber(sys.fileInput.frame))
+		} else {
+			l.Push(lua.LNumber(-1))
+		}
+		return 1
+	})
 	luaRegister(l, "replayRecord", func(*lua.LState) int {
 		if sys.netInput != nil {
-			sys.netInput.rep, _ = os.Create(strArg(l, 1))
+			var err error
+			if sys.netInput.rep, err = os.Create(strArg(l, 1)); err == nil {
+				err = newReplayHeader(true).write(sys.netInput.rep)
+			}
+			if err != nil {
+				sys.errLog.Printf("Failed to create replay: %v\n", err)
+			}
+		} else if sys.fileInput == nil {
+			if sys.inputRecorder != nil {
+				sys.inputRecorder.Close()
+			}
+			var err error
+			if sys.inputRecorder, err = NewInputRecorder(strArg(l, 1)); err != nil {
+				sys.errLog.Printf("Failed to create replay: %v\n", err)
+			}
 		}
 		return 0
 	})
@@ -1697,8 +1904,53 @@ func systemScriptInit(l *lua.LState) {
 			sys.netInput.rep.Close()
 			sys.netInput.rep = nil
 		}
+		if sys.inputRecorder != nil {
+			sys.inputRecorder.Close()
+			sys.inputRecorder = nil
+		}
 		return 0
 	})
+	luaRegister(l, "replaySeek", func(*lua.LState) int {
+		if sys.fileInput == nil {
+			l.Push(lua.LFalse)
+			return 1
+		}
+		if err := sys.fileInput.seek(int32(numArg(l, 1))); err != nil {
+			sys.appendToConsole(err.Error())
+			l.Push(lua.LFalse)
+			return 1
+		}
+		l.Push(lua.LTrue)
+		return 1
+	})
+	luaRegister(l, "replaySeekRound", func(*lua.LState) int {
+		if sys.fileInput == nil {
+			l.Push(lua.LFalse)
+			return 1
+		}
+		round := sys.round
+		if l.GetTop() >= 1 {
+			round = int32(numArg(l, 1))
+		}
+		if err := sys.fileInput.seekToRound(round); err != nil {
+			sys.appendToConsole(err.Error())
+			l.Push(lua.LFalse)
+			return 1
+		}
+		l.Push(lua.LTrue)
+		return 1
+	})
+	luaRegister(l, "replaySpeed", func(*lua.LState) int {
+		if sys.fileInput == nil {
+			l.Push(lua.LNumber(0))
+			return 1
+		}
+		if l.GetTop() >= 1 {
+			sys.fileInput.setSpeed(float32(numArg(l, 1)))
+		}
+		l.Push(lua.LNumber(sys.fileInput.speed))
+		return 1
+	})
 	luaRegister(l, "resetKey", func(*lua.LState) int {
 		sys.keyInput = KeyUnknown
 		sys.keyString = ""
@@ -1738,6 +1990,17 @@ func systemScriptInit(l *lua.LState) {
 		sys.roundResetFlg = true
 		return 0
 	})
+	luaRegister(l, "saveState", func(l *lua.LState) int {
+		data, err := sys.SaveState()
+		if err != nil {
+			sys.errLog.Printf("saveState: %v\n", err)
+			l.Push(lua.LNil)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		l.Push(lua.LString(data))
+		return 1
+	})
 	luaRegister(l, "screenshot", func(*lua.LState) int {
 		captureScreen()
 		return 0
@@ -2362,9 +2625,13 @@ func systemScriptInit(l *lua.LState) {
 	})
 	luaRegister(l, "synchronize", func(*lua.LState) int {
 		if err := sys.synchronize(); err != nil {
-			l.RaiseError(err.Error())
+			sys.errLog.Println(err.Error())
+			l.Push(lua.LFalse)
+			l.Push(lua.LString(err.Error()))
+			return 2
 		}
-		return 0
+		l.Push(lua.LTrue)
+		return 1
 	})
 	luaRegister(l, "textImgDraw", func(*lua.LState) int {
 		ts, ok := toUserData(l, 1).(*TextSprite)
@@ -2574,6 +2841,15 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "toggleProfiler", func(*lua.LState) int {
+		if !sys.allowDebugMode {
+			return 0
+		}
+		if l.GetTop() < 1 || boolArg(l, 1) != sys.profiler.enabled {
+			sys.profiler.toggle()
+		}
+		return 0
+	})
 	luaRegister(l, "toggleStatusDraw", func(*lua.LState) int {
 		if l.GetTop() >= 1 {
 			sys.statusDraw = boolArg(l, 1)
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SFF v2 sprite formats
+const (
+	SFF_raw   = 0
+	SFF_rle8  = 2
+	SFF_lz5   = 4
+	SFF_png8  = 10
+	SFF_png32 = 12
+)
+
+var sffFormatNames = map[byte]string{SFF_raw: "raw", SFF_rle8: "RLE8", SFF_lz5: "LZ5",
+	SFF_png8: "PNG8", SFF_png32: "PNG32"}
+
+type sffPalette struct {
+	group, number int16
+	colors        [256]uint32
+}
+
+// A sprite to be written. px holds palette indices, or the colors of a
+// true color sprite in the order of image.NRGBA.
+type sffSprite struct {
+	group, number int16
+	axis          [2]int16
+	width, height uint16
+	px            []byte
+	trueColor     bool
+	// Index of the palette of an indexed sprite
+	pal int
+}
+
+// Builds an SFF v2 file. Identical palettes are written once and linked, as
+// are identical sprites, and the data of each sprite is compressed with the
+// format that makes it the smallest.
+type sffWriter struct {
+	palettes []sffPalette
+	sprites  []sffSprite
+	// Number of sprites written with each format, and linked
+	formats map[byte]int
+	linked  int
+	shared  int
+}
+
+// Returns the index of a palette with the colors, adding it under the group
+// and number, or the next free number of the group, if there is none.
+func (w *sffWriter) palette(group, number int16, colors [256]uint32) int {
+	for i := range w.palettes {
+		if w.palettes[i].colors == colors {
+			return i
+		}
+	}
+	for w.paletteIndex(group, number) >= 0 {
+		number++
+	}
+	w.palettes = append(w.palettes, sffPalette{group, number, colors})
+	return len(w.palettes) - 1
+}
+func (w *sffWriter) paletteIndex(group, number int16) int {
+	for i, p := range w.palettes {
+		if p.group == group && p.number == number {
+			return i
+		}
+	}
+	return -1
+}
+
+// Compresses the data of the sprite with each format that can hold it and
+// returns the smallest, which starts with the size of the decompressed data
+// except for raw sprites.
+func (w *sffWriter) encode(sp *sffSprite) (format byte, data []byte, err error) {
+	var b bytes.Buffer
+	if sp.trueColor {
+		img := &image.NRGBA{Pix: sp.px, Stride: int(sp.width) * 4,
+			Rect: image.Rect(0, 0, int(sp.width), int(sp.height))}
+		binary.Write(&b, binary.LittleEndian, uint32(len(sp.px)))
+		if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&b, img); err != nil {
+			return 0, nil, err
+		}
+		return SFF_png32, b.Bytes(), nil
+	}
+	candidates := map[byte][]byte{SFF_rle8: sffRle8Encode(sp.px)}
+	if lz5, ok := sffLz5Encode(sp.px); ok {
+		candidates[SFF_lz5] = lz5
+	}
+	if png8, err := sffPng8Encode(sp, w.palettes[sp.pal].colors); err == nil {
+		candidates[SFF_png8] = png8
+	}
+	for _, f := range [...]byte{SFF_rle8, SFF_lz5, SFF_png8} {
+		if c, ok := candidates[f]; ok && (data == nil || len(c) < len(data)-4) {
+			b.Reset()
+			binary.Write(&b, binary.LittleEndian, uint32(len(sp.px)))
+			b.Write(c)
+			format, data = f, append([]byte{}, b.Bytes()...)
+		}
+	}
+	return
+}
+
+func (w *sffWriter) write(out io.Writer) error {
+	w.formats = make(map[byte]int)
+	le := binary.LittleEndian
+	nspr, npal := len(w.sprites), len(w.palettes)
+	sprNodes := make([]byte, 28*nspr)
+	palNodes := make([]byte, 16*npal)
+	var ldata, tdata bytes.Buffer
+	// Alpha is only read from version 2.01 files
+	var ver2 byte
+	written := make(map[[256]uint32]int)
+	for i, p := range w.palettes {
+		node := palNodes[16*i:]
+		le.PutUint16(node[0:], uint16(p.group))
+		le.PutUint16(node[2:], uint16(p.number))
+		le.PutUint16(node[4:], 256)
+		if j, ok := written[p.colors]; ok {
+			le.PutUint16(node[6:], uint16(j))
+			w.shared++
+			continue
+		}
+		written[p.colors] = i
+		for _, c := range p.colors {
+			if c>>24 != 255 {
+				ver2 = 1
+			}
+		}
+		le.PutUint32(node[8:], uint32(ldata.Len()))
+		le.PutUint32(node[12:], 1024)
+		binary.Write(&ldata, le, p.colors[:])
+	}
+	if ver2 == 0 {
+		// The byte after each color is reserved in version 2.00
+		data := ldata.Bytes()
+		for i := 3; i < len(data); i += 4 {
+			data[i] = 0
+		}
+	}
+	unique := make(map[string]int)
+	for i := range w.sprites {
+		sp := &w.sprites[i]
+		node := sprNodes[28*i:]
+		le.PutUint16(node[0:], uint16(sp.group))
+		le.PutUint16(node[2:], uint16(sp.number))
+		le.PutUint16(node[4:], sp.width)
+		le.PutUint16(node[6:], sp.height)
+		le.PutUint16(node[8:], uint16(sp.axis[0]))
+		le.PutUint16(node[10:], uint16(sp.axis[1]))
+		if sp.trueColor {
+			node[15] = 32
+		} else {
+			node[15] = 8
+			le.PutUint16(node[24:], uint16(sp.pal))
+		}
+		// Sprite data is kept in tdata
+		le.PutUint16(node[26:], 1)
+		key := fmt.Sprintf("%v %v %v %s", sp.width, sp.height, sp.trueColor, sp.px)
+		if j, ok := unique[key]; ok {
+			// Linked sprites have no data and keep their own axis and palette
+			le.PutUint16(node[12:], uint16(j))
+			node[14] = sprNodes[28*j+14]
+			w.linked++
+			continue
+		}
+		format, data, err := w.encode(sp)
+		if err != nil {
+			return Error(fmt.Sprintf("Sprite %v,%v: %v", sp.group, sp.number, err))
+		}
+		unique[key] = i
+		w.formats[format]++
+		node[14] = format
+		le.PutUint32(node[16:], uint32(tdata.Len()))
+		le.PutUint32(node[20:], uint32(len(data)))
+		tdata.Write(data)
+	}
+	header := make([]byte, 512)
+	copy(header, "ElecbyteSpr\x00")
+	// Version and compatible version
+	copy(header[12:], []byte{0, ver2, 0, 2})
+	copy(header[24:], []byte{0, ver2, 0, 2})
+	lofs := uint32(len(header) + len(sprNodes) + len(palNodes))
+	for i, v := range [...]uint32{uint32(len(header)), uint32(nspr),
+		uint32(len(header) + len(sprNodes)), uint32(npal),
+		lofs, uint32(ldata.Len()), lofs + uint32(ldata.Len()), uint32(tdata.Len())} {
+		le.PutUint32(header[36+4*i:], v)
+	}
+	for _, b := range [][]byte{header, sprNodes, palNodes, ldata.Bytes(), tdata.Bytes()} {
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encodes the palette indices in RLE8, where a byte is either a color or,
+// if its two top bits are 01, the length of a run of the color that follows.
+func sffRle8Encode(px []byte) (out []byte) {
+	for i := 0; i < len(px); {
+		c, n := px[i], 1
+		for i+n < len(px) && px[i+n] == c && n < 0x3f {
+			n++
+		}
+		if n == 1 && c&0xc0 != 0x40 {
+			out = append(out, c)
+		} else {
+			out = append(out, 0x40|byte(n), c)
+		}
+		i += n
+	}
+	return
+}
+
+// Encodes the palette indices in LZ5, which can only hold the 32 first
+// colors. Each bit of a control byte tells whether one of the next 8 packets
+// is a run of a color or a copy of earlier pixels. Short copies carry the
+// top bits of the offset of every 4th short copy, which has no offset byte.
+func sffLz5Encode(px []byte) ([]byte, bool) {
+	for _, c := range px {
+		if c >= 32 {
+			return nil, false
+		}
+	}
+	out := []byte{0}
+	ctrl, packets := 0, 0
+	packet := func(copy bool) {
+		if packets == 8 {
+			ctrl, packets = len(out), 0
+			out = append(out, 0)
+		}
+		if copy {
+			out[ctrl] |= 1 << packets
+		}
+		packets++
+	}
+	// Positions of the short copies whose top bits are still to be set
+	var short []int
+	// Last position of each pair of colors, and the previous position of
+	// the same pair for each position
+	var head [32 * 32]int
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int, len(px))
+	hash := func(i int) int { return int(px[i])<<5 | int(px[i+1]) }
+	for i := 0; i < len(px); {
+		run := 1
+		for i+run < len(px) && px[i+run] == px[i] && run < 263 {
+			run++
+		}
+		length, offset := 0, 0
+		if i+1 < len(px) {
+			for j, steps := head[hash(i)], 0; j >= 0 && i-j <= 1024 && steps < 256; j, steps = prev[j], steps+1 {
+				n := 0
+				for i+n < len(px) && px[j+n] == px[i+n] && n < 258 {
+					n++
+				}
+				if n > length && (n >= 3 || i-j <= 256) {
+					length, offset = n, i-j
+				}
+			}
+		}
+		var n int
+		switch {
+		case run >= length:
+			packet(false)
+			if n = run; n < 8 {
+				out = append(out, byte(n)<<5|px[i])
+			} else {
+				out = append(out, px[i], byte(n-8))
+			}
+		case offset <= 256 && length <= 64:
+			packet(true)
+			n = length
+			v := byte(offset - 1)
+			if len(short) < 3 {
+				short = append(short, len(out))
+				out = append(out, byte(n-1), v)
+			} else {
+				for k, pos := range short {
+					out[pos] |= (v >> (6 - 2*k)) << 6
+				}
+				out = append(out, byte(n-1)|v<<6)
+				short = short[:0]
+			}
+		default:
+			packet(true)
+			n = length
+			v := offset - 1
+			out = append(out, byte(v>>8)<<6, byte(v), byte(n-3))
+		}
+		for end := i + n; i < end; i++ {
+			if i+1 < len(px) {
+				h := hash(i)
+				prev[i], head[h] = head[h], i
+			}
+		}
+	}
+	return out, true
+}
+
+// Encodes the palette indices as a PNG with as few colors of the palette as
+// the sprite needs.
+func sffPng8Encode(sp *sffSprite, colors [256]uint32) ([]byte, error) {
+	var max byte
+	for _, c := range sp.px {
+		if c > max {
+			max = c
+		}
+	}
+	pal := make(color.Palette, int(max)+1)
+	for i := range pal {
+		c := colors[i]
+		pal[i] = color.NRGBA{byte(c), byte(c >> 8), byte(c >> 16), byte(c >> 24)}
+	}
+	img := &image.Paletted{Pix: sp.px, Stride: int(sp.width),
+		Rect: image.Rect(0, 0, int(sp.width), int(sp.height)), Palette: pal}
+	var b bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&b, img); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+const sprPackManifestFile = "sprites.json"
+
+// Manifest of a sprite pack, read from the sprites.json file of a directory
+// of PNG images. Paths are relative to the directory. For example:
+//
+//	{"Output": "kfm.sff",
+//	 "Palettes": [{"Group": 1, "Number": 1, "File": "kfm.act"}],
+//	 "Sprites": [{"Group": 0, "Number": 0, "File": "stand0.png", "Axis": [18, 96], "Palette": [1, 1]},
+//	             {"Group": 9000, "Number": 0, "File": "portrait.png"}]}
+//
+// An indexed sprite uses the palette of its PNG unless Palette is set. A
+// palette may be an ACT file or an indexed PNG.
+type sprPackManifest struct {
+	Output   string
+	Palettes []struct {
+		Group, Number int16
+		File          string
+	}
+	Sprites []struct {
+		Group, Number int16
+		File          string
+		Axis          [2]int16
+		Palette       *[2]int16
+	}
+}
+
+// Colors of a palette as kept by the engine. Missing colors are opaque black.
+func sprPackColors(p color.Palette) (colors [256]uint32) {
+	for i := range colors {
+		colors[i] = 0xff000000
+		if i < len(p) {
+			c := color.NRGBAModel.Convert(p[i]).(color.NRGBA)
+			colors[i] = uint32(c.A)<<24 | uint32(c.B)<<16 | uint32(c.G)<<8 | uint32(c.R)
+		}
+	}
+	return
+}
+func sprPackReadPNG(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, Error(fmt.Sprintf("%v: %v", file, err))
+	}
+	return img, nil
+}
+func sprPackReadPalette(file string) (colors [256]uint32, err error) {
+	if strings.EqualFold(filepath.Ext(file), ".act") {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return colors, err
+		}
+		if len(b) < 768 {
+			return colors, Error(file + ": not an ACT palette")
+		}
+		// Colors are stored from the last one, as the engine reads them
+		for i := range colors {
+			rgb := b[3*(255-i):]
+			colors[i] = 0xff000000 | uint32(rgb[2])<<16 | uint32(rgb[1])<<8 | uint32(rgb[0])
+		}
+		return colors, nil
+	}
+	img, err := sprPackReadPNG(file)
+	if err != nil {
+		return colors, err
+	}
+	pi, ok := img.(*image.Paletted)
+	if !ok {
+		return colors, Error(file + ": not an indexed PNG")
+	}
+	return sprPackColors(pi.Palette), nil
+}
+
+func sprPackLoad(dir string, m *sprPackManifest) (*sffWriter, error) {
+	w := &sffWriter{}
+	for _, p := range m.Palettes {
+		colors, err := sprPackReadPalette(filepath.Join(dir, p.File))
+		if err != nil {
+			return nil, err
+		}
+		if w.paletteIndex(p.Group, p.Number) >= 0 {
+			return nil, Error(fmt.Sprintf("Duplicated palette: %v,%v", p.Group, p.Number))
+		}
+		// Identical palettes are kept under each number, and linked
+		w.palettes = append(w.palettes, sffPalette{p.Group, p.Number, colors})
+	}
+	exists := make(map[[2]int16]bool)
+	for _, s := range m.Sprites {
+		if exists[[...]int16{s.Group, s.Number}] {
+			return nil, Error(fmt.Sprintf("Duplicated sprite: %v,%v", s.Group, s.Number))
+		}
+		exists[[...]int16{s.Group, s.Number}] = true
+		file := filepath.Join(dir, s.File)
+		img, err := sprPackReadPNG(file)
+		if err != nil {
+			return nil, err
+		}
+		r := img.Bounds()
+		if r.Dx() > 0xffff || r.Dy() > 0xffff {
+			return nil, Error(file + ": image too large")
+		}
+		sp := sffSprite{group: s.Group, number: s.Number, axis: s.Axis,
+			width: uint16(r.Dx()), height: uint16(r.Dy())}
+		if pi, ok := img.(*image.Paletted); ok {
+			sp.px = make([]byte, 0, r.Dx()*r.Dy())
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				i := pi.PixOffset(r.Min.X, y)
+				sp.px = append(sp.px, pi.Pix[i:i+r.Dx()]...)
+			}
+			if s.Palette != nil {
+				if sp.pal = w.paletteIndex(s.Palette[0], s.Palette[1]); sp.pal < 0 {
+					return nil, Error(fmt.Sprintf("%v: palette %v,%v not found", file,
+						s.Palette[0], s.Palette[1]))
+				}
+			} else {
+				sp.pal = w.palette(s.Group, s.Number, sprPackColors(pi.Palette))
+			}
+		} else {
+			if s.Palette != nil {
+				return nil, Error(file + ": palette set for a true color image")
+			}
+			nrgba := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+			draw.Draw(nrgba, nrgba.Rect, img, r.Min, draw.Src)
+			sp.px, sp.trueColor = nrgba.Pix, true
+		}
+		w.sprites = append(w.sprites, sp)
+	}
+	return w, nil
+}
+
+// Reads the written file back with the SFF loader of the engine, and checks
+// that it gives the same sprites and palettes.
+func (w *sffWriter) verify(filename string) error {
+	sff, err := loadSff(filename, false)
+	if err != nil {
+		return err
+	}
+	removeSFFCache(filename)
+	// Linked sprites are set up by main thread tasks
+	sys.runMainThreadTask()
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var h SffHeader
+	var lofs, tofs uint32
+	if err := h.Read(f, &lofs, &tofs); err != nil {
+		return err
+	}
+	decoded := make([][]byte, len(w.sprites))
+	for i := range w.sprites {
+		sp := &w.sprites[i]
+		mismatch := func(what string) error {
+			return Error(fmt.Sprintf("Sprite %v,%v: %v does not match", sp.group, sp.number, what))
+		}
+		s := newSprite()
+		var ofs, size uint32
+		var link uint16
+		f.Seek(int64(h.FirstSpriteHeaderOffset)+int64(28*i), 0)
+		if err := s.readHeaderV2(f, &ofs, &size, lofs, tofs, &link); err != nil {
+			return err
+		}
+		if size == 0 {
+			decoded[i] = decoded[link]
+		} else if decoded[i], _, _, _, err = s.decodeV2(f, int64(ofs), size); err != nil {
+			return err
+		}
+		expected := sp.px
+		if sp.trueColor {
+			// The engine uses premultiplied alpha
+			rgba := image.NewRGBA(image.Rect(0, 0, int(sp.width), int(sp.height)))
+			draw.Draw(rgba, rgba.Rect, &image.NRGBA{Pix: sp.px, Stride: 4 * int(sp.width),
+				Rect: rgba.Rect}, image.Point{}, draw.Src)
+			expected = rgba.Pix
+		}
+		if !bytes.Equal(decoded[i], expected) {
+			return mismatch("image")
+		}
+		ls := sff.GetSprite(sp.group, sp.number)
+		if ls == nil {
+			return mismatch("number")
+		}
+		if ls.Offset != sp.axis || ls.Size != [...]uint16{sp.width, sp.height} {
+			return mismatch("axis or size")
+		}
+		if !sp.trueColor {
+			pal := sff.palList.Get(ls.palidx)
+			for j, c := range w.palettes[sp.pal].colors {
+				if j >= len(pal) || pal[j] != c {
+					return mismatch("palette")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Builds an SFF v2 file from the manifest, or from the sprites.json file of
+// a directory, prints what was written and returns the exit code of the
+// process. sys must have been initialized with sys.headless set.
+func sprPackMain(path string) int {
+	manifest := path
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		manifest = filepath.Join(path, sprPackManifestFile)
+	}
+	dir := filepath.Dir(manifest)
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", manifest, err)
+		return 1
+	}
+	b, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		return fail(err)
+	}
+	var m sprPackManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fail(err)
+	}
+	w, err := sprPackLoad(dir, &m)
+	if err != nil {
+		return fail(err)
+	}
+	output := sys.cmdFlags["-sffout"]
+	if output == "" && m.Output != "" {
+		output = filepath.Join(dir, m.Output)
+	} else if output == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return fail(err)
+		}
+		output = abs + ".sff"
+	}
+	var out bytes.Buffer
+	if err := w.write(&out); err != nil {
+		return fail(err)
+	}
+	if err := ioutil.WriteFile(output, out.Bytes(), 0644); err != nil {
+		return fail(err)
+	}
+	if err := w.verify(output); err != nil {
+		return fail(Error(fmt.Sprintf("%v: %v", output, err)))
+	}
+	var formats []string
+	for _, f := range [...]byte{SFF_rle8, SFF_lz5, SFF_png8, SFF_png32} {
+		if w.formats[f] > 0 {
+			formats = append(formats, fmt.Sprintf("%v %v", w.formats[f], sffFormatNames[f]))
+		}
+	}
+	fmt.Printf("%v: %v sprites (%v linked; %v), %v palettes (%v linked), %v bytes\n",
+		output, len(w.sprites), w.linked, strings.Join(formats, ", "), len(w.palettes),
+		w.shared, out.Len())
+	return 0
+}
@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
-	"os"
 
 	"github.com/ikemen-engine/beep"
 	"github.com/ikemen-engine/beep/effects"
@@ -171,11 +171,11 @@ func (bgm *Bgm) Open(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd,
 		speaker.Unlock()
 	}
 	// Special value "" is used to stop music
-	if filename == "" {
+	if filename == "" || sys.headless {
 		return
 	}
 
-	f, err := os.Open(bgm.filename)
+	f, err := OpenFile(bgm.filename)
 	if err != nil {
 		sys.bgm = *newBgm()
 		sys.errLog.Printf("Failed to open bgm: %v", err)
@@ -226,7 +226,7 @@ func (bgm *Bgm) Open(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd,
 }
 
 func loadSoundFont(filename string) (*midi.SoundFont, error) {
-	f, err := os.Open(filename)
+	f, err := OpenFile(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -272,12 +272,12 @@ type Sound struct {
 	length  int
 }
 
-func readSound(f *os.File, size uint32) (*Sound, error) {
+func readSound(f io.Reader, size uint32) (*Sound, error) {
 	if size < 128 {
 		return nil, fmt.Errorf("wav size is too small")
 	}
 	wavData := make([]byte, size)
-	if _, err := f.Read(wavData); err != nil {
+	if _, err := io.ReadFull(f, wavData); err != nil {
 		return nil, err
 	}
 	// Decode the sound at least once, so that we know the format is OK
@@ -326,15 +326,15 @@ func LoadSnd(filename string) (*Snd, error) {
 // If max > 0, the function returns immediately when a matching entry is found. It also gives up after "max" non-matching entries.
 func LoadSndFiltered(filename string, keepItem func([2]int32) bool, max uint32) (*Snd, error) {
 	s := newSnd()
-	f, err := os.Open(filename)
+	f, err := OpenFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { chk(f.Close()) }()
+	defer f.Close()
 	buf := make([]byte, 12)
 	var n int
 	if n, err = f.Read(buf); err != nil {
-		return nil, err
+		return nil, formatError(filename, "header", 0, err)
 	}
 	if string(buf[:n]) != "ElecbyteSnd\x00" {
 		return nil, Error("Unrecognized SND file, invalid header")
@@ -342,19 +342,19 @@ func LoadSndFiltered(filename string, keepItem func([2]int32) bool, max uint32)
 	read := func(x interface{}) error {
 		return binary.Read(f, binary.LittleEndian, x)
 	}
-	if err := read(&s.ver); err != nil {
-		return nil, err
-	}
-	if err := read(&s.ver2); err != nil {
-		return nil, err
+	var numberOfSounds, subHeaderOffset uint32
+	for _, x := range []interface{}{&s.ver, &s.ver2, &numberOfSounds, &subHeaderOffset} {
+		if err := read(x); err != nil {
+			return nil, formatError(filename, "header", 0, err)
+		}
 	}
-	var numberOfSounds uint32
-	if err := read(&numberOfSounds); err != nil {
+	end, err := fileSize(f)
+	if err != nil {
 		return nil, err
 	}
-	var subHeaderOffset uint32
-	if err := read(&subHeaderOffset); err != nil {
-		return nil, err
+	// Each sound takes at least its 16 bytes header
+	if err := checkRange(end, 0, int64(numberOfSounds)*16); err != nil {
+		return nil, formatError(filename, "header", 0, err)
 	}
 	loops := numberOfSounds
 	if max > 0 && max < numberOfSounds {
@@ -362,26 +362,27 @@ func LoadSndFiltered(filename string, keepItem func([2]int32) bool, max uint32)
 	}
 	for i := uint32(0); i < loops; i++ {
 		f.Seek(int64(subHeaderOffset), 0)
-		var nextSubHeaderOffset uint32
-		if err := read(&nextSubHeaderOffset); err != nil {
-			return nil, err
-		}
-		var subFileLength uint32
-		if err := read(&subFileLength); err != nil {
-			return nil, err
-		}
+		var nextSubHeaderOffset, subFileLength uint32
 		var num [2]int32
-		if err := read(&num); err != nil {
-			return nil, err
+		for _, x := range []interface{}{&nextSubHeaderOffset, &subFileLength, &num} {
+			if err := read(x); err != nil {
+				return nil, formatError(filename, fmt.Sprintf("sound header %v", i),
+					int64(subHeaderOffset), err)
+			}
 		}
 		if keepItem(num) {
 			_, ok := s.table[num]
 			if !ok {
-				tmp, err := readSound(f, subFileLength)
+				var tmp *Sound
+				err := checkRange(end, int64(subHeaderOffset)+16, int64(subFileLength))
+				if err == nil {
+					tmp, err = readSound(f, subFileLength)
+				}
 				if err != nil {
 					sys.errLog.Printf("%v sound %v,%v can't be read: %v\n", filename, num[0], num[1], err)
 					if max > 0 {
-						return nil, err
+						return nil, formatError(filename, fmt.Sprintf("sound %v,%v", num[0], num[1]),
+							int64(subHeaderOffset)+16, err)
 					}
 				} else {
 					// Sound is corrupted and can't be played, so we export a warning message to the console
@@ -476,7 +477,7 @@ type SoundChannel struct {
 }
 
 func (s *SoundChannel) Play(sound *Sound, loop bool, freqmul float32) {
-	if sound == nil {
+	if sound == nil || sys.headless {
 		return
 	}
 	s.sound = sound
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Port spectators connect to when neither the address of the host nor the
+// SpectatorPort setting give one
+const defaultSpectatorPort = "7501"
+
+// Sends a netplay session to read-only spectators. The host feeds it the
+// same data it writes to its replay, and every spectator receives the whole
+// session from the start, so that one joining mid-match can simulate up to
+// the current frame. Spectators are kept delay frames behind the players.
+type spectatorHub struct {
+	ln        net.Listener
+	mu        sync.Mutex
+	cond      *sync.Cond
+	data      []byte
+	headerLen int
+	frameEnds []int
+	delay     int
+	closed    bool
+}
+
+func newSpectatorHub(addr, port string, delay int32) (*spectatorHub, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(addr, port))
+	if err != nil {
+		return nil, err
+	}
+	sh := &spectatorHub{ln: ln, delay: int(Max(0, delay))}
+	sh.cond = sync.NewCond(&sh.mu)
+	var b bytes.Buffer
+	if err := newReplayHeader(true).write(&b); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	sh.data, sh.headerLen = b.Bytes(), b.Len()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sh.serve(conn)
+		}
+	}()
+	return sh, nil
+}
+func (sh *spectatorHub) Close() {
+	sh.mu.Lock()
+	sh.closed = true
+	sh.cond.Broadcast()
+	sh.mu.Unlock()
+	sh.ln.Close()
+}
+func (sh *spectatorHub) write(v interface{}) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, v)
+	sh.data = append(sh.data, b.Bytes()...)
+}
+
+// Marks the end of the data of a frame, making the frame delay frames before
+// it available to spectators.
+func (sh *spectatorHub) endFrame() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.frameEnds = append(sh.frameEnds, len(sh.data))
+	sh.cond.Broadcast()
+}
+func (sh *spectatorHub) available() int {
+	if sh.closed {
+		return len(sh.data)
+	}
+	if i := len(sh.frameEnds) - 1 - sh.delay; i >= 0 {
+		return sh.frameEnds[i]
+	}
+	return sh.headerLen
+}
+func (sh *spectatorHub) serve(conn net.Conn) {
+	defer conn.Close()
+	sent := 0
+	for {
+		sh.mu.Lock()
+		for sh.available() <= sent && !sh.closed {
+			sh.cond.Wait()
+		}
+		// Appending never modifies the bytes already in data, so they can be
+		// sent after unlocking
+		chunk, closed := sh.data[sent:sh.available()], sh.closed
+		sh.mu.Unlock()
+		if len(chunk) > 0 {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+			sent += len(chunk)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// Session received from the host, read by FileInput like a replay file.
+// Everything received is kept so that the replay checkpoints can seek in it.
+type spectateStream struct {
+	conn   net.Conn
+	mu     sync.Mutex
+	cond   *sync.Cond
+	data   []byte
+	pos    int
+	closed bool
+}
+
+// The port can be given with the server, as host:port.
+func dialSpectate(server, port string) (*spectateStream, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		if port == "" {
+			port = defaultSpectatorPort
+		}
+		server = net.JoinHostPort(server, port)
+	}
+	conn, err := net.DialTimeout("tcp", server, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	ss := &spectateStream{conn: conn}
+	ss.cond = sync.NewCond(&ss.mu)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			ss.mu.Lock()
+			ss.data = append(ss.data, buf[:n]...)
+			if err != nil {
+				ss.closed = true
+			}
+			ss.cond.Broadcast()
+			ss.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ss, nil
+}
+func (ss *spectateStream) Read(p []byte) (int, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for ss.pos >= len(ss.data) && !ss.closed {
+		ss.cond.Wait()
+	}
+	if ss.pos >= len(ss.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, ss.data[ss.pos:])
+	ss.pos += n
+	return n, nil
+}
+func (ss *spectateStream) Seek(offset int64, whence int) (int64, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(ss.pos)
+	case io.SeekEnd:
+		offset += int64(len(ss.data))
+	}
+	if offset < 0 || offset > int64(len(ss.data)) {
+		return 0, Error("Seek out of the received data")
+	}
+	ss.pos = int(offset)
+	return offset, nil
+}
+func (ss *spectateStream) Close() error {
+	return ss.conn.Close()
+}
+
+// Number of received bytes not read yet, and whether the host is gone
+func (ss *spectateStream) unread() (int, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.data) - ss.pos, ss.closed
+}
+
+// Keeps the game running while waiting for n bytes from the host, so that
+// the window stays responsive. Returns false if spectating was stopped.
+func (ss *spectateStream) wait(n int) bool {
+	for {
+		if unread, closed := ss.unread(); unread >= n || closed {
+			return true
+		}
+		if sys.esc || !sys.await(FPS) {
+			return false
+		}
+	}
+}
+
+// Spectators that joined late or fell behind play as fast as possible until
+// they are less than a second behind the host's delayed stream again.
+func (fi *FileInput) catchingUp() bool {
+	if fi.spec == nil {
+		return false
+	}
+	unread, closed := fi.spec.unread()
+	return !closed && unread > len(fi.ib)*4*FPS
+}
+
+// Starts accepting spectators on the host, if enabled with the SpectatorPort
+// setting. Only the SpectatorAddress interface is listened on.
+func (ni *NetInput) startSpectators() {
+	if sys.spectatorPort == "" {
+		return
+	}
+	var err error
+	if ni.spec, err = newSpectatorHub(sys.spectatorAddress, sys.spectatorPort,
+		sys.spectatorDelay); err != nil {
+		sys.errLog.Printf("Failed to accept spectators on %v: %v\n",
+			net.JoinHostPort(sys.spectatorAddress, sys.spectatorPort), err)
+	}
+}
+
+// Writes v to the replay and sends it to the spectators.
+func (ni *NetInput) record(v interface{}) {
+	if ni.rep != nil {
+		binary.Write(ni.rep, binary.LittleEndian, v)
+	}
+	if ni.spec != nil {
+		ni.spec.write(v)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// Sprites loaded from an SFF keep their pixels as stored in the file, and
+// are only decoded into a texture when they are first drawn. The cache keeps
+// track of the decoded textures, and drops the least recently drawn ones at
+// the end of a frame when they take more memory than the budget, to decode
+// them again if needed.
+type spriteCache struct {
+	// In bytes, unlimited if 0
+	budget int64
+	size   int64
+	lru    list.List
+	// Statistics since the start
+	hits, decodes, evictions int64
+}
+
+func textureBytes(t *Texture) int64 {
+	return int64(t.width) * int64(t.height) * int64(Max(t.depth, 8)/8)
+}
+
+// Returns the texture of the sprite, decoding it if needed. Must be called
+// from the main thread.
+func (s *Sprite) texture() *Texture {
+	if s.link != nil {
+		return s.link.texture()
+	}
+	if s.data == nil || sys.headless {
+		return s.Tex
+	}
+	sc := &sys.spriteCache
+	if s.Tex != nil {
+		sc.hits++
+		if s.cacheElem != nil {
+			sc.lru.MoveToFront(s.cacheElem)
+		}
+		return s.Tex
+	}
+	px, w, h, depth, err := s.pixels()
+	if err != nil {
+		sys.errLog.Printf("Failed to decode sprite %v,%v: %v\n", s.Group, s.Number, err)
+	}
+	if s.upload(px, w, h, depth); s.Tex == nil {
+		// Not decoded again on every draw
+		s.data = nil
+	}
+	return s.Tex
+}
+
+// Decodes the data of the sprite. Safe to call from any goroutine.
+func (s *Sprite) pixels() (px []byte, w, h, depth int32, err error) {
+	if s.pcx {
+		// Decoding resets the bytes per line of the sprite
+		tmp := Sprite{Size: s.Size, rle: s.rle}
+		px = tmp.RlePcxDecode(s.data)
+		return px, int32(s.Size[0]), int32(s.Size[1]), 8, nil
+	}
+	return s.decodeV2(bytes.NewReader(s.data), 0, uint32(len(s.data)))
+}
+
+// Creates the texture and adds it to the cache. Must be called from the main
+// thread.
+func (s *Sprite) upload(px []byte, w, h, depth int32) {
+	// Truncated sprites are left without a texture
+	if len(px) == 0 || int64(len(px)) != int64(w)*int64(h)*int64(depth/8) {
+		return
+	}
+	if depth > 8 {
+		s.Tex = newTexture(w, h, depth, sys.pngFilter)
+	} else {
+		s.Tex = newTexture(w, h, 8, false)
+	}
+	s.Tex.SetData(px)
+	sc := &sys.spriteCache
+	sc.decodes++
+	// Without a budget the textures stay with their sprites
+	if sc.budget > 0 {
+		s.cacheElem = sc.lru.PushFront(s)
+		sc.size += textureBytes(s.Tex)
+	}
+}
+
+// Decodes the sprites on worker goroutines ahead of their first draw, and
+// waits for them. The textures are created by main thread tasks.
+func prefetchSprites(sprites []*Sprite) {
+	if sys.headless || len(sprites) == 0 {
+		return
+	}
+	queue := make(chan *Sprite)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range queue {
+				px, w, h, depth, err := s.pixels()
+				if err != nil {
+					continue
+				}
+				s := s
+				sys.mainThreadTask <- func() {
+					if s.Tex == nil && s.data != nil {
+						s.upload(px, w, h, depth)
+					}
+				}
+			}
+		}()
+	}
+	for _, s := range sprites {
+		queue <- s
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// Returns the sprites of the animations that have data to decode, once each.
+func animSprites(sff *Sff, anims ...*Animation) (sprites []*Sprite) {
+	if sff == nil {
+		return nil
+	}
+	seen := make(map[*Sprite]bool)
+	for _, a := range anims {
+		if a == nil {
+			continue
+		}
+		for _, f := range a.frames {
+			if s := sff.GetSprite(f.Group, f.Number); s != nil && s.data != nil && !seen[s] {
+				seen[s] = true
+				sprites = append(sprites, s)
+			}
+		}
+	}
+	return
+}
+
+// Drops the least recently drawn textures beyond the budget.
+func (sc *spriteCache) trim() {
+	for sc.budget > 0 && sc.size > sc.budget && sc.lru.Len() > 0 {
+		s := sc.lru.Remove(sc.lru.Back()).(*Sprite)
+		sc.size -= textureBytes(s.Tex)
+		s.Tex, s.cacheElem = nil, nil
+		sc.evictions++
+	}
+}
+func (sc *spriteCache) stats() []string {
+	usage := "no budget"
+	if sc.budget > 0 {
+		usage = fmt.Sprintf("%d textures, %.1f of %d MiB", sc.lru.Len(),
+			float64(sc.size)/(1<<20), sc.budget>>20)
+	}
+	return []string{
+		"Sprite cache: " + usage,
+		fmt.Sprintf("Hits %d, decodes %d, evictions %d", sc.hits, sc.decodes, sc.evictions),
+	}
+}
@@ -841,6 +841,10 @@ func loadStage(def string, main bool) (*Stage, error) {
 		sec[0].ReadBool("resetbg", &s.resetbg)
 		sec[0].readI32ForStage("localcoord", &s.stageCamera.localcoord[0],
 			&s.stageCamera.localcoord[1])
+		if s.stageCamera.localcoord[0] <= 0 || s.stageCamera.localcoord[1] <= 0 {
+			return nil, Error(fmt.Sprintf("%v: [StageInfo] localcoord = %v,%v is invalid", def,
+				s.stageCamera.localcoord[0], s.stageCamera.localcoord[1]))
+		}
 		sec[0].ReadF32("xscale", &s.scale[0])
 		sec[0].ReadF32("yscale", &s.scale[1])
 	}
@@ -901,7 +905,7 @@ func loadStage(def string, main bool) (*Stage, error) {
 		sec[0].ReadI32("bgmtrigger.alt", &s.bgmtriggeralt)
 	}
 	if sec := defmap["bgdef"]; len(sec) > 0 {
-		if sec[0].LoadFile("spr", []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
+		if err := sec[0].LoadFile("spr", []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
 			sff, err := loadSff(filename, false)
 			if err != nil {
 				return err
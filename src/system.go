@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ikemen-engine/beep"
@@ -66,7 +67,7 @@ var sys = System{
 	wincntFileName:        "save/autolevel.save",
 	powerShare:            [...]bool{true, true},
 	oldNextAddTime:        1,
-	commandLine:           make(chan string),
+	commandLine:           make(chan *consoleCommand, consoleCommandQueue),
 	cam:                   *newCamera(),
 	statusDraw:            true,
 	mainThreadTask:        make(chan func(), 65536),
@@ -119,6 +120,9 @@ type System struct {
 	debugFont               *TextSprite
 	debugDraw               bool
 	debugRef                [2]int
+	profiler                stateProfiler
+	debugger                stateDebugger
+	spriteCache             spriteCache
 	soundMixer              *beep.Mixer
 	bgm                     Bgm
 	soundChannels           *SoundChannels
@@ -130,7 +134,10 @@ type System struct {
 	keyState                map[Key]bool
 	netInput                *NetInput
 	fileInput               *FileInput
-	aiInput                 [MaxSimul*2 + MaxAttachedChar]AiInput
+	inputRecorder           *InputRecorder
+	recordLocalReplays      bool
+	replayMax               int32
+	aiInput                 [MaxSimul*2 + MaxAttachedChar]AIController
 	keyConfig               []KeyConfig
 	joystickConfig          []KeyConfig
 	com                     [MaxSimul*2 + MaxAttachedChar]float32
@@ -140,6 +147,20 @@ type System struct {
 	match                   int32
 	inputRemap              [MaxSimul*2 + MaxAttachedChar]int
 	listenPort              string
+	remoteConsoleAddr       string
+	remoteConsoleToken      string
+	remoteConsole           *remoteConsole
+	aiControllerName        string
+	aiExternalAddress       string
+	aiExternalTimeout       int32
+	netplayRendezvous       string
+	netplayTransport        string
+	spectatorDelay          int32
+	spectatorPort           string
+	spectatorAddress        string
+	rollbackFrames          int32
+	resimulating            bool
+	headless                bool
 	round                   int32
 	intro                   int32
 	time                    int32
@@ -214,7 +235,7 @@ type System struct {
 	reloadCharSlot          [MaxSimul*2 + MaxAttachedChar]bool
 	shortcutScripts         map[ShortcutKey]*ShortcutScript
 	turbo                   float32
-	commandLine             chan string
+	commandLine             chan *consoleCommand
 	drawScale               float32
 	zoomlag                 float32
 	zoomScale               float32
@@ -278,6 +299,11 @@ type System struct {
 	screenshotFolder        string
 	//FLAC_FrameWait          int
 
+	// Runs the logic of one frame of the current match, set by fight
+	fightFrame func() bool
+	// Set while fight runs, read by the remote console
+	fighting atomic.Bool
+
 	// Common Files
 	commonAir    []string
 	commonCmd    []string
@@ -374,8 +400,12 @@ func (s *System) init(w, h int32) *lua.LState {
 	s.setWindowSize(w, h)
 	var err error
 	// Create a system window.
-	s.window, err = s.newWindow(int(s.scrrect[2]), int(s.scrrect[3]))
-	chk(err)
+	if !s.headless {
+		s.window, err = s.newWindow(int(s.scrrect[2]), int(s.scrrect[3]))
+		chk(err)
+	} else {
+		s.frameSkip = true
+	}
 
 	// Check if the shader selected is currently available.
 	if s.postProcessingShader < int32(len(s.externalShaderList)) {
@@ -399,14 +429,14 @@ func (s *System) init(w, h int32) *lua.LState {
 			s.externalShaderNames[i] = splitDir[len(splitDir)-1]
 
 			// Load vert shaders.
-			content, err := ioutil.ReadFile(shaderLocation + ".vert")
+			content, err := ReadFile(shaderLocation + ".vert")
 			if err != nil {
 				chk(err)
 			}
 			s.externalShaders[0][i] = string(content) + "\x00"
 
 			// Load frag shaders.
-			content, err = ioutil.ReadFile(shaderLocation + ".frag")
+			content, err = ReadFile(shaderLocation + ".frag")
 			if err != nil {
 				chk(err)
 			}
@@ -416,14 +446,17 @@ func (s *System) init(w, h int32) *lua.LState {
 	// PS: The "\x00" is what is know as Null Terminator.
 
 	// Now we proceed to init the render.
-	gfx.Init()
-	gfx.BeginFrame(false)
-	// And the audio.
-	speaker.Init(audioFrequency, audioOutLen)
-	speaker.Play(NewNormalizer(s.soundMixer))
+	if !s.headless {
+		gfx.Init()
+		gfx.BeginFrame(false)
+		// And the audio.
+		speaker.Init(audioFrequency, audioOutLen)
+		speaker.Play(NewNormalizer(s.soundMixer))
+	}
 	l := lua.NewState()
 	l.Options.IncludeGoStackTrace = true
 	l.OpenLibs()
+	vfsLuaInit(l)
 	for i := range s.inputRemap {
 		s.inputRemap[i] = i
 	}
@@ -436,13 +469,13 @@ func (s *System) init(w, h int32) *lua.LState {
 	systemScriptInit(l)
 	s.shortcutScripts = make(map[ShortcutKey]*ShortcutScript)
 	// So now that we have a window we add a icon.
-	if len(s.windowMainIconLocation) > 0 {
+	if len(s.windowMainIconLocation) > 0 && !s.headless {
 		// First we initialize arrays.
 		var f = make([]io.ReadCloser, len(s.windowMainIconLocation))
 		s.windowMainIcon = make([]image.Image, len(s.windowMainIconLocation))
 		// And then we load them.
 		for i, iconLocation := range s.windowMainIconLocation {
-			f[i], err = os.Open(iconLocation)
+			f[i], err = OpenFile(iconLocation)
 			if err != nil {
 				var dErr = "Icon file can not be found.\nPanic: " + err.Error()
 				ShowErrorDialog(dErr)
@@ -456,22 +489,35 @@ func (s *System) init(w, h int32) *lua.LState {
 	// [Icon add end]
 
 	// Error print?
-	go func() {
-		stdin := bufio.NewScanner(os.Stdin)
-		for stdin.Scan() {
-			if err := stdin.Err(); err != nil {
-				s.errLog.Println(err.Error())
-				return
+	// The language server reads its requests from stdin
+	if _, lsp := s.cmdFlags["-lsp"]; !lsp {
+		go func() {
+			stdin := bufio.NewScanner(os.Stdin)
+			for stdin.Scan() {
+				if err := stdin.Err(); err != nil {
+					s.errLog.Println(err.Error())
+					return
+				}
+				s.commandLine <- &consoleCommand{text: stdin.Text()}
 			}
-			s.commandLine <- stdin.Text()
+		}()
+	}
+	if s.remoteConsoleAddr != "" {
+		if s.remoteConsole, err = newRemoteConsole(s.remoteConsoleAddr, s.remoteConsoleToken); err != nil {
+			s.errLog.Printf("Remote console: %v\n", err)
 		}
-	}()
+	}
 	return l
 }
 func (s *System) shutdown() {
 	if !sys.gameEnd {
 		sys.gameEnd = true
 	}
+	s.remoteConsole.close()
+	vfs.close()
+	if s.headless {
+		return
+	}
 	gfx.Close()
 	s.window.Close()
 	speaker.Close()
@@ -491,6 +537,9 @@ func (s *System) eventUpdate() bool {
 	for _, v := range s.shortcutScripts {
 		v.Activate = false
 	}
+	if s.headless {
+		return !s.gameEnd
+	}
 	s.window.pollEvents()
 	s.gameEnd = s.window.shouldClose()
 	return !s.gameEnd
@@ -507,10 +556,18 @@ func (s *System) runMainThreadTask() {
 }
 
 func (s *System) await(fps int) bool {
+	// Nothing is drawn in headless mode, so frames are run as fast as possible
+	if s.headless {
+		s.runMainThreadTask()
+		s.frameSkip = true
+		s.eventUpdate()
+		return !s.gameEnd
+	}
 	if !s.frameSkip {
 		// Render the finished frame
 		gfx.EndFrame()
 		s.window.SwapBuffers()
+		s.spriteCache.trim()
 		// Begin the next frame after events have been processed. Do not clear
 		// the screen if network input is present.
 		defer gfx.BeginFrame(sys.netInput == nil)
@@ -545,17 +602,16 @@ func (s *System) update() bool {
 		s.preFightTime = s.frameCounter
 	}
 	if s.fileInput != nil {
-		if s.anyHardButton() {
-			s.await(FPS * 4)
-		} else {
-			s.await(FPS)
-		}
+		s.await(s.fileInput.fps())
 		return s.fileInput.Update()
 	}
 	if s.netInput != nil {
 		s.await(FPS)
 		return s.netInput.Update()
 	}
+	if s.inputRecorder != nil {
+		s.inputRecorder.Update()
+	}
 	return s.await(FPS)
 }
 func (s *System) tickSound() {
@@ -592,9 +648,11 @@ func (s *System) loadStart() {
 }
 func (s *System) synchronize() error {
 	if s.fileInput != nil {
-		s.fileInput.Synchronize()
+		return s.fileInput.Synchronize()
 	} else if s.netInput != nil {
 		return s.netInput.Synchronize()
+	} else if s.inputRecorder != nil {
+		s.inputRecorder.Synchronize()
 	}
 	return nil
 }
@@ -641,6 +699,23 @@ func (s *System) screenWidth() float32 {
 func (s *System) roundEnd() bool {
 	return s.intro < -s.lifebar.ro.over_hittime
 }
+
+// Whether NetInput may predict remote inputs. The end of a round that may
+// end the match, or bring in the next char in turns mode, is run in
+// lockstep, as fight returns after it and cannot be rolled back.
+func (s *System) canRollback() bool {
+	if s.postMatchFlg {
+		return false
+	}
+	if s.roundEnd() {
+		for i, w := range s.wins {
+			if s.tmode[i] == TM_Turns || w+1 >= s.matchWins[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
 func (s *System) roundWinTime() bool {
 	return s.wintime < 0
 }
@@ -658,6 +733,7 @@ func (s *System) unsetSF(gsf GlobalSpecialFlag) {
 }
 func (s *System) appendToConsole(str string) {
 	s.consoleText = append(s.consoleText, str)
+	s.remoteConsole.console(str)
 	if len(s.consoleText) > s.consoleRows {
 		s.consoleText = s.consoleText[len(s.consoleText)-s.consoleRows:]
 	}
@@ -672,8 +748,7 @@ func (s *System) printToConsole(pn, sn int, a ...interface{}) {
 	}
 }
 func (s *System) loadTime(start time.Time, str string, shell, console bool) {
-	elapsed := time.Since(start)
-	str = fmt.Sprintf("%v; Load time: %v", str, elapsed)
+	str = loadTimeText(start, str)
 	if shell {
 		fmt.Printf("%s\n", str)
 	}
@@ -681,6 +756,9 @@ func (s *System) loadTime(start time.Time, str string, shell, console bool) {
 		s.appendToConsole(str)
 	}
 }
+func loadTimeText(start time.Time, str string) string {
+	return fmt.Sprintf("%v; Load time: %v", str, time.Since(start))
+}
 func (s *System) clsnHantei(clsn1 []float32, scl1, pos1 [2]float32,
 	facing1 float32, clsn2 []float32, scl2, pos2 [2]float32,
 	facing2 float32) bool {
@@ -876,6 +954,17 @@ func (s *System) tickInterpola() float32 {
 	}
 	return s.tickCountF - s.lastTick + s.nextAddTime
 }
+
+// Runs the game logic for one input frame without drawing, used to
+// resimulate frames after a rollback.
+func (s *System) simulateFrame() {
+	for {
+		s.fightFrame()
+		if s.addFrameTime(s.turbo) {
+			return
+		}
+	}
+}
 func (s *System) addFrameTime(t float32) bool {
 	if s.debugPaused() {
 		s.oldNextAddTime = 0
@@ -942,12 +1031,9 @@ func (s *System) commandUpdate() {
 			}
 			if r.key < 0 {
 				cc := int32(-1)
-				// AI Scaling
-				// TODO: Balance AI Scaling
-				if r.roundState() == 2 && RandF32(0, sys.com[i]/2+32) > 32 {
-					cc = Rand(0, int32(len(r.cmd[r.ss.sb.playerNo].Commands))-1)
-				} else {
-					cc = -1
+				if i < len(s.aiInput) {
+					cc = s.aiController(i).Command(newAIMatchView(i), sys.com[i],
+						len(r.cmd[r.ss.sb.playerNo].Commands))
 				}
 				for j := range p {
 					if p[j].helperIndex >= 0 {
@@ -1677,6 +1763,32 @@ func (s *System) drawDebug() {
 			put(&x, &y, s)
 		}
 	}
+	//Profiler, debugger and sprite cache
+	var overlay, cache []string
+	if s.profiler.enabled {
+		overlay = s.profiler.overlay()
+	}
+	if s.debugDraw {
+		cache = s.spriteCache.stats()
+	}
+	x := (320+float32(s.gameWidth))/2 - 1
+	y := 240 - float32(s.gameHeight)
+	for i, lines := range [...][]string{overlay, s.debugger.panel(), cache} {
+		switch i {
+		case 0:
+			s.debugFont.SetColor(255, 255, 127)
+		case 1:
+			s.debugFont.SetColor(127, 255, 255)
+		default:
+			s.debugFont.SetColor(255, 255, 255)
+		}
+		for _, l := range lines {
+			y += float32(s.debugFont.fnt.Size[1]) * s.debugFont.yscl / s.heightScale
+			s.debugFont.fnt.Print(l, x, y, s.debugFont.xscl/s.widthScale,
+				s.debugFont.yscl/s.heightScale, 0, -1, &s.scrrect,
+				s.debugFont.palfx, s.debugFont.frgba)
+		}
+	}
 	//Clsn
 	if s.clsnDraw {
 		for _, t := range s.clsnText {
@@ -1694,9 +1806,12 @@ func (s *System) drawDebug() {
 func (s *System) fight() (reload bool) {
 	// Reset variables
 	s.gameTime, s.paused, s.accel = 0, false, 1
-	s.aiInput = [len(s.aiInput)]AiInput{}
+	s.debugger.resume()
+	s.aiInput = [len(s.aiInput)]AIController{}
+	s.fighting.Store(true)
 	// Defer resetting variables on return
 	defer func() {
+		s.fighting.Store(false)
 		s.oldNextAddTime = 1
 		s.nomusic = false
 		s.allPalFX.clear()
@@ -1707,6 +1822,8 @@ func (s *System) fight() (reload bool) {
 			}
 		}
 		s.wincnt.update()
+		s.remoteConsole.event("matchEnd", map[string]interface{}{"wins": s.wins,
+			"over": s.matchOver()})
 	}()
 	var oldStageVars Stage
 	oldStageVars.copyStageVars(s.stage)
@@ -1750,10 +1867,8 @@ func (s *System) fight() (reload bool) {
 	s.debugWC = sys.chars[0][0]
 	debugInput := func() {
 		select {
-		case cl := <-s.commandLine:
-			if err := s.luaLState.DoString(cl); err != nil {
-				s.errLog.Println(err.Error())
-			}
+		case cmd := <-s.commandLine:
+			cmd.run(s.luaLState)
 		default:
 		}
 	}
@@ -1766,6 +1881,13 @@ func (s *System) fight() (reload bool) {
 	if s.netInput != nil {
 		defer s.netInput.Stop()
 	}
+	if fi := s.fileInput; fi != nil {
+		fi.beginMatch()
+		defer fi.endMatch()
+	}
+	if ni := s.netInput; ni != nil && ni.rollback > 0 {
+		defer ni.endMatch()
+	}
 	s.wincnt.init()
 
 	// Initialize super meter values, and max power for teams sharing meter
@@ -1951,23 +2073,35 @@ func (s *System) fight() (reload bool) {
 		s.roundResetFlg, s.introSkipped = false, false
 		s.reloadFlg, s.reloadStageFlg, s.reloadLifebarFlg = false, false, false
 		s.cam.Update(s.cam.startzoom, 0, 0)
+		if !s.resimulating {
+			s.remoteConsole.event("roundStart", map[string]interface{}{"round": s.round})
+		}
 	}
-	reset()
-
-	// Loop until end of match
-	fin := false
-	for !s.endMatch {
-		s.step = false
-		for _, v := range s.shortcutScripts {
-			if v.Activate {
-				if err := s.luaLState.DoString(v.Script); err != nil {
-					s.errLog.Println(err.Error())
-				}
+	if s.remoteConsole != nil {
+		var players []interface{}
+		for i, p := range s.chars {
+			if len(p) > 0 {
+				players = append(players, map[string]interface{}{"player": i + 1,
+					"name": p[0].name, "def": p[0].gi().def})
 			}
 		}
+		s.remoteConsole.event("matchStart", map[string]interface{}{"players": players,
+			"stage": s.stage.def})
+	}
+	reset()
 
+	// Runs the round transitions and the game logic of one frame. Rollback
+	// resimulates frames with it too. Returns false when fight has to return
+	// for the next char in turns mode.
+	fin := false
+	frame := func() bool {
 		// If next round
 		if s.roundOver() && !fin {
+			if !s.resimulating {
+				s.remoteConsole.event("roundEnd", map[string]interface{}{"round": s.round,
+					"winner": s.winTeam + 1, "finish": [...]string{"", "KO", "DKO", "TO",
+						"TODraw"}[s.finish]})
+			}
 			s.round++
 			for i := range s.roundsExisted {
 				s.roundsExisted[i]++
@@ -2001,7 +2135,7 @@ func (s *System) fight() (reload bool) {
 				}
 			}
 			s.matchData.RawSetInt(int(s.round-1), tbl_roundNo)
-			s.scoreRounds = append(s.scoreRounds, [2]float32{s.lifebar.sc[0].scorePoints, s.lifebar.sc[1].scorePoints})
+			s.scoreRounds = append(s.scoreRounds[:s.round-2], [2]float32{s.lifebar.sc[0].scorePoints, s.lifebar.sc[1].scorePoints})
 			oldTeamLeader = s.teamLeader
 
 			if !s.matchOver() && (s.tmode[0] != TM_Turns || s.chars[0][0].win()) &&
@@ -2042,7 +2176,7 @@ func (s *System) fight() (reload bool) {
 				// If match isn't over, presumably this is turns mode,
 				// so break to restart fight for the next character
 				if !s.matchOver() {
-					break
+					return false
 				}
 
 				// Otherwise match is over
@@ -2056,6 +2190,24 @@ func (s *System) fight() (reload bool) {
 
 		// Update game state
 		s.action()
+		return true
+	}
+	s.fightFrame = frame
+	defer func() { s.fightFrame = nil }()
+
+	// Loop until end of match
+	for !s.endMatch {
+		s.step = false
+		for _, v := range s.shortcutScripts {
+			if v.Activate {
+				if err := s.luaLState.DoString(v.Script); err != nil {
+					s.errLog.Println(err.Error())
+				}
+			}
+		}
+		if !frame() {
+			break
+		}
 
 		// F4 pressed to restart round
 		if s.roundResetFlg && !s.postMatchFlg {
@@ -2130,6 +2282,9 @@ func (s *System) fight() (reload bool) {
 		if !s.update() {
 			break
 		}
+		if s.netInput != nil && s.netInput.rollback > 0 {
+			s.netInput.rollbackFrame()
+		}
 
 		// If end match selected from menu/end of attract mode match/etc
 		if s.endMatch {
@@ -2269,6 +2424,8 @@ type SelectChar struct {
 	anims          PreloadedAnims
 	sff            *Sff
 	fnt            [10]*Fnt
+	// Why the char failed to load, so that it is no longer offered
+	loadErr error
 }
 
 func newSelectChar() *SelectChar {
@@ -2379,7 +2536,12 @@ func (s *Select) addChar(def string) {
 		return
 	}
 	idx := strings.Index(def, "/")
-	if len(def) >= 4 && strings.ToLower(def[len(def)-4:]) == ".def" {
+	if len(def) >= 4 && strings.ToLower(def[len(def)-4:]) == ".zip" {
+		if FileExist(def) == "" && FileExist("chars/"+def) != "" {
+			def = "chars/" + def
+		}
+		def = archiveDef(def)
+	} else if len(def) >= 4 && strings.ToLower(def[len(def)-4:]) == ".def" {
 		if idx < 0 {
 			sc.name = "dummyslot"
 			return
@@ -2520,12 +2682,11 @@ func (s *Select) addChar(def string) {
 		fp = sprite
 	}
 	if len(fp) > 0 {
-		LoadFile(&fp, []string{def, "", "data/"}, func(file string) error {
+		if err := LoadFile(&fp, []string{def, "", "data/"}, func(file string) error {
 			var selPal []int32
 			var err error
-			sc.sff, selPal, err = preloadSff(file, true, listSpr)
-			if err != nil {
-				panic(fmt.Errorf("failed to load %v: %v\nerror preloading %v", file, err, def))
+			if sc.sff, selPal, err = preloadSff(file, true, listSpr); err != nil {
+				return err
 			}
 			sc.anims.updateSff(sc.sff)
 			for k := range s.charSpritePreload {
@@ -2535,7 +2696,12 @@ func (s *Select) addChar(def string) {
 				sc.pal = selPal
 			}
 			return nil
-		})
+		}); err != nil {
+			sys.errLog.Printf("Failed to preload char %v: %v\n", def, err)
+			sc.loadErr = err
+			sc.sff = newSff()
+			sc.anims.updateSff(sc.sff)
+		}
 	} else {
 		sc.sff = newSff()
 		sc.anims.updateSff(sc.sff)
@@ -2574,6 +2740,9 @@ func (s *Select) AddStage(def string) error {
 		sys.loadTime(tnow, tstr, false, false)
 	}()
 	var lines []string
+	if len(def) >= 4 && strings.ToLower(def[len(def)-4:]) == ".zip" {
+		def = archiveDef(SearchFile(def, []string{"", "data/"}))
+	}
 	if err := LoadFile(&def, []string{"", "data/"}, func(file string) error {
 		str, err := LoadText(file)
 		if err != nil {
@@ -2649,18 +2818,21 @@ func (s *Select) AddStage(def string) error {
 			}
 		}
 		//preload portion of sff file
-		LoadFile(&spr, []string{def, "", "data/"}, func(file string) error {
+		if err := LoadFile(&spr, []string{def, "", "data/"}, func(file string) error {
 			var err error
-			ss.sff, _, err = preloadSff(file, false, listSpr)
-			if err != nil {
-				panic(fmt.Errorf("failed to load %v: %v\nerror preloading %v", file, err, def))
+			if ss.sff, _, err = preloadSff(file, false, listSpr); err != nil {
+				return err
 			}
 			ss.anims.updateSff(ss.sff)
 			for k := range s.stageSpritePreload {
 				ss.anims.addSprite(ss.sff, k[0], k[1])
 			}
 			return nil
-		})
+		}); err != nil {
+			sys.errLog.Printf("Failed to preload stage %v: %v\n", def, err)
+			ss.sff = newSff()
+			ss.anims.updateSff(ss.sff)
+		}
 	}
 	return nil
 }
@@ -2669,7 +2841,8 @@ func (s *Select) AddSelectedChar(tn, cn, pl int) bool {
 	if len(s.charlist) == 0 || len(s.charlist[n].def) == 0 {
 		return false
 	}
-	for s.charlist[n].def == "randomselect" || len(s.charlist[n].def) == 0 {
+	for s.charlist[n].def == "randomselect" || len(s.charlist[n].def) == 0 ||
+		s.charlist[n].loadErr != nil {
 		m++
 		if m > 100000 {
 			return false
@@ -2683,6 +2856,16 @@ func (s *Select) AddSelectedChar(tn, cn, pl int) bool {
 	sys.loadMutex.Unlock()
 	return true
 }
+
+// Keeps a char that failed to load from being offered again.
+func (s *Select) setLoadErr(cn int, err error) {
+	if cn < 0 {
+		return
+	}
+	sys.loadMutex.Lock()
+	s.charlist[cn].loadErr = err
+	sys.loadMutex.Unlock()
+}
 func (s *Select) ClearSelected() {
 	sys.loadMutex.Lock()
 	s.selected = [2][][2]int{}
@@ -2710,9 +2893,12 @@ type Loader struct {
 func newLoader() *Loader {
 	return &Loader{state: LS_NotYet, loadExit: make(chan LoaderState, 1)}
 }
-func (l *Loader) loadChar(pn int) int {
+
+// Returns 1 when the char is loaded, 0 when it is not selected yet, or -1 on
+// error, and the line for the console.
+func (l *Loader) loadChar(pn int) (int, string, error) {
 	if sys.roundsExisted[pn&1] > 0 {
-		return 1
+		return 1, "", nil
 	}
 	sys.loadMutex.Lock()
 	result := -1
@@ -2738,18 +2924,14 @@ func (l *Loader) loadChar(pn int) int {
 	}
 	if result >= 0 {
 		sys.loadMutex.Unlock()
-		return result
+		return result, "", nil
 	}
 	pal, idx := int32(sys.sel.selected[pn&1][memberNo][1]), make([]int, nsel)
 	for i := range idx {
 		idx[i] = sys.sel.selected[pn&1][i][0]
 	}
 	sys.loadMutex.Unlock()
-	var tstr string
 	tnow := time.Now()
-	defer func() {
-		sys.loadTime(tnow, tstr, false, true)
-	}()
 	var cdef string
 	var cdefOWnumber int
 	if sys.tmode[pn&1] == TM_Turns {
@@ -2757,10 +2939,13 @@ func (l *Loader) loadChar(pn int) int {
 	} else {
 		cdefOWnumber = pn
 	}
+	// The char in the select screen, if not overwritten
+	cn := -1
 	if sys.sel.cdefOverwrite[cdefOWnumber] != "" {
 		cdef = sys.sel.cdefOverwrite[cdefOWnumber]
 	} else {
-		cdef = sys.sel.charlist[idx[memberNo]].def
+		cn = idx[memberNo]
+		cdef = sys.sel.charlist[cn].def
 	}
 	var p *Char
 	if len(sys.chars[pn]) > 0 && cdef == sys.cgi[pn].def {
@@ -2793,18 +2978,25 @@ func (l *Loader) loadChar(pn int) int {
 	}
 	sys.chars[pn] = make([]*Char, 1)
 	sys.chars[pn][0] = p
+	var tstr string
 	if sys.cgi[pn].sff == nil {
-		if l.err = p.load(cdef); l.err != nil {
+		var err error
+		if err = p.load(cdef); err != nil {
 			sys.chars[pn] = nil
-			tstr = fmt.Sprintf("WARNING: Failed to load new char: %v", cdef)
-			return -1
+			sys.sel.setLoadErr(cn, err)
+			return -1, loadTimeText(tnow, "WARNING: Failed to load new char: "+cdef), err
 		}
-		if sys.cgi[pn].states, l.err =
-			newCompiler().Compile(p.playerNo, cdef, p.gi().constants); l.err != nil {
+		if sys.cgi[pn].states, err =
+			newCompiler().Compile(p.playerNo, cdef, p.gi().constants); err != nil {
 			sys.chars[pn] = nil
-			tstr = fmt.Sprintf("WARNING: Failed to compile new char states: %v", cdef)
-			return -1
+			sys.sel.setLoadErr(cn, err)
+			return -1, loadTimeText(tnow, "WARNING: Failed to compile new char states: "+cdef), err
+		}
+		var anims []*Animation
+		for _, a := range sys.cgi[pn].anim {
+			anims = append(anims, a)
 		}
+		prefetchSprites(animSprites(sys.cgi[pn].sff, anims...))
 		tstr = fmt.Sprintf("New char loaded: %v", cdef)
 	} else {
 		tstr = fmt.Sprintf("Cached char loaded: %v", cdef)
@@ -2821,19 +3013,15 @@ func (l *Loader) loadChar(pn int) int {
 				int16(fa.teammate_face_spr[1]))
 		}
 	}
-	return 1
+	return 1, loadTimeText(tnow, tstr), nil
 }
 
-func (l *Loader) loadAttachedChar(pn int) int {
+func (l *Loader) loadAttachedChar(pn int) (int, string, error) {
 	if sys.round != 1 {
-		return 1
+		return 1, "", nil
 	}
 	atcpn := pn - MaxSimul*2
-	var tstr string
 	tnow := time.Now()
-	defer func() {
-		sys.loadTime(tnow, tstr, false, true)
-	}()
 	sys.sel.ocd[2] = append(sys.sel.ocd[2], *newOverrideCharData())
 	cdef := sys.stageList[0].attachedchardef[atcpn]
 	var p *Char
@@ -2862,27 +3050,27 @@ func (l *Loader) loadAttachedChar(pn int) int {
 	sys.com[pn] = 8
 	sys.chars[pn] = make([]*Char, 1)
 	sys.chars[pn][0] = p
+	var tstr string
 	if sys.cgi[pn].sff == nil {
-		if l.err = p.load(cdef); l.err != nil {
+		var err error
+		if err = p.load(cdef); err != nil {
 			sys.chars[pn] = nil
-			tstr = fmt.Sprintf("WARNING: Failed to load new attachedchar: %v", cdef)
-			return -1
+			return -1, loadTimeText(tnow, "WARNING: Failed to load new attachedchar: "+cdef), err
 		}
-		if sys.cgi[pn].states, l.err =
-			newCompiler().Compile(p.playerNo, cdef, p.gi().constants); l.err != nil {
+		if sys.cgi[pn].states, err =
+			newCompiler().Compile(p.playerNo, cdef, p.gi().constants); err != nil {
 			sys.chars[pn] = nil
-			tstr = fmt.Sprintf("WARNING: Failed to compile new attachedchar states: %v", cdef)
-			return -1
+			return -1, loadTimeText(tnow, "WARNING: Failed to compile new attachedchar states: "+cdef), err
 		}
 		tstr = fmt.Sprintf("New attachedchar loaded: %v", cdef)
 	} else {
 		tstr = fmt.Sprintf("Cached attachedchar loaded: %v", cdef)
 	}
 	sys.cgi[pn].palno = 1
-	return 1
+	return 1, loadTimeText(tnow, tstr), nil
 }
 
-func (l *Loader) loadStage() bool {
+func (l *Loader) loadStage() (err error) {
 	if sys.round == 1 {
 		var def string
 		if sys.sel.selectedStageNo == 0 {
@@ -2895,14 +3083,21 @@ func (l *Loader) loadStage() bool {
 			def = sys.sel.sdefOverwrite
 		}
 		if sys.stage != nil && sys.stage.def == def && sys.stage.mainstage && !sys.stage.reload {
-			return true
+			return nil
 		}
 		sys.stageList = make(map[int32]*Stage)
 		sys.stageLoop = false
-		sys.stageList[0], l.err = loadStage(def, true)
+		sys.stageList[0], err = loadStage(def, true)
 		sys.stage = sys.stageList[0]
+		if err == nil {
+			var anims []*Animation
+			for _, b := range sys.stage.bg {
+				anims = append(anims, &b.anim)
+			}
+			prefetchSprites(animSprites(sys.stage.sff, anims...))
+		}
 	}
-	return l.err == nil
+	return
 }
 func (l *Loader) load() {
 	defer func() { l.loadExit <- l.state }()
@@ -2915,30 +3110,75 @@ func (l *Loader) load() {
 		}
 		return true
 	}
+	type job struct {
+		result int
+		msg    string
+		err    error
+	}
+	// The first error, reported once the rest is loaded
+	var loadErr error
 	for !stageDone || !allCharDone() {
+		// The stage and the chars left are loaded concurrently, then their
+		// results are applied in order, so that the console and the error
+		// reported do not depend on which load finishes first.
+		var wg sync.WaitGroup
+		var stageJob *job
 		if !stageDone && sys.sel.selectedStageNo >= 0 {
-			if !l.loadStage() {
-				l.state = LS_Error
-				return
-			}
-			stageDone = true
-		}
+			stageJob = &job{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stageJob.err = l.loadStage()
+			}()
+		}
+		jobs := make([]*job, len(charDone))
 		for i, b := range charDone {
-			if !b {
-				result := -1
-				if i < len(sys.chars)-MaxAttachedChar ||
-					len(sys.stageList[0].attachedchardef) <= i-MaxSimul*2 {
-					result = l.loadChar(i)
+			attached := i >= len(sys.chars)-MaxAttachedChar
+			// Attached chars are known once the stage is loaded
+			if b || attached && !stageDone {
+				continue
+			}
+			if attached && sys.stageList[0] == nil {
+				charDone[i] = true
+				continue
+			}
+			jobs[i] = &job{}
+			wg.Add(1)
+			go func(i int, j *job) {
+				defer wg.Done()
+				if !attached || len(sys.stageList[0].attachedchardef) <= i-MaxSimul*2 {
+					j.result, j.msg, j.err = l.loadChar(i)
 				} else {
-					result = l.loadAttachedChar(i)
+					j.result, j.msg, j.err = l.loadAttachedChar(i)
 				}
-				if result > 0 {
-					charDone[i] = true
-				} else if result < 0 {
-					l.state = LS_Error
-					return
+			}(i, jobs[i])
+		}
+		wg.Wait()
+		if stageJob != nil {
+			if stageJob.err != nil {
+				sys.errLog.Println(stageJob.err.Error())
+				if loadErr == nil {
+					loadErr = stageJob.err
 				}
 			}
+			stageDone = true
+		}
+		for i, j := range jobs {
+			if j == nil {
+				continue
+			}
+			if j.msg != "" {
+				sys.appendToConsole(j.msg)
+			}
+			if j.result < 0 {
+				sys.errLog.Println(j.err.Error())
+				if loadErr == nil {
+					loadErr = j.err
+				}
+			}
+			if j.result != 0 {
+				charDone[i] = true
+			}
 		}
 		for i := 0; i < 2; i++ {
 			if !charDone[i+2] && len(sys.sel.selected[i]) > 0 &&
@@ -2959,6 +3199,10 @@ func (l *Loader) load() {
 			return
 		}
 	}
+	if loadErr != nil {
+		l.err, l.state = loadErr, LS_Error
+		return
+	}
 	l.state = LS_Complete
 }
 func (l *Loader) reset() {
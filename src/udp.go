@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	udpMagic        = "IKUD"
+	udpHello        = 0
+	udpData         = 1
+	udpMaxStream    = 1024
+	udpKeepAlive    = 100 * time.Millisecond
+	udpTimeout      = 5 * time.Second
+	rendezvousMagic = "IKRV"
+)
+
+// Netplay connection over UDP. Inputs are sent unreliably: every packet
+// carries all the local frames the other peer has not acknowledged yet, so a
+// lost packet is made up for by the next one instead of stalling the stream
+// like a TCP retransmission would. Everything else (the Synchronize
+// handshake, end of stream markers, desync messages) goes through a small
+// reliable byte stream, which is what Read and Write expose.
+type udpConn struct {
+	pc       *net.UDPConn
+	raddr    *net.UDPAddr
+	start    time.Time
+	mu       sync.Mutex
+	cond     *sync.Cond
+	closed   bool
+	err      error
+	lastRecv time.Time
+	lastSend time.Time
+	ack      bool
+	gotData  bool
+	// Reliable stream. out holds the bytes not acknowledged yet, starting at
+	// stream offset outSeq.
+	out    []byte
+	outSeq uint32
+	outNew bool
+	in     []byte
+	inSeq  uint32
+	// Inputs, only exchanged between Synchronize and Stop. locAck is the
+	// first local frame the other peer has not received.
+	loc, rem *NetBuffer
+	locAck   int32
+	lastInpT int32
+	// Round trip time, measured by echoing the send time of the last packet
+	// received along with how long it was held
+	echoTime uint32
+	echoAt   time.Time
+	rtt      time.Duration
+}
+
+func newUDPConn(pc *net.UDPConn, raddr *net.UDPAddr) *udpConn {
+	now := time.Now()
+	uc := &udpConn{pc: pc, raddr: raddr, start: now, lastRecv: now}
+	uc.cond = sync.NewCond(&uc.mu)
+	go uc.recvLoop()
+	go uc.sendLoop()
+	return uc
+}
+func (uc *udpConn) Read(p []byte) (int, error) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	for len(uc.in) == 0 && !uc.closed && uc.err == nil {
+		uc.cond.Wait()
+	}
+	if len(uc.in) == 0 {
+		if uc.err != nil {
+			return 0, uc.err
+		}
+		return 0, Error("Connection closed")
+	}
+	n := copy(p, uc.in)
+	uc.in = uc.in[n:]
+	return n, nil
+}
+func (uc *udpConn) Write(p []byte) (int, error) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if uc.err != nil {
+		return 0, uc.err
+	}
+	if uc.closed {
+		return 0, Error("Connection closed")
+	}
+	uc.out = append(uc.out, p...)
+	uc.outNew = true
+	return len(p), nil
+}
+func (uc *udpConn) Close() error {
+	uc.mu.Lock()
+	uc.closed = true
+	uc.cond.Broadcast()
+	uc.mu.Unlock()
+	return uc.pc.Close()
+}
+func (uc *udpConn) RTT() time.Duration {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.rtt
+}
+
+// Sets the input buffers to exchange. Called by Synchronize after they have
+// been reset, and with nil by Stop.
+func (uc *udpConn) setBuffers(loc, rem *NetBuffer) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.loc, uc.rem = loc, rem
+	if loc != nil {
+		uc.locAck, uc.lastInpT = loc.inpT, loc.inpT
+	}
+}
+func (uc *udpConn) fail(err error) {
+	uc.mu.Lock()
+	if uc.err == nil {
+		uc.err = err
+	}
+	uc.cond.Broadcast()
+	uc.mu.Unlock()
+}
+
+// Milliseconds since the connection was made, starting at 1 as 0 is sent
+// when there is nothing to echo
+func (uc *udpConn) millis(t time.Time) uint32 {
+	return uint32(t.Sub(uc.start)/time.Millisecond) + 1
+}
+
+// Interval after which unacknowledged data is sent again
+func (uc *udpConn) resendTime() time.Duration {
+	rto := uc.rtt * 5 / 4
+	if rto < 10*time.Millisecond {
+		return 10 * time.Millisecond
+	} else if rto > 200*time.Millisecond {
+		return 200 * time.Millisecond
+	}
+	return rto
+}
+func (uc *udpConn) sendLoop() {
+	for {
+		time.Sleep(time.Millisecond)
+		now := time.Now()
+		uc.mu.Lock()
+		if uc.closed || uc.err != nil {
+			uc.mu.Unlock()
+			return
+		}
+		if now.Sub(uc.lastRecv) > udpTimeout {
+			uc.mu.Unlock()
+			uc.fail(Error("Connection timed out"))
+			return
+		}
+		newData := uc.outNew || uc.ack || uc.loc != nil && uc.loc.inpT > uc.lastInpT
+		unacked := len(uc.out) > 0 || uc.loc != nil && uc.locAck < uc.loc.inpT
+		since := now.Sub(uc.lastSend)
+		var pkt []byte
+		if newData || unacked && since >= uc.resendTime() || since >= udpKeepAlive {
+			pkt = uc.packet(now)
+		}
+		uc.mu.Unlock()
+		if pkt != nil {
+			uc.pc.WriteToUDP(pkt, uc.raddr)
+		}
+	}
+}
+
+// Builds a data packet:
+// time, echoed time, echo delay (ms), stream ack, stream offset, stream
+// length, stream bytes, input ack, first input frame, input count, inputs.
+func (uc *udpConn) packet(now time.Time) []byte {
+	var b bytes.Buffer
+	b.WriteString(udpMagic)
+	b.WriteByte(udpData)
+	w := func(v interface{}) { binary.Write(&b, binary.LittleEndian, v) }
+	w(uc.millis(now))
+	w(uc.echoTime)
+	w(uint32(now.Sub(uc.echoAt) / time.Millisecond))
+	w(uc.inSeq)
+	w(uc.outSeq)
+	stream := uc.out
+	if len(stream) > udpMaxStream {
+		stream = stream[:udpMaxStream]
+	}
+	w(uint16(len(stream)))
+	b.Write(stream)
+	inputAck := int32(-1)
+	if uc.rem != nil {
+		inputAck = uc.rem.inpT
+	}
+	w(inputAck)
+	if uc.loc != nil {
+		first := Max(uc.locAck, uc.loc.inpT-int32(len(uc.loc.buf)))
+		w(first)
+		w(uint8(uc.loc.inpT - first))
+		for f := first; f < uc.loc.inpT; f++ {
+			w(uc.loc.buf[f&31])
+		}
+		uc.loc.senT, uc.lastInpT = uc.loc.inpT, uc.loc.inpT
+	} else {
+		w(int32(0))
+		w(uint8(0))
+	}
+	uc.outNew, uc.ack, uc.lastSend = false, false, now
+	return b.Bytes()
+}
+func (uc *udpConn) recvLoop() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := uc.pc.ReadFromUDP(buf)
+		if err != nil {
+			uc.fail(err)
+			return
+		}
+		if !addr.IP.Equal(uc.raddr.IP) || addr.Port != uc.raddr.Port ||
+			n < len(udpMagic)+1 || string(buf[:len(udpMagic)]) != udpMagic {
+			continue
+		}
+		uc.mu.Lock()
+		if buf[len(udpMagic)] == udpHello {
+			// Our hello reply was lost, the other peer is still punching
+			if !uc.gotData {
+				uc.pc.WriteToUDP(udpHelloPacket(), uc.raddr)
+			}
+			uc.mu.Unlock()
+			continue
+		}
+		uc.gotData = true
+		uc.handle(bytes.NewReader(buf[len(udpMagic)+1 : n]))
+		uc.mu.Unlock()
+	}
+}
+func (uc *udpConn) handle(r *bytes.Reader) {
+	var sendTime, echoTime, echoDelay, streamAck, streamSeq uint32
+	var streamLen uint16
+	for _, v := range []interface{}{&sendTime, &echoTime, &echoDelay,
+		&streamAck, &streamSeq, &streamLen} {
+		if binary.Read(r, binary.LittleEndian, v) != nil {
+			return
+		}
+	}
+	stream := make([]byte, streamLen)
+	if _, err := io.ReadFull(r, stream); err != nil {
+		return
+	}
+	var inputAck, first int32
+	var count uint8
+	for _, v := range []interface{}{&inputAck, &first, &count} {
+		if binary.Read(r, binary.LittleEndian, v) != nil {
+			return
+		}
+	}
+	inputs := make([]InputBits, count)
+	if binary.Read(r, binary.LittleEndian, inputs) != nil {
+		return
+	}
+
+	now := time.Now()
+	uc.lastRecv = now
+	if echoTime != 0 {
+		if ms := int64(uc.millis(now)) - int64(echoTime) - int64(echoDelay); ms >= 0 {
+			sample := time.Duration(ms) * time.Millisecond
+			if uc.rtt == 0 {
+				uc.rtt = sample
+			} else {
+				uc.rtt = (uc.rtt*7 + sample) / 8
+			}
+		}
+	}
+	uc.echoTime, uc.echoAt = sendTime, now
+	if d := int64(streamAck) - int64(uc.outSeq); d > 0 && d <= int64(len(uc.out)) {
+		uc.out, uc.outSeq = uc.out[d:], streamAck
+	}
+	if streamLen > 0 {
+		if d := int64(uc.inSeq) - int64(streamSeq); d >= 0 && d < int64(streamLen) {
+			uc.in = append(uc.in, stream[d:]...)
+			uc.inSeq = streamSeq + uint32(streamLen)
+			uc.cond.Broadcast()
+			uc.ack = true
+		}
+	}
+	if uc.loc != nil && inputAck > uc.locAck {
+		uc.locAck = Min(inputAck, uc.loc.inpT)
+	}
+	if rem := uc.rem; rem != nil {
+		for i, ib := range inputs {
+			if first+int32(i) == rem.inpT && rem.inpT-rem.curT < int32(len(rem.buf)) {
+				rem.buf[rem.inpT&31] = ib
+				rem.inpT++
+				rem.senT = rem.inpT
+				uc.ack = true
+			}
+		}
+	}
+}
+
+func udpHelloPacket() []byte {
+	return append([]byte(udpMagic), udpHello)
+}
+
+// Waits for the hello of the other peer, sending ours to peer every 100ms.
+// If peer is unknown and a rendezvous server is set, the host registers with
+// it and the guest asks it for the address of the host whose public IP is
+// hostIP. The server then sends both sides each other's address, and their
+// hellos punch a hole through NAT on both ends.
+func udpHandshake(pc *net.UDPConn, peer *net.UDPAddr, rendezvous, hostIP string) (*net.UDPAddr, error) {
+	var rv *net.UDPAddr
+	if rendezvous != "" {
+		var err error
+		if rv, err = net.ResolveUDPAddr("udp", rendezvous); err != nil {
+			return nil, err
+		}
+		peer = nil
+	}
+	buf := make([]byte, 2048)
+	for {
+		if peer != nil {
+			pc.WriteToUDP(udpHelloPacket(), peer)
+		} else if rv != nil {
+			msg := rendezvousMagic + " host"
+			if hostIP != "" {
+				msg = rendezvousMagic + " join " + hostIP
+			}
+			pc.WriteToUDP([]byte(msg), rv)
+		}
+		pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			msg := buf[:n]
+			if rv != nil && addr.IP.Equal(rv.IP) && addr.Port == rv.Port {
+				if f := strings.Fields(string(msg)); len(f) == 3 &&
+					f[0] == rendezvousMagic && f[1] == "peer" {
+					if a, err := net.ResolveUDPAddr("udp", f[2]); err == nil {
+						peer = a
+						pc.WriteToUDP(udpHelloPacket(), peer)
+					}
+				}
+			} else if n == len(udpMagic)+1 && string(msg[:len(udpMagic)]) == udpMagic &&
+				msg[len(udpMagic)] == udpHello {
+				pc.WriteToUDP(udpHelloPacket(), addr)
+				pc.SetReadDeadline(time.Time{})
+				return addr, nil
+			}
+		}
+	}
+}
+
+// Minimal rendezvous server for UDP hole punching, run with -rendezvous
+// <port>. Hosts register with "IKRV host", and guests ask for a host by its
+// public IP with "IKRV join <ip>". Both are then sent each other's address
+// with "IKRV peer <addr>".
+func runRendezvous(port string) error {
+	laddr, err := net.ResolveUDPAddr("udp", ":"+port)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	hosts := make(map[string]*net.UDPAddr)
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		f := strings.Fields(string(buf[:n]))
+		if len(f) < 2 || f[0] != rendezvousMagic {
+			continue
+		}
+		switch f[1] {
+		case "host":
+			hosts[addr.IP.String()] = addr
+		case "join":
+			if len(f) < 3 {
+				continue
+			}
+			if h, ok := hosts[f[2]]; ok {
+				pc.WriteToUDP([]byte(rendezvousMagic+" peer "+addr.String()), h)
+				pc.WriteToUDP([]byte(rendezvousMagic+" peer "+h.String()), addr)
+			}
+		}
+	}
+}
@@ -22,21 +22,28 @@ func ShowInfoDialog(message, title string) {
 }
 
 func ShowErrorDialog(message string) {
+	if sys.headless {
+		os.Stderr.WriteString(message + "\n")
+		return
+	}
 	dialog.Message(message).Title("I.K.E.M.E.N Error").Error()
 }
 
 // TTF font loading
-func LoadFntTtf(f *Fnt, fontfile string, filename string, height int32) {
+func LoadFntTtf(f *Fnt, fontfile string, filename string, height int32) error {
 	//Search in local directory
 	fileDir := SearchFile(filename, []string{fontfile, sys.motifDir, "", "data/", "font/"})
 	//Search in system directory
 	fp := fileDir
+	var err error
 	if fp = FileExist(fp); len(fp) == 0 {
-		var err error
 		fileDir, err = findfont.Find(fileDir)
-		if err != nil {
-			panic(err)
-		}
+	} else {
+		// glfont opens the font by name, so one in an archive is extracted
+		fileDir, err = LocalPath(fp)
+	}
+	if err != nil {
+		return err
 	}
 	//Load ttf
 	if height == -1 {
@@ -44,15 +51,19 @@ func LoadFntTtf(f *Fnt, fontfile string, filename string, height int32) {
 	} else {
 		f.Size[1] = uint16(height)
 	}
-	ttf, err := glfont.LoadFont(fileDir, height, int(sys.gameWidth), int(sys.gameHeight), sys.fontShaderVer)
-	if err != nil {
-		panic(err)
+	//Fonts are never drawn in headless mode, and glfont needs a GL context
+	if !sys.headless {
+		ttf, err := glfont.LoadFont(fileDir, height, int(sys.gameWidth), int(sys.gameHeight), sys.fontShaderVer)
+		if err != nil {
+			return err
+		}
+		f.ttf = ttf
 	}
-	f.ttf = ttf
 
 	//Create Ttf dummy palettes
 	f.palettes = make([][256]uint32, 1)
 	for i := 0; i < 256; i++ {
 		f.palettes[0][i] = 0
 	}
+	return nil
 }
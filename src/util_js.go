@@ -33,6 +33,6 @@ func ShowErrorDialog(message string) {
 }
 
 // TTF font loading stub
-func LoadFntTtf(f *Fnt, fontfile string, filename string, height int32) {
-	panic(Error("TrueType fonts are not supported on this platform"))
+func LoadFntTtf(f *Fnt, fontfile string, filename string, height int32) error {
+	return Error("TrueType fonts are not supported on this platform")
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// All the game files are read through this. Content packs, which are zip
+// archives or directories, are mounted over the loose files, in priority
+// order. Besides, a zip archive can be used in a path as if it were a
+// directory, so that a character can ship as chars/kfm.zip and have its
+// files read as chars/kfm.zip/kfm.def, chars/kfm.zip/kfm.sff and so on.
+var vfs = &virtualFS{archives: make(map[string]*vfsMount)}
+
+type virtualFS struct {
+	mu     sync.Mutex
+	mounts []*vfsMount
+	// Archives used as directories, by path. nil for files that are not
+	// archives.
+	archives map[string]*vfsMount
+	// Archived files extracted for the libraries that need a file on disk
+	tmpdir    string
+	extracted map[string]string
+}
+
+type vfsMount struct {
+	path string
+	// What the names of its files start with: nothing for the mounts, the
+	// path of the archive for the archives used as directories
+	prefix string
+	fsys   fs.FS
+	closer io.Closer
+	dir    bool
+}
+
+// A file read in memory from an archive.
+type vfsFile struct{ *bytes.Reader }
+
+func (vfsFile) Close() error { return nil }
+
+// Mounts the zip archive or directory over the loose files, with a lower
+// priority than the ones mounted before.
+func (v *virtualFS) mount(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	m := &vfsMount{path: name}
+	if fi.IsDir() {
+		m.fsys, m.dir = os.DirFS(name), true
+	} else {
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return Error(name + ": " + err.Error())
+		}
+		m.fsys, m.closer = zr, zr
+	}
+	v.mu.Lock()
+	v.mounts = append(v.mounts, m)
+	v.mu.Unlock()
+	return nil
+}
+func (v *virtualFS) close() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, m := range v.mounts {
+		if m.closer != nil {
+			m.closer.Close()
+		}
+	}
+	for _, m := range v.archives {
+		if m != nil && m.closer != nil {
+			m.closer.Close()
+		}
+	}
+	v.mounts, v.archives = nil, make(map[string]*vfsMount)
+	if v.tmpdir != "" {
+		os.RemoveAll(v.tmpdir)
+		v.tmpdir, v.extracted = "", nil
+	}
+}
+
+// Finds the file, ignoring the case of the names when there is no exact
+// match, as FileExist always did. Returns the mount or archive holding it,
+// nil for a loose file, and the name of the file in it. The name is empty if
+// the file is not found.
+func (v *virtualFS) find(name string) (*vfsMount, string) {
+	name = filepath.ToSlash(name)
+	v.mu.Lock()
+	mounts := v.mounts
+	v.mu.Unlock()
+	if rel := path.Clean(name); len(mounts) > 0 && fs.ValidPath(rel) {
+		for _, m := range mounts {
+			if fn := fsFind(m.fsys, rel); fn != "" {
+				return m, fn
+			}
+		}
+	}
+	if fn := osFind(name); fn != "" {
+		return nil, fn
+	}
+	// A path going through an archive
+	elems := strings.Split(name, "/")
+	for i := len(elems) - 2; i >= 0; i-- {
+		if strings.ToLower(path.Ext(elems[i])) != ".zip" {
+			continue
+		}
+		if a := v.archive(strings.Join(elems[:i+1], "/")); a != nil {
+			if fn := fsFind(a.fsys, path.Clean(strings.Join(elems[i+1:], "/"))); fn != "" {
+				return a, fn
+			}
+		}
+	}
+	return nil, ""
+}
+
+// Opens the archive to use it as a directory.
+func (v *virtualFS) archive(name string) *vfsMount {
+	v.mu.Lock()
+	a, ok := v.archives[name]
+	v.mu.Unlock()
+	if ok {
+		return a
+	}
+	if f, err := OpenFile(name); err == nil {
+		ra, ok := f.(io.ReaderAt)
+		size, err := f.Seek(0, io.SeekEnd)
+		if ok && err == nil {
+			if zr, err := zip.NewReader(ra, size); err == nil {
+				a = &vfsMount{path: name, prefix: name + "/", fsys: zr, closer: f}
+			}
+		}
+		if a == nil {
+			f.Close()
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// Opened meanwhile by another goroutine
+	if b, ok := v.archives[name]; ok {
+		if a != nil {
+			a.closer.Close()
+		}
+		return b
+	}
+	v.archives[name] = a
+	return a
+}
+
+// Returns the name of the file in fsys, ignoring the case of the names when
+// there is no exact match, or an empty string if it does not exist.
+func fsFind(fsys fs.FS, name string) string {
+	if fi, err := fs.Stat(fsys, name); err == nil {
+		if fi.IsDir() {
+			return ""
+		}
+		return name
+	}
+	dir := "."
+	for _, elem := range strings.Split(name, "/") {
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			return ""
+		}
+		found := false
+		for _, e := range entries {
+			if strings.EqualFold(e.Name(), elem) {
+				dir, found = path.Join(dir, e.Name()), true
+				break
+			}
+		}
+		if !found {
+			return ""
+		}
+	}
+	if fi, err := fs.Stat(fsys, dir); err != nil || fi.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+// Finds a loose file.
+func osFind(filename string) string {
+	if info, err := os.Stat(filename); !os.IsNotExist(err) {
+		if info == nil || info.IsDir() {
+			return ""
+		}
+		return filename
+	}
+	var pattern string
+	for _, r := range filename {
+		if r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' {
+			pattern += "[" + string(unicode.ToLower(r)) +
+				string(unicode.ToLower(r)+'A'-'a') + "]"
+		} else if r == '*' || r == '?' || r == '[' {
+			pattern += "\\" + string(r)
+		} else {
+			pattern += string(r)
+		}
+	}
+	if m, _ := filepath.Glob(pattern); len(m) > 0 {
+		return m[0]
+	}
+	return ""
+}
+
+// Opens a loose file, or one of a content pack or an archive.
+func OpenFile(name string) (io.ReadSeekCloser, error) {
+	m, fn := vfs.find(name)
+	if m == nil {
+		if fn == "" {
+			fn = name
+		}
+		return os.Open(fn)
+	}
+	f, err := m.fsys.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	if rsc, ok := f.(io.ReadSeekCloser); ok {
+		return rsc, nil
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return vfsFile{bytes.NewReader(b)}, nil
+}
+func ReadFile(name string) ([]byte, error) {
+	f, err := OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Returns a path on disk to the file, for the libraries that only open files
+// by name. Files in archives are extracted to a temporary directory.
+func LocalPath(name string) (string, error) {
+	m, fn := vfs.find(name)
+	if m == nil {
+		if fn == "" {
+			return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return fn, nil
+	}
+	if m.dir {
+		return filepath.Join(m.path, filepath.FromSlash(fn)), nil
+	}
+	key := m.path + "/" + fn
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	if p, ok := vfs.extracted[key]; ok {
+		return p, nil
+	}
+	if vfs.tmpdir == "" {
+		dir, err := os.MkdirTemp("", "ikemen")
+		if err != nil {
+			return "", err
+		}
+		vfs.tmpdir, vfs.extracted = dir, make(map[string]string)
+	}
+	b, err := fs.ReadFile(m.fsys, fn)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(vfs.tmpdir, fmt.Sprint(len(vfs.extracted)), path.Base(fn))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(p, b, 0644); err != nil {
+		return "", err
+	}
+	vfs.extracted[key] = p
+	return p, nil
+}
+
+// Returns the def file of a character or stage shipped as an archive: the
+// one named after the archive, or else the only def file at its root or in
+// its only directory.
+func archiveDef(name string) string {
+	name = filepath.ToSlash(name)
+	base := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	def := name + "/" + base + ".def"
+	if fp := FileExist(def); fp != "" {
+		return fp
+	}
+	fn := FileExist(name)
+	if fn == "" {
+		return def
+	}
+	a := vfs.archive(filepath.ToSlash(fn))
+	if a == nil {
+		return def
+	}
+	for dir := "."; ; {
+		entries, err := fs.ReadDir(a.fsys, dir)
+		if err != nil {
+			return def
+		}
+		var defs, dirs []string
+		for _, e := range entries {
+			if e.IsDir() {
+				dirs = append(dirs, e.Name())
+			} else if strings.ToLower(path.Ext(e.Name())) == ".def" {
+				defs = append(defs, e.Name())
+			}
+		}
+		if len(defs) == 1 {
+			return name + "/" + path.Join(dir, defs[0])
+		}
+		if len(defs) > 1 || len(dirs) != 1 {
+			return def
+		}
+		dir = path.Join(dir, dirs[0])
+		if fn := fsFind(a.fsys, path.Join(dir, base+".def")); fn != "" {
+			return name + "/" + fn
+		}
+	}
+}
+
+// Loads a Lua file through the virtual filesystem.
+func luaLoadFile(l *lua.LState, name string) (*lua.LFunction, error) {
+	b, err := ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) >= 3 && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf {
+		b = b[3:]
+	}
+	return l.Load(bytes.NewReader(b), name)
+}
+
+// Makes dofile, loadfile and require read the Lua files through the virtual
+// filesystem.
+func vfsLuaInit(l *lua.LState) {
+	l.SetGlobal("loadfile", l.NewFunction(func(l *lua.LState) int {
+		fn, err := luaLoadFile(l, strArg(l, 1))
+		if err != nil {
+			l.Push(lua.LNil)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		l.Push(fn)
+		return 1
+	}))
+	l.SetGlobal("dofile", l.NewFunction(func(l *lua.LState) int {
+		top := l.GetTop()
+		fn, err := luaLoadFile(l, strArg(l, 1))
+		if err != nil {
+			l.RaiseError(err.Error())
+		}
+		l.Push(fn)
+		l.Call(0, lua.MultRet)
+		return l.GetTop() - top
+	}))
+	// The loader of Lua modules follows the preload one
+	if loaders, ok := l.GetField(l.GetGlobal("package"), "loaders").(*lua.LTable); ok {
+		loaders.RawSetInt(2, l.NewFunction(func(l *lua.LState) int {
+			name := strings.Replace(strArg(l, 1), ".", "/", -1)
+			var msg string
+			for _, pat := range strings.Split(lua.LVAsString(
+				l.GetField(l.GetGlobal("package"), "path")), ";") {
+				file := strings.Replace(pat, "?", name, -1)
+				if fp := FileExist(file); fp != "" {
+					fn, err := luaLoadFile(l, fp)
+					if err != nil {
+						l.RaiseError(err.Error())
+					}
+					l.Push(fn)
+					return 1
+				}
+				msg += "\n\tno file '" + file + "'"
+			}
+			l.Push(lua.LString(msg))
+			return 1
+		}))
+	}
+}